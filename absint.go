@@ -0,0 +1,635 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Abstract interpretation
+//
+// The analyzer runs a program on abstract values: each integer variable is
+// mapped to an element of an abstract domain (e.g. an interval) describing
+// every value it may hold at a program point. Loops are iterated until the
+// abstract state at the loop head stabilizes, using widening to guarantee
+// termination, followed by one narrowing step to regain precision.
+
+// AbsInt is an element of an abstract domain of integers
+type AbsInt interface{}
+
+// Domain is a lattice of abstract integers with the abstract versions of the
+// integer operators, i.e. the transfer functions of the integer expression
+// cases. The analyzer handles variables and booleans generically and lifts a
+// domain to states with nonRelational, so a new domain only needs to
+// implement this interface and be added to domains.
+type Domain interface {
+	bottom() AbsInt // no value
+	top() AbsInt    // any value
+	constant(n int) AbsInt
+	isBottom(a AbsInt) bool
+	leq(a, b AbsInt) bool
+	join(a, b AbsInt) AbsInt
+	widen(a, b AbsInt) AbsInt
+	plus(a, b AbsInt) AbsInt
+	mult(a, b AbsInt) AbsInt
+	less(a, b AbsInt) AbsBool
+	equal(a, b AbsInt) AbsBool
+	// refine the operands of a comparison, assuming it evaluates to truth
+	assumeLess(a, b AbsInt, truth bool) (AbsInt, AbsInt)
+	assumeEqual(a, b AbsInt, truth bool) (AbsInt, AbsInt)
+	show(a AbsInt) string
+}
+
+// available domains, by name
+var domains = map[string]Domain{
+	"interval": IntervalDomain{},
+	"sign":     SignDomain{},
+	"parity":   ParityDomain{},
+}
+
+// StateDomain is the statement level of an analysis: the transfer functions
+// of declarations, assignments and conditions, and the join, widening and
+// order of states used where control flow meets and at loop heads. The
+// analyzer only follows the control flow and iterates loops.
+type StateDomain interface {
+	declare(st AbsState, x string, v absVal) AbsState
+	assign(st AbsState, x string, v absVal) AbsState
+	// refine a state for a boolean variable or a comparison evaluating to
+	// truth, given the values of its operands. nil if that is impossible
+	refine(st AbsState, cond Exp, args []absVal, truth bool) AbsState
+	join(x, y AbsState) AbsState
+	widen(x, y AbsState) AbsState
+	leq(x, y AbsState) bool
+}
+
+// domains that can tell whether the concrete (wrapping) operators may overflow
+type overflowChecker interface {
+	mayOverflow(op Exp, a, b AbsInt) bool
+}
+
+// Abstract booleans: the set of possible truth values
+
+type AbsBool int
+
+const (
+	boolBottom AbsBool = 0
+	boolTrue   AbsBool = 1
+	boolFalse  AbsBool = 2
+	boolTop    AbsBool = 3
+)
+
+func absBool(b bool) AbsBool {
+	if b {
+		return boolTrue
+	}
+	return boolFalse
+}
+
+func (b AbsBool) may(truth bool) bool {
+	return b&absBool(truth) != 0
+}
+
+func (b AbsBool) String() string {
+	switch b {
+	case boolTrue:
+		return "true"
+	case boolFalse:
+		return "false"
+	case boolTop:
+		return "true|false"
+	}
+	return "bottom"
+}
+
+// Abstract values and state
+
+type absVal struct {
+	ty Type
+	n  AbsInt  // if ty == TyInt
+	b  AbsBool // if ty == TyBool
+}
+
+// AbsState maps the variables to abstract values. nil is the state of
+// unreachable code
+type AbsState = Scopes[absVal]
+
+func (v absVal) typ() Type {
+	return v.ty
+}
+
+// the visible variables, innermost mapping first
+func visibleVars(st AbsState) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for i := len(st) - 1; i >= 0; i-- {
+		var scope []string
+		for name := range st[i] {
+			if !seen[name] {
+				seen[name] = true
+				scope = append(scope, name)
+			}
+		}
+		sort.Strings(scope)
+		names = append(names, scope...)
+	}
+	return names
+}
+
+// Analyzer
+
+type analyzer struct {
+	d        Domain
+	s        StateDomain
+	dry      bool             // only compute states, used while iterating loops to a fixed point
+	pos      Pos              // position of the current statement
+	states   map[Pos]AbsState // state after each located statement
+	stmts    map[Pos]Stmt     // located statements
+	warnings []string         // in order of discovery
+	warned   map[string]bool
+}
+
+func newAnalyzer(d Domain) *analyzer {
+	return &analyzer{d: d, s: nonRelational{d}, states: make(map[Pos]AbsState), stmts: make(map[Pos]Stmt), warned: make(map[string]bool)}
+}
+
+// analyze a well-typed program, returns the state at the end of the program
+func (a *analyzer) analyze(prog Program) AbsState {
+	return a.stmt(prog, newScopes[absVal]())
+}
+
+func (a *analyzer) warn(format string, args ...interface{}) {
+	if a.dry {
+		return
+	}
+	msg := a.pos.String() + ": " + fmt.Sprintf(format, args...)
+	if !a.warned[msg] {
+		a.warned[msg] = true
+		a.warnings = append(a.warnings, msg)
+	}
+}
+
+// Non-relational states
+//
+// nonRelational maps every variable to an abstract value of its own, with
+// the integers taken from a Domain. A comparison refines its operands that
+// are variables.
+
+type nonRelational struct {
+	d Domain
+}
+
+func (n nonRelational) declare(st AbsState, x string, v absVal) AbsState {
+	st.declare(x, v)
+	return st
+}
+
+func (n nonRelational) assign(st AbsState, x string, v absVal) AbsState {
+	st.assign(x, v)
+	return st
+}
+
+func (n nonRelational) refine(st AbsState, cond Exp, args []absVal, truth bool) AbsState {
+	switch cond := cond.(type) {
+	case Var:
+		v := args[0]
+		if !v.b.may(truth) {
+			return nil
+		}
+		st = st.copy()
+		v.b = absBool(truth)
+		st.assign(string(cond), v)
+		return st
+	case Less, Equal:
+		var x, y Exp
+		var refine func(AbsInt, AbsInt, bool) (AbsInt, AbsInt)
+		if l, ok := cond.(Less); ok {
+			x, y, refine = l[0], l[1], n.d.assumeLess
+		} else {
+			e := cond.(Equal)
+			x, y, refine = e[0], e[1], n.d.assumeEqual
+		}
+		nx, ny := refine(args[0].n, args[1].n, truth)
+		if n.d.isBottom(nx) || n.d.isBottom(ny) {
+			return nil
+		}
+		st = st.copy()
+		if name, ok := x.(Var); ok {
+			st.assign(string(name), absVal{ty: TyInt, n: nx})
+		}
+		if name, ok := y.(Var); ok {
+			st.assign(string(name), absVal{ty: TyInt, n: ny})
+		}
+		return st
+	}
+	return st.copy()
+}
+
+// combine two states with the same scope structure, using f on integers
+func (n nonRelational) combine(x, y AbsState, f func(AbsInt, AbsInt) AbsInt) AbsState {
+	if x == nil {
+		return y.copy()
+	} else if y == nil {
+		return x.copy()
+	}
+	ret := x.copy()
+	for i, scope := range ret {
+		for name, v := range scope {
+			if w, ok := y[i][name]; ok && w.ty == v.ty {
+				if v.ty == TyInt {
+					v.n = f(v.n, w.n)
+				}
+				v.b |= w.b
+				scope[name] = v
+			}
+		}
+	}
+	return ret
+}
+
+func (n nonRelational) join(x, y AbsState) AbsState {
+	return n.combine(x, y, n.d.join)
+}
+
+func (n nonRelational) widen(x, y AbsState) AbsState {
+	return n.combine(x, y, n.d.widen)
+}
+
+func (n nonRelational) leq(x, y AbsState) bool {
+	if x == nil {
+		return true
+	} else if y == nil {
+		return false
+	}
+	for i, scope := range x {
+		for name, v := range scope {
+			w := y[i][name]
+			if v.ty == TyInt && !n.d.leq(v.n, w.n) {
+				return false
+			}
+			if v.b|w.b != w.b {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Statements
+
+func (a *analyzer) stmt(stmt Stmt, st AbsState) AbsState {
+	// located statements are recorded even if unreachable
+	if _, ok := stmt.(Located); !ok && st == nil {
+		return nil
+	}
+	switch stmt := stmt.(type) {
+	case Located:
+		pos := a.pos
+		a.pos = stmt.pos
+		st = a.stmt(stmt.stmt, st)
+		if !a.dry {
+			a.stmts[stmt.pos] = stmt.stmt
+			a.states[stmt.pos] = a.s.join(a.states[stmt.pos], st)
+		}
+		a.pos = pos
+		return st
+	case Seq:
+		return a.stmt(stmt[1], a.stmt(stmt[0], st))
+	case Decl:
+		return a.s.declare(st, stmt.lhs, a.exp(stmt.rhs, st))
+	case Assign:
+		return a.s.assign(st, stmt.lhs, a.exp(stmt.rhs, st))
+	case Print:
+		a.exp(stmt.exp, st)
+		return st
+	case Read:
+		if v, ok := st.lookup(stmt.lhs); ok {
+			return a.s.assign(st, stmt.lhs, absVal{ty: v.ty, n: a.d.top(), b: boolTop})
+		}
+		return st
+	case Requires:
+		return a.assume(stmt.exp, st, true)
+	case Assume:
+		return a.assume(stmt.exp, st, true)
+	case Ensures:
+		return a.check("postcondition", stmt.exp, st)
+	case Assert:
+		return a.check("assertion", stmt.exp, st)
+	case IfThenElse:
+		a.exp(stmt.cond, st)
+		st1 := a.assume(stmt.cond, st, true)
+		st1.startBlock()
+		st1 = a.stmt(stmt.thenStmt, st1)
+		st1.endBlock()
+		st2 := a.assume(stmt.cond, st, false)
+		st2.startBlock()
+		st2 = a.stmt(stmt.elseStmt, st2)
+		st2.endBlock()
+		return a.s.join(st1, st2)
+	case While:
+		head := a.loopHead(stmt, st)
+		a.exp(stmt.cond, head)
+		// analyze the body once more to record its states
+		body := a.assume(stmt.cond, head, true)
+		body.startBlock()
+		a.stmt(stmt.body, body)
+		return a.assume(stmt.cond, head, false)
+	default:
+		return st
+	}
+}
+
+// warn if a specification may not hold, then continue assuming that it does
+func (a *analyzer) check(what string, spec Exp, st AbsState) AbsState {
+	if a.exp(spec, st).b.may(false) {
+		a.warn("%s %s may fail", what, spec.pretty())
+	}
+	return a.assume(spec, st, true)
+}
+
+// number of loop iterations before widening
+const widenDelay = 3
+
+// state at the head of a loop: a fixed point of
+// head = init join body(head restricted to cond)
+func (a *analyzer) loopHead(loop While, init AbsState) AbsState {
+	dry := a.dry
+	a.dry = true
+	defer func() { a.dry = dry }()
+	iterate := func(head AbsState) AbsState {
+		body := a.assume(loop.cond, head, true)
+		body.startBlock()
+		body = a.stmt(loop.body, body)
+		body.endBlock()
+		return a.s.join(init, body)
+	}
+	head := init.copy()
+	for i := 0; ; i++ {
+		next := iterate(head)
+		if a.s.leq(next, head) {
+			break
+		}
+		if i >= widenDelay {
+			next = a.s.widen(head, next)
+		}
+		head = next
+	}
+	// narrowing: the fixed point is sound, another iteration can only refine it
+	return iterate(head)
+}
+
+// refine a state assuming cond evaluates to truth. returns nil if that is impossible.
+// the result is always a new state
+func (a *analyzer) assume(cond Exp, st AbsState, truth bool) AbsState {
+	if st == nil {
+		return nil
+	}
+	switch cond := cond.(type) {
+	case Not:
+		return a.assume(cond.exp, st, !truth)
+	case And:
+		if truth {
+			return a.assume(cond[1], a.assume(cond[0], st, true), true)
+		}
+		return a.s.join(a.assume(cond[0], st, false), a.assume(cond[1], a.assume(cond[0], st, true), false))
+	case Or:
+		if !truth {
+			return a.assume(cond[1], a.assume(cond[0], st, false), false)
+		}
+		return a.s.join(a.assume(cond[0], st, true), a.assume(cond[1], a.assume(cond[0], st, false), true))
+	case Var:
+		if v, _ := st.lookup(string(cond)); v.ty == TyBool {
+			return a.s.refine(st, cond, []absVal{v}, truth)
+		}
+	case Less:
+		if vx, vy := a.quiet(cond[0], st), a.quiet(cond[1], st); vx.ty == TyInt && vy.ty == TyInt {
+			return a.s.refine(st, cond, []absVal{vx, vy}, truth)
+		}
+	case Equal:
+		if vx, vy := a.quiet(cond[0], st), a.quiet(cond[1], st); vx.ty == TyInt && vy.ty == TyInt {
+			return a.s.refine(st, cond, []absVal{vx, vy}, truth)
+		}
+	}
+	if !a.quiet(cond, st).b.may(truth) {
+		return nil
+	}
+	return st.copy()
+}
+
+// evaluate without warnings
+func (a *analyzer) quiet(e Exp, st AbsState) absVal {
+	dry := a.dry
+	a.dry = true
+	defer func() { a.dry = dry }()
+	return a.exp(e, st)
+}
+
+// Expressions
+
+func (a *analyzer) exp(e Exp, st AbsState) absVal {
+	ill := absVal{ty: TyIllTyped}
+	switch e := e.(type) {
+	case Num:
+		return absVal{ty: TyInt, n: a.d.constant(int(e))}
+	case Bool:
+		return absVal{ty: TyBool, b: absBool(bool(e))}
+	case Var:
+		if v, ok := st.lookup(string(e)); ok {
+			return v
+		}
+		return ill
+	case Plus, Mult:
+		var x, y absVal
+		var op func(AbsInt, AbsInt) AbsInt
+		if p, ok := e.(Plus); ok {
+			x, y, op = a.exp(p[0], st), a.exp(p[1], st), a.d.plus
+		} else {
+			m := e.(Mult)
+			x, y, op = a.exp(m[0], st), a.exp(m[1], st), a.d.mult
+		}
+		if x.ty != TyInt || y.ty != TyInt {
+			return ill
+		}
+		if oc, ok := a.d.(overflowChecker); ok && oc.mayOverflow(e, x.n, y.n) {
+			a.warn("%s may overflow (operands %s and %s)", e.pretty(), a.d.show(x.n), a.d.show(y.n))
+		}
+		return absVal{ty: TyInt, n: op(x.n, y.n)}
+	case Less:
+		x, y := a.exp(e[0], st), a.exp(e[1], st)
+		if x.ty != TyInt || y.ty != TyInt {
+			return ill
+		}
+		b := a.d.less(x.n, y.n)
+		if (b == boolTrue || b == boolFalse) && len(expVars(e)) > 0 {
+			a.warn("%s is always %s", e.pretty(), b)
+		}
+		return absVal{ty: TyBool, b: b}
+	case Equal:
+		x, y := a.exp(e[0], st), a.exp(e[1], st)
+		switch {
+		case x.ty == TyInt && y.ty == TyInt:
+			return absVal{ty: TyBool, b: a.d.equal(x.n, y.n)}
+		case x.ty == TyBool && y.ty == TyBool:
+			if (x.b == boolTrue || x.b == boolFalse) && x.b == y.b {
+				return absVal{ty: TyBool, b: boolTrue}
+			} else if x.b&y.b == boolBottom {
+				return absVal{ty: TyBool, b: boolFalse}
+			}
+			return absVal{ty: TyBool, b: boolTop}
+		}
+		return ill
+	case And, Or:
+		var l, r Exp
+		short := false // value of the left operand that skips the right operand
+		if and, ok := e.(And); ok {
+			l, r = and[0], and[1]
+		} else {
+			or := e.(Or)
+			l, r, short = or[0], or[1], true
+		}
+		x := a.exp(l, st)
+		if x.ty != TyBool {
+			return ill
+		}
+		ret := boolBottom
+		if x.b.may(short) {
+			ret |= absBool(short)
+		}
+		if st := a.assume(l, st, !short); st != nil {
+			y := a.exp(r, st)
+			if y.ty != TyBool {
+				return ill
+			}
+			ret |= y.b
+		}
+		return absVal{ty: TyBool, b: ret}
+	case Not:
+		x := a.exp(e.exp, st)
+		if x.ty != TyBool {
+			return ill
+		}
+		return absVal{ty: TyBool, b: (x.b&boolTrue)<<1 | (x.b&boolFalse)>>1}
+	}
+	return ill
+}
+
+// Reporting
+
+func (a *analyzer) showVal(v absVal) string {
+	switch v.ty {
+	case TyInt:
+		return a.d.show(v.n)
+	case TyBool:
+		return v.b.String()
+	}
+	return "?"
+}
+
+func (a *analyzer) showState(st AbsState) string {
+	if st == nil {
+		return "unreachable"
+	}
+	var vars []string
+	for _, name := range visibleVars(st) {
+		v, _ := st.lookup(name)
+		vars = append(vars, name+" = "+a.showVal(v))
+	}
+	return strings.Join(vars, ", ")
+}
+
+// state after every located statement, in source order
+func (a *analyzer) report() string {
+	var positions []Pos
+	for pos := range a.stmts {
+		positions = append(positions, pos)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		if positions[i].line != positions[j].line {
+			return positions[i].line < positions[j].line
+		}
+		return positions[i].col < positions[j].col
+	})
+	var sb strings.Builder
+	for _, pos := range positions {
+		first, _, _ := strings.Cut(a.stmts[pos].pretty(), "\n")
+		fmt.Fprintf(&sb, "%s: %s\n\t%s\n", pos, first, a.showState(a.states[pos]))
+	}
+	return sb.String()
+}
+
+// mbse-imp analyze [-domain name] <file>
+func analyze_cmd(args []string) int {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	domain := fs.String("domain", "interval", "abstract domain: interval, sign or parity")
+	fs.Parse(args)
+	d, ok := domains[*domain]
+	if !ok || fs.NArg() != 1 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	a := newAnalyzer(d)
+	a.analyze(prog)
+	fmt.Print(a.report())
+	if len(a.warnings) > 0 {
+		fmt.Println()
+		fmt.Println("Warnings:")
+		for _, w := range a.warnings {
+			fmt.Println(w)
+		}
+	}
+	return 0
+}
+
+// Helpers for finite domains
+//
+// An abstract integer of a finite domain is a set of atoms (e.g. the signs
+// negative, zero and positive) represented as a bit set. Operators are lifted
+// from a table on single atoms to sets by taking the union over all pairs.
+
+type atoms uint8
+
+func (a atoms) has(i int) bool {
+	return a&(1<<i) != 0
+}
+
+func liftAtoms(a, b atoms, n int, f func(x, y int) atoms) atoms {
+	var ret atoms
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			if a.has(x) && b.has(y) {
+				ret |= f(x, y)
+			}
+		}
+	}
+	return ret
+}
+
+func liftBool(a, b atoms, n int, f func(x, y int) AbsBool) AbsBool {
+	ret := boolBottom
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			if a.has(x) && b.has(y) {
+				ret |= f(x, y)
+			}
+		}
+	}
+	return ret
+}
+
+// keep only the atoms of a and b for which f may evaluate to truth
+func refineAtoms(a, b atoms, n int, truth bool, f func(x, y int) AbsBool) (atoms, atoms) {
+	var ra, rb atoms
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			if a.has(x) && b.has(y) && f(x, y).may(truth) {
+				ra |= 1 << x
+				rb |= 1 << y
+			}
+		}
+	}
+	return ra, rb
+}
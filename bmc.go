@@ -0,0 +1,596 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Bounded model checking
+//
+// bmc() looks for executions of a well-typed program that violate an
+// assertion, postcondition or loop invariant, considering only executions
+// where every loop runs at most k iterations. Integers are fixed-width
+// bit-vectors in two's complement, so Plus and Mult wrap around like in the
+// interpreter (with width 64). The program is translated into a circuit of
+// and/xor gates over the bits of every binding (see resolve.go), guarded by
+// the condition under which each statement is executed:
+//   - x := e, x = e and read x set x to mux(guard, e, x)
+//   - requires e and assume e restrict the executions from then on
+//   - if b runs both branches, under guard && b and guard && !b
+//   - while b is unrolled k times, and executions where b still holds
+//     afterwards are excluded
+// The circuit is translated into CNF (Tseitin) and every specification is
+// checked by the SAT solver in sat.go. A satisfying assignment is mapped back
+// to the executed statements and the values of the variables after each one.
+// A specification is proved if no loop can run more than k iterations,
+// otherwise it only holds for the executions considered.
+
+// circuit builds gates as solver variables, folding constants and sharing
+// identical gates
+type circuit struct {
+	s     *satSolver
+	tt    lit // constant true
+	gates map[[3]lit]lit
+}
+
+func newCircuit() *circuit {
+	c := &circuit{s: newSatSolver(), gates: make(map[[3]lit]lit)}
+	c.tt = c.s.newVar()
+	c.s.addClause(c.tt)
+	return c
+}
+
+func (c *circuit) ff() lit {
+	return c.tt.not()
+}
+
+func (c *circuit) and(a, b lit) lit {
+	switch {
+	case a == c.ff() || b == c.ff() || a == b.not():
+		return c.ff()
+	case a == c.tt || a == b:
+		return b
+	case b == c.tt:
+		return a
+	}
+	if a > b {
+		a, b = b, a
+	}
+	key := [3]lit{0, a, b}
+	if o, ok := c.gates[key]; ok {
+		return o
+	}
+	o := c.s.newVar()
+	c.s.addClause(o.not(), a)
+	c.s.addClause(o.not(), b)
+	c.s.addClause(o, a.not(), b.not())
+	c.gates[key] = o
+	return o
+}
+
+func (c *circuit) or(a, b lit) lit {
+	return c.and(a.not(), b.not()).not()
+}
+
+func (c *circuit) xor(a, b lit) lit {
+	switch {
+	case a == c.ff():
+		return b
+	case b == c.ff():
+		return a
+	case a == c.tt:
+		return b.not()
+	case b == c.tt:
+		return a.not()
+	case a == b:
+		return c.ff()
+	case a == b.not():
+		return c.tt
+	}
+	if a > b {
+		a, b = b, a
+	}
+	key := [3]lit{1, a, b}
+	if o, ok := c.gates[key]; ok {
+		return o
+	}
+	o := c.s.newVar()
+	c.s.addClause(o.not(), a, b)
+	c.s.addClause(o.not(), a.not(), b.not())
+	c.s.addClause(o, a.not(), b)
+	c.s.addClause(o, a, b.not())
+	c.gates[key] = o
+	return o
+}
+
+// if cond then a else b
+func (c *circuit) mux(cond, a, b lit) lit {
+	switch {
+	case cond == c.tt || a == b:
+		return a
+	case cond == c.ff():
+		return b
+	}
+	return c.or(c.and(cond, a), c.and(cond.not(), b))
+}
+
+// Bit-vectors, least significant bit first
+
+func (c *circuit) constant(n, width int) []lit {
+	ret := make([]lit, width)
+	for i := range ret {
+		ret[i] = c.ff()
+		if i < 64 && n>>uint(i)&1 == 1 || i >= 64 && n < 0 {
+			ret[i] = c.tt
+		}
+	}
+	return ret
+}
+
+func (c *circuit) add(a, b []lit) []lit {
+	ret := make([]lit, len(a))
+	carry := c.ff()
+	for i := range a {
+		t := c.xor(a[i], b[i])
+		ret[i] = c.xor(t, carry)
+		carry = c.or(c.and(a[i], b[i]), c.and(t, carry))
+	}
+	return ret
+}
+
+// shift-and-add, dropping the bits above the width, which is the product in
+// two's complement for signed factors as well. a constant factor contributes
+// a row for each bit set only. a negative constant has most bits set, so
+// a * -n is computed as -(a * n) if n has fewer (the most negative constant
+// is its own negation)
+func (c *circuit) mul(a, b []lit) []lit {
+	if c.isConstant(a) {
+		a, b = b, a
+	}
+	if c.isConstant(b) && b[len(b)-1] == c.tt {
+		if n := c.neg(b); c.ones(n) < c.ones(b) {
+			return c.neg(c.mul(a, n))
+		}
+	}
+	ret := c.constant(0, len(a))
+	for i := range b {
+		if b[i] == c.ff() {
+			continue
+		}
+		row := c.constant(0, len(a))
+		for j := 0; i+j < len(a); j++ {
+			row[i+j] = c.and(a[j], b[i])
+		}
+		ret = c.add(ret, row)
+	}
+	return ret
+}
+
+// two's complement
+func (c *circuit) neg(a []lit) []lit {
+	ret := make([]lit, len(a))
+	for i := range a {
+		ret[i] = a[i].not()
+	}
+	return c.add(ret, c.constant(1, len(a)))
+}
+
+// number of bits of a constant that are set
+func (c *circuit) ones(a []lit) int {
+	n := 0
+	for _, l := range a {
+		if l == c.tt {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *circuit) isConstant(a []lit) bool {
+	for _, l := range a {
+		if l != c.tt && l != c.ff() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *circuit) equal(a, b []lit) lit {
+	ret := c.tt
+	for i := range a {
+		ret = c.and(ret, c.xor(a[i], b[i]).not())
+	}
+	return ret
+}
+
+// signed comparison: unsigned comparison from the least significant bit,
+// where the sign bits count the other way round
+func (c *circuit) less(a, b []lit) lit {
+	ret := c.ff()
+	for i := range a {
+		x, y := a[i], b[i]
+		if i == len(a)-1 {
+			x, y = y, x
+		}
+		same := c.xor(x, y).not()
+		ret = c.or(c.and(x.not(), y), c.and(same, ret))
+	}
+	return ret
+}
+
+func (c *circuit) muxVec(cond lit, a, b []lit) []lit {
+	ret := make([]lit, len(a))
+	for i := range a {
+		ret[i] = c.mux(cond, a[i], b[i])
+	}
+	return ret
+}
+
+// Encoding
+
+// a statement executed under guard, and the variables visible afterwards
+type bmcStep struct {
+	pos   Pos
+	text  string
+	guard lit
+	value []lit    // value of a condition or specification, nil for other statements
+	vars  []string // bindings shown after statements without value
+	vals  [][]lit
+	goal  int // index of the specification checked here, -1 if none
+	fail  lit // execution fails the specification here
+}
+
+// a value read from the input
+type bmcRead struct {
+	guard lit
+	bits  []lit
+}
+
+type bmcGoal struct {
+	what    string
+	message string // printed by the interpreter when it fails
+	pos     Pos
+	fail    lit // some execution fails it
+}
+
+type bmcEncoder struct {
+	c      *circuit
+	width  int
+	bound  int
+	types  map[string]Type
+	env    map[string][]lit // current value of every binding
+	scopes [][]string       // bindings declared per block, for traces
+	guard  lit              // the current statement is executed
+	valid  lit              // the assumptions hold so far
+	pos    Pos
+	steps  []bmcStep
+	reads  []bmcRead
+	goals  []bmcGoal
+	index  map[string]int // goal per specification
+	unwind []lit          // executions with more than bound iterations
+}
+
+func newBMCEncoder(types map[string]Type, width, bound int) *bmcEncoder {
+	c := newCircuit()
+	return &bmcEncoder{c: c, width: width, bound: bound, types: types,
+		env: make(map[string][]lit), scopes: [][]string{nil}, guard: c.tt, valid: c.tt,
+		index: make(map[string]int)}
+}
+
+func (b *bmcEncoder) exp(e Exp) []lit {
+	c := b.c
+	switch e := e.(type) {
+	case Num:
+		return c.constant(int(e), b.width)
+	case Bool:
+		if e {
+			return []lit{c.tt}
+		}
+		return []lit{c.ff()}
+	case Var:
+		return b.env[string(e)]
+	case Plus:
+		return c.add(b.exp(e[0]), b.exp(e[1]))
+	case Mult:
+		return c.mul(b.exp(e[0]), b.exp(e[1]))
+	case Equal:
+		return []lit{c.equal(b.exp(e[0]), b.exp(e[1]))}
+	case Less:
+		return []lit{c.less(b.exp(e[0]), b.exp(e[1]))}
+	case And:
+		return []lit{c.and(b.cond(e[0]), b.cond(e[1]))}
+	case Or:
+		return []lit{c.or(b.cond(e[0]), b.cond(e[1]))}
+	case Not:
+		return []lit{b.cond(e.exp).not()}
+	}
+	panic("bmc: unexpected expression " + e.pretty())
+}
+
+func (b *bmcEncoder) cond(e Exp) lit {
+	return b.exp(e)[0]
+}
+
+func (b *bmcEncoder) set(x string, val []lit) {
+	if old, ok := b.env[x]; ok {
+		val = b.c.muxVec(b.guard, val, old)
+	}
+	b.env[x] = val
+}
+
+func (b *bmcEncoder) declare(x string) {
+	scope := b.scopes[len(b.scopes)-1]
+	for _, y := range scope {
+		if y == x {
+			return
+		}
+	}
+	b.scopes[len(b.scopes)-1] = append(scope, x)
+}
+
+// record a statement changing the state, with the visible variables
+func (b *bmcEncoder) step(text string) {
+	st := bmcStep{pos: b.pos, text: text, guard: b.guard, goal: -1}
+	// inner bindings hide outer ones of the same name
+	index := make(map[string]int)
+	for _, scope := range b.scopes {
+		for _, x := range scope {
+			if i, ok := index[sourceName(x)]; ok {
+				st.vars[i], st.vals[i] = x, b.env[x]
+				continue
+			}
+			index[sourceName(x)] = len(st.vars)
+			st.vars = append(st.vars, x)
+			st.vals = append(st.vals, b.env[x])
+		}
+	}
+	b.steps = append(b.steps, st)
+}
+
+// record the evaluation of a condition
+func (b *bmcEncoder) test(text string, value lit) {
+	b.steps = append(b.steps, bmcStep{pos: b.pos, text: text, guard: b.guard, value: []lit{value}, goal: -1})
+}
+
+func (b *bmcEncoder) assume(text string, e Exp) {
+	v := b.cond(e)
+	b.test(text, v)
+	b.valid = b.c.and(b.valid, b.c.or(b.guard.not(), v))
+}
+
+// a specification fails if the execution reaches it, satisfies the
+// assumptions so far and e is false
+func (b *bmcEncoder) check(what string, e Exp) {
+	if e == nil {
+		return
+	}
+	v := b.cond(e)
+	fail := b.c.and(b.c.and(b.guard, b.valid), v.not())
+	spec := mapExpVars(e, sourceName).pretty()
+	key := b.pos.String() + ": " + what + " " + spec
+	i, ok := b.index[key]
+	if !ok {
+		i = len(b.goals)
+		b.index[key] = i
+		b.goals = append(b.goals, bmcGoal{what + " " + spec, what + " failed: " + spec, b.pos, b.c.ff()})
+	}
+	what = b.goals[i].what
+	b.goals[i].fail = b.c.or(b.goals[i].fail, fail)
+	b.steps = append(b.steps, bmcStep{pos: b.pos, text: what, guard: b.guard, value: []lit{v}, goal: i, fail: fail})
+}
+
+func (b *bmcEncoder) block(guard lit, stmt Stmt) {
+	outer := b.guard
+	b.guard = guard
+	b.scopes = append(b.scopes, nil)
+	b.stmt(stmt)
+	b.scopes = b.scopes[:len(b.scopes)-1]
+	b.guard = outer
+}
+
+func (b *bmcEncoder) stmt(stmt Stmt) {
+	show := func(s Stmt) string {
+		return mapStmtVars(s, sourceName).pretty()
+	}
+	showExp := func(e Exp) string {
+		return mapExpVars(e, sourceName).pretty()
+	}
+	switch stmt := stmt.(type) {
+	case Seq:
+		b.stmt(stmt[0])
+		b.stmt(stmt[1])
+	case Decl:
+		b.set(stmt.lhs, b.exp(stmt.rhs))
+		b.declare(stmt.lhs)
+		b.step(show(stmt))
+	case Assign:
+		b.set(stmt.lhs, b.exp(stmt.rhs))
+		b.step(show(stmt))
+	case Read:
+		width := b.width
+		if b.types[stmt.lhs] == TyBool {
+			width = 1
+		}
+		bits := make([]lit, width)
+		for i := range bits {
+			bits[i] = b.c.s.newVar()
+		}
+		b.reads = append(b.reads, bmcRead{b.guard, bits})
+		b.set(stmt.lhs, bits)
+		b.step(show(stmt))
+	case Print:
+		b.steps = append(b.steps, bmcStep{pos: b.pos, text: show(stmt), guard: b.guard, value: b.exp(stmt.exp), goal: -1})
+	case Requires:
+		b.assume(show(stmt), stmt.exp)
+	case Assume:
+		b.assume(show(stmt), stmt.exp)
+	case Ensures:
+		b.check("postcondition", stmt.exp)
+	case Assert:
+		b.check("assertion", stmt.exp)
+	case IfThenElse:
+		c := b.cond(stmt.cond)
+		b.test("if "+showExp(stmt.cond), c)
+		b.block(b.c.and(b.guard, c), stmt.thenStmt)
+		b.block(b.c.and(b.guard, c.not()), stmt.elseStmt)
+	case While:
+		outer, pos := b.guard, b.pos
+		b.check("loop invariant", stmt.inv)
+		for i := 0; i < b.bound; i++ {
+			c := b.cond(stmt.cond)
+			b.test("while "+showExp(stmt.cond), c)
+			b.block(b.c.and(b.guard, c), stmt.body)
+			b.guard = b.c.and(b.guard, c)
+			b.pos = pos
+			b.check("loop invariant", stmt.inv)
+		}
+		c := b.cond(stmt.cond)
+		b.test("while "+showExp(stmt.cond), c)
+		more := b.c.and(b.c.and(b.guard, b.valid), c)
+		b.unwind = append(b.unwind, more)
+		b.valid = b.c.and(b.valid, more.not())
+		b.guard = outer
+	case Located:
+		b.pos = stmt.pos
+		b.stmt(stmt.stmt)
+	}
+}
+
+// Checking
+
+type bmcResult struct {
+	what     string
+	message  string
+	pos      Pos
+	failed   bool
+	trace    []string // executed statements up to the failure
+	inputs   []Val    // values read, in order
+	complete bool     // no execution was cut off by the bound
+	bound    int
+}
+
+func (r bmcResult) String() string {
+	ret := r.pos.String() + ": " + r.what
+	switch {
+	case r.failed:
+		ret += " failed\n\t" + strings.Join(r.trace, "\n\t")
+	case r.complete:
+		ret += " proved"
+	default:
+		ret += fmt.Sprintf(" holds with at most %d loop iterations", r.bound)
+	}
+	return ret
+}
+
+// check the specifications of a well-typed program for the executions
+// with at most bound iterations per loop and width-bit integers
+func bmc(prog Program, width, bound int) []bmcResult {
+	resolved, types := resolveTyped(prog)
+	b := newBMCEncoder(types, width, bound)
+	b.stmt(resolved)
+
+	complete := true
+	for _, u := range b.unwind {
+		if b.c.s.solve(u) {
+			complete = false
+			break
+		}
+	}
+	var ret []bmcResult
+	for i, g := range b.goals {
+		r := bmcResult{what: g.what, message: g.message, pos: g.pos, complete: complete, bound: bound}
+		if b.c.s.solve(g.fail) {
+			r.failed = true
+			r.trace, r.inputs = b.trace(i)
+		}
+		ret = append(ret, r)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		x, y := ret[i].pos, ret[j].pos
+		return x.line < y.line || x.line == y.line && x.col < y.col
+	})
+	return ret
+}
+
+func (b *bmcEncoder) bits(bits []lit) Val {
+	s := b.c.s
+	if len(bits) == 1 && b.width > 1 {
+		return mkBool(s.modelValue(bits[0]))
+	}
+	n := 0
+	for i, l := range bits {
+		if s.modelValue(l) {
+			n |= 1 << uint(i)
+		}
+	}
+	// sign extension
+	if b.width < 64 && s.modelValue(bits[b.width-1]) {
+		n -= 1 << uint(b.width)
+	}
+	return mkInt(n)
+}
+
+// statements executed in the last model up to the failure of a goal
+func (b *bmcEncoder) trace(goal int) ([]string, []Val) {
+	s := b.c.s
+	var trace []string
+	for _, st := range b.steps {
+		if !s.modelValue(st.guard) {
+			continue
+		}
+		line := st.pos.String() + ": " + st.text
+		if st.value != nil {
+			line += " -> " + showVal(b.bits(st.value))
+		} else {
+			var vals []string
+			for i, x := range st.vars {
+				vals = append(vals, sourceName(x)+" = "+showVal(b.bits(st.vals[i])))
+			}
+			if len(vals) > 0 {
+				line += " -> " + strings.Join(vals, ", ")
+			}
+		}
+		trace = append(trace, line)
+		if st.goal == goal && s.modelValue(st.fail) {
+			break
+		}
+	}
+	var inputs []Val
+	for _, r := range b.reads {
+		if s.modelValue(r.guard) {
+			inputs = append(inputs, b.bits(r.bits))
+		}
+	}
+	return trace, inputs
+}
+
+func bmc_cmd(args []string) int {
+	fs := flag.NewFlagSet("bmc", flag.ExitOnError)
+	k := fs.Int("unroll", 10, "maximal number of iterations per loop")
+	width := fs.Int("width", 64, "bits per integer")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *k < 0 || *width < 2 || *width > 64 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	results := bmc(prog, *width, *k)
+	if len(results) == 0 {
+		fmt.Println("nothing to check")
+		return 0
+	}
+	failed := false
+	for _, r := range results {
+		fmt.Println(r)
+		failed = failed || r.failed
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"strings"
+)
+
+// Coverage
+//
+// With coverage enabled, the evaluator counts the executions of every
+// statement with a source position and of every branch: the then and else
+// arm of an if, a while entered or skipped at its first test, and for
+// && and || whether the left operand short-circuits the expression or the
+// right operand is evaluated as well. Branches of && and || are identified by
+// their statement and the expression, so equal expressions in one statement
+// count as one. Counts of several runs are added up, also across invocations
+// by saving them to a file, and reported as a summary, in LCOV format, or as
+// a standalone HTML page of the annotated source.
+
+// a branch of an if or while, or of an && or || in the statement at pos
+type branchPoint struct {
+	pos Pos
+	exp string // "" for an if or while
+	arm string
+}
+
+// where the program branches: two arms of an if, while, && or ||
+type branchSite struct {
+	pos  Pos
+	exp  string
+	what string // shown in reports
+	arms [2]string
+}
+
+func (b branchSite) point(i int) branchPoint {
+	return branchPoint{b.pos, b.exp, b.arms[i]}
+}
+
+// statements and branches of a program, in source order
+type coverSites struct {
+	stmts    []Located
+	branches []branchSite
+}
+
+func findCoverSites(prog Stmt) coverSites {
+	var sites coverSites
+	var pos Pos
+	seen := make(map[branchPoint]bool)
+	var exp func(e Exp)
+	exp = func(e Exp) {
+		if e == nil {
+			return
+		}
+		switch e.(type) {
+		case And, Or:
+			b := branchSite{pos, e.pretty(), e.pretty(), [2]string{"short-circuit", "rhs"}}
+			if !seen[b.point(0)] {
+				seen[b.point(0)] = true
+				sites.branches = append(sites.branches, b)
+			}
+		}
+		for _, f := range subformulas(e) {
+			exp(f)
+		}
+	}
+	var stmt func(s Stmt)
+	stmt = func(s Stmt) {
+		switch s := s.(type) {
+		case Seq:
+			stmt(s[0])
+			stmt(s[1])
+		case Located:
+			pos = s.pos
+			sites.stmts = append(sites.stmts, s)
+			stmt(s.stmt)
+		case IfThenElse:
+			sites.branches = append(sites.branches, branchSite{pos, "", stmtHeader(s), [2]string{"then", "else"}})
+			exp(s.cond)
+			stmt(s.thenStmt)
+			stmt(s.elseStmt)
+		case While:
+			sites.branches = append(sites.branches, branchSite{pos, "", stmtHeader(s), [2]string{"entered", "skipped"}})
+			exp(s.cond)
+			exp(s.inv)
+			stmt(s.body)
+		case Decl:
+			exp(s.rhs)
+		case Assign:
+			exp(s.rhs)
+		case Print:
+			exp(s.exp)
+		case Requires:
+			exp(s.exp)
+		case Ensures:
+			exp(s.exp)
+		case Assert:
+			exp(s.exp)
+		case Assume:
+			exp(s.exp)
+		}
+	}
+	stmt(prog)
+	return sites
+}
+
+// execution counts
+type coverage struct {
+	runs     int
+	stmts    map[Pos]int
+	branches map[branchPoint]int
+}
+
+func newCoverage() *coverage {
+	return &coverage{stmts: make(map[Pos]int), branches: make(map[branchPoint]int)}
+}
+
+// state of the covering evaluator
+var cover struct {
+	enabled bool
+	counts  *coverage
+	stmts   []Pos // statements being executed, innermost last
+}
+
+// run a located statement, counting it
+func coverStmt(l Located, s ValState) {
+	cover.counts.stmts[l.pos]++
+	cover.stmts = append(cover.stmts, l.pos)
+	l.stmt.eval(s)
+	cover.stmts = cover.stmts[:len(cover.stmts)-1]
+}
+
+// an arm of the current if or while, or of e, is taken
+func coverBranch(e Exp, arm string) {
+	if !cover.enabled || len(cover.stmts) == 0 {
+		return
+	}
+	b := branchPoint{pos: cover.stmts[len(cover.stmts)-1], arm: arm}
+	if e != nil {
+		b.exp = e.pretty()
+	}
+	cover.counts.branches[b]++
+}
+
+// run a program with coverage, adding the counts to c
+func runCovered(prog Stmt, c *coverage) {
+	cover.enabled, cover.counts, cover.stmts = true, c, nil
+	defer func() { cover.enabled = false }()
+	prog.eval(newValState())
+	c.runs++
+}
+
+// add the counts of another coverage
+func (c *coverage) merge(other *coverage) {
+	c.runs += other.runs
+	for pos, n := range other.stmts {
+		c.stmts[pos] += n
+	}
+	for b, n := range other.branches {
+		c.branches[b] += n
+	}
+}
+
+// Saved coverage
+
+type coverageFile struct {
+	Program    string `json:"program"`
+	Runs       int    `json:"runs"`
+	Statements []struct {
+		Line  int `json:"line"`
+		Col   int `json:"col"`
+		Count int `json:"count"`
+	} `json:"statements"`
+	Branches []struct {
+		Line  int    `json:"line"`
+		Col   int    `json:"col"`
+		Exp   string `json:"exp,omitempty"`
+		Arm   string `json:"arm"`
+		Count int    `json:"count"`
+	} `json:"branches"`
+}
+
+func writeCoverage(w io.Writer, program string, sites coverSites, c *coverage) error {
+	f := coverageFile{Program: program, Runs: c.runs}
+	for _, l := range sites.stmts {
+		f.Statements = append(f.Statements, struct {
+			Line  int `json:"line"`
+			Col   int `json:"col"`
+			Count int `json:"count"`
+		}{l.pos.line, l.pos.col, c.stmts[l.pos]})
+	}
+	for _, b := range sites.branches {
+		for i := range b.arms {
+			f.Branches = append(f.Branches, struct {
+				Line  int    `json:"line"`
+				Col   int    `json:"col"`
+				Exp   string `json:"exp,omitempty"`
+				Arm   string `json:"arm"`
+				Count int    `json:"count"`
+			}{b.pos.line, b.pos.col, b.exp, b.arms[i], c.branches[b.point(i)]})
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(f)
+}
+
+// read saved counts, which must be of the same program
+func readCoverage(r io.Reader, sites coverSites) (*coverage, error) {
+	var f coverageFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	stmts := make(map[Pos]bool)
+	for _, l := range sites.stmts {
+		stmts[l.pos] = true
+	}
+	branches := make(map[branchPoint]bool)
+	for _, b := range sites.branches {
+		branches[b.point(0)], branches[b.point(1)] = true, true
+	}
+	c := newCoverage()
+	c.runs = f.Runs
+	for _, s := range f.Statements {
+		pos := Pos{s.Line, s.Col}
+		if !stmts[pos] {
+			return nil, fmt.Errorf("coverage of %s does not match the program: no statement at %d:%d", f.Program, s.Line, s.Col)
+		}
+		c.stmts[pos] += s.Count
+	}
+	for _, b := range f.Branches {
+		p := branchPoint{Pos{b.Line, b.Col}, b.Exp, b.Arm}
+		if !branches[p] {
+			return nil, fmt.Errorf("coverage of %s does not match the program: no branch %s at %d:%d", f.Program, b.Arm, b.Line, b.Col)
+		}
+		c.branches[p] += b.Count
+	}
+	return c, nil
+}
+
+// Reports
+
+// covered and total statements and branches
+func (c *coverage) totals(sites coverSites) (stmts, allStmts, branches, allBranches int) {
+	for _, l := range sites.stmts {
+		if c.stmts[l.pos] > 0 {
+			stmts++
+		}
+	}
+	for _, b := range sites.branches {
+		for i := range b.arms {
+			if c.branches[b.point(i)] > 0 {
+				branches++
+			}
+		}
+	}
+	return stmts, len(sites.stmts), branches, 2 * len(sites.branches)
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "100.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
+
+// percentages and everything not covered
+func writeCoverageSummary(w io.Writer, sites coverSites, c *coverage) {
+	stmts, allStmts, branches, allBranches := c.totals(sites)
+	fmt.Fprintf(w, "runs: %d\n", c.runs)
+	fmt.Fprintf(w, "statements: %d/%d (%s)\n", stmts, allStmts, percent(stmts, allStmts))
+	fmt.Fprintf(w, "branches: %d/%d (%s)\n", branches, allBranches, percent(branches, allBranches))
+	for _, l := range sites.stmts {
+		if c.stmts[l.pos] == 0 {
+			fmt.Fprintf(w, "%s: not executed: %s\n", l.pos, stmtHeader(l.stmt))
+		}
+	}
+	for _, b := range sites.branches {
+		for i, arm := range b.arms {
+			if c.branches[b.point(i)] == 0 {
+				fmt.Fprintf(w, "%s: %s not taken: %s\n", b.pos, arm, b.what)
+			}
+		}
+	}
+}
+
+// LCOV tracefile: the count of a line is the largest of its statements.
+// every if, while, && and || is a block with the branches 0 and 1, taken "-"
+// if its statement was never executed
+func writeLCOV(w io.Writer, path string, sites coverSites, c *coverage) {
+	fmt.Fprintln(w, "TN:")
+	fmt.Fprintf(w, "SF:%s\n", path)
+	lines := make(map[int]int)
+	var order []int
+	for _, l := range sites.stmts {
+		n, ok := lines[l.pos.line]
+		if !ok {
+			order = append(order, l.pos.line)
+		}
+		if c.stmts[l.pos] > n || !ok {
+			lines[l.pos.line] = c.stmts[l.pos]
+		}
+	}
+	_, _, branches, allBranches := c.totals(sites)
+	for block, b := range sites.branches {
+		for i := range b.arms {
+			taken := "-"
+			if c.stmts[b.pos] > 0 {
+				taken = fmt.Sprint(c.branches[b.point(i)])
+			}
+			fmt.Fprintf(w, "BRDA:%d,%d,%d,%s\n", b.pos.line, block, i, taken)
+		}
+	}
+	fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", allBranches, branches)
+	hit := 0
+	for _, line := range order {
+		fmt.Fprintf(w, "DA:%d,%d\n", line, lines[line])
+		if lines[line] > 0 {
+			hit++
+		}
+	}
+	fmt.Fprintf(w, "LF:%d\nLH:%d\n", len(order), hit)
+	fmt.Fprintln(w, "end_of_record")
+}
+
+const coverageCSS = `body { font-family: sans-serif; }
+table { border-collapse: collapse; font-family: monospace; }
+td { padding: 0 0.5em; white-space: pre; vertical-align: top; }
+td.line, td.count { text-align: right; color: #555; }
+tr.covered td.source { background: #dfd; }
+tr.partial td.source { background: #ffc; }
+tr.missed td.source { background: #fdd; }
+.branches { color: #555; font-size: smaller; }
+.untaken { color: #c00; font-weight: bold; }
+`
+
+// standalone HTML page: the source, every line with its count and colored
+// as covered, partially covered or missed, and the branches with their counts
+func writeCoverageHTML(w io.Writer, path, source string, sites coverSites, c *coverage) {
+	counts := make(map[int]int)
+	executable := make(map[int]bool)
+	partial := make(map[int]bool) // a statement or branch of the line is not covered
+	for _, l := range sites.stmts {
+		n := c.stmts[l.pos]
+		if n > counts[l.pos.line] {
+			counts[l.pos.line] = n
+		}
+		executable[l.pos.line] = true
+		partial[l.pos.line] = partial[l.pos.line] || n == 0
+	}
+	branches := make(map[int][]string)
+	for _, b := range sites.branches {
+		var arms []string
+		for i, arm := range b.arms {
+			n := c.branches[b.point(i)]
+			text := html.EscapeString(fmt.Sprintf("%s %d", arm, n))
+			if n == 0 {
+				partial[b.pos.line] = true
+				text = `<span class="untaken">` + text + `</span>`
+			}
+			arms = append(arms, text)
+		}
+		branches[b.pos.line] = append(branches[b.pos.line], html.EscapeString(b.what)+": "+strings.Join(arms, ", "))
+	}
+
+	stmts, allStmts, nBranches, allBranches := c.totals(sites)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Coverage of %s</title>\n<style>\n%s</style>\n</head>\n<body>\n", html.EscapeString(path), coverageCSS)
+	fmt.Fprintf(w, "<h1>%s</h1>\n<p>%d runs, statements %d/%d (%s), branches %d/%d (%s)</p>\n<table>\n",
+		html.EscapeString(path), c.runs, stmts, allStmts, percent(stmts, allStmts), nBranches, allBranches, percent(nBranches, allBranches))
+	for i, text := range strings.Split(strings.TrimSuffix(source, "\n"), "\n") {
+		line := i + 1
+		class, count := "", ""
+		if executable[line] {
+			count = fmt.Sprint(counts[line])
+			switch {
+			case counts[line] == 0:
+				class = "missed"
+			case partial[line]:
+				class = "partial"
+			default:
+				class = "covered"
+			}
+		}
+		fmt.Fprintf(w, "<tr class=\"%s\"><td class=\"line\">%d</td><td class=\"count\">%s</td><td class=\"source\">%s</td><td class=\"branches\">%s</td></tr>\n",
+			class, line, count, html.EscapeString(text), strings.Join(branches[line], "; "))
+	}
+	fmt.Fprint(w, "</table>\n</body>\n</html>\n")
+}
+
+// input files of the runs, one run per file
+type inputFiles []string
+
+func (f *inputFiles) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *inputFiles) Set(file string) error {
+	*f = append(*f, file)
+	return nil
+}
+
+// write a report with the given function to a file
+func writeReport(path string, write func(w io.Writer)) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	write(w)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func coverage_cmd(args []string) int {
+	fs := flag.NewFlagSet("coverage", flag.ExitOnError)
+	var inputs inputFiles
+	fs.Var(&inputs, "input", "run the program with this file as input, may be repeated")
+	data := fs.String("data", "", "add the counts to those saved in this file and save them")
+	lcov := fs.String("lcov", "", "write an LCOV tracefile")
+	htmlOut := fs.String("html", "", "write an HTML report")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	path := fs.Arg(0)
+	prog, err := load_checked(path)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	source, _ := os.ReadFile(path)
+	sites := findCoverSites(prog)
+
+	c := newCoverage()
+	if *data != "" {
+		f, err := os.Open(*data)
+		if err == nil {
+			saved, err := readCoverage(f, sites)
+			f.Close()
+			if err != nil {
+				fmt.Printf("%s: %s\n", *data, err)
+				return 1
+			}
+			c.merge(saved)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			fmt.Println(err)
+			return 1
+		}
+	}
+
+	// the output of the program goes to stderr, not into the summary
+	stdout = os.Stderr
+	if len(inputs) == 0 {
+		runCovered(prog, c)
+	}
+	for _, input := range inputs {
+		f, err := os.Open(input)
+		if err != nil {
+			stdout = os.Stdout
+			fmt.Println(err)
+			return 1
+		}
+		stdin = bufio.NewReader(f)
+		runCovered(prog, c)
+		f.Close()
+	}
+	stdout = os.Stdout
+
+	writeCoverageSummary(os.Stdout, sites, c)
+	for _, report := range []struct {
+		path  string
+		write func(w io.Writer)
+	}{
+		{*data, func(w io.Writer) { writeCoverage(w, path, sites, c) }},
+		{*lcov, func(w io.Writer) { writeLCOV(w, path, sites, c) }},
+		{*htmlOut, func(w io.Writer) { writeCoverageHTML(w, path, string(source), sites, c) }},
+	} {
+		if report.path == "" {
+			continue
+		}
+		if err := writeReport(report.path, report.write); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Debug Adapter Protocol
+//
+// serveDAP() lets editors drive the debugger: messages are JSON objects,
+// each preceded by a Content-Length header, read from in and written to out.
+// Supported requests are initialize, launch, setBreakpoints,
+// configurationDone, threads, continue, next, stepIn, stepOut, stackTrace,
+// scopes, variables, evaluate and disconnect. There is a single thread, and
+// one stack frame per scope, innermost first, whose variables are those of
+// the scope. The program's output is sent as output events; values for read
+// statements are taken from the "input" argument of launch.
+
+type dapObject map[string]interface{}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapServer struct {
+	in          *bufio.Reader
+	out         io.Writer
+	seq         int
+	program     string // path of the launched program
+	stopOnEntry bool
+	input       string // for read statements
+	d           *debugger
+	breakpoints map[int]Exp // shared with d, may be set before launch
+}
+
+// read a message: headers, an empty line and Content-Length bytes of JSON
+func readDAPMessage(in *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid header %s", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
+	}
+	buf := make([]byte, length)
+	_, err := io.ReadFull(in, buf)
+	return buf, err
+}
+
+func writeDAPMessage(out io.Writer, msg interface{}) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+	return err
+}
+
+func (s *dapServer) send(msg interface{}) {
+	writeDAPMessage(s.out, msg)
+}
+
+func (s *dapServer) nextSeq() int {
+	s.seq++
+	return s.seq
+}
+
+func (s *dapServer) event(name string, body interface{}) {
+	s.send(dapEvent{Seq: s.nextSeq(), Type: "event", Event: name, Body: body})
+}
+
+// program output becomes output events
+type dapOutput struct {
+	s *dapServer
+}
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	o.s.event("output", dapObject{"category": "stdout", "output": string(p)})
+	return len(p), nil
+}
+
+// serve requests until disconnect or the end of the input
+func serveDAP(in io.Reader, out io.Writer) error {
+	s := &dapServer{in: bufio.NewReader(in), out: out, breakpoints: make(map[int]Exp)}
+	oldOut, oldIn := stdout, stdin
+	stdout = dapOutput{s}
+	defer func() { stdout, stdin = oldOut, oldIn }()
+	for {
+		buf, err := readDAPMessage(s.in)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var req dapRequest
+		if err := json.Unmarshal(buf, &req); err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, err := s.handle(req)
+		resp := dapResponse{Seq: s.nextSeq(), Type: "response", RequestSeq: req.Seq, Success: err == nil, Command: req.Command, Body: body}
+		if err != nil {
+			resp.Message = err.Error()
+			resp.Body = nil
+		}
+		s.send(resp)
+		if err == nil {
+			s.after(req.Command)
+		}
+		if req.Command == "disconnect" {
+			return nil
+		}
+	}
+}
+
+// handle a request, returning the body of the response
+func (s *dapServer) handle(req dapRequest) (interface{}, error) {
+	var args struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+		Input       string `json:"input"`
+		Breakpoints []struct {
+			Line      int    `json:"line"`
+			Condition string `json:"condition"`
+		} `json:"breakpoints"`
+		FrameID            int    `json:"frameId"`
+		VariablesReference int    `json:"variablesReference"`
+		Expression         string `json:"expression"`
+	}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+	switch req.Command {
+	case "initialize":
+		return dapObject{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+		}, nil
+	case "launch":
+		prog, err := load_checked(args.Program)
+		if err != nil {
+			return nil, err
+		}
+		s.program, s.stopOnEntry, s.input = args.Program, args.StopOnEntry, args.Input
+		s.d = newDebugger(prog)
+		s.d.breakpoints = s.breakpoints
+		return nil, nil
+	case "setBreakpoints":
+		// the breakpoints replace all previous ones of the program
+		for line := range s.breakpoints {
+			delete(s.breakpoints, line)
+		}
+		var verified []dapObject
+		for _, b := range args.Breakpoints {
+			bp := dapObject{"line": b.Line, "verified": true}
+			e, err := parseCondition(b.Condition)
+			if err != nil {
+				bp["verified"], bp["message"] = false, err.Error()
+			} else {
+				s.breakpoints[b.Line] = e
+			}
+			verified = append(verified, bp)
+		}
+		return dapObject{"breakpoints": verified}, nil
+	case "configurationDone", "disconnect":
+		return nil, nil
+	case "threads":
+		return dapObject{"threads": []dapObject{{"id": 1, "name": "main"}}}, nil
+	case "continue", "next", "stepIn", "stepOut":
+		if s.d == nil || s.d.finished() {
+			return nil, fmt.Errorf("the program is not running")
+		}
+		if req.Command == "continue" {
+			return dapObject{"allThreadsContinued": true}, nil
+		}
+		return nil, nil
+	case "stackTrace":
+		frames := []dapObject{}
+		if s.d != nil {
+			for i := len(s.d.lines) - 1; i >= 0; i-- {
+				name := "global scope"
+				if i > 0 {
+					name = "block at " + s.d.lines[i-1].String()
+				}
+				frames = append(frames, dapObject{
+					"id":     i + 1,
+					"name":   name,
+					"line":   s.d.lines[i].line,
+					"column": s.d.lines[i].col,
+					"source": dapObject{"name": filepath.Base(s.program), "path": s.program},
+				})
+			}
+		}
+		return dapObject{"stackFrames": frames, "totalFrames": len(frames)}, nil
+	case "scopes":
+		if _, err := s.scope(args.FrameID); err != nil {
+			return nil, err
+		}
+		return dapObject{"scopes": []dapObject{{"name": "Locals", "variablesReference": args.FrameID, "expensive": false}}}, nil
+	case "variables":
+		scope, err := s.scope(args.VariablesReference)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for x := range scope {
+			names = append(names, x)
+		}
+		sort.Strings(names)
+		vars := []dapObject{}
+		for _, x := range names {
+			vars = append(vars, dapObject{"name": x, "value": showVal(scope[x]), "type": showValType(scope[x]), "variablesReference": 0})
+		}
+		return dapObject{"variables": vars}, nil
+	case "evaluate":
+		if s.d == nil {
+			return nil, fmt.Errorf("the program is not running")
+		}
+		// in the scopes visible from the frame, all of them by default
+		state := s.d.state
+		if args.FrameID > 0 {
+			if _, err := s.scope(args.FrameID); err != nil {
+				return nil, err
+			}
+			state = state[:args.FrameID]
+		}
+		e, err := newParser().parse_expfromstring(args.Expression)
+		if err != nil {
+			return nil, err
+		}
+		v, err := evalIn(e, state)
+		if err != nil {
+			return nil, err
+		}
+		return dapObject{"result": showVal(v), "type": showValType(v), "variablesReference": 0}, nil
+	}
+	return nil, fmt.Errorf("unsupported request %s", req.Command)
+}
+
+// the scope of a stack frame, numbered from 1 for the global scope
+func (s *dapServer) scope(frame int) (Scope, error) {
+	if s.d == nil || frame < 1 || frame > len(s.d.lines) {
+		return nil, fmt.Errorf("no stack frame %d", frame)
+	}
+	return s.d.state[frame-1], nil
+}
+
+// events following the response to a request: running the program
+func (s *dapServer) after(command string) {
+	switch command {
+	case "initialize":
+		s.event("initialized", nil)
+	case "configurationDone":
+		if s.d == nil {
+			return
+		}
+		stdin = strings.NewReader(s.input)
+		if s.stopOnEntry && !s.d.finished() {
+			s.stopped(stopEntry)
+		} else {
+			s.stopped(s.d.resume(stepContinue))
+		}
+	case "continue":
+		s.stopped(s.d.resume(stepContinue))
+	case "next":
+		s.stopped(s.d.resume(stepOver))
+	case "stepIn":
+		s.stopped(s.d.resume(stepIn))
+	case "stepOut":
+		s.stopped(s.d.resume(stepOut))
+	}
+}
+
+func (s *dapServer) stopped(reason stopReason) {
+	if reason == stopExited {
+		s.event("exited", dapObject{"exitCode": 0})
+		s.event("terminated", nil)
+		return
+	}
+	name := map[stopReason]string{stopEntry: "entry", stopStep: "step", stopBreakpoint: "breakpoint"}[reason]
+	s.event("stopped", dapObject{"reason": name, "threadId": 1, "allThreadsStopped": true})
+}
+
+func dap_cmd(args []string) int {
+	fs := flag.NewFlagSet("dap", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		usage()
+	}
+	if err := serveDAP(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,196 @@
+package main
+
+// Dead code elimination
+//
+// A backwards liveness analysis over a resolved program (see resolve.go), so
+// that every variable name denotes exactly one binding. Removed are:
+//   - assignments whose value is never read afterwards
+//   - declarations of variables that are never mentioned afterwards
+//   - branches of if-then-else and loops whose condition is constant false
+//   - skip statements
+// Print, read and specification statements are always kept, along with the
+// expressions they observe.
+
+// variables after a program point
+type liveness struct {
+	live map[string]bool // values that may be read
+	used map[string]bool // bindings that may be read or assigned
+}
+
+func (l liveness) copy() liveness {
+	return liveness{copySet(l.live), copySet(l.used)}
+}
+
+func (l liveness) union(other liveness) liveness {
+	return liveness{unionSet(l.live, other.live), unionSet(l.used, other.used)}
+}
+
+func (l liveness) equal(other liveness) bool {
+	return len(l.live) == len(other.live) && len(l.used) == len(other.used) &&
+		len(unionSet(l.live, other.live)) == len(l.live) &&
+		len(unionSet(l.used, other.used)) == len(l.used)
+}
+
+// x is declared with the value of e. the binding itself is not a use,
+// so that a declaration in a loop body does not keep itself alive
+func (l liveness) declare(x string, e Exp) liveness {
+	ret := l.copy()
+	delete(ret.live, x)
+	return ret.read(e)
+}
+
+// x is assigned the value of e. the binding must exist beforehand
+func (l liveness) assign(x string, e Exp) liveness {
+	ret := l.declare(x, e)
+	ret.used[x] = true
+	return ret
+}
+
+// x is read from the input. the binding must exist beforehand
+func (l liveness) input(x string) liveness {
+	ret := l.copy()
+	delete(ret.live, x)
+	ret.used[x] = true
+	return ret
+}
+
+func (l liveness) read(e Exp) liveness {
+	if e == nil {
+		return l
+	}
+	ret := l.copy()
+	for x := range expVars(e) {
+		ret.live[x] = true
+		ret.used[x] = true
+	}
+	return ret
+}
+
+type deadCode struct {
+	dry     bool     // only analyze, used while iterating loops to a fixed point
+	removed []string // descriptions of removed code
+}
+
+// remove dead code from a well-typed program.
+// returns the new program and a description of everything that was removed
+func eliminateDeadCode(prog Program) (Program, []string) {
+	d := &deadCode{}
+	out := liveness{make(map[string]bool), make(map[string]bool)}
+	stmt, _ := d.stmt(resolve(prog), out)
+	// the analysis runs backwards, report in program order
+	for i, j := 0, len(d.removed)-1; i < j; i, j = i+1, j-1 {
+		d.removed[i], d.removed[j] = d.removed[j], d.removed[i]
+	}
+	return (Program)(unresolve(stmt)), d.removed
+}
+
+func (d *deadCode) remove(what string, stmt Stmt) {
+	if !d.dry {
+		d.removed = append(d.removed, what+": "+unresolve(stmt).pretty())
+	}
+}
+
+// returns the statement without dead code and the liveness before it
+func (d *deadCode) stmt(stmt Stmt, out liveness) (Stmt, liveness) {
+	switch stmt := stmt.(type) {
+	case Seq:
+		second, mid := d.stmt(stmt[1], out)
+		first, in := d.stmt(stmt[0], mid)
+		return mkSeq(first, second), in
+	case Decl:
+		if !out.used[stmt.lhs] {
+			d.remove("unused variable", stmt)
+			return Skip{}, out
+		}
+		return stmt, out.declare(stmt.lhs, stmt.rhs)
+	case Assign:
+		if !out.live[stmt.lhs] {
+			d.remove("unused assignment", stmt)
+			return Skip{}, out
+		}
+		return stmt, out.assign(stmt.lhs, stmt.rhs)
+	case Print:
+		return stmt, out.read(stmt.exp)
+	case Requires:
+		return stmt, out.read(stmt.exp)
+	case Ensures:
+		return stmt, out.read(stmt.exp)
+	case Assert:
+		return stmt, out.read(stmt.exp)
+	case Assume:
+		return stmt, out.read(stmt.exp)
+	case Read:
+		// reads consume input, so they are always kept
+		return stmt, out.input(stmt.lhs)
+	case Skip:
+		return stmt, out
+	case IfThenElse:
+		if b, ok := stmt.cond.(Bool); ok {
+			branch, dead := stmt.thenStmt, stmt.elseStmt
+			if !b {
+				branch, dead = dead, branch
+			}
+			if dead != Stmt(Skip{}) {
+				d.remove("unreachable branch", dead)
+			}
+			branch, in := d.stmt(branch, out)
+			if !declaresInScope(branch) {
+				return branch, in
+			}
+			if b {
+				return IfThenElse{stmt.cond, branch, Skip{}}, in
+			}
+			return IfThenElse{stmt.cond, Skip{}, branch}, in
+		}
+		elseStmt, inElse := d.stmt(stmt.elseStmt, out)
+		thenStmt, inThen := d.stmt(stmt.thenStmt, out)
+		if thenStmt == Stmt(Skip{}) && elseStmt == Stmt(Skip{}) {
+			d.remove("empty if", IfThenElse{stmt.cond, Skip{}, Skip{}})
+			return Skip{}, out
+		}
+		return IfThenElse{stmt.cond, thenStmt, elseStmt}, inThen.union(inElse).read(stmt.cond)
+	case While:
+		if stmt.cond == Exp(Bool(false)) {
+			d.remove("unreachable loop", stmt)
+			return Skip{}, out
+		}
+		// liveness at the loop head: after the loop or after another iteration
+		head := out.read(stmt.cond).read(stmt.inv)
+		dry := d.dry
+		d.dry = true
+		for {
+			_, in := d.stmt(stmt.body, head)
+			next := head.union(in)
+			if next.equal(head) {
+				break
+			}
+			head = next
+		}
+		d.dry = dry
+		body, _ := d.stmt(stmt.body, head)
+		return While{stmt.cond, body, stmt.inv}, head
+	case Located:
+		inner, in := d.stmt(stmt.stmt, out)
+		return relocate(stmt.pos, inner), in
+	default:
+		return stmt, out
+	}
+}
+
+// Set helpers
+
+func copySet(s map[string]bool) map[string]bool {
+	ret := make(map[string]bool, len(s))
+	for x := range s {
+		ret[x] = true
+	}
+	return ret
+}
+
+func unionSet(a, b map[string]bool) map[string]bool {
+	ret := copySet(a)
+	for x := range b {
+		ret[x] = true
+	}
+	return ret
+}
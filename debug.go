@@ -0,0 +1,390 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Debugger
+//
+// A debugger runs a program with the small-step semantics, see step(), and
+// pauses at the start of statements: after every statement when stepping
+// into, at the next statement in the same or an enclosing scope when stepping
+// over, after the current block when stepping out, and at breakpoints when
+// continuing. Loops pause at their condition before every iteration.
+// Breakpoints are set on source lines and may have a condition, which stops
+// the program only if it evaluates to true. Expressions are type-checked and
+// evaluated against the current scope stack.
+
+// why the program stopped
+type stopReason int
+
+const (
+	stopEntry      stopReason = iota // before the first statement
+	stopStep                         // after stepping
+	stopBreakpoint                   // at a breakpoint
+	stopExited                       // the program has finished
+)
+
+type stepMode int
+
+const (
+	stepIn stepMode = iota
+	stepOver
+	stepOut
+	stepContinue
+)
+
+type debugger struct {
+	stmt        Stmt // remaining program, as in step()
+	state       ValState
+	lines       []Pos       // current statement of every scope, innermost last
+	breakpoints map[int]Exp // condition of the breakpoint on every line, nil if none
+}
+
+// debugger paused before the first statement of a program parsed with
+// newLocatingParser()
+func newDebugger(prog Program) *debugger {
+	d := &debugger{stmt: prog, state: newValState(), breakpoints: make(map[int]Exp)}
+	if pos, ok := nextStmt(d.stmt); ok {
+		d.enter(pos)
+	}
+	return d
+}
+
+// type environment view, used to check expressions against the state
+func (env ValState) types() TyState {
+	t := make(TyState, len(env))
+	for i, scope := range env {
+		t[i] = make(TyScope, len(scope))
+		for name, v := range scope {
+			switch v.flag {
+			case ValueInt:
+				t[i][name] = TyBinding{ty: TyInt}
+			case ValueBool:
+				t[i][name] = TyBinding{ty: TyBool}
+			}
+		}
+	}
+	return t
+}
+
+// position of the statement the next step starts, if it starts one
+func nextStmt(stmt Stmt) (Pos, bool) {
+	switch stmt := stmt.(type) {
+	case Seq:
+		return nextStmt(stmt[0])
+	case Block:
+		return nextStmt(stmt.stmt)
+	case Located:
+		return stmt.pos, true
+	}
+	return Pos{}, false
+}
+
+func (d *debugger) finished() bool {
+	return isSkip(d.stmt)
+}
+
+// position of the current statement
+func (d *debugger) pos() Pos {
+	if len(d.lines) == 0 {
+		return Pos{}
+	}
+	return d.lines[len(d.lines)-1]
+}
+
+// the statement at pos is next, in the innermost scope
+func (d *debugger) enter(pos Pos) {
+	depth := len(d.state)
+	if len(d.lines) > depth {
+		d.lines = d.lines[:depth]
+	}
+	for len(d.lines) < depth {
+		d.lines = append(d.lines, d.pos())
+	}
+	d.lines[depth-1] = pos
+}
+
+// run to the start of the next statement. false if the program finished
+func (d *debugger) stepStmt() bool {
+	for !d.finished() {
+		d.stmt = step(d.stmt, &d.state)
+		if pos, ok := nextStmt(d.stmt); ok {
+			d.enter(pos)
+			return true
+		}
+	}
+	d.lines = nil
+	return false
+}
+
+// resume running until the step is done or a breakpoint is hit
+func (d *debugger) resume(mode stepMode) stopReason {
+	depth := len(d.state)
+	for d.stepStmt() {
+		if d.atBreakpoint() {
+			return stopBreakpoint
+		}
+		switch {
+		case mode == stepIn,
+			mode == stepOver && len(d.state) <= depth,
+			mode == stepOut && len(d.state) < depth:
+			return stopStep
+		}
+	}
+	return stopExited
+}
+
+// whether a breakpoint is set on the current line and its condition holds.
+// a condition that cannot be evaluated stops the program as well
+func (d *debugger) atBreakpoint() bool {
+	cond, ok := d.breakpoints[d.pos().line]
+	if !ok || cond == nil {
+		return ok
+	}
+	v, err := d.eval(cond)
+	return err != nil || v.flag != ValueBool || v.valB
+}
+
+// evaluate an expression in the current state
+func (d *debugger) eval(e Exp) (Val, error) {
+	return evalIn(e, d.state)
+}
+
+// evaluate an expression if it is well-typed in the given scopes
+func evalIn(e Exp, s ValState) (Val, error) {
+	if e.infer(s.types()) == TyIllTyped {
+		return mkUndefined(), fmt.Errorf("%s is ill-typed in the current scope", e.pretty())
+	}
+	return e.eval(s), nil
+}
+
+// parse and evaluate an expression, e.g. typed by the user
+func (d *debugger) evaluate(code string) (Val, error) {
+	e, err := newParser().parse_expfromstring(code)
+	if err != nil {
+		return mkUndefined(), err
+	}
+	return d.eval(e)
+}
+
+// set a breakpoint, with a condition unless cond is empty
+func (d *debugger) setBreakpoint(line int, cond string) error {
+	e, err := parseCondition(cond)
+	if err != nil {
+		return err
+	}
+	d.breakpoints[line] = e
+	return nil
+}
+
+// condition of a breakpoint, nil if there is none
+func parseCondition(cond string) (Exp, error) {
+	if strings.TrimSpace(cond) == "" {
+		return nil, nil
+	}
+	return newParser().parse_expfromstring(cond)
+}
+
+// Command line interface
+
+const debugHelp = `commands:
+  break <line> [if <exp>]  set a breakpoint, stopping only if exp is true
+  delete <line>            remove a breakpoint
+  info                     list breakpoints and watch expressions
+  step, s                  run to the next statement, stepping into blocks
+  next, n                  run to the next statement in this or an outer block
+  out, o                   run to the end of the current block
+  continue, c              run to the next breakpoint
+  scopes                   print the scope stack, innermost scope first
+  print <exp>, p <exp>     evaluate an expression in the current scope
+  watch <exp>              print an expression whenever the program stops
+  unwatch <n>              remove the nth watch expression
+  quit, q                  stop debugging
+`
+
+// a line of input. input is not buffered, the program reads from stdin too
+func readLine(in io.Reader) (string, bool) {
+	var line []byte
+	var b [1]byte
+	for {
+		n, err := in.Read(b[:])
+		if n == 1 {
+			if b[0] == '\n' {
+				return string(line), true
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			return string(line), len(line) > 0
+		}
+	}
+}
+
+// the first line of the current statement
+func (d *debugger) current() string {
+	var s Stmt = d.stmt
+	for {
+		switch stmt := s.(type) {
+		case Seq:
+			s = stmt[0]
+			continue
+		case Block:
+			s = stmt.stmt
+			continue
+		case Located:
+			s = stmt.stmt
+			continue
+		}
+		return strings.SplitN(s.pretty(), "\n", 2)[0]
+	}
+}
+
+// print why the program stopped and the watch expressions
+func (d *debugger) report(reason stopReason, watches []string) {
+	switch reason {
+	case stopExited:
+		fmt.Fprintln(stdout, "program finished")
+		return
+	case stopBreakpoint:
+		fmt.Fprintf(stdout, "breakpoint at %s: %s\n", d.pos(), d.current())
+		if cond := d.breakpoints[d.pos().line]; cond != nil {
+			if _, err := d.eval(cond); err != nil {
+				fmt.Fprintf(stdout, "condition %s\n", err)
+			}
+		}
+	default:
+		fmt.Fprintf(stdout, "%s: %s\n", d.pos(), d.current())
+	}
+	for i, w := range watches {
+		fmt.Fprintf(stdout, "watch %d: %s = %s\n", i+1, w, d.show(w))
+	}
+}
+
+// value of an expression typed by the user, or the error
+func (d *debugger) show(code string) string {
+	v, err := d.evaluate(code)
+	if err != nil {
+		return err.Error()
+	}
+	return showVal(v)
+}
+
+// read and run debugger commands from stdin until quit or end of input
+func (d *debugger) repl() {
+	var watches []string
+	d.report(stopEntry, watches)
+	for {
+		fmt.Fprint(stdout, "(debug) ")
+		line, ok := readLine(stdin)
+		if !ok {
+			fmt.Fprintln(stdout)
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		arg = strings.TrimSpace(arg)
+		switch cmd {
+		case "":
+		case "break", "b":
+			lineArg, cond, _ := strings.Cut(arg, " ")
+			cond = strings.TrimSpace(cond)
+			n, err := strconv.Atoi(lineArg)
+			if err != nil {
+				fmt.Fprintln(stdout, "usage: break <line> [if <exp>]")
+				break
+			}
+			if cond != "" && !strings.HasPrefix(cond, "if ") {
+				fmt.Fprintln(stdout, "usage: break <line> [if <exp>]")
+				break
+			}
+			if err := d.setBreakpoint(n, strings.TrimSpace(strings.TrimPrefix(cond, "if "))); err != nil {
+				fmt.Fprintln(stdout, err)
+				break
+			}
+			fmt.Fprintf(stdout, "breakpoint at line %d\n", n)
+		case "delete", "d":
+			n, err := strconv.Atoi(arg)
+			if _, ok := d.breakpoints[n]; err != nil || !ok {
+				fmt.Fprintf(stdout, "no breakpoint at line %s\n", arg)
+				break
+			}
+			delete(d.breakpoints, n)
+		case "info", "i":
+			var lines []int
+			for n := range d.breakpoints {
+				lines = append(lines, n)
+			}
+			sort.Ints(lines)
+			for _, n := range lines {
+				if cond := d.breakpoints[n]; cond != nil {
+					fmt.Fprintf(stdout, "breakpoint at line %d if %s\n", n, cond.pretty())
+				} else {
+					fmt.Fprintf(stdout, "breakpoint at line %d\n", n)
+				}
+			}
+			for i, w := range watches {
+				fmt.Fprintf(stdout, "watch %d: %s\n", i+1, w)
+			}
+		case "step", "s", "next", "n", "out", "o", "continue", "c":
+			if d.finished() {
+				d.report(stopExited, watches)
+				break
+			}
+			mode := map[string]stepMode{
+				"step": stepIn, "s": stepIn, "next": stepOver, "n": stepOver,
+				"out": stepOut, "o": stepOut, "continue": stepContinue, "c": stepContinue,
+			}[cmd]
+			d.report(d.resume(mode), watches)
+		case "scopes":
+			for i := len(d.state) - 1; i >= 0; i-- {
+				where := "finished"
+				if i < len(d.lines) {
+					where = d.lines[i].String()
+				}
+				fmt.Fprintf(stdout, "scope %d (%s): %s\n", i, where, showScopes(d.state[i:i+1]))
+			}
+		case "print", "p":
+			fmt.Fprintln(stdout, d.show(arg))
+		case "watch", "w":
+			if _, err := newParser().parse_expfromstring(arg); err != nil {
+				fmt.Fprintln(stdout, err)
+				break
+			}
+			watches = append(watches, arg)
+			fmt.Fprintf(stdout, "watch %d: %s = %s\n", len(watches), arg, d.show(arg))
+		case "unwatch":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > len(watches) {
+				fmt.Fprintf(stdout, "no watch expression %s\n", arg)
+				break
+			}
+			watches = append(watches[:n-1], watches[n:]...)
+		case "quit", "q":
+			return
+		case "help", "h":
+			fmt.Fprint(stdout, debugHelp)
+		default:
+			fmt.Fprintf(stdout, "unknown command %s, try help\n", cmd)
+		}
+	}
+}
+
+func debug_cmd(args []string) int {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	newDebugger(prog).repl()
+	return 0
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"os"
+	"strings"
+)
+
+// Derivation trees
+//
+// deriveEval() builds the big-step derivation of running a program, and
+// deriveTypes() the typing derivation checked by Stmt.check. Every node
+// records the rule applied, its premises and its conclusion, which is
+// computed by eval, infer and check themselves, so the trees always agree
+// with the interpreter and the type checker. Judgements are
+//   σ ⊢ e ⇓ v       expression e evaluates to v in state σ
+//   σ ⊢ s ⇓ σ'      statement s turns state σ into σ'
+//   Γ ⊢ e : T       expression e has type T in environment Γ
+//   Γ ⊢ s : Γ'      statement s is well-typed and declares Γ'
+// where states and environments are scope stacks, innermost scope last.
+// Loops are derived by unfolding, so long loops give deep trees: the
+// iterations after the first few can be omitted, and any tree can be cut at
+// some depth when rendering. Trees are rendered as indented text, LaTeX
+// (bussproofs) or HTML.
+
+type judgement struct {
+	env     string // state or type environment
+	subject string // expression or statement
+	typing  bool   // ":" rather than "⇓"
+	result  string
+}
+
+type derivation struct {
+	rule       string
+	premises   []*derivation
+	conclusion judgement
+	omitted    string // why the premises are not shown, if they are not
+	val        Val    // value of an evaluated expression
+}
+
+// pretty print on one line
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+type deriver struct {
+	iterations int // loop iterations derived in full, 0 for all
+}
+
+// derivation of running a program from the empty state
+func deriveEval(prog Program, iterations int) *derivation {
+	d := &deriver{iterations}
+	s := newValState()
+	return d.stmt(prog, &s)
+}
+
+func (d *deriver) exp(e Exp, s ValState) *derivation {
+	v := e.eval(s)
+	node := &derivation{conclusion: judgement{env: showScopes(s), subject: e.pretty(), result: showVal(v)}, val: v}
+	switch e := e.(type) {
+	case Num:
+		node.rule = "Num"
+	case Bool:
+		node.rule = "Bool"
+	case Var:
+		node.rule = "Var"
+	case Plus:
+		node.rule = "Plus"
+		node.premises = []*derivation{d.exp(e[0], s), d.exp(e[1], s)}
+	case Mult:
+		node.rule = "Mult"
+		node.premises = []*derivation{d.exp(e[0], s), d.exp(e[1], s)}
+	case Equal:
+		node.rule = "Equal"
+		node.premises = []*derivation{d.exp(e[0], s), d.exp(e[1], s)}
+	case Less:
+		node.rule = "Less"
+		node.premises = []*derivation{d.exp(e[0], s), d.exp(e[1], s)}
+	case And:
+		// the right operand is evaluated only if the left one is true
+		left := d.exp(e[0], s)
+		node.rule, node.premises = "And1", []*derivation{left}
+		if left.val.flag == ValueBool && left.val.valB {
+			node.rule, node.premises = "And2", append(node.premises, d.exp(e[1], s))
+		}
+	case Or:
+		left := d.exp(e[0], s)
+		node.rule, node.premises = "Or1", []*derivation{left}
+		if left.val.flag == ValueBool && !left.val.valB {
+			node.rule, node.premises = "Or2", append(node.premises, d.exp(e[1], s))
+		}
+	case Not:
+		node.rule = "Not"
+		node.premises = []*derivation{d.exp(e.exp, s)}
+	default:
+		node.rule = "?"
+	}
+	return node
+}
+
+// derive a statement, running it on s
+func (d *deriver) stmt(stmt Stmt, s *ValState) *derivation {
+	node := &derivation{conclusion: judgement{env: showScopes(*s), subject: oneLine(stmt.pretty())}}
+	exps := func(es ...Exp) {
+		for _, e := range es {
+			if e != nil {
+				node.premises = append(node.premises, d.exp(e, *s))
+			}
+		}
+	}
+	switch stmt := stmt.(type) {
+	case Located:
+		return d.stmt(stmt.stmt, s)
+	case Seq:
+		node.rule = "Seq"
+		node.premises = []*derivation{d.stmt(stmt[0], s), d.stmt(stmt[1], s)}
+	case IfThenElse:
+		cond := d.exp(stmt.cond, *s)
+		node.premises = []*derivation{cond}
+		switch {
+		case cond.val.flag != ValueBool:
+			node.rule = "If-Err"
+			stmt.eval(*s) // reports the error
+		case cond.val.valB:
+			node.rule = "If-T"
+			node.premises = append(node.premises, d.block(stmt.thenStmt, s))
+		default:
+			node.rule = "If-F"
+			node.premises = append(node.premises, d.block(stmt.elseStmt, s))
+		}
+	case While:
+		return d.loop(stmt, s, 0)
+	default:
+		// atomic statements: the premises are the expressions evaluated
+		switch stmt := stmt.(type) {
+		case Decl:
+			node.rule = "Decl"
+			exps(stmt.rhs)
+		case Assign:
+			node.rule = "Assign"
+			exps(stmt.rhs)
+		case Print:
+			node.rule = "Print"
+			exps(stmt.exp)
+		case Read:
+			node.rule = "Read"
+		case Skip:
+			node.rule = "Skip"
+		case Requires:
+			node.rule = "Requires"
+			exps(stmt.exp)
+		case Ensures:
+			node.rule = "Ensures"
+			exps(stmt.exp)
+		case Assert:
+			node.rule = "Assert"
+			exps(stmt.exp)
+		case Assume:
+			node.rule = "Assume"
+			exps(stmt.exp)
+		case TestBlock:
+			node.rule = "Test"
+		default:
+			node.rule = "?"
+		}
+		stmt.eval(*s)
+	}
+	node.conclusion.result = showScopes(*s)
+	return node
+}
+
+// a body in its own scope
+func (d *deriver) block(stmt Stmt, s *ValState) *derivation {
+	s.startBlock()
+	ret := d.stmt(stmt, s)
+	s.endBlock()
+	return ret
+}
+
+// the loop after iter iterations. the invariant is checked at the start of
+// every node: on entry and after each iteration, like While.eval
+func (d *deriver) loop(loop While, s *ValState, iter int) *derivation {
+	node := &derivation{conclusion: judgement{env: showScopes(*s), subject: oneLine(loop.pretty())}}
+	if d.iterations > 0 && iter >= d.iterations {
+		node.rule = "While"
+		node.omitted = "further iterations"
+		iterate{loop}.eval(*s)
+		node.conclusion.result = showScopes(*s)
+		return node
+	}
+	cond := d.exp(loop.cond, *s)
+	node.premises = []*derivation{cond}
+	if iter == 0 && cond.val.flag != ValueBool {
+		node.rule = "While-Err"
+		loop.eval(*s) // reports the error
+		node.conclusion.result = showScopes(*s)
+		return node
+	}
+	if loop.inv != nil {
+		node.premises = append(node.premises, d.exp(loop.inv, *s))
+		checkSpec("loop invariant", loop.inv, *s)
+	}
+	if cond.val.flag == ValueBool && cond.val.valB {
+		node.rule = "While-T"
+		node.premises = append(node.premises, d.block(loop.body, s), d.loop(loop, s, iter+1))
+	} else {
+		node.rule = "While-F"
+	}
+	node.conclusion.result = showScopes(*s)
+	return node
+}
+
+// Typing derivations
+
+// typing derivation of a program, and whether it type-checks
+func deriveTypes(prog Program) (*derivation, bool) {
+	t := newTyState()
+	return typeStmt(prog, &t)
+}
+
+// type environment, innermost scope last
+func showTypes(t TyState) string {
+	var scopes []string
+	for _, scope := range t {
+		var vars []string
+		for _, x := range sortedVars(typedVars(scope)) {
+			vars = append(vars, x+" : "+showType(scope[x].ty))
+		}
+		scopes = append(scopes, "["+strings.Join(vars, ", ")+"]")
+	}
+	return strings.Join(scopes, " ")
+}
+
+func typedVars(scope TyScope) map[string]bool {
+	ret := make(map[string]bool, len(scope))
+	for x := range scope {
+		ret[x] = true
+	}
+	return ret
+}
+
+func typeExp(e Exp, t TyState) *derivation {
+	node := &derivation{conclusion: judgement{env: showTypes(t), subject: e.pretty(), typing: true, result: showType(e.infer(t))}}
+	var subs []Exp
+	switch e := e.(type) {
+	case Num:
+		node.rule = "T-Num"
+	case Bool:
+		node.rule = "T-Bool"
+	case Var:
+		node.rule = "T-Var"
+	case Plus:
+		node.rule, subs = "T-Plus", e[:]
+	case Mult:
+		node.rule, subs = "T-Mult", e[:]
+	case Equal:
+		node.rule, subs = "T-Equal", e[:]
+	case Less:
+		node.rule, subs = "T-Less", e[:]
+	case And:
+		node.rule, subs = "T-And", e[:]
+	case Or:
+		node.rule, subs = "T-Or", e[:]
+	case Not:
+		node.rule, subs = "T-Not", []Exp{e.exp}
+	default:
+		node.rule = "?"
+	}
+	for _, sub := range subs {
+		node.premises = append(node.premises, typeExp(sub, t))
+	}
+	return node
+}
+
+// derive the typing of a statement, declaring its variables in t. the
+// premises stop at the first one that fails, like Stmt.check
+func typeStmt(stmt Stmt, t *TyState) (*derivation, bool) {
+	node := &derivation{conclusion: judgement{env: showTypes(*t), subject: oneLine(stmt.pretty()), typing: true}}
+	ok := true
+	// premise e : want, where want == TyIllTyped accepts any well-typed e
+	exp := func(e Exp, want Type) {
+		if !ok || e == nil {
+			return
+		}
+		p := typeExp(e, *t)
+		node.premises = append(node.premises, p)
+		ty := e.infer(*t)
+		ok = ty != TyIllTyped && (want == TyIllTyped || ty == want)
+	}
+	sub := func(stmt Stmt, block bool) {
+		if !ok {
+			return
+		}
+		if block {
+			t.startBlock()
+		}
+		p, subOk := typeStmt(stmt, t)
+		if block {
+			t.endBlock()
+		}
+		node.premises = append(node.premises, p)
+		ok = subOk
+	}
+	switch stmt := stmt.(type) {
+	case Located:
+		return typeStmt(stmt.stmt, t)
+	case Seq:
+		node.rule = "T-Seq"
+		sub(stmt[0], false)
+		sub(stmt[1], false)
+	case Decl:
+		node.rule = "T-Decl"
+		exp(stmt.rhs, TyIllTyped)
+		if ok {
+			t.declare(stmt.lhs, stmt.rhs.infer(*t))
+		}
+	case Assign:
+		node.rule = "T-Assign"
+		node.premises = []*derivation{typeExp(Var(stmt.lhs), *t), typeExp(stmt.rhs, *t)}
+		ok = stmt.check(*t)
+	case Read:
+		node.rule = "T-Read"
+		exp(Var(stmt.lhs), TyIllTyped)
+	case Print:
+		node.rule = "T-Print"
+		exp(stmt.exp, TyIllTyped)
+	case Skip:
+		node.rule = "T-Skip"
+	case Requires:
+		node.rule = "T-Requires"
+		exp(stmt.exp, TyBool)
+	case Ensures:
+		node.rule = "T-Ensures"
+		exp(stmt.exp, TyBool)
+	case Assert:
+		node.rule = "T-Assert"
+		exp(stmt.exp, TyBool)
+	case Assume:
+		node.rule = "T-Assume"
+		exp(stmt.exp, TyBool)
+	case IfThenElse:
+		node.rule = "T-If"
+		exp(stmt.cond, TyBool)
+		sub(stmt.thenStmt, true)
+		sub(stmt.elseStmt, true)
+	case While:
+		node.rule = "T-While"
+		exp(stmt.cond, TyBool)
+		exp(stmt.inv, TyBool)
+		sub(stmt.body, true)
+	case TestBlock:
+		// the body is typed in an empty environment
+		node.rule = "T-Test"
+		outer := *t
+		*t = newTyState()
+		sub(stmt.body, false)
+		*t = outer
+	default:
+		node.rule = "?"
+		ok = false
+	}
+	node.conclusion.result = showTypes(*t)
+	if !ok {
+		node.conclusion.result = showType(TyIllTyped)
+	}
+	return node, ok
+}
+
+// Rendering
+
+// cut a tree below the given depth, 0 for none
+func prune(d *derivation, depth int) *derivation {
+	if depth <= 0 {
+		return d
+	}
+	ret := *d
+	if depth == 1 && len(d.premises) > 0 {
+		ret.premises = nil
+		ret.omitted = "premises"
+		return &ret
+	}
+	ret.premises = nil
+	for _, p := range d.premises {
+		ret.premises = append(ret.premises, prune(p, depth-1))
+	}
+	return &ret
+}
+
+func (j judgement) text() string {
+	rel := "=>"
+	if j.typing {
+		rel = ":"
+	}
+	return j.env + " |- " + j.subject + " " + rel + " " + j.result
+}
+
+// conclusions first, each premise indented below its conclusion
+func (d *derivation) ascii() string {
+	var b strings.Builder
+	var write func(d *derivation, indent string)
+	write = func(d *derivation, indent string) {
+		fmt.Fprintf(&b, "%s%s   (%s)\n", indent, d.conclusion.text(), d.rule)
+		if d.omitted != "" {
+			fmt.Fprintf(&b, "%s  ... %s omitted\n", indent, d.omitted)
+		}
+		for _, p := range d.premises {
+			write(p, indent+"  ")
+		}
+	}
+	write(d, "")
+	return b.String()
+}
+
+var latexEscapes = strings.NewReplacer(
+	`\`, `\textbackslash{}`, `{`, `\{`, `}`, `\}`, `&`, `\&`, `%`, `\%`,
+	`$`, `\$`, `#`, `\#`, `_`, `\_`, `^`, `\^{}`, `~`, `\~{}`,
+)
+
+func latexText(s string) string {
+	return `\texttt{` + latexEscapes.Replace(s) + `}`
+}
+
+// bussproofs source, premises before their conclusion
+func (d *derivation) latex() string {
+	var b strings.Builder
+	infer := []string{"", "Unary", "Binary", "Trinary", "Quaternary", "Quinary"}
+	var write func(d *derivation)
+	write = func(d *derivation) {
+		n := len(d.premises)
+		switch {
+		case d.omitted != "":
+			b.WriteString("\\AxiomC{$\\vdots$}\n")
+			n = 1
+		case n == 0:
+			b.WriteString("\\AxiomC{}\n")
+			n = 1
+		}
+		for _, p := range d.premises {
+			write(p)
+		}
+		j := d.conclusion
+		rel := `\Downarrow`
+		if j.typing {
+			rel = `:`
+		}
+		fmt.Fprintf(&b, "\\RightLabel{\\scriptsize %s}\n", latexEscapes.Replace(d.rule))
+		fmt.Fprintf(&b, "\\%sInfC{$%s \\vdash %s %s %s$}\n", infer[n], latexText(j.env), latexText(j.subject), rel, latexText(j.result))
+	}
+	b.WriteString("\\begin{prooftree}\n")
+	write(d)
+	b.WriteString("\\end{prooftree}\n")
+	return b.String()
+}
+
+const derivationCSS = `body { font-family: monospace; }
+.rule { display: inline-flex; flex-direction: column; align-items: center; margin: 0 0.8em; vertical-align: bottom; }
+.premises { display: flex; align-items: flex-end; }
+.conclusion { border-top: 1px solid black; padding: 0.2em 0.4em; white-space: nowrap; }
+.name { font-size: smaller; color: #555; margin-left: 0.6em; }
+.omitted { color: #555; }
+`
+
+// standalone HTML page, drawing the tree with nested boxes
+func (d *derivation) html() string {
+	var b strings.Builder
+	var write func(d *derivation)
+	write = func(d *derivation) {
+		b.WriteString(`<div class="rule"><div class="premises">`)
+		if d.omitted != "" {
+			fmt.Fprintf(&b, `<span class="omitted" title="%s omitted">&vellip;</span>`, html.EscapeString(d.omitted))
+		}
+		for _, p := range d.premises {
+			write(p)
+		}
+		j := d.conclusion
+		rel := "&DoubleDownArrow;"
+		if j.typing {
+			rel = ":"
+		}
+		fmt.Fprintf(&b, `</div><div class="conclusion">%s &vdash; %s %s %s<span class="name">%s</span></div></div>`,
+			html.EscapeString(j.env), html.EscapeString(j.subject), rel, html.EscapeString(j.result), html.EscapeString(d.rule))
+	}
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Derivation</title>\n<style>\n")
+	b.WriteString(derivationCSS)
+	b.WriteString("</style>\n</head>\n<body>\n")
+	write(d)
+	b.WriteString("\n</body>\n</html>\n")
+	return b.String()
+}
+
+func derive_cmd(args []string) int {
+	fs := flag.NewFlagSet("derive", flag.ExitOnError)
+	typing := fs.Bool("type", false, "typing derivation instead of evaluation")
+	format := fs.String("format", "ascii", "output format: ascii, latex or html")
+	depth := fs.Int("depth", 0, "omit premises below this depth, 0 for none")
+	iterations := fs.Int("iterations", 3, "loop iterations derived in full, 0 for all")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *depth < 0 || *iterations < 0 {
+		usage()
+	}
+	var render func(*derivation) string
+	switch *format {
+	case "ascii":
+		render = (*derivation).ascii
+	case "latex":
+		render = (*derivation).latex
+	case "html":
+		render = (*derivation).html
+	default:
+		usage()
+	}
+
+	if *typing {
+		prog, err := newLocatingParser().parse_fromfile(fs.Arg(0))
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		tree, ok := deriveTypes(prog)
+		fmt.Print(render(prune(tree, *depth)))
+		if !ok {
+			fmt.Printf("%s contains type errors\n", fs.Arg(0))
+			return 1
+		}
+		return 0
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	// the output of the program goes to stderr, not into the rendered tree
+	stdout = os.Stderr
+	tree := deriveEval(prog, *iterations)
+	stdout = os.Stdout
+	fmt.Print(render(prune(tree, *depth)))
+	return 0
+}
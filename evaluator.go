@@ -1,24 +1,52 @@
 package main
 
-import "fmt"
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
 
 // Evaluator
 
+// destination of print statements and runtime errors. tests redirect this to capture output
+var stdout io.Writer = os.Stdout
+
+// source of read statements
+var stdin io.Reader = bufio.NewReader(os.Stdin)
+
+// number of runtime errors reported so far, used by the test runner
+var runtimeErrors int
+
+// position of the statement being evaluated, zero if unknown
+var evalPos Pos
+
+// report a runtime error. evaluation goes on, e.g. with an undefined value
+func runtimeError(format string, args ...interface{}) {
+	runtimeErrors++
+	fmt.Fprintf(stdout, format+"\n", args...)
+}
+
 // Statements
 
 // Maps are represented via pointers.
 // Hence, maps are passed by "reference" and the update is visible for the caller as well.
 func (decl Decl) eval(s ValState) {
 	x := (string)(decl.lhs)
-	v := decl.rhs.eval(s)
+	v := assigned(decl.rhs.eval(s))
+	if decl.label == Secret {
+		v.secret = true
+	}
 	s.declare(x, v)
 }
 
 func (assign Assign) eval(s ValState) {
 	x := (string)(assign.lhs)
-	v := assign.rhs.eval(s)
+	v := assigned(assign.rhs.eval(s))
 	if !s.assign(x, v) {
-		fmt.Printf("assign eval fail: tried to assign %s to %s\n", showValType(v), showValType(s.lookup(x)))
+		runtimeError("assign eval fail: tried to assign %s to %s", showValType(v), showValType(s.lookup(x)))
 	}
 }
 
@@ -29,7 +57,13 @@ func (stmt Seq) eval(s ValState) {
 
 func (ite IfThenElse) eval(s ValState) {
 	v := ite.cond.eval(s)
+	traceBranch(v, ifBranch(v), s)
 	if v.flag == ValueBool {
+		coverBranch(nil, ifBranch(v))
+		if v.secret {
+			taint.pc++
+			defer func() { taint.pc-- }()
+		}
 		s.startBlock()
 		if v.valB {
 			ite.thenStmt.eval(s)
@@ -38,29 +72,170 @@ func (ite IfThenElse) eval(s ValState) {
 		}
 		s.endBlock()
 	} else {
-		fmt.Printf("if-then-else eval fail: condition has type %s instead of boolean\n", showValType(v))
+		runtimeError("if-then-else eval fail: condition has type %s instead of boolean", showValType(v))
 	}
 
 }
 
 func (e While) eval(s ValState) {
 	v := e.cond.eval(s)
+	traceBranch(v, loopBranch(v), s)
 	if v.flag != ValueBool {
-		fmt.Printf("while eval fail: condition has type %s instead of boolean\n", showValType(v))
+		runtimeError("while eval fail: condition has type %s instead of boolean", showValType(v))
 		return
 	}
+	coverBranch(nil, loopEntry(v))
 	// evaluate body in a new scope as long as condition holds
+	checkSpec("loop invariant", e.inv, s)
 	for v.valB {
+		if v.secret {
+			taint.pc++
+		}
+		profileIteration()
 		s.startBlock()
 		e.body.eval(s)
 		s.endBlock()
+		checkSpec("loop invariant", e.inv, s)
+		if v.secret {
+			taint.pc--
+		}
 		v = e.cond.eval(s)
+		traceBranch(v, loopBranch(v), s)
 	}
 }
 
+// branch of an if taken for the value of its condition, see traceBranch()
+// and coverBranch()
+func ifBranch(cond Val) string {
+	if cond.valB {
+		return "then"
+	}
+	return "else"
+}
+
+// branch of a loop taken for the value of its condition, see traceBranch()
+func loopBranch(cond Val) string {
+	if cond.valB {
+		return "body"
+	}
+	return "exit"
+}
+
+// whether a loop is entered at all, see coverBranch()
+func loopEntry(cond Val) string {
+	if cond.valB {
+		return "entered"
+	}
+	return "skipped"
+}
+
 func (e Print) eval(s ValState) {
 	x := e.exp.eval(s)
-	fmt.Println(showVal(x))
+	taintOutput("print", x)
+	traceOutput(x)
+	fmt.Fprintln(stdout, showVal(x))
+}
+
+func (e Skip) eval(s ValState) {}
+
+// read a value of the variable's type from stdin
+func (r Read) eval(s ValState) {
+	old := s.lookup(r.lhs)
+	var tok string
+	fmt.Fscan(stdin, &tok)
+	v := mkUndefined()
+	switch old.flag {
+	case ValueInt:
+		if n, err := strconv.Atoi(tok); err == nil {
+			v = mkInt(n)
+		}
+	case ValueBool:
+		if tok == "true" || tok == "false" {
+			v = mkBool(tok == "true")
+		}
+	}
+	if v.flag == Undefined {
+		runtimeError("read eval fail: expected %s for %s, found \"%s\"", showValType(old), r.lhs, tok)
+	}
+	s.assign(r.lhs, assigned(v))
+}
+
+// specifications are checked at runtime as well
+
+func checkSpec(what string, spec Exp, s ValState) {
+	if spec == nil {
+		return
+	}
+	v := spec.eval(s)
+	taintOutput(what, v)
+	if v.flag != ValueBool || !v.valB {
+		where := ""
+		if evalPos.line > 0 {
+			where = evalPos.String() + ": "
+		}
+		var values []string
+		for _, e := range operands(spec) {
+			values = append(values, e.pretty()+" = "+showVal(e.eval(s)))
+		}
+		if len(values) > 0 {
+			runtimeError("%s%s failed: %s with %s", where, what, spec.pretty(), strings.Join(values, ", "))
+		} else {
+			runtimeError("%s%s failed: %s", where, what, spec.pretty())
+		}
+	}
+}
+
+// the operands of a failed condition, whose values explain the failure: the
+// sides of a comparison or connective, also under a negation. literals are
+// left out
+func operands(e Exp) []Exp {
+	if not, ok := e.(Not); ok {
+		e = not.exp
+	}
+	var ret []Exp
+	for _, side := range subformulas(e) {
+		switch side.(type) {
+		case Num, Bool:
+		default:
+			ret = append(ret, side)
+		}
+	}
+	return ret
+}
+
+func (r Requires) eval(s ValState) {
+	checkSpec("precondition", r.exp, s)
+}
+
+func (e Ensures) eval(s ValState) {
+	checkSpec("postcondition", e.exp, s)
+}
+
+func (a Assert) eval(s ValState) {
+	checkSpec("assertion", a.exp, s)
+}
+
+func (a Assume) eval(s ValState) {
+	checkSpec("assumption", a.exp, s)
+}
+
+// a test is not run with the program, see testrunner.go
+func (tb TestBlock) eval(s ValState) {}
+
+func (l Located) eval(s ValState) {
+	outer := evalPos
+	evalPos = l.pos
+	switch {
+	case trace.out != nil:
+		traceStmt(l, s)
+	case prof.enabled:
+		profileStmt(l, s)
+	case cover.enabled:
+		coverStmt(l, s)
+	default:
+		l.stmt.eval(s)
+	}
+	evalPos = outer
 }
 
 // Expressions
@@ -83,9 +258,9 @@ func (e Equal) eval(s ValState) Val {
 	if n1.flag == n2.flag && n1.flag != Undefined {
 		switch n1.flag {
 		case ValueBool:
-			return mkBool(n1.valB == n2.valB)
+			return tainted(mkBool(n1.valB == n2.valB), n1, n2)
 		case ValueInt:
-			return mkBool(n1.valI == n2.valI)
+			return tainted(mkBool(n1.valI == n2.valI), n1, n2)
 		}
 	}
 	return mkUndefined()
@@ -95,7 +270,7 @@ func (e Less) eval(s ValState) Val {
 	n1 := e[0].eval(s)
 	n2 := e[1].eval(s)
 	if n1.flag == ValueInt && n2.flag == ValueInt {
-		return mkBool(n1.valI < n2.valI)
+		return tainted(mkBool(n1.valI < n2.valI), n1, n2)
 	}
 	return mkUndefined()
 }
@@ -104,7 +279,7 @@ func (e Mult) eval(s ValState) Val {
 	n1 := e[0].eval(s)
 	n2 := e[1].eval(s)
 	if n1.flag == ValueInt && n2.flag == ValueInt {
-		return mkInt(n1.valI * n2.valI)
+		return tainted(mkInt(n1.valI*n2.valI), n1, n2)
 	}
 	return mkUndefined()
 }
@@ -113,7 +288,7 @@ func (e Plus) eval(s ValState) Val {
 	n1 := e[0].eval(s)
 	n2 := e[1].eval(s)
 	if n1.flag == ValueInt && n2.flag == ValueInt {
-		return mkInt(n1.valI + n2.valI)
+		return tainted(mkInt(n1.valI+n2.valI), n1, n2)
 	}
 	return mkUndefined()
 }
@@ -123,12 +298,14 @@ func (e And) eval(s ValState) Val {
 	if b1.flag == ValueBool {
 		// short circuit: false && _ => false
 		if !b1.valB {
-			return mkBool(false)
+			coverBranch(e, "short-circuit")
+			return tainted(mkBool(false), b1)
 		}
+		coverBranch(e, "rhs")
 		b2 := e[1].eval(s)
 		if b2.flag == ValueBool {
 			// true && V => V
-			return mkBool(b2.valB)
+			return tainted(mkBool(b2.valB), b1, b2)
 		}
 	}
 	return mkUndefined()
@@ -139,12 +316,14 @@ func (e Or) eval(s ValState) Val {
 	if b1.flag == ValueBool {
 		// short circuit: true || _ => true
 		if b1.valB {
-			return mkBool(true)
+			coverBranch(e, "short-circuit")
+			return tainted(mkBool(true), b1)
 		}
+		coverBranch(e, "rhs")
 		b2 := e[1].eval(s)
 		if b2.flag == ValueBool {
 			// false || V => V
-			return mkBool(b2.valB)
+			return tainted(mkBool(b2.valB), b1, b2)
 		}
 	}
 	return mkUndefined()
@@ -153,7 +332,7 @@ func (e Or) eval(s ValState) Val {
 func (e Not) eval(s ValState) Val {
 	val := e.exp.eval(s)
 	if val.flag == ValueBool {
-		return mkBool(!val.valB)
+		return tainted(mkBool(!val.valB), val)
 	}
 	return mkUndefined()
 }
@@ -0,0 +1,215 @@
+package main
+
+import "fmt"
+
+// Information-flow security
+//
+// Declarations can be labelled secret or public, and checkFlows() rejects
+// programs where secret values may influence public variables or the output,
+// following the Volpano-Smith type system:
+//   - explicit flows: the level of the assigned expression must be below the
+//     level of the variable, e.g. pub = sec is rejected
+//   - implicit flows: inside an if or while whose condition depends on a
+//     secret, only secret variables may be assigned or read, e.g.
+//     if sec { pub = 1; } else { skip; } is rejected
+//   - print and the runtime checks of specifications are public outputs
+// A declaration without label gets the level of its right-hand side (and of
+// the enclosing conditions), so programs without labels are always secure.
+// Like the type system, this is termination-insensitive: a secret loop
+// condition may still decide whether the program terminates.
+//
+// The interpreter can track taint dynamically instead (-taint): values
+// computed from secret variables, and values assigned under conditions on
+// secret values, are marked secret, and printing them or printing under a
+// secret condition is reported at runtime. A program accepted by
+// checkFlows() never reports a violation.
+
+// security levels of variables and expressions. declarations are
+// Unlabelled unless annotated
+type Level int
+
+const (
+	Unlabelled Level = iota
+	Public
+	Secret
+)
+
+func (l Level) String() string {
+	if l == Secret {
+		return "secret"
+	}
+	return "public"
+}
+
+func join(a, b Level) Level {
+	if a == Secret || b == Secret {
+		return Secret
+	}
+	return Public
+}
+
+type flowChecker struct {
+	scopes TyState // with the levels of the variables
+	pc     []Pos   // secret conditions around the current statement
+	pos    Pos
+	errors []string
+}
+
+// information flows of a well-typed program violating the security labels
+func checkFlows(prog Program) []string {
+	c := &flowChecker{scopes: newTyState()}
+	c.stmt(prog)
+	return c.errors
+}
+
+func (c *flowChecker) report(format string, args ...interface{}) {
+	c.errors = append(c.errors, c.pos.String()+": "+fmt.Sprintf(format, args...))
+}
+
+func (c *flowChecker) level(e Exp) Level {
+	ret := Public
+	for x := range expVars(e) {
+		if b, _ := c.scopes.binding(x); b.level == Secret {
+			ret = Secret
+		}
+	}
+	return ret
+}
+
+func (c *flowChecker) pcLevel() Level {
+	if len(c.pc) > 0 {
+		return Secret
+	}
+	return Public
+}
+
+// the value of e flows into the variable x of level to
+func (c *flowChecker) flow(x string, to Level, e Exp) {
+	if to == Secret {
+		return
+	}
+	if e != nil && c.level(e) == Secret {
+		c.report("explicit flow: secret value assigned to public variable %s", x)
+	} else if len(c.pc) > 0 {
+		c.report("implicit flow: public variable %s assigned under secret condition at %s", x, c.pc[len(c.pc)-1])
+	}
+}
+
+// the value of e is output, e.g. printed
+func (c *flowChecker) output(what string, e Exp) {
+	if c.level(e) == Secret {
+		c.report("explicit flow: %s depends on secret value", what)
+	} else if len(c.pc) > 0 {
+		c.report("implicit flow: %s under secret condition at %s", what, c.pc[len(c.pc)-1])
+	}
+}
+
+// enter a block guarded by the condition cond at pos
+func (c *flowChecker) block(pos Pos, cond Exp, stmt Stmt) {
+	secret := c.level(cond) == Secret
+	if secret {
+		c.pc = append(c.pc, pos)
+	}
+	c.scopes.startBlock()
+	c.stmt(stmt)
+	c.scopes.endBlock()
+	if secret {
+		c.pc = c.pc[:len(c.pc)-1]
+	}
+}
+
+func (c *flowChecker) stmt(stmt Stmt) {
+	switch stmt := stmt.(type) {
+	case Seq:
+		c.stmt(stmt[0])
+		c.stmt(stmt[1])
+	case Decl:
+		ty := stmt.rhs.infer(c.scopes)
+		// a declaration updating a variable keeps its level
+		i, update := declScope(c.scopes, stmt.lhs, ty)
+		if update {
+			b := c.scopes[i][stmt.lhs]
+			if stmt.label != Unlabelled && stmt.label != b.level {
+				c.report("%s is already declared %s", stmt.lhs, b.level)
+			}
+			c.flow(stmt.lhs, b.level, stmt.rhs)
+			return
+		}
+		level := stmt.label
+		if level == Unlabelled {
+			level = join(c.level(stmt.rhs), c.pcLevel())
+		}
+		c.flow(stmt.lhs, level, stmt.rhs)
+		c.scopes[i][stmt.lhs] = TyBinding{ty, level}
+	case Assign:
+		b, _ := c.scopes.binding(stmt.lhs)
+		c.flow(stmt.lhs, b.level, stmt.rhs)
+	case Read:
+		b, _ := c.scopes.binding(stmt.lhs)
+		c.flow(stmt.lhs, b.level, nil)
+	case Print:
+		c.output("print", stmt.exp)
+	case Requires:
+		c.output("precondition", stmt.exp)
+	case Ensures:
+		c.output("postcondition", stmt.exp)
+	case Assert:
+		c.output("assertion", stmt.exp)
+	case Assume:
+		c.output("assumption", stmt.exp)
+	case IfThenElse:
+		pos := c.pos
+		c.block(pos, stmt.cond, stmt.thenStmt)
+		c.block(pos, stmt.cond, stmt.elseStmt)
+	case While:
+		pos := c.pos
+		if stmt.inv != nil {
+			c.output("loop invariant", stmt.inv)
+		}
+		c.block(pos, stmt.cond, stmt.body)
+		// the invariant is checked again after every iteration
+		if stmt.inv != nil && c.level(stmt.cond) == Secret {
+			c.pos = pos
+			c.pc = append(c.pc, pos)
+			c.output("loop invariant", stmt.inv)
+			c.pc = c.pc[:len(c.pc)-1]
+		}
+	case Located:
+		c.pos = stmt.pos
+		c.stmt(stmt.stmt)
+	}
+}
+
+// Dynamic taint tracking
+
+// state of the taint tracking interpreter
+var taint struct {
+	enabled bool // report violations
+	pc      int  // number of secret conditions around the current statement
+}
+
+// v is secret if one of the values it was computed from is
+func tainted(v Val, from ...Val) Val {
+	for _, w := range from {
+		v.secret = v.secret || w.secret
+	}
+	return v
+}
+
+// a value assigned under the current conditions
+func assigned(v Val) Val {
+	v.secret = v.secret || taint.pc > 0
+	return v
+}
+
+// v is output, e.g. printed
+func taintOutput(what string, v Val) {
+	if !taint.enabled {
+		return
+	}
+	if v.secret {
+		fmt.Fprintf(stdout, "%s: taint violation: %s depends on secret value\n", evalPos, what)
+	} else if taint.pc > 0 {
+		fmt.Fprintf(stdout, "%s: taint violation: %s under secret condition\n", evalPos, what)
+	}
+}
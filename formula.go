@@ -0,0 +1,511 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+)
+
+// Formulas
+//
+// Formulas of the verifier and the predicate transformers are expressions
+// extended with implication and quantifiers over a single typed variable.
+
+type Implies [2]Exp
+type Forall struct {
+	x    string
+	ty   Type
+	body Exp
+}
+type Exists struct {
+	x    string
+	ty   Type
+	body Exp
+}
+
+func implies(x, y Exp) Exp {
+	return Implies{x, y}
+}
+
+func forall(x string, ty Type, body Exp) Exp {
+	return Forall{x, ty, body}
+}
+
+func exists(x string, ty Type, body Exp) Exp {
+	return Exists{x, ty, body}
+}
+
+func (e Implies) pretty() string {
+	return showFormula(e, false)
+}
+
+func (e Forall) pretty() string {
+	return showFormula(e, false)
+}
+
+func (e Exists) pretty() string {
+	return showFormula(e, false)
+}
+
+func (e Implies) eval(s ValState) Val {
+	b1 := e[0].eval(s)
+	switch {
+	case b1.flag != ValueBool:
+		return mkUndefined()
+	case !b1.valB:
+		return mkBool(true)
+	}
+	b2 := e[1].eval(s)
+	if b2.flag != ValueBool {
+		return mkUndefined()
+	}
+	return b2
+}
+
+// quantifiers over Bool are evaluated for both values, over Int they are undefined
+func (e Forall) eval(s ValState) Val {
+	return evalQuantifier(e.x, e.ty, e.body, true, s)
+}
+
+func (e Exists) eval(s ValState) Val {
+	return evalQuantifier(e.x, e.ty, e.body, false, s)
+}
+
+func evalQuantifier(x string, ty Type, body Exp, all bool, s ValState) Val {
+	if ty != TyBool {
+		return mkUndefined()
+	}
+	for _, b := range []bool{false, true} {
+		s.startBlock()
+		s.declare(x, mkBool(b))
+		v := body.eval(s)
+		s.endBlock()
+		if v.flag != ValueBool {
+			return mkUndefined()
+		}
+		if v.valB != all {
+			return v
+		}
+	}
+	return mkBool(all)
+}
+
+func (e Implies) infer(t TyState) Type {
+	if e[0].infer(t) == TyBool && e[1].infer(t) == TyBool {
+		return TyBool
+	}
+	return TyIllTyped
+}
+
+func (e Forall) infer(t TyState) Type {
+	return inferQuantifier(e.x, e.ty, e.body, t)
+}
+
+func (e Exists) infer(t TyState) Type {
+	return inferQuantifier(e.x, e.ty, e.body, t)
+}
+
+func inferQuantifier(x string, ty Type, body Exp, t TyState) Type {
+	t.startBlock()
+	defer t.endBlock()
+	t.declare(x, ty)
+	if body.infer(t) == TyBool {
+		return TyBool
+	}
+	return TyIllTyped
+}
+
+// Substitution
+
+// names of the free variables of a formula
+func freeVars(f Exp) map[string]bool {
+	vars := make(map[string]bool)
+	var walk func(f Exp, bound map[string]bool)
+	walk = func(f Exp, bound map[string]bool) {
+		switch f := f.(type) {
+		case Var:
+			if !bound[string(f)] {
+				vars[string(f)] = true
+			}
+		case Forall:
+			walk(f.body, unionSet(bound, map[string]bool{f.x: true}))
+		case Exists:
+			walk(f.body, unionSet(bound, map[string]bool{f.x: true}))
+		default:
+			for _, g := range subformulas(f) {
+				walk(g, bound)
+			}
+		}
+	}
+	walk(f, map[string]bool{})
+	return vars
+}
+
+func subformulas(f Exp) []Exp {
+	switch f := f.(type) {
+	case Plus:
+		return f[:]
+	case Mult:
+		return f[:]
+	case Equal:
+		return f[:]
+	case Less:
+		return f[:]
+	case And:
+		return f[:]
+	case Or:
+		return f[:]
+	case Implies:
+		return f[:]
+	case Not:
+		return []Exp{f.exp}
+	case Forall:
+		return []Exp{f.body}
+	case Exists:
+		return []Exp{f.body}
+	}
+	return nil
+}
+
+// replace the free variable x by e, renaming bound variables to avoid capture
+func subst(f Exp, x string, e Exp) Exp {
+	switch f := f.(type) {
+	case Var:
+		if string(f) == x {
+			return e
+		}
+		return f
+	case Plus:
+		return plus(subst(f[0], x, e), subst(f[1], x, e))
+	case Mult:
+		return mult(subst(f[0], x, e), subst(f[1], x, e))
+	case Equal:
+		return equal(subst(f[0], x, e), subst(f[1], x, e))
+	case Less:
+		return less(subst(f[0], x, e), subst(f[1], x, e))
+	case And:
+		return and(subst(f[0], x, e), subst(f[1], x, e))
+	case Or:
+		return or(subst(f[0], x, e), subst(f[1], x, e))
+	case Implies:
+		return implies(subst(f[0], x, e), subst(f[1], x, e))
+	case Not:
+		return not(subst(f.exp, x, e))
+	case Forall:
+		y, body := substBinder(f.x, f.body, x, e)
+		return forall(y, f.ty, body)
+	case Exists:
+		y, body := substBinder(f.x, f.body, x, e)
+		return exists(y, f.ty, body)
+	default:
+		return f
+	}
+}
+
+func substBinder(y string, body Exp, x string, e Exp) (string, Exp) {
+	if y == x {
+		return y, body
+	}
+	if fv := freeVars(e); fv[y] {
+		z := prime(y, unionSet(fv, freeVars(body)))
+		body = subst(body, y, Var(z))
+		y = z
+	}
+	return y, subst(body, x, e)
+}
+
+// x followed by primes, so that it differs from all the given names
+func prime(x string, taken map[string]bool) string {
+	x += "'"
+	for taken[x] {
+		x += "'"
+	}
+	return x
+}
+
+// Simplification
+
+// whether a sum or product of integer literals leaves the range of int,
+// which the interpreter wraps around but formulas do not
+func overflows(e Exp) bool {
+	ops := subformulas(e)
+	if len(ops) != 2 {
+		return false
+	}
+	x, ok1 := ops[0].(Num)
+	y, ok2 := ops[1].(Num)
+	if !ok1 || !ok2 {
+		return false
+	}
+	r := new(big.Int)
+	switch e.(type) {
+	case Plus:
+		r.Add(bigInt(int(x)), bigInt(int(y)))
+	case Mult:
+		r.Mul(bigInt(int(x)), bigInt(int(y)))
+	}
+	return !r.IsInt64()
+}
+
+// simplify a formula by evaluating constants and applying
+// propositional identities and the one-point rule for quantifiers
+func simplify(f Exp) Exp {
+	switch f := f.(type) {
+	case Plus:
+		x, y := simplify(f[0]), simplify(f[1])
+		switch {
+		case isLit(x) && isLit(y) && !overflows(plus(x, y)):
+			return evalLit(plus(x, y))
+		case x == Exp(Num(0)):
+			return y
+		case y == Exp(Num(0)):
+			return x
+		}
+		return plus(x, y)
+	case Mult:
+		x, y := simplify(f[0]), simplify(f[1])
+		switch {
+		case isLit(x) && isLit(y) && !overflows(mult(x, y)):
+			return evalLit(mult(x, y))
+		case x == Exp(Num(0)) || y == Exp(Num(0)):
+			return Num(0)
+		case x == Exp(Num(1)):
+			return y
+		case y == Exp(Num(1)):
+			return x
+		}
+		return mult(x, y)
+	case Equal:
+		x, y := simplify(f[0]), simplify(f[1])
+		switch {
+		case isLit(x) && isLit(y):
+			return evalLit(equal(x, y))
+		case x == y:
+			return Bool(true)
+		}
+		return equal(x, y)
+	case Less:
+		x, y := simplify(f[0]), simplify(f[1])
+		switch {
+		case isLit(x) && isLit(y):
+			return evalLit(less(x, y))
+		case x == y:
+			return Bool(false)
+		}
+		return less(x, y)
+	case And:
+		x, y := simplify(f[0]), simplify(f[1])
+		switch {
+		case x == Exp(Bool(false)) || y == Exp(Bool(false)):
+			return Bool(false)
+		case x == Exp(Bool(true)) || x == y:
+			return y
+		case y == Exp(Bool(true)):
+			return x
+		}
+		return and(x, y)
+	case Or:
+		x, y := simplify(f[0]), simplify(f[1])
+		switch {
+		case x == Exp(Bool(true)) || y == Exp(Bool(true)):
+			return Bool(true)
+		case x == Exp(Bool(false)) || x == y:
+			return y
+		case y == Exp(Bool(false)):
+			return x
+		}
+		return or(x, y)
+	case Implies:
+		x, y := simplify(f[0]), simplify(f[1])
+		switch {
+		case x == Exp(Bool(false)) || y == Exp(Bool(true)) || x == y:
+			return Bool(true)
+		case x == Exp(Bool(true)):
+			return y
+		case y == Exp(Bool(false)):
+			return simplify(not(x))
+		}
+		if y, ok := y.(Implies); ok {
+			// a ==> b ==> c is a && b ==> c
+			return implies(and(x, y[0]), y[1])
+		}
+		return implies(x, y)
+	case Not:
+		x := simplify(f.exp)
+		if isLit(x) {
+			return evalLit(not(x))
+		} else if x, ok := x.(Not); ok {
+			return x.exp
+		}
+		return not(x)
+	case Forall:
+		body := simplify(f.body)
+		if !freeVars(body)[f.x] {
+			return body
+		}
+		// forall x. x == t && a ==> b is (a ==> b)[t/x]
+		if body, ok := body.(Implies); ok {
+			if t, rest, ok := definition(f.x, body[0]); ok {
+				return simplify(subst(implies(rest, body[1]), f.x, t))
+			}
+		}
+		return forall(f.x, f.ty, body)
+	case Exists:
+		body := simplify(f.body)
+		if !freeVars(body)[f.x] {
+			return body
+		}
+		// exists x. x == t && a is a[t/x]
+		if t, rest, ok := definition(f.x, body); ok {
+			return simplify(subst(rest, f.x, t))
+		}
+		return exists(f.x, f.ty, body)
+	default:
+		return f
+	}
+}
+
+// find a conjunct x == t of f where t does not mention x.
+// returns t and the other conjuncts
+func definition(x string, f Exp) (Exp, Exp, bool) {
+	cs := conjuncts(f)
+	for i, c := range cs {
+		eq, ok := c.(Equal)
+		if !ok {
+			continue
+		}
+		for j, side := range eq {
+			t := eq[1-j]
+			if side == Exp(Var(x)) && !freeVars(t)[x] {
+				rest := append(append([]Exp(nil), cs[:i]...), cs[i+1:]...)
+				return t, conjunction(rest), true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+func conjuncts(f Exp) []Exp {
+	if f, ok := f.(And); ok {
+		return append(conjuncts(f[0]), conjuncts(f[1])...)
+	}
+	return []Exp{f}
+}
+
+func conjunction(fs []Exp) Exp {
+	if len(fs) == 0 {
+		return Bool(true)
+	}
+	ret := fs[0]
+	for _, f := range fs[1:] {
+		ret = and(ret, f)
+	}
+	return ret
+}
+
+// Pretty printing with as few parentheses as possible
+
+// binding strength of the outermost operator
+func precedence(f Exp) int {
+	switch f.(type) {
+	case Forall, Exists:
+		return 0
+	case Implies:
+		return 1
+	case Or:
+		return 2
+	case And:
+		return 3
+	case Equal, Less:
+		return 4
+	case Plus:
+		return 5
+	case Mult:
+		return 6
+	case Not:
+		return 7
+	}
+	return 8
+}
+
+type notation struct {
+	forall, exists, dot                string
+	implies, or, and, not, equal, less string
+	plus, mult                         string
+	boolean                            func(bool) string
+	variable                           func(string) string
+}
+
+var asciiNotation = notation{"forall ", "exists ", ". ", " ==> ", " || ", " && ", "!", " == ", " < ", " + ", " * ",
+	func(b bool) string { return Bool(b).pretty() },
+	func(x string) string { return x },
+}
+
+var latexNotation = notation{"\\forall ", "\\exists ", ".\\; ", " \\Rightarrow ", " \\lor ", " \\land ", "\\neg ", " = ", " < ", " + ", " \\cdot ",
+	func(b bool) string { return "\\mathit{" + Bool(b).pretty() + "}" },
+	latexVar,
+}
+
+// x#2 is printed as x_{2}, keeping primes. longer names in italics
+func latexVar(x string) string {
+	primes := len(x) - len(strings.TrimRight(x, "'"))
+	x = x[:len(x)-primes]
+	name, index, _ := strings.Cut(x, "#")
+	name = strings.ReplaceAll(name, "_", "\\_")
+	if len(name) > 1 {
+		name = "\\mathit{" + name + "}"
+	}
+	if index != "" {
+		name += "_{" + index + "}"
+	}
+	return name + strings.Repeat("'", primes)
+}
+
+// print a formula in ASCII or LaTeX notation
+func showFormula(f Exp, latex bool) string {
+	n := asciiNotation
+	if latex {
+		n = latexNotation
+	}
+	return n.show(f, 0)
+}
+
+// show f as an operand that binds at least as strongly as prec
+func (n notation) show(f Exp, prec int) string {
+	var s string
+	binary := func(x Exp, op string, y Exp, left, right int) string {
+		return n.show(x, left) + op + n.show(y, right)
+	}
+	p := precedence(f)
+	switch f := f.(type) {
+	case Forall:
+		s = n.forall + n.variable(f.x) + n.dot + n.show(f.body, 0)
+	case Exists:
+		s = n.exists + n.variable(f.x) + n.dot + n.show(f.body, 0)
+	case Implies:
+		s = binary(f[0], n.implies, f[1], p+1, p)
+	case Or:
+		s = binary(f[0], n.or, f[1], p, p+1)
+	case And:
+		s = binary(f[0], n.and, f[1], p, p+1)
+	case Equal:
+		s = binary(f[0], n.equal, f[1], p+1, p+1)
+	case Less:
+		s = binary(f[0], n.less, f[1], p+1, p+1)
+	case Plus:
+		s = binary(f[0], n.plus, f[1], p, p+1)
+	case Mult:
+		s = binary(f[0], n.mult, f[1], p, p+1)
+	case Not:
+		s = n.not + n.show(f.exp, p+1)
+	case Bool:
+		s = n.boolean(bool(f))
+	case Var:
+		s = n.variable(string(f))
+	default:
+		s = f.pretty()
+	}
+	if p < prec {
+		return "(" + s + ")"
+	}
+	return s
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Random programs
+//
+// A generator builds random well-typed programs for property-based testing.
+// It keeps the types of the declared variables in a TyState, so expressions
+// only use variables of the right type in scope. Programs do not read input,
+// and terminate: every loop counts a variable of its own up to a small bound,
+//
+//	i0 := 0;
+//	while i0 < 3 {
+//		...
+//		i0 = i0 + 1;
+//	};
+//
+// and no other statement declares or assigns the counter. shrink() minimises
+// a program that makes a property fail.
+
+type generator struct {
+	r        *rand.Rand
+	types    TyState
+	counters int // loop counters declared so far
+	depth    int // of nested blocks
+	maxDepth int // of nested blocks and expressions
+}
+
+func newGenerator(seed int64) *generator {
+	return &generator{r: rand.New(rand.NewSource(seed)), types: newTyState(), maxDepth: 3}
+}
+
+// names of ordinary variables; loop counters are i0, i1, ...
+var genNames = []string{"a", "b", "c", "d", "x", "y", "z"}
+
+// a program of n statements at the top level
+func (g *generator) program(n int) Program {
+	g.types, g.counters, g.depth = newTyState(), 0, 0
+	stmts := g.stmts(n)
+	return Program(seq(stmts[0], stmts[1:]...))
+}
+
+func (g *generator) stmts(n int) []Stmt {
+	var stmts []Stmt
+	for i := 0; i < n; i++ {
+		stmts = append(stmts, g.stmt()...)
+	}
+	return stmts
+}
+
+// a block of up to three statements in a new scope, followed by last
+func (g *generator) block(last ...Stmt) Stmt {
+	g.types.startBlock()
+	g.depth++
+	body := append(g.stmts(1+g.r.Intn(3)), last...)
+	g.depth--
+	g.types.endBlock()
+	return seq(body[0], body[1:]...)
+}
+
+// a statement, or the two of a loop
+func (g *generator) stmt() []Stmt {
+	for {
+		switch g.r.Intn(10) {
+		case 0, 1, 2:
+			x := genNames[g.r.Intn(len(genNames))]
+			ty := TyInt
+			if g.r.Intn(2) == 0 {
+				ty = TyBool
+			}
+			rhs := g.exp(ty, 0)
+			g.types.declare(x, ty)
+			return []Stmt{Decl{x, rhs, Unlabelled}}
+		case 3, 4:
+			if x, ty, ok := g.variable(TyIllTyped); ok {
+				return []Stmt{Assign{x, g.exp(ty, 0)}}
+			}
+		case 5:
+			return []Stmt{Print{g.exp(g.anyType(), 0)}}
+		case 6:
+			return []Stmt{Skip{}}
+		case 7, 8:
+			if g.depth < g.maxDepth {
+				return []Stmt{IfThenElse{g.exp(TyBool, 0), g.block(), g.block()}}
+			}
+		case 9:
+			if g.depth < g.maxDepth {
+				return g.loop()
+			}
+		}
+	}
+}
+
+// a loop counting a new variable up to at most 3
+func (g *generator) loop() []Stmt {
+	i := fmt.Sprintf("i%d", g.counters)
+	g.counters++
+	g.types.declare(i, TyInt)
+	bound := Num(1 + g.r.Intn(3))
+	body := g.block(Assign{i, plus(Var(i), Num(1))})
+	return []Stmt{Decl{i, Num(0), Unlabelled}, While{less(Var(i), bound), body, nil}}
+}
+
+func (g *generator) anyType() Type {
+	if g.r.Intn(2) == 0 {
+		return TyInt
+	}
+	return TyBool
+}
+
+// a random variable in scope of the given type, of any type for TyIllTyped.
+// loop counters are left out
+func (g *generator) variable(ty Type) (string, Type, bool) {
+	var names []string
+	for _, x := range genNames {
+		if t := g.types.lookup(x); t != TyIllTyped && (ty == TyIllTyped || t == ty) {
+			names = append(names, x)
+		}
+	}
+	if len(names) == 0 {
+		return "", TyIllTyped, false
+	}
+	x := names[g.r.Intn(len(names))]
+	return x, g.types.lookup(x), true
+}
+
+// a random expression of the given type, which may read loop counters
+func (g *generator) exp(ty Type, depth int) Exp {
+	if depth >= g.maxDepth || g.r.Intn(3) == 0 {
+		return g.atom(ty)
+	}
+	depth++
+	if ty == TyInt {
+		if g.r.Intn(2) == 0 {
+			return plus(g.exp(TyInt, depth), g.exp(TyInt, depth))
+		}
+		return mult(g.exp(TyInt, depth), g.exp(TyInt, depth))
+	}
+	switch g.r.Intn(5) {
+	case 0:
+		return and(g.exp(TyBool, depth), g.exp(TyBool, depth))
+	case 1:
+		return or(g.exp(TyBool, depth), g.exp(TyBool, depth))
+	case 2:
+		return not(g.exp(TyBool, depth))
+	case 3:
+		operands := g.anyType()
+		return equal(g.exp(operands, depth), g.exp(operands, depth))
+	default:
+		return less(g.exp(TyInt, depth), g.exp(TyInt, depth))
+	}
+}
+
+// a literal or variable of the given type
+func (g *generator) atom(ty Type) Exp {
+	if g.r.Intn(2) == 0 {
+		var vars []string
+		for i := 0; i < g.counters; i++ {
+			if x := fmt.Sprintf("i%d", i); g.types.lookup(x) == ty {
+				vars = append(vars, x)
+			}
+		}
+		if x, _, ok := g.variable(ty); ok {
+			vars = append(vars, x)
+		}
+		if len(vars) > 0 {
+			return Var(vars[g.r.Intn(len(vars))])
+		}
+	}
+	if ty == TyInt {
+		return Num(g.r.Intn(21) - 5)
+	}
+	return Bool(g.r.Intn(2) == 0)
+}
+
+// Soundness
+
+// run a well-typed program for at most the given number of small steps and
+// describe what goes wrong: an undefined variable or an evaluation error.
+// "" if nothing does. Failed specifications are not violations
+func soundnessViolation(prog Stmt, steps int) string {
+	var out strings.Builder
+	old := stdout
+	stdout = &out
+	defer func() { stdout = old }()
+	s := newValState()
+	for n := 0; n < steps && !isSkip(prog); n++ {
+		prog = step(prog, &s)
+		for _, scope := range s {
+			for x, v := range scope {
+				if v.flag == Undefined {
+					return x + " is undefined"
+				}
+			}
+		}
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		switch {
+		case strings.Contains(line, "eval fail"):
+			return line
+		case strings.Contains(line, "Undefined"):
+			return "printed an undefined value"
+		}
+	}
+	return ""
+}
+
+// Shrinking
+
+// a smallest well-typed variant of a program for which fails holds, found by
+// repeatedly replacing statements by skip or by their parts, and expressions
+// by their operands or literals
+func shrink(prog Stmt, fails func(Stmt) bool) Stmt {
+	for {
+		smaller := false
+		for _, c := range shrinkStmt(prog) {
+			if size(c) < size(prog) && c.check(newTyState()) && fails(c) {
+				prog, smaller = c, true
+				break
+			}
+		}
+		if !smaller {
+			return prog
+		}
+	}
+}
+
+// number of nodes, variables and literals other than 0 or false counting
+// twice, so shrinking prefers 0 and false
+func size(node interface{}) int {
+	switch n := node.(type) {
+	case Seq:
+		return 1 + size(n[0]) + size(n[1])
+	case Located:
+		return size(n.stmt)
+	case Decl:
+		return 1 + size(n.rhs)
+	case Assign:
+		return 1 + size(n.rhs)
+	case Print:
+		return 1 + size(n.exp)
+	case IfThenElse:
+		return 1 + size(n.cond) + size(n.thenStmt) + size(n.elseStmt)
+	case While:
+		ret := 1 + size(n.cond) + size(n.body)
+		if n.inv != nil {
+			ret += size(n.inv)
+		}
+		return ret
+	case Var:
+		return 2
+	case Num:
+		if n != 0 {
+			return 2
+		}
+	case Bool:
+		if n {
+			return 2
+		}
+	case Exp:
+		ret := 1
+		for _, e := range subformulas(n) {
+			ret += size(e)
+		}
+		return ret
+	}
+	return 1
+}
+
+// variants of a statement one step smaller
+func shrinkStmt(stmt Stmt) []Stmt {
+	var ret []Stmt
+	if _, ok := stmt.(Skip); !ok {
+		ret = append(ret, Skip{})
+	}
+	switch s := stmt.(type) {
+	case Seq:
+		ret = append(ret, s[0], s[1])
+		for _, c := range shrinkStmt(s[0]) {
+			ret = append(ret, mkSeq(c, s[1]))
+		}
+		for _, c := range shrinkStmt(s[1]) {
+			ret = append(ret, mkSeq(s[0], c))
+		}
+	case Located:
+		ret = append(ret, s.stmt)
+	case Decl:
+		for _, e := range shrinkExp(s.rhs) {
+			ret = append(ret, Decl{s.lhs, e, s.label})
+		}
+	case Assign:
+		for _, e := range shrinkExp(s.rhs) {
+			ret = append(ret, Assign{s.lhs, e})
+		}
+	case Print:
+		for _, e := range shrinkExp(s.exp) {
+			ret = append(ret, Print{e})
+		}
+	case IfThenElse:
+		ret = append(ret, s.thenStmt, s.elseStmt)
+		for _, e := range shrinkExp(s.cond) {
+			ret = append(ret, IfThenElse{e, s.thenStmt, s.elseStmt})
+		}
+		for _, c := range shrinkStmt(s.thenStmt) {
+			ret = append(ret, IfThenElse{s.cond, c, s.elseStmt})
+		}
+		for _, c := range shrinkStmt(s.elseStmt) {
+			ret = append(ret, IfThenElse{s.cond, s.thenStmt, c})
+		}
+	case While:
+		ret = append(ret, s.body)
+		for _, e := range shrinkExp(s.cond) {
+			ret = append(ret, While{e, s.body, s.inv})
+		}
+		for _, c := range shrinkStmt(s.body) {
+			ret = append(ret, While{s.cond, c, s.inv})
+		}
+	}
+	return ret
+}
+
+// variants of an expression one step smaller
+func shrinkExp(e Exp) []Exp {
+	ret := []Exp{Num(0), Bool(false)}
+	subs := subformulas(e)
+	ret = append(ret, subs...)
+	for i, sub := range subs {
+		for _, c := range shrinkExp(sub) {
+			ret = append(ret, replaceOperand(e, i, c))
+		}
+	}
+	return ret
+}
+
+// e with its ith operand replaced
+func replaceOperand(e Exp, i int, by Exp) Exp {
+	switch e := e.(type) {
+	case Plus:
+		e[i] = by
+		return e
+	case Mult:
+		e[i] = by
+		return e
+	case Equal:
+		e[i] = by
+		return e
+	case Less:
+		e[i] = by
+		return e
+	case And:
+		e[i] = by
+		return e
+	case Or:
+		e[i] = by
+		return e
+	case Not:
+		return Not{by}
+	}
+	return e
+}
+
+func generate_cmd(args []string) int {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	seed := fs.Int64("seed", 1, "seed of the random numbers")
+	n := fs.Int("n", 1, "number of programs")
+	stmts := fs.Int("stmts", 8, "number of statements at the top level")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *n < 1 || *stmts < 1 {
+		usage()
+	}
+	g := newGenerator(*seed)
+	for i := 0; i < *n; i++ {
+		if i > 0 {
+			fmt.Println()
+		}
+		src := g.program(*stmts).pretty()
+		if !strings.HasSuffix(src, ";") {
+			src += ";"
+		}
+		fmt.Println(src)
+	}
+	return 0
+}
@@ -1,52 +1,74 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
+var parserGoodTests = []struct {
+	name string
+	code string
+	want Program
+}{
+	// Sequences
+	{"single stmt", "print 42;", seq(printStmt(Num(42)))},
+	{"seq", "print 42; print 54;", seq(printStmt(Num(42)), printStmt(Num(54)))},
+	{"nested seq", "print 42; print 54; print 9001;",
+		seq(printStmt(Num(42)), printStmt(Num(54)), printStmt(Num(9001)))},
+	{"newline", "print 42; \n\n print 54;\n", seq(printStmt(Num(42)), printStmt(Num(54)))},
+	{"comment", "print 42; // this is a comment", printStmt(Num(42))},
+
+	// Statements
+	{":=", "x := 42;", seq(Decl{"x", Num(42), Unlabelled})},
+	{"=", "x = 42;", seq(Assign{"x", Num(42)})},
+	{"while body with 1 stmt",
+		"while true {print 42;};",
+		seq(While{cond: Bool(true), body: printStmt(Num(42))})},
+	{"while body with >1 stmt",
+		"while true {print 42; print 54;};",
+		seq(While{cond: Bool(true), body: seq(printStmt(Num(42)), printStmt(Num(54)))})},
+	{"if-then-else",
+		"if true {print 42;} else {print 54;};",
+		seq(IfThenElse{Bool(true), printStmt(Num(42)), printStmt(Num(54))})},
+	{"print", "print 42;", printStmt(Num(42))},
+	{"while invariant",
+		"while x < 3 invariant x < 4 {x = x + 1;};",
+		seq(While{less(Var("x"), Num(3)), seq(Assign{"x", plus(Var("x"), Num(1))}), less(Var("x"), Num(4))})},
+	{"read", "read x;", seq(Read{"x"})},
+	{"requires", "requires 0 < x;", seq(Requires{less(Num(0), Var("x"))})},
+	{"ensures", "ensures 0 < x;", seq(Ensures{less(Num(0), Var("x"))})},
+	{"assert", "assert x == 1;", seq(Assert{equal(Var("x"), Num(1))})},
+	{"assume", "assume !b;", seq(Assume{not(Var("b"))})},
+	{"secret", "secret x := 42;", seq(Decl{"x", Num(42), Secret})},
+	{"public", "public x := y;", seq(Decl{"x", Var("y"), Public})},
+
+	// Expressions
+	{"==", "print x == y;", printStmt(equal(Var("x"), Var("y")))},
+	{"<", "print x < y;", printStmt(less(Var("x"), Var("y")))},
+	{"+", "print x + y;", printStmt(plus(Var("x"), Var("y")))},
+	{"||", "print x || y;", printStmt(or(Var("x"), Var("y")))},
+	{"*", "print x * y;", printStmt(mult(Var("x"), Var("y")))},
+	{"&&", "print x && y;", printStmt(and(Var("x"), Var("y")))},
+	{"int", "print 42;", printStmt(Num(42))},
+	{"bool", "print true;", printStmt(Bool(true))},
+	{"vars", "print x;", printStmt(Var("x"))},
+	{"not (!)", "print !x;", printStmt(not(Var("x")))},
+	{"(exp) => exp", "print (x);", printStmt(Var("x"))},
+}
+
 func TestParserGood(t *testing.T) {
-	tests := []struct {
-		name string
-		code string
-		want Program
-	}{
-		// Sequences
-		{"single stmt", "print 42;", seq(printStmt(Num(42)))},
-		{"seq", "print 42; print 54;", seq(printStmt(Num(42)), printStmt(Num(54)))},
-		{"nested seq", "print 42; print 54; print 9001;",
-			seq(printStmt(Num(42)), printStmt(Num(54)), printStmt(Num(9001)))},
-		{"newline", "print 42; \n\n print 54;\n", seq(printStmt(Num(42)), printStmt(Num(54)))},
-		{"comment", "print 42; // this is a comment", printStmt(Num(42))},
-
-		// Statements
-		{":=", "x := 42;", seq(Decl{"x", Num(42)})},
-		{"=", "x = 42;", seq(Assign{"x", Num(42)})},
-		{"while body with 1 stmt",
-			"while true {print 42;};",
-			seq(While{Bool(true), printStmt(Num(42))})},
-		{"while body with >1 stmt",
-			"while true {print 42; print 54;};",
-			seq(While{Bool(true), seq(printStmt(Num(42)), printStmt(Num(54)))})},
-		{"if-then-else",
-			"if true {print 42;} else {print 54;};",
-			seq(IfThenElse{Bool(true), printStmt(Num(42)), printStmt(Num(54))})},
-		{"print", "print 42;", printStmt(Num(42))},
-
-		// Expressions
-		{"==", "print x == y;", printStmt(equal(Var("x"), Var("y")))},
-		{"<", "print x < y;", printStmt(less(Var("x"), Var("y")))},
-		{"+", "print x + y;", printStmt(plus(Var("x"), Var("y")))},
-		{"||", "print x || y;", printStmt(or(Var("x"), Var("y")))},
-		{"*", "print x * y;", printStmt(mult(Var("x"), Var("y")))},
-		{"&&", "print x && y;", printStmt(and(Var("x"), Var("y")))},
-		{"int", "print 42;", printStmt(Num(42))},
-		{"bool", "print true;", printStmt(Bool(true))},
-		{"vars", "print x;", printStmt(Var("x"))},
-		{"not (!)", "print !x;", printStmt(not(Var("x")))},
-		{"(exp) => exp", "print (x);", printStmt(Var("x"))},
-	}
-	for _, tt := range tests {
+	for _, tt := range parserGoodTests {
 		t.Run(tt.name, func(t *testing.T) {
 			got, err := newParser().parse_fromstring(tt.code)
 			failed := false
@@ -66,33 +88,36 @@ func TestParserGood(t *testing.T) {
 }
 
 // expected failures
+var parserBadTests = []struct {
+	name string
+	code string
+}{
+	{"unexpected character", "%"},
+	{"unexpected token", "42"},
+	{"missing semicolon between stmts", "x := 42 x = 54;"},
+	{"missing semicolon at end", "x := 42; x = 54"},
+	{"decl/assign", "x < 42;"},
+	{"bad while cond", "while < {print 54;};"},
+	{"bad if cond", "if == {print 42;} else {print 54;};"},
+	{"bad then stmt", "if true {42;} else {print 54;};"},
+	{"missing else", "if true {print 42;};"},
+	{"missing opening brace", "if true print 42;};"},
+	{"missing closing brace", "if true {print 42;;"},
+	{"bad equal rhs", "x := 42 == ;"},
+	{"bad less rhs", "x := 42 < ;"},
+	{"bad plus rhs", "x := 42 + ;"},
+	{"bad or rhs", "x := true || ;"},
+	{"bad mult rhs", "x := 6 * ;"},
+	{"bad and rhs", "x := true && ;"},
+	{"bad paren exp", "x := (;);"},
+	{"missing close paren", "x := (42;"},
+	{"bad factor", "x := ; + ;"},
+	{"read expression", "read 42;"},
+	{"read as variable", "read := 1;"},
+}
+
 func TestParserBad(t *testing.T) {
-	tests := []struct {
-		name string
-		code string
-	}{
-		{"unexpected character", "%"},
-		{"unexpected token", "42"},
-		{"missing semicolon between stmts", "x := 42 x = 54;"},
-		{"missing semicolon at end", "x := 42; x = 54"},
-		{"decl/assign", "x < 42;"},
-		{"bad while cond", "while < {print 54;};"},
-		{"bad if cond", "if == {print 42;} else {print 54;};"},
-		{"bad then stmt", "if true {42;} else {print 54;};"},
-		{"missing else", "if true {print 42;};"},
-		{"missing opening brace", "if true print 42;};"},
-		{"missing closing brace", "if true {print 42;;"},
-		{"bad equal rhs", "x := 42 == ;"},
-		{"bad less rhs", "x := 42 < ;"},
-		{"bad plus rhs", "x := 42 + ;"},
-		{"bad or rhs", "x := true || ;"},
-		{"bad mult rhs", "x := 6 * ;"},
-		{"bad and rhs", "x := true && ;"},
-		{"bad paren exp", "x := (;);"},
-		{"missing close paren", "x := (42;"},
-		{"bad factor", "x := ; + ;"},
-	}
-	for _, tt := range tests {
+	for _, tt := range parserBadTests {
 		t.Run(tt.name, func(t *testing.T) {
 			_, err := newParser().parse_fromstring(tt.code)
 			if err == nil {
@@ -102,56 +127,82 @@ func TestParserBad(t *testing.T) {
 	}
 }
 
-func TestTypeChecker(t *testing.T) {
-	tests := []struct {
-		name string
-		code string
-		want bool
-	}{
-		// Sequences
-		{"seq", "print 42; print 54;", true},
-		{"seq2", "x := 42 < true; print 54 < false;", false},
-		{"seq3", "print 42; print 54 < false;", false},
-
-		// Statements
-		{"assign", "x := 42; x = 54;", true},
-		{"assign2", "x := 42; x = true;", false},
-		{"assign3", "x = 42;", false},
-		{"while", "while true {print 42;};", true},
-		{"while2", "while 42 {print 42;};", false},
-		{"if-then-else", "if false {print 42;} else {print 54;};", true},
-		{"if-then-else2", "if true {print 42 < true;} else {print 54;};", false},
-		{"if-then-else3", "if 42 {print 42;} else {print 54;};", false},
-		{"print", "print 42;", true},
-
-		// Expressions
-		{"equal", "x := true == false;", true},
-		{"equal2", "x := true == 54;", false},
-		{"less", "x := 42 < 54;", true},
-		{"less2", "x := 42 < true;", false},
-		{"plus", "x := 42 + 54;", true},
-		{"plus2", "x := 42 + false;", false},
-		{"mult", "x := 6 * 9;", true},
-		{"mult2", "x := 6 * false;", false},
-		{"(exp) => exp", "x := (42+54);", true},
-		{"(exp) => exp 2", "x := (42+false);", false},
-
-		// note: short circuit is supported but fails type check which requires two bools
-		{"or", "x := false || true;", true},
-		{"or2", "x := false || 42;", false},
-		{"or sc", "x := true || false;", true},
-		{"or sc2", "x := true || 54;", false},
-
-		{"and", "x := true && true;", true},
-		{"and2", "x := true && 42;", false},
-		{"and sc", "x := false && true;", true},
-		{"and sc2", "x := false && 54;", false},
-
-		{"not", "x := !true;", true},
-		{"not2", "x := !42;", false},
-		{"not3", "x := true; y := !x;", true},
-		{"not4", "x := 54; y := !x;", false},
+// the token stream printed by -v names every keyword
+func TestLexKeywords(t *testing.T) {
+	for kw := range keywords {
+		t.Run(kw, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := os.Stdout
+			os.Stdout = w
+			defer func() { os.Stdout = old }()
+			// lex_file() starts after the token read by newLexer()
+			newLexer("x " + kw).lex_file()
+			w.Close()
+			out, _ := io.ReadAll(r)
+			if !strings.Contains(string(out), "("+kw+")") {
+				t.Errorf("got %q", out)
+			}
+		})
 	}
+}
+
+var typeCheckerTests = []struct {
+	name string
+	code string
+	want bool
+}{
+	// Sequences
+	{"seq", "print 42; print 54;", true},
+	{"seq2", "x := 42 < true; print 54 < false;", false},
+	{"seq3", "print 42; print 54 < false;", false},
+
+	// Statements
+	{"assign", "x := 42; x = 54;", true},
+	{"assign2", "x := 42; x = true;", false},
+	{"assign3", "x = 42;", false},
+	{"read", "x := 0; read x;", true},
+	{"read undeclared", "read x;", false},
+	{"while", "while true {print 42;};", true},
+	{"while2", "while 42 {print 42;};", false},
+	{"if-then-else", "if false {print 42;} else {print 54;};", true},
+	{"if-then-else2", "if true {print 42 < true;} else {print 54;};", false},
+	{"if-then-else3", "if 42 {print 42;} else {print 54;};", false},
+	{"print", "print 42;", true},
+
+	// Expressions
+	{"equal", "x := true == false;", true},
+	{"equal2", "x := true == 54;", false},
+	{"less", "x := 42 < 54;", true},
+	{"less2", "x := 42 < true;", false},
+	{"plus", "x := 42 + 54;", true},
+	{"plus2", "x := 42 + false;", false},
+	{"mult", "x := 6 * 9;", true},
+	{"mult2", "x := 6 * false;", false},
+	{"(exp) => exp", "x := (42+54);", true},
+	{"(exp) => exp 2", "x := (42+false);", false},
+
+	// note: short circuit is supported but fails type check which requires two bools
+	{"or", "x := false || true;", true},
+	{"or2", "x := false || 42;", false},
+	{"or sc", "x := true || false;", true},
+	{"or sc2", "x := true || 54;", false},
+
+	{"and", "x := true && true;", true},
+	{"and2", "x := true && 42;", false},
+	{"and sc", "x := false && true;", true},
+	{"and sc2", "x := false && 54;", false},
+
+	{"not", "x := !true;", true},
+	{"not2", "x := !42;", false},
+	{"not3", "x := true; y := !x;", true},
+	{"not4", "x := 54; y := !x;", false},
+}
+
+func TestTypeChecker(t *testing.T) {
+	tests := typeCheckerTests
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			prog, err := newParser().parse_fromstring(tt.code)
@@ -172,69 +223,71 @@ func TestTypeChecker(t *testing.T) {
 	}
 }
 
+var evaluatorTests = []struct {
+	name string
+	code string
+	want Val // convention: output stored in "x"
+}{
+	// Sequences
+	{"seq", "x := 42; y := 12; x = x + y;", mkInt(54)},
+	{"seq2", "x := 42; x = false;", mkUndefined()},
+	{"seq3", "x := 42; x = x + true;", mkUndefined()},
+
+	// Statements
+	{"declare", "x := 42;", mkInt(42)},
+	{"declare2", "x := 42; x := true;", mkBool(true)},
+	{"assign", "x := 42; x = 54;", mkInt(54)},
+	{"assign2", "x = 54;", mkUndefined()},
+	{"print", "x:=42; print x;", mkInt(42)},
+
+	{"while", "n := 1; x := 0; while n<11 {x=x+n; n=n+1;};", mkInt(55)},
+	// general case: declaration updates global variable if types match
+	{"while2", "n := 1; x := 0; while n<11 {x:=x+n; n=n+1;};", mkInt(55)},
+	{"while3", "b := true; x := 42; while b {x:=true; b=false;};", mkInt(42)},
+
+	{"while cond bad type", "while 42 {x := 42;};", mkUndefined()},
+
+	{"if-then-else", "if true {x := 42;} else {x := 54;};", mkUndefined()},
+	{"if-then-else2", "x:=0; if true {x = 42;} else {x = 54;};", mkInt(42)},
+	{"if-then-else3", "x:=0; if false {x = 42;} else {x = 54;};", mkInt(54)},
+	// general case: decl updates global if same type
+	{"if-then-else4", "x:=0; if true {x := 42;} else {x := 54;};", mkInt(42)},
+	{"if-then-else5", "x:=42; if false {x := true;} else {x := false;};", mkInt(42)},
+
+	{"if cond bad type", "if 42 {x := 42;} else {x := 54;};", mkUndefined()},
+
+	// Expressions
+	{"equal", "x := true == false;", mkBool(false)},
+	{"equal2", "x := 42 == 42;", mkBool(true)},
+	{"equal3", "x := true == 54;", mkUndefined()},
+	{"less", "x := 42 < 54;", mkBool(true)},
+	{"less2", "x := 42 < true;", mkUndefined()},
+	{"plus", "x := 42 + 54;", mkInt(96)},
+	{"plus2", "x := 42 + false;", mkUndefined()},
+	{"mult", "x := 6 * 9;", mkInt(54)},
+	{"mult2", "x := 6 * false;", mkUndefined()},
+	{"(exp) => exp", "x := (42+54);", mkInt(96)},
+	{"(exp) => exp 2", "x := (42+false);", mkUndefined()},
+
+	// note: short circuit is supported but fails type check which requires two bools
+	{"or", "x := false || true;", mkBool(true)},
+	{"or2", "x := false || 42;", mkUndefined()},
+	{"or sc", "x := true || false;", mkBool(true)},
+	{"or sc2", "x := true || 54;", mkBool(true)},
+
+	{"and", "x := true && true;", mkBool(true)},
+	{"and2", "x := true && 42;", mkUndefined()},
+	{"and sc", "x := false && true;", mkBool(false)},
+	{"and sc2", "x := false && 54;", mkBool(false)},
+
+	{"not", "x := !true;", mkBool(false)},
+	{"not2", "x := !42;", mkUndefined()},
+	{"not3", "y := true; x := !y;", mkBool(false)},
+	{"not4", "y := 54; x := !y;", mkUndefined()},
+}
+
 func TestEvaluator(t *testing.T) {
-	tests := []struct {
-		name string
-		code string
-		want Val // convention: output stored in "x"
-	}{
-		// Sequences
-		{"seq", "x := 42; y := 12; x = x + y;", mkInt(54)},
-		{"seq2", "x := 42; x = false;", mkUndefined()},
-		{"seq3", "x := 42; x = x + true;", mkUndefined()},
-
-		// Statements
-		{"declare", "x := 42;", mkInt(42)},
-		{"declare2", "x := 42; x := true;", mkBool(true)},
-		{"assign", "x := 42; x = 54;", mkInt(54)},
-		{"assign2", "x = 54;", mkUndefined()},
-		{"print", "x:=42; print x;", mkInt(42)},
-
-		{"while", "n := 1; x := 0; while n<11 {x=x+n; n=n+1;};", mkInt(55)},
-		// general case: declaration updates global variable if types match
-		{"while2", "n := 1; x := 0; while n<11 {x:=x+n; n=n+1;};", mkInt(55)},
-		{"while3", "b := true; x := 42; while b {x:=true; b=false;};", mkInt(42)},
-
-		{"while cond bad type", "while 42 {x := 42;};", mkUndefined()},
-
-		{"if-then-else", "if true {x := 42;} else {x := 54;};", mkUndefined()},
-		{"if-then-else2", "x:=0; if true {x = 42;} else {x = 54;};", mkInt(42)},
-		{"if-then-else3", "x:=0; if false {x = 42;} else {x = 54;};", mkInt(54)},
-		// general case: decl updates global if same type
-		{"if-then-else4", "x:=0; if true {x := 42;} else {x := 54;};", mkInt(42)},
-		{"if-then-else5", "x:=42; if false {x := true;} else {x := false;};", mkInt(42)},
-
-		{"if cond bad type", "if 42 {x := 42;} else {x := 54;};", mkUndefined()},
-
-		// Expressions
-		{"equal", "x := true == false;", mkBool(false)},
-		{"equal2", "x := 42 == 42;", mkBool(true)},
-		{"equal3", "x := true == 54;", mkUndefined()},
-		{"less", "x := 42 < 54;", mkBool(true)},
-		{"less2", "x := 42 < true;", mkUndefined()},
-		{"plus", "x := 42 + 54;", mkInt(96)},
-		{"plus2", "x := 42 + false;", mkUndefined()},
-		{"mult", "x := 6 * 9;", mkInt(54)},
-		{"mult2", "x := 6 * false;", mkUndefined()},
-		{"(exp) => exp", "x := (42+54);", mkInt(96)},
-		{"(exp) => exp 2", "x := (42+false);", mkUndefined()},
-
-		// note: short circuit is supported but fails type check which requires two bools
-		{"or", "x := false || true;", mkBool(true)},
-		{"or2", "x := false || 42;", mkUndefined()},
-		{"or sc", "x := true || false;", mkBool(true)},
-		{"or sc2", "x := true || 54;", mkBool(true)},
-
-		{"and", "x := true && true;", mkBool(true)},
-		{"and2", "x := true && 42;", mkUndefined()},
-		{"and sc", "x := false && true;", mkBool(false)},
-		{"and sc2", "x := false && 54;", mkBool(false)},
-
-		{"not", "x := !true;", mkBool(false)},
-		{"not2", "x := !42;", mkUndefined()},
-		{"not3", "y := true; x := !y;", mkBool(false)},
-		{"not4", "y := 54; x := !y;", mkUndefined()},
-	}
+	tests := evaluatorTests
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			prog, err := newParser().parse_fromstring(tt.code)
@@ -256,3 +309,2270 @@ func TestEvaluator(t *testing.T) {
 		})
 	}
 }
+
+// specifications are checked at runtime
+func TestSpecifications(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		input string
+		want  string
+	}{
+		{"hold", "x := 0; read x; requires 0 < x; assert x == 3; ensures x < 4;", "3", ""},
+		{"precondition", "x := 0; read x; requires 0 < x;", "-1", "precondition failed: (0<x) with x = -1\n"},
+		{"assertion", "x := 1; assert x == 2;", "", "assertion failed: (x==2) with x = 1\n"},
+		{"postcondition", "x := true; read x; ensures x;", "false", "postcondition failed: x\n"},
+		{"loop invariant", "i := 0; while i < 3 invariant i < 3 { i = i + 1; };", "",
+			"loop invariant failed: (i<3) with i = 3\n"},
+		{"bad input", "x := 0; read x; print x;", "abc",
+			"read eval fail: expected Int for x, found \"abc\"\nUndefined\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			old := stdin
+			stdin = strings.NewReader(tt.input)
+			defer func() { stdin = old }()
+			if got := runOutput(prog); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// read parses a token of the variable's type from the input
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		input string
+		want  string
+	}{
+		{"int", "x := 0; read x; print x + 1;", "41", "42\n"},
+		{"negative", "x := 0; read x; print x;", "-7", "-7\n"},
+		{"bool", "b := true; read b; print !b;", "true", "false\n"},
+		{"whitespace", "x := 0; y := 0; read x; read y; print x * y;", " 6\n\n\t7 ", "42\n"},
+		{"inner scope", "x := 0; if true { read x; } else { skip; }; print x;", "5", "5\n"},
+		{"bool for int", "x := 0; read x;", "true", "read eval fail: expected Int for x, found \"true\"\n"},
+		{"int for bool", "b := false; read b;", "1", "read eval fail: expected Bool for b, found \"1\"\n"},
+		{"end of input", "x := 0; read x;", "", "read eval fail: expected Int for x, found \"\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			old := stdin
+			stdin = strings.NewReader(tt.input)
+			defer func() { stdin = old }()
+			if got := runOutput(prog); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// run a program and return everything it prints
+func runOutput(prog Stmt) string {
+	var buf bytes.Buffer
+	old := stdout
+	stdout = &buf
+	defer func() { stdout = old }()
+	prog.eval(newValState())
+	return buf.String()
+}
+
+func TestOptimizer(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string // pretty print of the optimized program
+	}{
+		{"fold plus", "print 2 + 3;", "print 5"},
+		{"fold mult", "x := 1; x = x + 2*1 + -1;", "x := 1;\nx = 2;"},
+		{"fold comparison", "print 1 < 2 == true;", "print true"},
+		{"fold not", "print !(true && false);", "print true"},
+		{"short circuit", "b := true; b = b && false || !b;", "b := true;\nb = false;"},
+		{"identity", "x := 0; while x < 10 { x = (x + 0) * 1 + 1; };", "x := 0;\nwhile (x<10) {\n\tx = (x+1);\n};"},
+		{"propagate", "x := 4; y := x * x; print y;", "x := 4;\ny := 16;\nprint 16;"},
+		{"scope", "x := 1; if true { x := true; print x; } else { skip; }; print x;",
+			"x := 1;\nif true {\n\tx := true;\n\tprint true;\n} else {\n\tskip;\n};\nprint 1;"},
+		{"inline taken branch", "x := 1; if true { x = 2; } else { skip; }; print x;", "x := 1;\nx = 2;\nprint 2;"},
+		// declarations stay in their block
+		{"keep block", "x := 1; if true { x := 2; } else { skip; }; print x;",
+			"x := 1;\nif true {\n\tx := 2;\n} else {\n\tskip;\n};\nprint 2;"},
+		{"merge same", "x := 1; if 0 < x { x = 2; } else { x = 2; }; print x;", "x := 1;\nx = 2;\nprint 2;"},
+		{"merge differ", "b := 0 < 1; x := 1; if b { x = 2; } else { skip; }; print x;",
+			"b := true;\nx := 1;\nx = 2;\nprint 2;"},
+		{"unknown cond", "n := 3; b := true; while b { b = false; }; if b { n = 4; } else { skip; }; print n;",
+			"n := 3;\nb := true;\nwhile b {\n\tb = false;\n};\nif b {\n\tn = 4;\n} else {\n\tskip;\n};\nprint n;"},
+		{"while false", "x := 0; while x < 0 { x = x + 1; }; print x;", "x := 0;\nwhile (x<0) {\n\tx = (x+1);\n};\nprint x;"},
+		{"while false constant", "while 1 < 0 { print 1; }; print 2;", "print 2"},
+		{"loop invalidates", "i := 0; n := 5; while i < n { i = i + 1; }; print i + n;",
+			"i := 0;\nn := 5;\nwhile (i<5) {\n\ti = (i+1);\n};\nprint (i+5);"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			if !prog.check(newTyState()) {
+				t.Fatalf("Program does not type-check: %s", tt.code)
+			}
+			opt := optimize(prog)
+			if got := opt.pretty(); got != tt.want {
+				t.Errorf("optimize() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if got, want := runOutput(opt), runOutput(prog); got != want {
+				t.Errorf("optimized output %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// optimized and unoptimized programs must behave identically
+func TestOptimizerPreservesOutput(t *testing.T) {
+	files := []string{"primes.imp", "test_script.imp"}
+	for _, f := range files {
+		t.Run(f, func(t *testing.T) {
+			prog, err := newParser().parse_fromfile(f)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			if !prog.check(newTyState()) {
+				t.Fatalf("%s does not type-check", f)
+			}
+			want := runOutput(prog)
+			opt := optimize(prog)
+			if got := runOutput(opt); got != want {
+				t.Errorf("optimized output:\n%s\nwant:\n%s", got, want)
+			}
+			opt = hoistInvariants(opt)
+			if got := runOutput(opt); got != want {
+				t.Errorf("output after hoisting invariants:\n%s\nwant:\n%s", got, want)
+			}
+			opt, _ = eliminateDeadCode(opt)
+			if got := runOutput(opt); got != want {
+				t.Errorf("output without dead code:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestDeadCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		want    string   // pretty print of the program without dead code
+		removed []string // reported removals
+	}{
+		{"unused decl", "x := 1; y := 2; print x;", "x := 1;\nprint x;", []string{"unused variable: y := 2"}},
+		{"overwritten assign", "x := 1; x = 2; x = 3; print x;", "x := 1;\nx = 3;\nprint x;",
+			[]string{"unused assignment: x = 2"}},
+		{"dead after print", "x := 1; print x; x = x + 1;", "x := 1;\nprint x;",
+			[]string{"unused assignment: x = (x+1)"}},
+		{"keep print", "print 1 < 2;", "print (1<2)", nil},
+		{"skip", "skip; print 1; skip;", "print 1", nil},
+		{"unreachable then", "x := 1; if false { x = 2; } else { print x; };", "x := 1;\nprint x;",
+			[]string{"unreachable branch: x = 2"}},
+		{"unreachable else keeps block", "if true { y := 1; print y; } else { print 2; };",
+			"if true {\n\ty := 1;\n\tprint y;\n} else {\n\tskip;\n}", []string{"unreachable branch: print 2"}},
+		{"unreachable loop", "while false { print 1; }; print 2;", "print 2",
+			[]string{"unreachable loop: while false {\n\tprint 1;\n}"}},
+		{"nothing observed", "x := 1; b := true; if b { x = 2; } else { x = 3; };", "skip",
+			[]string{"unused variable: x := 1", "unused variable: b := true", "empty if: if b {\n\tskip;\n} else {\n\tskip;\n}",
+				"unused assignment: x = 2", "unused assignment: x = 3"}},
+		{"empty if", "x := 1; if x < 2 { skip; } else { skip; }; print x;", "x := 1;\nprint x;",
+			[]string{"empty if: if (x<2) {\n\tskip;\n} else {\n\tskip;\n}"}},
+		{"live in branch", "x := 1; if x < 2 { x = 2; } else { skip; }; print x;",
+			"x := 1;\nif (x<2) {\n\tx = 2;\n} else {\n\tskip;\n};\nprint x;", nil},
+		{"loop carried", "i := 0; s := 0; while i < 3 { s = s + i; i = i + 1; }; print s;",
+			"i := 0;\ns := 0;\nwhile (i<3) {\n\ts = (s+i);\n\ti = (i+1);\n};\nprint s;", nil},
+		{"unused in loop", "i := 0; while i < 3 { t := i * 2; i = i + 1; };",
+			"i := 0;\nwhile (i<3) {\n\ti = (i+1);\n};", []string{"unused variable: t := (i*2)"}},
+		// the outer x is printed, the inner one shadows it and is never read
+		{"shadowing", "x := 1; if x < 2 { x := true; x = false; } else { skip; }; print x;",
+			"x := 1;\nprint x;", []string{"empty if: if (x<2) {\n\tskip;\n} else {\n\tskip;\n}",
+				"unused variable: x := true", "unused assignment: x = false"}},
+		{"decl updates outer", "x := 1; if x < 2 { x := 2; } else { skip; }; print x;",
+			"x := 1;\nif (x<2) {\n\tx := 2;\n} else {\n\tskip;\n};\nprint x;", nil},
+		// the binding is needed by the later assignment even if its value is not
+		{"decl kept for assign", "x := 1; x = 2; print x;", "x := 1;\nx = 2;\nprint x;", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			if !prog.check(newTyState()) {
+				t.Fatalf("Program does not type-check: %s", tt.code)
+			}
+			got, removed := eliminateDeadCode(prog)
+			if got.pretty() != tt.want {
+				t.Errorf("eliminateDeadCode() =\n%s\nwant\n%s", got.pretty(), tt.want)
+			}
+			if !reflect.DeepEqual(removed, tt.removed) {
+				t.Errorf("removed %q, want %q", removed, tt.removed)
+			}
+			if got, want := runOutput(got), runOutput(prog); got != want {
+				t.Errorf("output %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// an operator that counts its evaluations
+type countingExp struct {
+	Exp
+	n *int
+}
+
+func (e countingExp) eval(s ValState) Val {
+	*e.n++
+	return e.Exp.eval(s)
+}
+
+func countOperators(e Exp, n *int) Exp {
+	for i, sub := range subformulas(e) {
+		e = replaceOperand(e, i, countOperators(sub, n))
+	}
+	if isOperator(e) {
+		return countingExp{e, n}
+	}
+	return e
+}
+
+// run a program and return its output and the number of evaluated operators
+func runCounting(prog Stmt) (string, int) {
+	n := 0
+	out := runOutput(mapStmtExps(prog, func(e Exp) Exp { return countOperators(e, &n) }))
+	return out, n
+}
+
+func TestHoistInvariants(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string // pretty print of the program after hoisting
+	}{
+		{"hoist from body",
+			"i := 0; n := 3; k := 2; while i < n { print k * k; i = i + 1; };",
+			"i := 0;\nn := 3;\nk := 2;\ninv1 := (k*k);\nwhile (i<n) {\n\tprint inv1;\n\ti = (i+1);\n};"},
+		{"hoist from condition",
+			"i := 0; n := 3; k := 2; while i < n * k { i = i + 1; };",
+			"i := 0;\nn := 3;\nk := 2;\ninv1 := (n*k);\nwhile (i<inv1) {\n\ti = (i+1);\n};"},
+		{"shared temporary",
+			"i := 0; k := 2; while i < k + 1 { i = i + (k + 1); };",
+			"i := 0;\nk := 2;\ninv1 := (k+1);\nwhile (i<inv1) {\n\ti = (i+inv1);\n};"},
+		{"maximal subexpression",
+			"i := 0; k := 2; while i < 5 { i = i + k * (k + 1); };",
+			"i := 0;\nk := 2;\ninv1 := (k*(k+1));\nwhile (i<5) {\n\ti = (i+inv1);\n};"},
+		{"modified operand",
+			"i := 0; k := 2; while i < 5 { k = k + 1; i = i + k * 2; };",
+			"i := 0;\nk := 2;\nwhile (i<5) {\n\tk = (k+1);\n\ti = (i+(k*2));\n};"},
+		// k is redeclared in the body, so k*2 refers to the inner binding
+		{"declared in body",
+			"i := 0; k := true; while i < 5 { k := 3; i = i + k * 2; };",
+			"i := 0;\nk := true;\nwhile (i<5) {\n\tk := 3;\n\ti = (i+(k*2));\n};"},
+		{"fresh name",
+			"inv1 := 2; i := 0; while i < 3 { i = i + inv1 * inv1; };",
+			"inv1 := 2;\ni := 0;\ninv2 := (inv1*inv1);\nwhile (i<3) {\n\ti = (i+inv2);\n};"},
+		{"nested loops",
+			"i := 0; k := 2; while i < 3 { j := 0; while j < i * k { j = j + 1; }; i = i + 1; };",
+			"i := 0;\nk := 2;\nwhile (i<3) {\n\tj := 0;\n\tinv1 := (i*k);\n\twhile (j<inv1) {\n\t\tj = (j+1);\n\t};\n\ti = (i+1);\n};"},
+		{"hoisted twice",
+			"i := 0; k := 2; while i < 3 { j := 0; while j < k * k { j = j + 1; }; i = i + 1; };",
+			"i := 0;\nk := 2;\ninv1 := (k*k);\nwhile (i<3) {\n\tj := 0;\n\twhile (j<inv1) {\n\t\tj = (j+1);\n\t};\n\ti = (i+1);\n};"},
+		// k*k moves out of both loops, i*k out of the innermost one only
+		{"hoisted from three loops",
+			"i := 0; k := 2; while i < 2 { j := 0; while j < 2 { l := 0; while l < k * k + i * k { l = l + 1; }; j = j + 1; }; i = i + 1; };",
+			"i := 0;\nk := 2;\ninv2 := (k*k);\nwhile (i<2) {\n\tj := 0;\n\tinv1 := (inv2+(i*k));\n\twhile (j<2) {\n\t\tl := 0;\n\t\twhile (l<inv1) {\n\t\t\tl = (l+1);\n\t\t};\n\t\tj = (j+1);\n\t};\n\ti = (i+1);\n};"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			if !prog.check(newTyState()) {
+				t.Fatalf("Program does not type-check: %s", tt.code)
+			}
+			got := hoistInvariants(prog)
+			if got.pretty() != tt.want {
+				t.Errorf("hoistInvariants() =\n%s\nwant\n%s", got.pretty(), tt.want)
+			}
+			if copies := regexp.MustCompile(`inv\d+ := inv\d+;`).FindString(got.pretty()); copies != "" {
+				t.Errorf("copied temporary: %s", copies)
+			}
+			if !got.check(newTyState()) {
+				t.Errorf("hoisted program does not type-check")
+			}
+			out, ops := runCounting(got)
+			wantOut, wantOps := runCounting(prog)
+			if out != wantOut {
+				t.Errorf("output %q, want %q", out, wantOut)
+			}
+			if ops > wantOps {
+				t.Errorf("evaluated %d operators, more than the original %d", ops, wantOps)
+			}
+		})
+	}
+}
+
+func TestHoistInvariantsFewerOps(t *testing.T) {
+	code := `
+		n := 10; k := 7; i := 0; s := 0;
+		while i < n * k {
+			s = s + (k * k + 1);
+			if s < k * n { print s; } else { skip; };
+			i = i + 1;
+		};
+		print s;`
+	prog, err := newParser().parse_fromstring(code)
+	if err != nil {
+		t.Fatalf("Parser returned error: %s", err.Error())
+	}
+	out, ops := runCounting(hoistInvariants(prog))
+	wantOut, wantOps := runCounting(prog)
+	if out != wantOut {
+		t.Errorf("output:\n%s\nwant:\n%s", out, wantOut)
+	}
+	// originally 8 operators per iteration and 2 for the final condition.
+	// after hoisting n*k, k*k+1 and k*n (4 operators) only 4 remain per iteration
+	if want := 4 + 70*4 + 1; wantOps != 70*8+2 || ops != want {
+		t.Errorf("evaluated %d operators, want %d (originally %d)", ops, want, wantOps)
+	}
+}
+
+func TestIntervalAnalysis(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		want     string   // state at the end of the program
+		warnings []string // expected warnings
+	}{
+		{"constants", "x := 2; y := x * 3 + 1;", "x = [2, 2], y = [7, 7]", nil},
+		{"branches", "b := 0 < 1; x := 0; if b { x = 5; } else { x = -3; };", "b = true, x = [5, 5]", nil},
+		{"join", "x := 0; y := 0; while x < 10 { x = x + 1; }; if x == 10 { y = 1; } else { y = 7; };",
+			"x = [10, 10], y = [1, 1]", nil},
+		{"counting loop", "i := 0; while i < 10 { i = i + 1; };", "i = [10, 10]", nil},
+		// intervals do not relate s to i, so s is unbounded
+		{"unbounded", "i := 0; s := 0; while i < 10 { s = s + 2; i = i + 1; };", "i = [10, 10], s = [-inf, +inf]",
+			[]string{"line 1: (s+2) may overflow (operands [-inf, +inf] and [2, 2])"}},
+		{"refine condition", "i := 0; j := 0; while i < 100 { if i < 50 { j = i; } else { j = 0; }; i = i + 1; };",
+			"i = [100, 100], j = [0, 49]", nil},
+		{"scopes", "x := 1; if x < 2 { x := true; y := 5; } else { skip; };", "x = [1, 1]",
+			[]string{"line 1: (x<2) is always true"}},
+		{"overflow plus", "x := 4611686018427387904; y := x + x;", "x = [4611686018427387904, 4611686018427387904], y = [-inf, +inf]",
+			[]string{"line 1: (x+x) may overflow (operands [4611686018427387904, 4611686018427387904] and [4611686018427387904, 4611686018427387904])"}},
+		{"overflow loop", "x := 1; while 0 < x { x = x * 2; };", "x = [-inf, 0]",
+			[]string{"line 1: (x*2) may overflow (operands [1, +inf] and [2, 2])"}},
+		{"no overflow when bounded", "x := 1; while x < 1000 { x = x * 2; };", "x = [1000, 1998]", nil},
+		{"always false", "x := 5; while x < 3 { x = x + 1; };", "x = [5, 5]",
+			[]string{"line 1: (x<3) is always false"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newLocatingParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			a := newAnalyzer(IntervalDomain{})
+			if got := a.showState(a.analyze(prog)); got != tt.want {
+				t.Errorf("final state %s, want %s", got, tt.want)
+			}
+			if !reflect.DeepEqual(a.warnings, tt.warnings) {
+				t.Errorf("warnings %q, want %q", a.warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+// every concrete value must lie in the interval computed for its variable
+func TestIntervalAnalysisSound(t *testing.T) {
+	codes := []string{
+		"x := 0; y := 1; while x < 20 { y = y * 2 + x; x = x + 3; };",
+		"x := 7; y := 0; while 0 < x { if x == 3 { y = y + x; } else { y = y + -1; }; x = x + -1; };",
+		"n := 27; c := 0; while !(n == 1) { m := n; h := 0; while 1 < m { m = m + -2; h = h + 1; };" +
+			" if m == 0 { n = h; } else { n = 3 * n + 1; }; c = c + 1; };",
+	}
+	for _, f := range []string{"primes.imp", "test_script.imp"} {
+		code, _ := os.ReadFile(f)
+		codes = append(codes, string(code))
+	}
+	for _, code := range codes {
+		prog, err := newParser().parse_fromstring(code)
+		if err != nil {
+			t.Fatalf("Parser returned error: %s", err.Error())
+		}
+		env := newValState()
+		old := stdout
+		stdout = &bytes.Buffer{} // discard output
+		prog.eval(env)
+		stdout = old
+		for dname, d := range domains {
+			final := newAnalyzer(d).analyze(prog)
+			for name, v := range env[0] {
+				abs, ok := final.lookup(name)
+				if !ok {
+					t.Errorf("%s: %s missing from abstract state", dname, name)
+					continue
+				}
+				if v.flag == ValueInt && !d.leq(d.constant(v.valI), abs.n) {
+					t.Errorf("%s: %s = %d not in %s\nCode: %s", dname, name, v.valI, d.show(abs.n), code)
+				}
+				if v.flag == ValueBool && !abs.b.may(v.valB) {
+					t.Errorf("%s: %s = %v not in %s\nCode: %s", dname, name, v.valB, abs.b, code)
+				}
+			}
+		}
+	}
+}
+
+func TestSignAnalysis(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string // state at the end of the program
+	}{
+		{"constants", "x := -3; y := 0; z := 7;", "x = -, y = 0, z = +"},
+		// sums and products may wrap around
+		{"plus", "x := -3; y := 7; a := x + x; b := y + y; c := x + y; d := y + 0;", "a = top, b = -|+, c = top, d = +, x = -, y = +"},
+		{"mult", "x := -3; y := 7; a := x * x; b := x * y; c := x * 0;", "a = top, b = top, c = 0, x = -, y = +"},
+		{"wraparound", "x := 9223372036854775807; y := x + 1; z := -9223372036854775807 + -1; w := z + z;", "w = top, x = +, y = -|+, z = top"},
+		// signs cannot order two positive numbers
+		{"join", "x := 1; b := x < 2; if b { x = 0; } else { skip; };", "b = true|false, x = 0|+"},
+		{"loop", "x := 10; while 0 < x { x = x + -1; };", "x = -|0"},
+		{"refine", "x := 5; y := 0; while 0 < x { y = x; x = x + -1; };", "x = -|0, y = 0|+"},
+		{"compare", "x := -1; y := 1; b := x < y; c := y == x;", "b = true, c = false, x = -, y = +"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			a := newAnalyzer(SignDomain{})
+			if got := a.showState(a.analyze(prog)); got != tt.want {
+				t.Errorf("final state %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParityAnalysis(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string // state at the end of the program
+	}{
+		{"constants", "x := -3; y := 0;", "x = odd, y = even"},
+		{"plus", "x := 3; y := 4; a := x + x; b := x + y;", "a = even, b = odd, x = odd, y = even"},
+		{"mult", "x := 3; y := 4; a := x * x; b := x * y;", "a = odd, b = even, x = odd, y = even"},
+		{"loop keeps parity", "x := 0; while x < 10 { x = x + 2; };", "x = even"},
+		{"loop loses parity", "x := 0; while x < 10 { x = x + 1; };", "x = top"},
+		{"double", "x := 5; i := 0; while i < 3 { x = x * 2; i = i + 1; };", "i = top, x = top"},
+		{"equal", "x := 2; y := 3; b := x == y;", "b = false, x = even, y = odd"},
+		{"refine equal", "x := 3; y := 0; while !(x == 0) { y = x * 2 + 1; x = x + -1; }; z := x == 1;", "x = even, y = top, z = false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			a := newAnalyzer(ParityDomain{})
+			if got := a.showState(a.analyze(prog)); got != tt.want {
+				t.Errorf("final state %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSatisfiable(t *testing.T) {
+	types := TyState{TyScope{"x": {ty: TyInt}, "y": {ty: TyInt}, "b": {ty: TyBool}}}
+	tests := []struct {
+		name string
+		f    Exp
+		want satResult
+	}{
+		{"bounds", and(less(Num(0), Var("x")), less(Var("x"), Num(2))), sat},
+		{"empty", and(less(Num(0), Var("x")), less(Var("x"), Num(1))), unsat},
+		// 2x == 1 has a rational solution only
+		{"tightening", equal(mult(Num(2), Var("x")), Num(1)), unsat},
+		{"transitive", and(and(less(Var("x"), Var("y")), less(Var("y"), Var("x"))), Bool(true)), unsat},
+		{"disequality", and(not(equal(Var("x"), Num(0))), and(less(Num(-1), Var("x")), less(Var("x"), Num(1)))), unsat},
+		{"bool", and(equal(Var("b"), less(Var("x"), Num(0))), and(Var("b"), less(Num(5), Var("x")))), unsat},
+		{"case split", or(and(Var("b"), not(Var("b"))), equal(plus(Var("x"), Var("y")), Num(7))), sat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, m := satisfiable(tt.f, types)
+			if got != tt.want {
+				t.Fatalf("satisfiable(%s) = %v, want %v", tt.f.pretty(), got, tt.want)
+			}
+			if got == sat {
+				// the model must satisfy the formula
+				s := newValState()
+				s.declare("x", mkInt(m.ints["x"]))
+				s.declare("y", mkInt(m.ints["y"]))
+				s.declare("b", mkBool(m.bools["b"]))
+				if v := tt.f.eval(s); !v.valB {
+					t.Errorf("model %v does not satisfy %s", m, tt.f.pretty())
+				}
+			}
+		})
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want []string
+	}{
+		{"assignment", "x := 1; y := x + 2; assert y == 3;", []string{"line 1: assertion (y==3) proved"}},
+		{"false", "x := 1; assert x == 2;", []string{"line 1: assertion (x==2) failed: false in every execution"}},
+		{"precondition", "x := 0;\nread x;\nrequires (0 < x) && (x < 1000);\ny := x + x;\nensures x < y;",
+			[]string{"line 5: postcondition (x<y) proved"}},
+		{"counterexample", "x := 0;\nread x; requires (-1000 < x) && (x < 1000);\ny := x * 2;\nassert y < 10;",
+			[]string{"line 4: assertion (y<10) failed: counterexample x = 5 read at line 2"}},
+		{"branches", "x := 0;\nread x; requires (-1000 < x) && (x < 1000);\nif x < 0 { x = x * -1; } else { skip; };\nassert 0 < x + 1;\nassert 0 < x;",
+			[]string{"line 4: assertion (0<(x+1)) proved",
+				"line 5: assertion (0<x) failed: counterexample x = 0 read at line 2"}},
+		{"assertions are assumed", "b := true; read b; assert b; assert b || false;",
+			[]string{"line 1: assertion b failed: counterexample b = false read at line 1",
+				"line 1: assertion (b||false) proved"}},
+		{"loop", "n := 0;\nread n;\nrequires (0 < n) && (n < 1000);\ni := 0;\ns := 0;\n" +
+			"while i < n invariant (i < n + 1) && (s == i * 2) {\n\ts = s + 2;\n\ti = i + 1;\n};\nensures s == n * 2;",
+			[]string{"line 6: loop invariant ((i<(n+1))&&(s==(i*2))) on entry proved",
+				"line 6: loop invariant ((i<(n+1))&&(s==(i*2))) preserved proved",
+				"line 10: postcondition (s==(n*2)) proved"}},
+		{"invariant not preserved", "i := 0;\nwhile i < 10 invariant i < 10 {\n\ti = i + 1;\n};",
+			[]string{"line 2: loop invariant (i<10) on entry proved",
+				"line 2: loop invariant (i<10) preserved not proved: counterexample i = 9 at the loop head (line 2), the loop invariant may be too weak"}},
+		{"weak invariant", "i := 0;\nwhile i < 10 {\n\ti = i + 1;\n};\nassert i == 10;",
+			[]string{"line 5: assertion (i==10) not proved: counterexample i = 11 at the loop head (line 2), the loop invariant may be too weak"}},
+		{"assert in loop", "i := 0;\nwhile i < 10 invariant !(i < 0) {\n\tassert i < 10;\n\ti = i + 1;\n};",
+			[]string{"line 2: loop invariant !(i<0) on entry proved",
+				"line 2: loop invariant !(i<0) preserved proved",
+				"line 3: assertion (i<10) proved"}},
+		{"shadowing", "x := 1; if true { x := true; assert x; } else { skip; }; assert x == 1;",
+			[]string{"line 1: assertion x proved", "line 1: assertion (x==1) proved"}},
+		{"nonlinear", "x := 0; read x; assert !(x * x < 0);",
+			[]string{"line 1: no overflow in (x*x) not proved: nonlinear arithmetic",
+				"line 1: assertion !((x*x)<0) not proved: nonlinear arithmetic"}},
+		// the interpreter wraps around: 9223372036854775807 + 1 is negative
+		{"overflow", "x := 0;\nread x;\nrequires 0 < x;\ny := x + 1;\nassert 0 < y;",
+			[]string{"line 4: no overflow in (x+1) failed: counterexample x = 9223372036854775807 read at line 2",
+				"line 5: assertion (0<y) proved"}},
+		{"overflow of constants", "x := 4611686018427387904;\ny := x * -2;\nz := y + -1;",
+			[]string{"line 3: no overflow in (y+-1) failed: false in every execution"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newLocatingParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			if !prog.check(newTyState()) {
+				t.Fatalf("type error in %s", tt.code)
+			}
+			var got []string
+			for _, r := range verify(prog) {
+				got = append(got, r.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("verify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubstAvoidsCapture(t *testing.T) {
+	// (forall x. x < y)[x + 1/y] renames the bound x
+	f := forall("x", TyInt, less(Var("x"), Var("y")))
+	got := subst(f, "y", plus(Var("x"), Num(1)))
+	if want := "forall x'. x' < x + 1"; got.pretty() != want {
+		t.Errorf("subst() = %s, want %s", got.pretty(), want)
+	}
+	// bound occurrences are not replaced
+	if got := subst(f, "x", Num(3)); got != f {
+		t.Errorf("subst() = %s, want %s", got.pretty(), f.pretty())
+	}
+}
+
+func TestShowFormula(t *testing.T) {
+	tests := []struct {
+		f     Exp
+		ascii string
+		latex string
+	}{
+		{implies(and(Var("a"), or(Var("b"), Var("c"))), not(less(Var("x"), Num(1)))),
+			"a && (b || c) ==> !(x < 1)", "a \\land (b \\lor c) \\Rightarrow \\neg (x < 1)"},
+		{implies(implies(Var("a"), Var("b")), Var("c")), "(a ==> b) ==> c", "(a \\Rightarrow b) \\Rightarrow c"},
+		{mult(plus(Var("n#2"), Num(1)), Var("count'")), "(n#2 + 1) * count'", "(n_{2} + 1) \\cdot \\mathit{count}'"},
+		{and(forall("x", TyInt, less(Num(0), Var("x"))), exists("b", TyBool, equal(Var("b"), Bool(true)))),
+			"(forall x. 0 < x) && (exists b. b == true)",
+			"(\\forall x.\\; 0 < x) \\land (\\exists b.\\; b = \\mathit{true})"},
+	}
+	for _, tt := range tests {
+		if got := showFormula(tt.f, false); got != tt.ascii {
+			t.Errorf("ascii: got %s, want %s", got, tt.ascii)
+		}
+		if got := showFormula(tt.f, true); got != tt.latex {
+			t.Errorf("latex: got %s, want %s", got, tt.latex)
+		}
+	}
+}
+
+func TestWeakestPre(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		post string
+		want string
+	}{
+		{"assignment", "x := 1; y := x + 2;", "y == 3", "true"},
+		{"read", "x := 0; read x; y := x * 2;", "0 < y", "forall x. 0 < x * 2"},
+		{"requires", "x := 0; read x; requires 0 < x; x = x + 1;", "1 < x", "forall x. 0 < x ==> 1 < x + 1"},
+		{"if", "x := 0; read x; if x < 0 { x = x * -1; } else { skip; };", "!(x < 0)",
+			"forall x. x < 0 ==> !(x * -1 < 0)"},
+		{"assert", "x := 0; read x; assert x == 2;", "x + x == 4", "forall x. x == 2 && x + x == 4"},
+		{"while", "i := 0; while i < 10 invariant !(10 < i) { i = i + 1; };", "i == 10",
+			"forall i. (!(10 < i) && i < 10 ==> !(10 < i + 1)) && (!(10 < i) && !(i < 10) ==> i == 10)"},
+		{"shadowed", "x := 1; if true { x := true; } else { skip; }; x := x + 1;", "x == 2", "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			post, err := newParser().parse_expfromstring(tt.post)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			f, err := weakestPre(prog, post)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := showFormula(f, false); got != tt.want {
+				t.Errorf("wp = %s, want %s", got, tt.want)
+			}
+		})
+	}
+	// the postcondition must be well-typed in the final state
+	prog, _ := newParser().parse_fromstring("x := 1;")
+	if _, err := weakestPre(prog, less(Var("y"), Num(1))); err == nil {
+		t.Errorf("wp accepted a postcondition over an undeclared variable")
+	}
+}
+
+func TestStrongestPost(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"declarations", "x := 1; y := x + 2;", "y == x + 2 && x == 1"},
+		{"assignment", "x := 0; read x; x = x + 1;", "exists x'. x == x' + 1"},
+		{"requires", "x := 0; read x; requires 0 < x;", "0 < x"},
+		{"if", "x := 0; read x; if x < 0 { x = x * -1; } else { skip; };",
+			"(exists x'. x == x' * -1 && x' < 0) || !(x < 0)"},
+		{"local", "x := 0; if true { y := 2; x = y; } else { skip; };", "x == 2"},
+		{"while", "i := 0; while i < 10 invariant !(10 < i) { i = i + 1; };", "!(10 < i) && !(i < 10)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatalf("Parser returned error: %s", err.Error())
+			}
+			if got := showFormula(strongestPost(prog), false); got != tt.want {
+				t.Errorf("sp = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// compare the SMT-LIB2 export of the programs in testdata/smt with golden files.
+// go test -run TestExportSMT -update rewrites them
+func TestExportSMT(t *testing.T) {
+	tests := []struct {
+		prog   string
+		k      int
+		golden string
+	}{
+		{"abs.imp", 0, "abs.smt2"},
+		{"sum.imp", 0, "sum.smt2"},
+		{"sum.imp", 2, "sum.unroll2.smt2"},
+		{"square.imp", 0, "square.smt2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			prog, err := load_checked("testdata/smt/" + tt.prog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := exportSMT(prog, tt.k)
+			golden := "testdata/smt/" + tt.golden
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("export differs from %s:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestUnroll(t *testing.T) {
+	prog, _ := newParser().parse_fromstring("i := 0; while i < 2 { i = i + 1; }; assert i == 2;")
+	if got := runOutput(unroll(prog, 3)); got != "" {
+		t.Errorf("unrolled loop printed %q", got)
+	}
+	// one iteration is too few
+	if got := runOutput(unroll(prog, 1)); got != "assumption failed: !(i<2) with i = 1\nassertion failed: (i==2) with i = 1\n" {
+		t.Errorf("unrolled loop printed %q", got)
+	}
+}
+
+func TestSymbolicExecution(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		paths int
+	}{
+		{"straight line", "x := 0; read x; print x + 1;", 1},
+		{"abs", "x := 0; read x; if x < 0 { x = x * -1; } else { skip; }; print x; assert !(x < 0);", 2},
+		{"failing assertion", "x := 0; read x; y := x + 1; assert x < y; assert !(x == 3);", 2},
+		{"infeasible branch", "x := 0; read x; if x < 0 { if 0 < x { print 1; } else { print 2; }; } else { print 3; };", 2},
+		{"assume", "x := 0; read x; assume 0 < x; if x < 1 { print 1; } else { print 2; };", 1},
+		{"booleans", "b := false; c := false; read b; read c; if b && !c { print 1; } else { print 2; };", 2},
+		{"loop", "n := 0; read n; i := 0; while i < n { print i; i = i + 1; };", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := newExplorer(3, 1000, 100)
+			paths := e.explore(prog)
+			if len(paths) != tt.paths {
+				t.Fatalf("got %d paths, want %d:\n%s", len(paths), tt.paths, e.report(paths))
+			}
+			for i, p := range paths {
+				inputs, outputs, ok := e.concretize(p)
+				if !ok {
+					t.Errorf("path %d: no inputs found", i+1)
+					continue
+				}
+				var in, out []string
+				for _, v := range inputs {
+					in = append(in, showVal(v))
+				}
+				for _, v := range outputs {
+					out = append(out, showVal(v)+"\n")
+				}
+				old := stdin
+				stdin = strings.NewReader(strings.Join(in, " "))
+				got := runOutput(prog)
+				stdin = old
+				switch p.status {
+				case pathCompleted:
+					if want := strings.Join(out, ""); got != want {
+						t.Errorf("path %d with inputs %v printed %q, want %q", i+1, in, got, want)
+					}
+				case pathFailed:
+					if !strings.Contains(got, p.failure) {
+						t.Errorf("path %d with inputs %v printed %q, want %q", i+1, in, got, p.failure)
+					}
+				case pathBounded:
+					if !strings.HasPrefix(got, strings.Join(out, "")) {
+						t.Errorf("path %d with inputs %v printed %q, want prefix %q", i+1, in, got, strings.Join(out, ""))
+					}
+				}
+			}
+		})
+	}
+}
+
+// the solver's model overflows in the interpreter, which takes the else branch
+func TestSymbolicExecutionOverflow(t *testing.T) {
+	prog, _ := newParser().parse_fromstring("x := 0; read x; assume 9223372036854775000 < x; if x < x + 1000 { print 1; } else { print 2; };")
+	e := newExplorer(3, 1000, 100)
+	paths := e.explore(prog)
+	if len(paths) != 1 {
+		t.Fatalf("got %d paths:\n%s", len(paths), e.report(paths))
+	}
+	if inputs, _, ok := e.concretize(paths[0]); ok {
+		t.Errorf("got inputs %v", inputs)
+	}
+}
+
+func TestSymbolicExecutionLimits(t *testing.T) {
+	prog, _ := newParser().parse_fromstring("n := 0; read n; while 0 < n { n = n + -1; };")
+	e := newExplorer(2, 1000, 100)
+	paths := e.explore(prog)
+	if len(paths) != 3 || paths[2].status != pathBounded || paths[2].failure != "stopped after 2 forks" {
+		t.Errorf("fork limit:\n%s", e.report(paths))
+	}
+	e = newExplorer(10, 1000, 2)
+	paths = e.explore(prog)
+	if len(paths) != 2 || !e.truncated {
+		t.Errorf("path limit:\n%s", e.report(paths))
+	}
+	// failed specifications fork as well
+	prog, _ = newParser().parse_fromstring("n := 0; read n; while 0 < n { assert n < 3; n = n + -1; }; assert n == 0;")
+	for limit := 1; limit <= 8; limit++ {
+		e = newExplorer(10, 1000, limit)
+		if paths = e.explore(prog); len(paths) > limit {
+			t.Errorf("-paths %d: %d paths:\n%s", limit, len(paths), e.report(paths))
+		}
+	}
+}
+
+// all assignments of n variables satisfying the clauses, by enumeration
+func bruteForceSAT(n int, clauses [][]lit) bool {
+	for m := 0; m < 1<<uint(n); m++ {
+		ok := true
+		for _, c := range clauses {
+			sat := false
+			for _, l := range c {
+				sat = sat || (m>>uint(l.variable()-1)&1 == 1) != (l&1 == 1)
+			}
+			ok = ok && sat
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSAT(t *testing.T) {
+	// pigeonhole: n+1 pigeons do not fit into n holes
+	for n := 1; n <= 5; n++ {
+		s := newSatSolver()
+		p := make([][]lit, n+1)
+		for i := range p {
+			for j := 0; j < n; j++ {
+				p[i] = append(p[i], s.newVar())
+			}
+			s.addClause(p[i]...)
+		}
+		for j := 0; j < n; j++ {
+			for i := range p {
+				for k := i + 1; k < len(p); k++ {
+					s.addClause(p[i][j].not(), p[k][j].not())
+				}
+			}
+		}
+		if s.solve() {
+			t.Errorf("pigeonhole %d: found a model", n)
+		}
+	}
+
+	// random 3-SAT around the threshold, compared with enumeration
+	seed := uint32(1)
+	random := func(n int) int {
+		seed = seed*1664525 + 1013904223
+		return int(seed>>8) % n
+	}
+	for round := 0; round < 200; round++ {
+		const vars = 10
+		s := newSatSolver()
+		for i := 0; i < vars; i++ {
+			s.newVar()
+		}
+		var clauses [][]lit
+		for i := 0; i < 43; i++ {
+			var c []lit
+			for j := 0; j < 3; j++ {
+				c = append(c, lit(2*(1+random(vars))+random(2)))
+			}
+			clauses = append(clauses, c)
+			s.addClause(c...)
+		}
+		want := bruteForceSAT(vars, clauses)
+		if got := s.solve(); got != want {
+			t.Fatalf("round %d: solve() = %v, want %v", round, got, want)
+		}
+		if !want {
+			continue
+		}
+		for _, c := range clauses {
+			sat := false
+			for _, l := range c {
+				sat = sat || s.modelValue(l)
+			}
+			if !sat {
+				t.Fatalf("round %d: model violates a clause", round)
+			}
+		}
+		// under assumptions, then without them again
+		a := lit(2 * (1 + random(vars)))
+		got := s.solve(a)
+		if want := bruteForceSAT(vars, append(clauses, []lit{a})); got != want {
+			t.Fatalf("round %d: solve(%d) = %v, want %v", round, a, got, want)
+		}
+		if !s.solve() {
+			t.Fatalf("round %d: assumption was kept", round)
+		}
+	}
+}
+
+func TestBitVectors(t *testing.T) {
+	const width = 8
+	values := []int{0, 1, 2, 3, -1, -2, 5, 7, 64, 100, 127, -128, -100}
+	c := newCircuit()
+	x, y := make([]lit, width), make([]lit, width)
+	for i := range x {
+		x[i], y[i] = c.s.newVar(), c.s.newVar()
+	}
+	sum, prod, negProd := c.add(x, y), c.mul(x, y), c.mul(x, c.constant(-3, width))
+	eq, lt := c.equal(x, y), c.less(x, y)
+	wrap := func(n int) int { return int(int8(n)) }
+	value := func(bits []lit) int {
+		n := 0
+		for i, l := range bits {
+			if c.s.modelValue(l) {
+				n |= 1 << uint(i)
+			}
+		}
+		return wrap(n)
+	}
+	for _, a := range values {
+		for _, b := range values {
+			if !c.s.solve(c.equal(x, c.constant(a, width)), c.equal(y, c.constant(b, width))) {
+				t.Fatalf("%d, %d: no model", a, b)
+			}
+			if got := value(sum); got != wrap(a+b) {
+				t.Errorf("%d + %d = %d", a, b, got)
+			}
+			if got := value(prod); got != wrap(a*b) {
+				t.Errorf("%d * %d = %d", a, b, got)
+			}
+			if got := value(negProd); got != wrap(a*-3) {
+				t.Errorf("%d * -3 = %d", a, got)
+			}
+			if got := c.s.modelValue(eq); got != (a == b) {
+				t.Errorf("%d == %d is %v", a, b, got)
+			}
+			if got := c.s.modelValue(lt); got != (a < b) {
+				t.Errorf("%d < %d is %v", a, b, got)
+			}
+		}
+	}
+}
+
+func TestBMC(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		width int
+		want  []string // first line of every result
+	}{
+		{"proved", "x := 0; read x; y := x + 1; assert y == 1 + x;", 64,
+			[]string{"line 1: assertion (y==(1+x)) proved"}},
+		{"overflow", "x := 0; read x; assert x < x + 1;", 64,
+			[]string{"line 1: assertion (x<(x+1)) failed"}},
+		{"no overflow after assume", "x := 0; read x; assume x < 100; assert x < x + 1;", 64,
+			[]string{"line 1: assertion (x<(x+1)) proved"}},
+		{"nonlinear", "x := 0; read x; assert !(x * x == 49);", 8,
+			[]string{"line 1: assertion !((x*x)==49) failed"}},
+		{"branches", "x := 0; read x; y := 0; if x < 0 { y = 1; } else { y = 2; }; ensures (0 < y) && (y < 3);", 64,
+			[]string{"line 1: postcondition ((0<y)&&(y<3)) proved"}},
+		{"shadowing", "x := 1; if true { x := true; assert x; } else { skip; }; assert x == 1;", 64,
+			[]string{"line 1: assertion x proved", "line 1: assertion (x==1) proved"}},
+		{"bounded loop", "i := 0; while i < 3 { i = i + 1; }; assert i == 3;", 64,
+			[]string{"line 1: assertion (i==3) proved"}},
+		{"unbounded loop", "n := 0; read n; i := 0; while i < n { i = i + 1; }; assert !(i == 4);", 64,
+			[]string{"line 1: assertion !(i==4) failed"}},
+		{"beyond the bound", "n := 0; read n; i := 0; while i < n { i = i + 1; }; assert !(i == 6);", 64,
+			[]string{"line 1: assertion !(i==6) holds with at most 5 loop iterations"}},
+		{"invariant", "n := 0; read n; assume n < 10; i := 0; while i < n invariant !(i == 2) { i = i + 1; };", 64,
+			[]string{"line 1: loop invariant !(i==2) failed"}},
+		// the most negative constant is its own negation
+		{"minimal constant", "x := 0; read x; y := x * -128; assert (y == 0) || (y == -128); assert y == 0;", 8,
+			[]string{"line 1: assertion ((y==0)||(y==-128)) proved", "line 1: assertion (y==0) failed"}},
+		{"booleans", "b := false; c := false; read b; read c; assert (b || c) == !(!b && !c); assert b == c;", 64,
+			[]string{"line 1: assertion ((b||c)==!(!b&&!c)) proved", "line 1: assertion (b==c) failed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newLocatingParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results := bmc(prog, tt.width, 5)
+			var got []string
+			for _, r := range results {
+				got = append(got, strings.SplitN(r.String(), "\n", 2)[0])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for _, r := range results {
+				if !r.failed || tt.width != 64 {
+					continue
+				}
+				// the counterexample fails in the interpreter as well
+				var in []string
+				for _, v := range r.inputs {
+					in = append(in, showVal(v))
+				}
+				old := stdin
+				stdin = strings.NewReader(strings.Join(in, " "))
+				out := runOutput(prog)
+				stdin = old
+				if !strings.Contains(out, r.message) {
+					t.Errorf("inputs %v printed %q, want %q", in, out, r.message)
+				}
+			}
+		})
+	}
+}
+
+// x * -1 has to stay as cheap as -(x * 1) at the interpreter's width
+func TestBMCNegativeConstant(t *testing.T) {
+	prog, err := newLocatingParser().parse_fromstring("x := 0; read x; y := x; if x < 0 { y = x * -1; } else { skip; }; assert 0 < y + 1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []bmcResult, 1)
+	go func() { done <- bmc(prog, 64, 5) }()
+	select {
+	case results := <-done:
+		// fails for the most negative x only
+		if len(results) != 1 || !results[0].failed || results[0].inputs[0] != mkInt(-1<<63) {
+			t.Fatalf("got %v", results)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("bmc did not finish in 10s")
+	}
+}
+
+func TestFlows(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		input string
+		want  []string
+	}{
+		{"unlabelled", "x := 1; read x; y := x * 2; if y < 0 { print y; } else { skip; };", "3", nil},
+		{"secret to secret", "secret s := 0; read s; t := s + 1; secret u := t; u = u * s;", "3", nil},
+		{"public to secret", "public p := 1; secret s := p; s = p + s;", "", nil},
+		{"explicit", "secret s := 0; read s; public p := 0; p = s;", "3",
+			[]string{"line 1: explicit flow: secret value assigned to public variable p"}},
+		{"explicit declaration", "secret s := 1; public p := s + 1;", "",
+			[]string{"line 1: explicit flow: secret value assigned to public variable p"}},
+		{"print", "secret s := 0; read s; x := s * 2; print x;", "3",
+			[]string{"line 1: explicit flow: print depends on secret value"}},
+		{"implicit", "secret s := 0; read s; p := 0; if s < 0 { p = 1; } else { skip; };", "-3",
+			[]string{"line 1: implicit flow: public variable p assigned under secret condition at line 1"}},
+		{"implicit print", "secret s := true; read s; while s { print 1; s = false; };", "true",
+			[]string{"line 1: implicit flow: print under secret condition at line 1"}},
+		{"secret branch", "secret s := 0; read s; secret t := 0; if s < 0 { t = 1; x := 2; x = x + 1; } else { skip; }; print 1;", "-3", nil},
+		{"public local in secret branch", "secret s := true; if s { public p := 1; } else { skip; };", "",
+			[]string{"line 1: implicit flow: public variable p assigned under secret condition at line 1"}},
+		{"read", "secret s := true; p := 0; if s { read p; } else { skip; };", "4",
+			[]string{"line 1: implicit flow: public variable p assigned under secret condition at line 1"}},
+		{"assertion", "secret s := 0; read s; assert 0 < s;", "3",
+			[]string{"line 1: explicit flow: assertion depends on secret value"}},
+		{"relabel", "secret s := 0; public s := 1;", "",
+			[]string{"line 1: s is already declared secret"}},
+		{"shadowing", "secret s := 0; if true { s := true; print s; } else { skip; };", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newLocatingParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !prog.check(newTyState()) {
+				t.Fatal("type error")
+			}
+			if got := checkFlows(prog); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checkFlows() = %q, want %q", got, tt.want)
+			}
+
+			// taint tracking agrees with the static result
+			out := runTaint(prog, tt.input)
+			if violation := strings.Contains(out, "taint violation"); violation && tt.want == nil {
+				t.Errorf("secure program printed %q", out)
+			}
+		})
+	}
+
+	// the monitor only sees the branch taken, and flows into variables that are printed
+	prog, _ := newLocatingParser().parse_fromstring("secret s := true; p := false; if s { p = true; } else { skip; }; print p;")
+	if got := runTaint(prog, ""); got != "line 1: taint violation: print depends on secret value\ntrue\n" {
+		t.Errorf("taint tracking printed %q", got)
+	}
+	prog, _ = newLocatingParser().parse_fromstring("secret s := false; p := false; if s { p = true; } else { skip; }; print p;")
+	if got := runTaint(prog, ""); got != "false\n" {
+		t.Errorf("taint tracking printed %q", got)
+	}
+}
+
+// run a program with taint tracking
+func runTaint(prog Stmt, input string) string {
+	old := stdin
+	stdin = strings.NewReader(input)
+	taint.enabled = true
+	defer func() { stdin, taint.enabled = old, false }()
+	return runOutput(prog)
+}
+
+// small-step and big-step semantics agree on the final state and the output
+func TestSmallStep(t *testing.T) {
+	tests := evaluatorTests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			big := newValState()
+			bigOut := captureOutput(func() { prog.eval(big) })
+			small := newValState()
+			smallOut := captureOutput(func() { run(prog, &small) })
+			if smallOut != bigOut {
+				t.Errorf("small-step printed %q, big-step %q", smallOut, bigOut)
+			}
+			if got, want := showScopes(small), showScopes(big); got != want {
+				t.Errorf("small-step state %s, big-step %s", got, want)
+			}
+			if got := small.lookup("x"); !got.equal(tt.want) {
+				t.Errorf("x = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	prog, _ := newParser().parse_fromstring("i := 0; while i < 2 invariant i < 2 { j := i; i = j + 1; };")
+	var configs []string
+	var stmt Stmt = prog
+	s := newValState()
+	out := captureOutput(func() {
+		for !isSkip(stmt) {
+			stmt = step(stmt, &s)
+			configs = append(configs, strings.ReplaceAll(stmt.pretty(), "\n", " ")+" | "+showScopes(s))
+		}
+	})
+	want := []string{
+		"skip; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 0]",
+		"while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); } | [i = 0]",
+		"{ \tj := i; \ti = (j+1); }; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 0] []",
+		"{ \tskip; \ti = (j+1); }; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 0] [j = 0]",
+		"{ \ti = (j+1); }; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 0] [j = 0]",
+		"{ \tskip; }; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 1] [j = 0]",
+		"skip; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 1]",
+		"while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); } | [i = 1]",
+		"{ \tj := i; \ti = (j+1); }; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 1] []",
+		"{ \tskip; \ti = (j+1); }; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 1] [j = 1]",
+		"{ \ti = (j+1); }; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 1] [j = 1]",
+		"{ \tskip; }; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 2] [j = 1]",
+		"skip; while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); }; | [i = 2]",
+		"while (i<2) invariant (i<2) { \tj := i; \ti = (j+1); } | [i = 2]",
+		"skip | [i = 2]",
+	}
+	if !reflect.DeepEqual(configs, want) {
+		t.Errorf("configurations:\n%s", strings.Join(configs, "\n"))
+	}
+	// the invariant is checked after the last iteration
+	if out != "loop invariant failed: (i<2) with i = 2\n" {
+		t.Errorf("printed %q", out)
+	}
+}
+
+// everything printed while running f
+func captureOutput(f func()) string {
+	var buf bytes.Buffer
+	old := stdout
+	stdout = &buf
+	defer func() { stdout = old }()
+	f()
+	return buf.String()
+}
+
+func TestDerivations(t *testing.T) {
+	// evaluation derivations end in the state eval() computes
+	for _, tt := range evaluatorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := newValState()
+			want := captureOutput(func() { prog.eval(env) })
+			var tree *derivation
+			out := captureOutput(func() { tree = deriveEval(prog, 0) })
+			if out != want {
+				t.Errorf("derivation printed %q, eval %q", out, want)
+			}
+			if got := tree.conclusion.result; got != showScopes(env) {
+				t.Errorf("derivation ends in %s, eval in %s", got, showScopes(env))
+			}
+		})
+	}
+	// typing derivations succeed exactly for well-typed programs
+	for _, tt := range typeCheckerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := newParser().parse_fromstring(tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree, ok := deriveTypes(prog)
+			if ok != tt.want {
+				t.Errorf("deriveTypes() = %v, want %v\n%s", ok, tt.want, tree.ascii())
+			}
+			if ill := tree.conclusion.result == showType(TyIllTyped); ill == ok {
+				t.Errorf("conclusion %s", tree.conclusion.text())
+			}
+		})
+	}
+
+	prog, _ := newParser().parse_fromstring("x := 0; while x < 5 { x = x + 1; }; y := false && (x < 3);")
+	tree := deriveEval(prog, 2)
+	got := tree.ascii()
+	want := `[] |- x := 0; while (x<5) { x = (x+1); }; y := (false&&(x<3)); => [x = 5, y = false]   (Seq)
+  [] |- x := 0 => [x = 0]   (Decl)
+    [] |- 0 => 0   (Num)
+  [x = 0] |- while (x<5) { x = (x+1); }; y := (false&&(x<3)); => [x = 5, y = false]   (Seq)
+    [x = 0] |- while (x<5) { x = (x+1); } => [x = 5]   (While-T)
+      [x = 0] |- (x<5) => true   (Less)
+        [x = 0] |- x => 0   (Var)
+        [x = 0] |- 5 => 5   (Num)
+      [x = 0] [] |- x = (x+1) => [x = 1] []   (Assign)
+        [x = 0] [] |- (x+1) => 1   (Plus)
+          [x = 0] [] |- x => 0   (Var)
+          [x = 0] [] |- 1 => 1   (Num)
+      [x = 1] |- while (x<5) { x = (x+1); } => [x = 5]   (While-T)
+        [x = 1] |- (x<5) => true   (Less)
+          [x = 1] |- x => 1   (Var)
+          [x = 1] |- 5 => 5   (Num)
+        [x = 1] [] |- x = (x+1) => [x = 2] []   (Assign)
+          [x = 1] [] |- (x+1) => 2   (Plus)
+            [x = 1] [] |- x => 1   (Var)
+            [x = 1] [] |- 1 => 1   (Num)
+        [x = 2] |- while (x<5) { x = (x+1); } => [x = 5]   (While)
+          ... further iterations omitted
+    [x = 5] |- y := (false&&(x<3)) => [x = 5, y = false]   (Decl)
+      [x = 5] |- (false&&(x<3)) => false   (And1)
+        [x = 5] |- false => false   (Bool)
+`
+	if got != want {
+		t.Errorf("ascii:\n%s", got)
+	}
+	// cutting at depth 1 leaves the root
+	if got := prune(tree, 1).ascii(); got != strings.SplitAfter(want, "\n")[0]+"  ... premises omitted\n" {
+		t.Errorf("pruned:\n%s", got)
+	}
+	latex := prune(tree, 2).latex()
+	for _, s := range []string{"\\begin{prooftree}", "\\BinaryInfC{$\\texttt{[]} \\vdash", "\\AxiomC{$\\vdots$}", "\\RightLabel{\\scriptsize Seq}", "\\{ x = (x+1); \\}"} {
+		if !strings.Contains(latex, s) {
+			t.Errorf("latex lacks %q:\n%s", s, latex)
+		}
+	}
+	if page := tree.html(); !strings.Contains(page, "(x&lt;5) &DoubleDownArrow; true") {
+		t.Errorf("html:\n%s", page)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	code := `x := 0;
+i := 0;
+while i < 3 {
+	j := i * 2;
+	if j == 2 {
+		x = x + j;
+	} else {
+		skip;
+	};
+	i = i + 1;
+};
+print x;
+`
+	prog, err := newLocatingParser().parse_fromstring(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDebugger(prog)
+	var lines []int
+	out := captureOutput(func() {
+		for d.resume(stepIn) != stopExited {
+			lines = append(lines, d.pos().line)
+		}
+	})
+	want := []int{2, 3, 4, 5, 8, 10, 3, 4, 5, 6, 10, 3, 4, 5, 8, 10, 3, 12}
+	if !reflect.DeepEqual(lines, want) || out != "2\n" {
+		t.Errorf("stepping into stopped at %v, printed %q", lines, out)
+	}
+
+	steps := func(d *debugger, modes ...stepMode) []int {
+		var lines []int
+		captureOutput(func() {
+			for _, mode := range modes {
+				if d.resume(mode) == stopExited {
+					lines = append(lines, 0)
+				} else {
+					lines = append(lines, d.pos().line)
+				}
+			}
+		})
+		return lines
+	}
+	d = newDebugger(prog)
+	if got := steps(d, stepOver, stepOver, stepIn, stepOver, stepOver, stepOut, stepIn); !reflect.DeepEqual(got, []int{2, 3, 4, 5, 10, 3, 4}) {
+		t.Errorf("stepping over and out stopped at %v", got)
+	}
+	if got := showScopes(d.state); got != "[i = 1, x = 0] []" {
+		t.Errorf("state %s", got)
+	}
+	if got := d.lines; !reflect.DeepEqual(got, []Pos{{3, 1}, {4, 2}}) {
+		t.Errorf("scopes at %s", got)
+	}
+
+	// conditional breakpoints, also on loop conditions
+	d = newDebugger(prog)
+	d.setBreakpoint(6, "")
+	d.setBreakpoint(3, "i == 3")
+	if got := steps(d, stepContinue, stepContinue, stepContinue); !reflect.DeepEqual(got, []int{6, 3, 0}) {
+		t.Errorf("continuing stopped at %v", got)
+	}
+	if err := d.setBreakpoint(1, "i <"); err == nil {
+		t.Error("setBreakpoint() accepted a syntax error")
+	}
+
+	d = newDebugger(prog)
+	steps(d, stepOver, stepOver, stepIn, stepIn)
+	for code, want := range map[string]string{"i * 2 + j": "0", "(j == 0) && (x < 1)": "true", "y": "y is ill-typed in the current scope", "i +": `expected value or expression on line 1, found ""`} {
+		if got := d.show(code); got != want {
+			t.Errorf("%s = %s, want %s", code, got, want)
+		}
+	}
+
+	old := stdin
+	stdin = strings.NewReader("break 6 if x == 0\nwatch x + 1\nc\nscopes\nn\np j\ninfo\nc\nn\n")
+	defer func() { stdin = old }()
+	out = captureOutput(newDebugger(prog).repl)
+	wantOut := `line 1: x := 0
+(debug) breakpoint at line 6
+(debug) watch 1: x + 1 = (x+1) is ill-typed in the current scope
+(debug) breakpoint at line 6: x = (x+j)
+watch 1: x + 1 = 1
+(debug) scope 2 (line 6): []
+scope 1 (line 5): [j = 2]
+scope 0 (line 3): [i = 1, x = 0]
+(debug) line 10: i = (i+1)
+watch 1: x + 1 = 3
+(debug) 2
+(debug) breakpoint at line 6 if (x==0)
+watch 1: x + 1
+(debug) 2
+program finished
+(debug) program finished
+(debug) 
+`
+	if out != wantOut {
+		t.Errorf("debugger printed\n%s", out)
+	}
+}
+
+// fake DAP client talking to serveDAP() through pipes
+type dapClient struct {
+	t   *testing.T
+	w   io.Writer
+	r   *bufio.Reader
+	seq int
+}
+
+// next message from the server
+func (c *dapClient) receive() map[string]interface{} {
+	c.t.Helper()
+	buf, err := readDAPMessage(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(buf, &msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// send a request and return the body of the response, failing on errors
+// unless fail is set, in which case the error message is returned
+func (c *dapClient) request(command string, args interface{}, fail bool) map[string]interface{} {
+	c.t.Helper()
+	c.seq++
+	writeDAPMessage(c.w, dapObject{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	resp := c.receive()
+	if resp["type"] != "response" || resp["request_seq"] != float64(c.seq) || resp["command"] != command {
+		c.t.Fatalf("%s: unexpected message %v", command, resp)
+	}
+	if resp["success"] != !fail {
+		c.t.Fatalf("%s: response %v", command, resp)
+	}
+	if fail {
+		return map[string]interface{}{"message": resp["message"]}
+	}
+	body, _ := resp["body"].(map[string]interface{})
+	return body
+}
+
+// the next event, which must be called name
+func (c *dapClient) event(name string) map[string]interface{} {
+	c.t.Helper()
+	msg := c.receive()
+	if msg["type"] != "event" || msg["event"] != name {
+		c.t.Fatalf("expected %s event, got %v", name, msg)
+	}
+	body, _ := msg["body"].(map[string]interface{})
+	return body
+}
+
+// the server stopped for the reason, at the line
+func (c *dapClient) stoppedAt(reason string, line int) {
+	c.t.Helper()
+	if body := c.event("stopped"); body["reason"] != reason {
+		c.t.Fatalf("stopped for %v, want %s", body["reason"], reason)
+	}
+	frames := c.request("stackTrace", dapObject{"threadId": 1}, false)["stackFrames"].([]interface{})
+	if got := frames[0].(map[string]interface{})["line"]; got != float64(line) {
+		c.t.Fatalf("stopped at line %v, want %d", got, line)
+	}
+}
+
+func TestDAP(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "loop.imp")
+	code := "x := 0;\nread x;\ni := 0;\nwhile i < 3 {\n\tj := i + x;\n\tprint j;\n\ti = i + 1;\n};\n"
+	if err := os.WriteFile(program, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- serveDAP(serverR, serverW)
+		serverW.Close()
+	}()
+	c := &dapClient{t: t, w: clientW, r: bufio.NewReader(clientR)}
+
+	if caps := c.request("initialize", dapObject{"adapterID": "imp"}, false); caps["supportsConditionalBreakpoints"] != true {
+		t.Errorf("capabilities %v", caps)
+	}
+	c.event("initialized")
+	c.request("launch", dapObject{"program": program + ".missing"}, true)
+	c.request("launch", dapObject{"program": program, "input": "10"}, false)
+	bps := c.request("setBreakpoints", dapObject{
+		"source":      dapObject{"path": program},
+		"breakpoints": []dapObject{{"line": 6, "condition": "i == 1"}, {"line": 7, "condition": "i <"}},
+	}, false)["breakpoints"].([]interface{})
+	if len(bps) != 2 || bps[0].(map[string]interface{})["verified"] != true || bps[1].(map[string]interface{})["verified"] != false {
+		t.Errorf("breakpoints %v", bps)
+	}
+	c.request("configurationDone", nil, false)
+
+	// the first iteration prints 10, then the breakpoint is hit
+	if out := c.event("output"); out["output"] != "10\n" {
+		t.Errorf("output %v", out)
+	}
+	c.stoppedAt("breakpoint", 6)
+	frames := c.request("stackTrace", dapObject{"threadId": 1}, false)["stackFrames"].([]interface{})
+	if len(frames) != 2 || frames[1].(map[string]interface{})["name"] != "global scope" || frames[0].(map[string]interface{})["name"] != "block at line 4" {
+		t.Errorf("frames %v", frames)
+	}
+	inner, global := frames[0].(map[string]interface{})["id"], frames[1].(map[string]interface{})["id"]
+	scopes := c.request("scopes", dapObject{"frameId": global}, false)["scopes"].([]interface{})
+	ref := scopes[0].(map[string]interface{})["variablesReference"]
+	vars := c.request("variables", dapObject{"variablesReference": ref}, false)["variables"].([]interface{})
+	var got []string
+	for _, v := range vars {
+		v := v.(map[string]interface{})
+		got = append(got, fmt.Sprintf("%v = %v : %v", v["name"], v["value"], v["type"]))
+	}
+	if want := []string{"i = 1 : Int", "x = 10 : Int"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("variables %v, want %v", got, want)
+	}
+	if r := c.request("evaluate", dapObject{"expression": "j * 2", "frameId": inner}, false); r["result"] != "22" {
+		t.Errorf("evaluate %v", r)
+	}
+	// j is not visible in the global scope
+	if r := c.request("evaluate", dapObject{"expression": "j", "frameId": global}, true); r["message"] != "j is ill-typed in the current scope" {
+		t.Errorf("evaluate %v", r)
+	}
+
+	c.request("next", dapObject{"threadId": 1}, false)
+	if out := c.event("output"); out["output"] != "11\n" {
+		t.Errorf("output %v", out)
+	}
+	c.stoppedAt("step", 7)
+	c.request("stepOut", dapObject{"threadId": 1}, false)
+	c.stoppedAt("step", 4)
+	c.request("stepIn", dapObject{"threadId": 1}, false)
+	c.stoppedAt("step", 5)
+	c.request("continue", dapObject{"threadId": 1}, false)
+	c.event("output")
+	c.event("exited")
+	c.event("terminated")
+	c.request("next", dapObject{"threadId": 1}, true)
+	c.request("disconnect", nil, false)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLanguageServer(t *testing.T) {
+	// diagnostics agree with the type checker
+	for _, tt := range typeCheckerTests {
+		if doc := analyzeDocument(tt.code); (len(doc.diagnostics) == 0) != tt.want {
+			t.Errorf("%s: diagnostics %v, want well-typed %v", tt.name, doc.diagnostics, tt.want)
+		}
+	}
+
+	code := "x := 1;\nb := x < 2 + true;\nwhile b {\n\ty := x + 1;\n\tx = y;\n};\nprint z;\n"
+	doc := analyzeDocument(code)
+	var got []string
+	for _, d := range doc.diagnostics {
+		got = append(got, fmt.Sprintf("%v-%v %s", doc.position(d.start), doc.position(d.end), d.message))
+	}
+	want := []string{
+		"{1 9}-{1 17} (2+true): operands of + must be Int",
+		"{2 6}-{2 7} b is not declared",
+		"{6 6}-{6 7} z is not declared",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diagnostics %q", got)
+	}
+	if doc := analyzeDocument("x := 1;\nwhile x {\n\tskip;\n};\n"); len(doc.diagnostics) != 1 || doc.diagnostics[0].message != "condition must be Bool, found Int" {
+		t.Errorf("diagnostics %v", doc.diagnostics)
+	}
+	if doc := analyzeDocument("x := 1;\nprint x +;\n"); doc.parsed || doc.position(doc.diagnostics[0].start) != (lspPosition{1, 9}) {
+		t.Errorf("parse error %v", doc.diagnostics)
+	}
+
+	code = "x := 1;\nwhile x < 3 {\n\ty := x + 1;\n\tx = y;\n\tx := true;\n};\nprint x;\n"
+	doc = analyzeDocument(code)
+	at := func(line, char int) int { return doc.offset(lspPosition{line, char}) }
+	for _, tt := range []struct {
+		line, char int
+		want       string
+	}{
+		{1, 6, "x : Int"},
+		{1, 8, "(x<3) : Bool"},
+		{2, 7, "(x+1) : Int"},
+		{2, 1, "y : Int"},
+		{4, 1, "x : Bool"},
+		{6, 6, "x : Int"},
+	} {
+		if _, got, _ := doc.hover(at(tt.line, tt.char)); got != tt.want {
+			t.Errorf("hover at %d:%d = %q, want %q", tt.line, tt.char, got, tt.want)
+		}
+	}
+	if _, _, ok := doc.hover(at(1, 0)); ok {
+		t.Error("hover on a keyword")
+	}
+	for _, tt := range []struct{ line, char, defLine, defChar int }{
+		{3, 1, 0, 0}, // x = y assigns the outer x
+		{3, 5, 2, 1},
+		{6, 6, 0, 0},
+		{4, 1, 4, 1},
+	} {
+		s, ok := doc.definition(at(tt.line, tt.char))
+		if got := doc.position(s.start); !ok || got != (lspPosition{tt.defLine, tt.defChar}) || s.end-s.start != 1 {
+			t.Errorf("definition at %d:%d = %v, want %d:%d", tt.line, tt.char, got, tt.defLine, tt.defChar)
+		}
+	}
+	labels := func(items []dapObject) []string {
+		var ret []string
+		for _, item := range items {
+			if item["kind"] == 6 {
+				ret = append(ret, fmt.Sprintf("%v : %v", item["label"], item["detail"]))
+			}
+		}
+		return ret
+	}
+	if got := labels(completions(doc.scopeAt(at(4, 0)))); !reflect.DeepEqual(got, []string{"y : Int", "x : Int"}) {
+		t.Errorf("completions in the loop %v", got)
+	}
+	if got := labels(completions(doc.scopeAt(at(5, 2)))); !reflect.DeepEqual(got, []string{"x : Int"}) {
+		t.Errorf("completions after the loop %v", got)
+	}
+	items := completions(nil)
+	if len(items) != len(keywords)+2 || items[0]["label"] != "assert" {
+		t.Errorf("keywords %v", items)
+	}
+
+	// the protocol, with a fake client
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- serveLSP(serverR, serverW)
+		serverW.Close()
+	}()
+	r := bufio.NewReader(clientR)
+	receive := func() map[string]interface{} {
+		buf, err := readDAPMessage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]interface{}
+		json.Unmarshal(buf, &msg)
+		return msg
+	}
+	id := 0
+	request := func(method string, params interface{}) interface{} {
+		id++
+		writeDAPMessage(clientW, dapObject{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+		msg := receive()
+		if msg["id"] != float64(id) {
+			t.Fatalf("%s: response %v", method, msg)
+		}
+		return msg["result"]
+	}
+	notify := func(method string, params interface{}) {
+		writeDAPMessage(clientW, dapObject{"jsonrpc": "2.0", "method": method, "params": params})
+	}
+	uri := "file:///tmp/loop.imp"
+	caps := request("initialize", dapObject{"capabilities": dapObject{}}).(map[string]interface{})["capabilities"].(map[string]interface{})
+	if caps["hoverProvider"] != true || caps["textDocumentSync"] != float64(1) {
+		t.Errorf("capabilities %v", caps)
+	}
+	notify("initialized", dapObject{})
+	notify("textDocument/didOpen", dapObject{"textDocument": dapObject{"uri": uri, "languageId": "imp", "version": 1, "text": "x := 1;\nprint y;\n"}})
+	diags := receive()["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	if len(diags) != 1 || diags[0].(map[string]interface{})["message"] != "y is not declared" {
+		t.Errorf("diagnostics %v", diags)
+	}
+	notify("textDocument/didChange", dapObject{"textDocument": dapObject{"uri": uri, "version": 2}, "contentChanges": []dapObject{{"text": code}}})
+	if diags := receive()["params"].(map[string]interface{})["diagnostics"].([]interface{}); len(diags) != 0 {
+		t.Errorf("diagnostics %v", diags)
+	}
+	pos := dapObject{"textDocument": dapObject{"uri": uri}, "position": dapObject{"line": 2, "character": 7}}
+	hover := request("textDocument/hover", pos).(map[string]interface{})
+	if hover["contents"].(map[string]interface{})["value"] != "(x+1) : Int" {
+		t.Errorf("hover %v", hover)
+	}
+	pos["position"] = dapObject{"line": 2, "character": 6}
+	def := request("textDocument/definition", pos).(map[string]interface{})
+	if start := def["range"].(map[string]interface{})["start"]; !reflect.DeepEqual(start, map[string]interface{}{"line": float64(0), "character": float64(0)}) {
+		t.Errorf("definition %v", def)
+	}
+	symbols := request("textDocument/documentSymbol", dapObject{"textDocument": dapObject{"uri": uri}}).([]interface{})
+	var names []string
+	for _, s := range symbols {
+		s := s.(map[string]interface{})
+		names = append(names, fmt.Sprintf("%v : %v", s["name"], s["detail"]))
+	}
+	if !reflect.DeepEqual(names, []string{"x : Int", "y : Int", "x : Bool"}) {
+		t.Errorf("symbols %v", names)
+	}
+	// a broken document still completes the variables of its last version
+	notify("textDocument/didChange", dapObject{"textDocument": dapObject{"uri": uri, "version": 3}, "contentChanges": []dapObject{{"text": code + "print "}}})
+	receive()
+	completion := request("textDocument/completion", dapObject{"textDocument": dapObject{"uri": uri}, "position": dapObject{"line": 7, "character": 6}}).([]interface{})
+	if first := completion[0].(map[string]interface{}); first["label"] != "x" {
+		t.Errorf("completion %v", completion)
+	}
+	request("shutdown", nil)
+	notify("exit", nil)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	prog, err := newLocatingParser().parse_fromstring("x := 1;\nwhile x < 3 {\n\tx = x + 1;\n\tb := x == 3;\n};\nif x == 3 {\n\tprint x;\n} else {\n\tskip;\n};\nx := true;\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	trace.out, trace.step = &buf, 0
+	defer func() { trace.out = nil }()
+	captureOutput(func() { prog.eval(newValState()) })
+	trace.out = nil
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 11 {
+		t.Fatalf("trace:\n%s", buf.String())
+	}
+	for i, want := range map[int]string{
+		0:  `{"step":1,"kind":"Decl","line":1,"col":1,"depth":1,"stmt":"x := 1","writes":[{"var":"x","old":null,"new":{"type":"Int","value":1}}]}`,
+		1:  `{"step":2,"kind":"While","line":2,"col":1,"depth":1,"stmt":"while (x<3)","cond":{"type":"Bool","value":true},"branch":"body"}`,
+		2:  `{"step":3,"kind":"Assign","line":3,"col":2,"depth":2,"stmt":"x = (x+1)","writes":[{"var":"x","old":{"type":"Int","value":1},"new":{"type":"Int","value":2}}]}`,
+		8:  `{"step":9,"kind":"IfThenElse","line":6,"col":1,"depth":1,"stmt":"if (x==3)","cond":{"type":"Bool","value":true},"branch":"then"}`,
+		9:  `{"step":10,"kind":"Print","line":7,"col":2,"depth":2,"stmt":"print x","output":"3"}`,
+		10: `{"step":11,"kind":"Decl","line":11,"col":1,"depth":1,"stmt":"x := true","writes":[{"var":"x","old":{"type":"Int","value":3},"new":{"type":"Bool","value":true}}]}`,
+	} {
+		if lines[i] != want {
+			t.Errorf("event %d:\n%s\nwant\n%s", i+1, lines[i], want)
+		}
+	}
+
+	var table bytes.Buffer
+	if err := replayTrace(&buf, &table); err != nil {
+		t.Fatal(err)
+	}
+	want := `step  line  depth  statement      effect
+1     1     1      x := 1         x = 1
+2     2     1      while (x<3)    true -> body
+3     3     2        x = (x+1)    x: 1 -> 2
+4     4     2        b := (x==3)  b = false
+5     2     1      while (x<3)    true -> body
+6     3     2        x = (x+1)    x: 2 -> 3
+7     4     2        b := (x==3)  b = true
+8     2     1      while (x<3)    false -> exit
+9     6     1      if (x==3)      true -> then
+10    7     2        print x      prints 3
+11    11    1      x := true      x: 3 -> true
+`
+	if table.String() != want {
+		t.Errorf("table:\n%s", table.String())
+	}
+	if err := replayTrace(strings.NewReader("{}\nnot json\n"), io.Discard); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("replayTrace() = %v", err)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	source := "x := 0;\nwhile x < 2 {\n\tx = x + 1;\n};\nprint x;\n"
+	prog, err := newLocatingParser().parse_fromstring(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startProfile()
+	defer func() { prof.enabled = false }()
+	// every reading of the clock takes a millisecond
+	var clock time.Time
+	prof.now = func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+	if out := captureOutput(func() { prog.eval(newValState()) }); out != "2\n" {
+		t.Errorf("output %q", out)
+	}
+	prof.enabled = false
+
+	loop := prof.stats[Pos{2, 1}]
+	if loop == nil || loop.count != 1 || loop.iterations != 2 || loop.total != 5*time.Millisecond || loop.self != 3*time.Millisecond {
+		t.Errorf("loop profile %+v", loop)
+	}
+	if body := prof.stats[Pos{3, 2}]; body == nil || body.count != 2 || body.total != 2*time.Millisecond || body.self != body.total {
+		t.Errorf("body profile %+v", body)
+	}
+
+	var folded bytes.Buffer
+	writeFoldedStacks(&folded)
+	want := `line 1: x := 0 1000000
+line 2: while (x<2) 3000000
+line 2: while (x<2);line 3: x = (x+1) 2000000
+line 5: print x 1000000
+`
+	if folded.String() != want {
+		t.Errorf("folded stacks:\n%s", folded.String())
+	}
+
+	var report bytes.Buffer
+	writeProfileReport(&report, 2)
+	want = `hot statements:
+  line  count  total  self  
+     2      1    5ms   3ms  while (x<2)
+     3      2    2ms   2ms  x = (x+1)
+
+hot loops:
+  line  entered  iterations  per entry  total  
+     2        1           2        2.0    5ms  while (x<2)
+`
+	if report.String() != want {
+		t.Errorf("report:\n%s", report.String())
+	}
+
+	var annotated bytes.Buffer
+	writeAnnotatedSource(&annotated, source)
+	want = `  count  self  
+      1   1ms  x := 0;
+      1   3ms  while x < 2 {
+      2   2ms      x = x + 1;
+               };
+      1   1ms  print x;
+`
+	if annotated.String() != want {
+		t.Errorf("annotated source:\n%s", annotated.String())
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	source := "x := 0;\nread x;\nif (x < 3) && (0 < x) {\n\tprint x;\n} else {\n\tskip;\n};\nwhile x < 0 {\n\tx = x + 1;\n};\n"
+	prog, err := newLocatingParser().parse_fromstring(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sites := findCoverSites(prog)
+	if len(sites.stmts) != 7 || len(sites.branches) != 3 {
+		t.Fatalf("%d statements, %d branches", len(sites.stmts), len(sites.branches))
+	}
+	run := func(input string) *coverage {
+		c := newCoverage()
+		oldIn := stdin
+		stdin = strings.NewReader(input)
+		defer func() { stdin = oldIn }()
+		captureOutput(func() { runCovered(prog, c) })
+		return c
+	}
+
+	c := run("2")
+	var summary bytes.Buffer
+	writeCoverageSummary(&summary, sites, c)
+	want := `runs: 1
+statements: 5/7 (71.4%)
+branches: 3/6 (50.0%)
+line 6: not executed: skip
+line 9: not executed: x = (x+1)
+line 3: else not taken: if ((x<3)&&(0<x))
+line 3: short-circuit not taken: ((x<3)&&(0<x))
+line 8: entered not taken: while (x<0)
+`
+	if summary.String() != want {
+		t.Errorf("summary:\n%s", summary.String())
+	}
+
+	// saved counts are merged with those of another run
+	var saved bytes.Buffer
+	if err := writeCoverage(&saved, "test.imp", sites, c); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := readCoverage(&saved, sites)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged.merge(run("5"))
+	if s, _, b, _ := merged.totals(sites); merged.runs != 2 || s != 6 || b != 5 {
+		t.Errorf("merged: %d runs, %d statements, %d branches covered", merged.runs, s, b)
+	}
+
+	var lcov bytes.Buffer
+	writeLCOV(&lcov, "test.imp", sites, merged)
+	want = `TN:
+SF:test.imp
+BRDA:3,0,0,1
+BRDA:3,0,1,1
+BRDA:3,1,0,1
+BRDA:3,1,1,1
+BRDA:8,2,0,0
+BRDA:8,2,1,2
+BRF:6
+BRH:5
+DA:1,2
+DA:2,2
+DA:3,2
+DA:4,1
+DA:6,1
+DA:8,2
+DA:9,0
+LF:7
+LH:6
+end_of_record
+`
+	if lcov.String() != want {
+		t.Errorf("LCOV:\n%s", lcov.String())
+	}
+
+	var page bytes.Buffer
+	writeCoverageHTML(&page, "test.imp", source, sites, merged)
+	for _, want := range []string{
+		"statements 6/7 (85.7%), branches 5/6 (83.3%)",
+		`<tr class="covered"><td class="line">3</td><td class="count">2</td><td class="source">if (x &lt; 3) &amp;&amp; (0 &lt; x) {</td>`,
+		`<tr class="partial"><td class="line">8</td><td class="count">2</td><td class="source">while x &lt; 0 {</td><td class="branches">while (x&lt;0): <span class="untaken">entered 0</span>, skipped 2</td></tr>`,
+		`<tr class="missed"><td class="line">9</td><td class="count">0</td>`,
+	} {
+		if !strings.Contains(page.String(), want) {
+			t.Errorf("HTML report does not contain %s:\n%s", want, page.String())
+		}
+	}
+
+	// counts of another program are rejected
+	other, _ := newLocatingParser().parse_fromstring("y := 1;\n\tprint y;\n")
+	saved.Reset()
+	writeCoverage(&saved, "other.imp", findCoverSites(other), newCoverage())
+	if _, err := readCoverage(&saved, sites); err == nil {
+		t.Error("readCoverage() accepted the coverage of another program")
+	}
+}
+
+func TestImpTestRunner(t *testing.T) {
+	sum, err := runImpTests([]string{filepath.Join("testdata", "programs")}, false, false, io.Discard)
+	if err != nil || sum.passed != 6 || sum.failed != 0 || sum.skipped != 0 {
+		t.Errorf("testdata/programs: %s, %v", sum, err)
+	}
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	write("block.imp", "print 1;\nprint 2;\n// output:\n// 1\n// 3\n")
+	write("golden.imp", "print true;\n")
+	write("golden.out", "true\nfalse\n")
+	write("none.imp", "print 1;\n")
+	write("illtyped.imp", "x := 1 + true;\n// output:\n")
+	var out bytes.Buffer
+	sum, err = runImpTests([]string{dir}, false, false, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.String() != "0 passed, 3 failed, 1 skipped" {
+		t.Errorf("summary %s", sum)
+	}
+	for _, want := range []string{
+		"FAIL " + filepath.Join(dir, "block.imp") + `: output line 2: want "3", got "2"`,
+		"FAIL " + filepath.Join(dir, "golden.imp") + `: output line 2: missing "false"`,
+		"FAIL " + filepath.Join(dir, "illtyped.imp") + ": " + filepath.Join(dir, "illtyped.imp") + " contains type errors",
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("report does not contain %s:\n%s", want, out.String())
+		}
+	}
+
+	// -update rewrites the comment block and the golden file
+	sum, err = runImpTests([]string{dir}, true, false, io.Discard)
+	if err != nil || sum.updated != 2 || sum.failed != 1 {
+		t.Errorf("update: %s, %v", sum, err)
+	}
+	if got := read("block.imp"); got != "print 1;\nprint 2;\n// output:\n// 1\n// 2\n" {
+		t.Errorf("updated block.imp:\n%s", got)
+	}
+	if got := read("golden.out"); got != "true\n" {
+		t.Errorf("updated golden.out:\n%s", got)
+	}
+	os.Remove(filepath.Join(dir, "illtyped.imp"))
+	if sum, _ = runImpTests([]string{dir}, false, false, io.Discard); sum.String() != "2 passed, 0 failed, 1 skipped" {
+		t.Errorf("after update: %s", sum)
+	}
+}
+
+func TestTestBlocks(t *testing.T) {
+	code := "x := 1;\ntest \"passes\" {\n\ty := 2;\n\tassert y == 2;\n};\ntest \"fails\" {\n\ty := 2;\n\tassert !(y + 1 == 3) && true;\n\tprint y;\n\tassert y < 1;\n};\nprint x;\n"
+	prog, err := newLocatingParser().parse_fromstring(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prog.check(newTyState()) {
+		t.Fatal("program does not type-check")
+	}
+	// tests are skipped
+	if got := runOutput(prog); got != "1\n" {
+		t.Errorf("program printed %q", got)
+	}
+	if got, err := newParser().parse_fromstring(prog.pretty()); err != nil || got.pretty() != prog.pretty() {
+		t.Errorf("pretty print does not parse back: %v\n%s", err, prog.pretty())
+	}
+	// tests do not see the variables of the program
+	other, _ := newParser().parse_fromstring("x := 1; test \"t\" { print x; };")
+	if other.check(newTyState()) {
+		t.Error("test using a variable of the program type-checks")
+	}
+
+	tests := testBlocks(prog)
+	if len(tests) != 2 || tests[0].pos != (Pos{2, 1}) || tests[1].stmt.(TestBlock).name != "fails" {
+		t.Fatalf("test blocks %v", tests)
+	}
+	out, errs := runCaptured(tests[1].stmt.(TestBlock).body, nil)
+	want := "line 8: assertion failed: (!((y+1)==3)&&true) with !((y+1)==3) = false\n2\nline 10: assertion failed: (y<1) with y = 2\n"
+	if errs != 2 || out != want {
+		t.Errorf("%d errors, output:\n%s", errs, out)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tests.imp")
+	os.WriteFile(path, []byte(code), 0o644)
+	var report bytes.Buffer
+	sum, err := runImpTests([]string{dir}, false, true, &report)
+	if err != nil || sum.String() != "1 passed, 1 failed, 0 skipped" {
+		t.Errorf("summary %s, %v", sum, err)
+	}
+	want = "ok   " + path + ": test \"passes\"\nFAIL " + path + ": test \"fails\" at line 6\n" +
+		"    line 8: assertion failed: (!((y+1)==3)&&true) with !((y+1)==3) = false\n    2\n    line 10: assertion failed: (y<1) with y = 2\n"
+	if report.String() != want {
+		t.Errorf("report:\n%s", report.String())
+	}
+}
+
+func TestMutation(t *testing.T) {
+	prog, err := newLocatingParser().parse_fromstring("x := 1;\nif x < 2 {\n\tprint x + 1;\n} else {\n\tskip;\n};\nassert x == 1;\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range mutants(prog, Pos{}) {
+		got = append(got, fmt.Sprintf("%s: %s", m.pos, m.desc))
+	}
+	want := []string{
+		"line 2: deleted if (x<2)",
+		"line 2: swapped the branches of if (x<2)",
+		"line 2: (x<2) replaced by !(x<2)",
+		"line 2: (x<2) replaced by (x==2)",
+		"line 3: deleted print (x+1)",
+		"line 3: (x+1) replaced by (x*1)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mutants:\n%s", strings.Join(got, "\n"))
+	}
+	// (true==false) has no well-typed mutant
+	m := mutants(Print{equal(Bool(true), Bool(false))}, Pos{})
+	if len(m) != 2 || m[1].prog.check(newTyState()) {
+		t.Errorf("mutants %v", m)
+	}
+
+	// runs are limited, and report the line of a failed assertion
+	loop, _ := newLocatingParser().parse_fromstring("while true { skip; };")
+	if _, _, done := runLimited(loop, nil, 100); done {
+		t.Error("infinite loop terminated")
+	}
+	out, errs, done := runLimited(prog, nil, 100)
+	if out != "2\n" || errs != 0 || !done {
+		t.Errorf("run printed %q with %d errors, terminated: %v", out, errs, done)
+	}
+	failing, _ := newLocatingParser().parse_fromstring("x := 1;\n\nassert x == 2;")
+	if out, errs, _ := runLimited(failing, nil, 100); out != "line 3: assertion failed: (x==2) with x = 1\n" || errs != 1 {
+		t.Errorf("run printed %q with %d errors", out, errs)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.imp"), []byte("x := 1;\nif x < 2 {\n\tprint x + 1;\n} else {\n\tprint 2;\n};\n// output:\n// 2\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.imp"), []byte("test \"loop\" {\n\ti := 0;\n\twhile i < 3 {\n\t\ti = i + 1;\n\t};\n\tassert i == 3;\n};\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "c.imp"), []byte("print 1;\n// output:\n// 2\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "d.imp"), []byte("print 1;\n"), 0o644)
+	var report bytes.Buffer
+	sum, err := runMutationTests([]string{dir}, 1000, true, &report)
+	if err != nil || sum.String() != "12 mutants, 8 killed, 4 survived: score 66.7%" {
+		t.Errorf("summary %s, %v", sum, err)
+	}
+	a, b, c := filepath.Join(dir, "a.imp"), filepath.Join(dir, "b.imp"), filepath.Join(dir, "c.imp")
+	wantReport := "KILLED   " + a + ": line 2: deleted if (x<2), by output\n" +
+		"SURVIVED " + a + ": line 2: swapped the branches of if (x<2)\n"
+	if !strings.HasPrefix(report.String(), wantReport) {
+		t.Errorf("report:\n%s", report.String())
+	}
+	for _, line := range []string{
+		"KILLED   " + b + ": line 3: (i<3) replaced by (i==3), by test \"loop\"\n",
+		"KILLED   " + b + ": line 4: deleted i = (i+1), by timeout\n",
+		"SKIP " + c + ": tests fail without mutations: output\n",
+	} {
+		if !strings.Contains(report.String(), line) {
+			t.Errorf("report lacks %q:\n%s", line, report.String())
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	code := "// shadowing\nx := 1;\nc := true;\nif c {\n\tx := true; // inner\n\tprint x;\n} else {\n\tprint (x);\n\tx = x + 1;\n};\nprint x;\n"
+	tests := []struct {
+		name      string
+		code      string
+		line, col int
+		to        string
+		want      string // renamed source or error
+	}{
+		{"outer", code, 9, 6, "total",
+			"// shadowing\ntotal := 1;\nc := true;\nif c {\n\tx := true; // inner\n\tprint x;\n} else {\n\tprint (total);\n\ttotal = total + 1;\n};\nprint total;\n"},
+		{"inner", code, 5, 2, "flag",
+			"// shadowing\nx := 1;\nc := true;\nif c {\n\tflag := true; // inner\n\tprint flag;\n} else {\n\tprint (x);\n\tx = x + 1;\n};\nprint x;\n"},
+		{"same name", code, 2, 1, "x", code},
+		{"captured use", "x := 1;\nif true {\n\ty := 2;\n\tprint x;\n} else {\n\tskip;\n};\n", 1, 1, "y",
+			"x on line 4 would refer to the y declared on line 3"},
+		{"capturing declaration", "x := 1;\nif true {\n\ty := 2;\n\tprint x;\n} else {\n\tskip;\n};\n", 3, 2, "x",
+			"x on line 4 would refer to the renamed y declared on line 3"},
+		{"redeclaration", code, 3, 1, "x", "x on line 8 would refer to the renamed c declared on line 3"},
+		{"test block", "x := 1;\ntest \"t\" { x := 2; print x; };\nprint x;\n", 2, 12, "y",
+			"x := 1;\ntest \"t\" { y := 2; print y; };\nprint x;\n"},
+		// the inner declaration updates the outer x at runtime
+		{"updated outer", "x := 1;\nif true { x := 2; } else { print 0; };\nprint x;\n", 1, 1, "y",
+			"the declaration of x on line 2 updates the x declared on line 1 at runtime"},
+		{"updating inner", "x := 1;\nif true { x := 2; } else { print 0; };\nprint x;\n", 2, 11, "y",
+			"the declaration of x on line 2 updates the x declared on line 1 at runtime"},
+		{"new update", "x := 1;\nif true { y := 2; } else { print 0; };\nprint x;\n", 1, 1, "y",
+			"the declaration of y on line 2 would update the y declared on line 1 at runtime"},
+		{"other type", "x := 1;\nif true { x := false; } else { print 0; };\nprint x;\n", 1, 1, "y",
+			"y := 1;\nif true { x := false; } else { print 0; };\nprint y;\n"},
+		{"keyword", code, 2, 1, "while", "while is a keyword"},
+		{"not a name", code, 2, 1, "X", "X is not a variable name"},
+		{"not a variable", code, 4, 1, "y", "no declared variable at line 4"},
+		{"type error", "x := 1;\nprint x + true;\n", 1, 1, "y", "line 2: (x+true): operands of + must be Int"},
+	}
+	for _, tt := range tests {
+		doc := &document{text: tt.code}
+		got, _, err := rename(tt.code, doc.offset(lspPosition{tt.line - 1, tt.col - 1}), tt.to)
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got\n%s", tt.name, got)
+		}
+	}
+}
+
+// generated programs type-check, parse back from their pretty print and run
+// without undefined values or evaluation errors
+func TestGenerator(t *testing.T) {
+	for seed := int64(1); seed <= 200; seed++ {
+		prog := newGenerator(seed).program(8)
+		src := prog.pretty()
+		if !strings.HasSuffix(src, ";") {
+			src += ";"
+		}
+		if !prog.check(newTyState()) {
+			t.Fatalf("seed %d: program does not type-check:\n%s", seed, src)
+		}
+		if got, err := newParser().parse_fromstring(src); err != nil || !reflect.DeepEqual(got, prog) {
+			t.Fatalf("seed %d: pretty print does not parse back: %v\n%s", seed, err, src)
+		}
+		if v := soundnessViolation(prog, 2000); v != "" {
+			t.Fatalf("seed %d: %s in\n%s", seed, v, src)
+		}
+	}
+	// the same seed gives the same program
+	if newGenerator(7).program(8).pretty() != newGenerator(7).program(8).pretty() {
+		t.Error("generator is not deterministic")
+	}
+}
+
+func TestShrink(t *testing.T) {
+	prints := func(stmt Stmt) bool { return runOutput(stmt) != "" }
+	shrunk := 0
+	for seed := int64(1); seed <= 20; seed++ {
+		prog := newGenerator(seed).program(8)
+		if !prints(prog) {
+			continue
+		}
+		shrunk++
+		if got := shrink(prog, prints).pretty(); got != "print 0" && got != "print false" {
+			t.Errorf("seed %d: shrunk to\n%s", seed, got)
+		}
+	}
+	if shrunk == 0 {
+		t.Error("no generated program prints")
+	}
+
+	// shrinking keeps programs well-typed: x must stay declared and an int
+	prints3 := func(stmt Stmt) bool { return strings.Contains(runOutput(stmt), "3") }
+	prog, _ := newParser().parse_fromstring("x := 1 + 2; y := true; if y { print x * 1; } else { skip; }; print false;")
+	if got := shrink(prog, prints3); got.pretty() != "x := (1+2);\nprint x;" {
+		t.Errorf("shrunk to\n%s", got.pretty())
+	}
+}
+
+// Fuzzing: go test -fuzz=FuzzParser, seeded with the programs of the tests
+// and the example .imp files
+
+func fuzzSeeds(f *testing.F) {
+	for _, tt := range parserGoodTests {
+		f.Add(tt.code)
+	}
+	for _, tt := range parserBadTests {
+		f.Add(tt.code)
+	}
+	for _, tt := range typeCheckerTests {
+		f.Add(tt.code)
+	}
+	for _, tt := range evaluatorTests {
+		f.Add(tt.code)
+	}
+	files, err := findImpFiles([]string{"."})
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		code, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(code))
+	}
+}
+
+// the lexer terminates, every token advancing through the source
+func FuzzLexer(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, code string) {
+		l := newLexer(code)
+		for n := 0; l.tokType != TokEOF; n++ {
+			if n > len(code) {
+				t.Fatalf("more tokens than characters in %q", code)
+			}
+			start := l.cursor
+			if ok, _ := l.next(); !ok {
+				return
+			}
+			if l.cursor <= start && l.tokType != TokEOF {
+				t.Fatalf("token %q at %d does not advance in %q", l.tok.String(), start, code)
+			}
+		}
+	})
+}
+
+// parsing does not panic, and a parsed program's pretty print parses back to
+// the same program
+func FuzzParser(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, code string) {
+		newRecordingParser().parse_fromstring(code)
+		prog, err := newParser().parse_fromstring(code)
+		if err != nil {
+			return
+		}
+		// a program is a sequence of statements ending in ";"
+		pretty := prog.pretty()
+		if !strings.HasSuffix(pretty, ";") {
+			pretty += ";"
+		}
+		again, err := newParser().parse_fromstring(pretty)
+		if err != nil {
+			t.Fatalf("pretty print of %q does not parse: %s\n%s", code, err, pretty)
+		}
+		if !reflect.DeepEqual(prog, again) {
+			t.Fatalf("pretty print of %q parses to another program:\n%s\n%s", code, pretty, again.pretty())
+		}
+	})
+}
+
+// evaluating a well-typed program without read statements never yields an
+// undefined value or an evaluation error. runs at most 1000 small steps
+func FuzzEvaluator(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, code string) {
+		prog, err := newParser().parse_fromstring(code)
+		if err != nil || strings.Contains(prog.pretty(), "read ") || !prog.check(newTyState()) {
+			return
+		}
+		if v := soundnessViolation(prog, 1000); v != "" {
+			t.Fatalf("%s in\n%s", v, prog.pretty())
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// Interval domain
+//
+// An abstract integer is an interval [lo, hi] containing all possible values.
+// math.MinInt and math.MaxInt stand for -infinity and +infinity, so the
+// interval [-inf, +inf] is top. Intervals with lo > hi are empty (bottom).
+// Since Plus and Mult wrap around on overflow, an operation that may overflow
+// can produce any value.
+
+type Interval struct {
+	lo, hi int
+}
+
+const (
+	negInf = math.MinInt
+	posInf = math.MaxInt
+)
+
+type IntervalDomain struct{}
+
+func (IntervalDomain) bottom() AbsInt {
+	return Interval{1, 0}
+}
+
+func (IntervalDomain) top() AbsInt {
+	return Interval{negInf, posInf}
+}
+
+func (IntervalDomain) constant(n int) AbsInt {
+	return Interval{n, n}
+}
+
+func (IntervalDomain) isBottom(a AbsInt) bool {
+	return a.(Interval).empty()
+}
+
+func (x Interval) empty() bool {
+	return x.lo > x.hi
+}
+
+func (IntervalDomain) leq(a, b AbsInt) bool {
+	x, y := a.(Interval), b.(Interval)
+	return x.empty() || y.lo <= x.lo && x.hi <= y.hi
+}
+
+func (IntervalDomain) join(a, b AbsInt) AbsInt {
+	x, y := a.(Interval), b.(Interval)
+	if x.empty() {
+		return y
+	} else if y.empty() {
+		return x
+	}
+	return Interval{minInt(x.lo, y.lo), maxInt(x.hi, y.hi)}
+}
+
+func meet(x, y Interval) Interval {
+	return Interval{maxInt(x.lo, y.lo), minInt(x.hi, y.hi)}
+}
+
+// unstable bounds jump to infinity
+func (IntervalDomain) widen(a, b AbsInt) AbsInt {
+	x, y := a.(Interval), b.(Interval)
+	if x.empty() {
+		return y
+	} else if y.empty() {
+		return x
+	}
+	ret := x
+	if y.lo < x.lo {
+		ret.lo = negInf
+	}
+	if y.hi > x.hi {
+		ret.hi = posInf
+	}
+	return ret
+}
+
+func (d IntervalDomain) plus(a, b AbsInt) AbsInt {
+	x, y := a.(Interval), b.(Interval)
+	if x.empty() || y.empty() {
+		return d.bottom()
+	}
+	lo, okLo := addBound(x.lo, y.lo)
+	hi, okHi := addBound(x.hi, y.hi)
+	if !okLo || !okHi {
+		return d.top()
+	}
+	return Interval{lo, hi}
+}
+
+func (d IntervalDomain) mult(a, b AbsInt) AbsInt {
+	x, y := a.(Interval), b.(Interval)
+	if x.empty() || y.empty() {
+		return d.bottom()
+	}
+	ret := Interval{posInf, negInf}
+	for _, i := range []int{x.lo, x.hi} {
+		for _, j := range []int{y.lo, y.hi} {
+			p, ok := multBound(i, j)
+			if !ok {
+				return d.top()
+			}
+			ret.lo, ret.hi = minInt(ret.lo, p), maxInt(ret.hi, p)
+		}
+	}
+	return ret
+}
+
+func (d IntervalDomain) mayOverflow(op Exp, a, b AbsInt) bool {
+	x, y := a.(Interval), b.(Interval)
+	if x.empty() || y.empty() {
+		return false
+	}
+	switch op.(type) {
+	case Plus:
+		_, okLo := addBound(x.lo, y.lo)
+		_, okHi := addBound(x.hi, y.hi)
+		return !okLo || !okHi
+	case Mult:
+		for _, i := range []int{x.lo, x.hi} {
+			for _, j := range []int{y.lo, y.hi} {
+				if _, ok := multBound(i, j); !ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (IntervalDomain) less(a, b AbsInt) AbsBool {
+	x, y := a.(Interval), b.(Interval)
+	switch {
+	case x.empty() || y.empty():
+		return boolBottom
+	case x.hi < y.lo:
+		return boolTrue
+	case x.lo >= y.hi:
+		return boolFalse
+	}
+	return boolTop
+}
+
+func (IntervalDomain) equal(a, b AbsInt) AbsBool {
+	x, y := a.(Interval), b.(Interval)
+	switch {
+	case x.empty() || y.empty():
+		return boolBottom
+	case x.lo == x.hi && x == y && x.lo != negInf && x.lo != posInf:
+		return boolTrue
+	case meet(x, y).empty():
+		return boolFalse
+	}
+	return boolTop
+}
+
+func (IntervalDomain) assumeLess(a, b AbsInt, truth bool) (AbsInt, AbsInt) {
+	x, y := a.(Interval), b.(Interval)
+	if truth {
+		// x < y
+		return meet(x, Interval{negInf, dec(y.hi)}), meet(y, Interval{inc(x.lo), posInf})
+	}
+	// x >= y
+	return meet(x, Interval{y.lo, posInf}), meet(y, Interval{negInf, x.hi})
+}
+
+func (IntervalDomain) assumeEqual(a, b AbsInt, truth bool) (AbsInt, AbsInt) {
+	x, y := a.(Interval), b.(Interval)
+	if truth {
+		m := meet(x, y)
+		return m, m
+	}
+	return exclude(x, y), exclude(y, x)
+}
+
+// remove the value of a singleton interval y from the bounds of x
+func exclude(x, y Interval) Interval {
+	if y.lo != y.hi || y.lo == negInf || y.lo == posInf {
+		return x
+	}
+	if x.lo == y.lo {
+		x.lo = inc(x.lo)
+	}
+	if x.hi == y.lo {
+		x.hi = dec(x.hi)
+	}
+	return x
+}
+
+func (IntervalDomain) show(a AbsInt) string {
+	x := a.(Interval)
+	if x.empty() {
+		return "bottom"
+	}
+	return "[" + showBound(x.lo) + ", " + showBound(x.hi) + "]"
+}
+
+// Bound arithmetic
+
+func showBound(n int) string {
+	switch n {
+	case negInf:
+		return "-inf"
+	case posInf:
+		return "+inf"
+	}
+	return strconv.Itoa(n)
+}
+
+func isInf(n int) bool {
+	return n == negInf || n == posInf
+}
+
+func inc(n int) int {
+	if isInf(n) {
+		return n
+	}
+	return n + 1
+}
+
+func dec(n int) int {
+	if isInf(n) {
+		return n
+	}
+	return n - 1
+}
+
+// sum of two bounds. false if it may not fit into an int
+func addBound(x, y int) (int, bool) {
+	if isInf(x) || isInf(y) {
+		return 0, false
+	}
+	s := x + y
+	if (x > 0 && y > 0 && s < 0) || (x < 0 && y < 0 && s >= 0) {
+		return 0, false
+	}
+	return s, !isInf(s)
+}
+
+// product of two bounds. false if it may not fit into an int
+func multBound(x, y int) (int, bool) {
+	if x == 0 || y == 0 {
+		return 0, true
+	}
+	if isInf(x) || isInf(y) {
+		return 0, false
+	}
+	p := x * y
+	if p/y != x {
+		return 0, false
+	}
+	return p, !isInf(p)
+}
+
+func minInt(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+func maxInt(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
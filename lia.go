@@ -0,0 +1,377 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Decision procedure for linear integer arithmetic
+//
+// satisfiable() decides whether a quantifier-free formula over Int and Bool
+// variables has a model, treating integers as unbounded. The formula is split
+// lazily into conjunctions of literals: boolean literals are checked directly,
+// arithmetic literals become linear constraints t <= 0 which are decided by
+// Fourier-Motzkin elimination with integer tightening. A model is built by
+// back-substitution.
+//
+// Fourier-Motzkin is complete for the rationals but not for the integers. If
+// the rational shadow has a solution but back-substitution finds no integer
+// one, the result is unknown. Products of two non-constant terms are treated
+// as opaque integer variables, so models of nonlinear formulas may be spurious.
+
+type satResult int
+
+const (
+	unsat satResult = iota
+	sat
+	satUnknown
+)
+
+type model struct {
+	ints  map[string]int
+	bools map[string]bool
+}
+
+// linear term: sum of coef[x] * x, plus c. coefficients are unbounded, as
+// elimination multiplies them, and so are the values of the variables
+type linTerm struct {
+	coef map[string]*big.Int
+	c    *big.Int
+}
+
+func bigInt(n int) *big.Int {
+	return big.NewInt(int64(n))
+}
+
+func constTerm(c *big.Int) linTerm {
+	return linTerm{make(map[string]*big.Int), c}
+}
+
+// t + k*u
+func (t linTerm) add(u linTerm, k *big.Int) linTerm {
+	ret := constTerm(new(big.Int).Add(t.c, new(big.Int).Mul(k, u.c)))
+	for x, a := range t.coef {
+		ret.coef[x] = a
+	}
+	for x, a := range u.coef {
+		sum := new(big.Int).Mul(k, a)
+		if b, ok := ret.coef[x]; ok {
+			sum.Add(sum, b)
+		}
+		if sum.Sign() == 0 {
+			delete(ret.coef, x)
+		} else {
+			ret.coef[x] = sum
+		}
+	}
+	return ret
+}
+
+func (t linTerm) scale(k *big.Int) linTerm {
+	return constTerm(new(big.Int)).add(t, k)
+}
+
+// t + n
+func (t linTerm) plus(n int) linTerm {
+	return t.add(constTerm(bigInt(n)), bigInt(1))
+}
+
+func linearize(e Exp) linTerm {
+	switch e := e.(type) {
+	case Num:
+		return constTerm(bigInt(int(e)))
+	case Var:
+		return linTerm{map[string]*big.Int{string(e): bigInt(1)}, new(big.Int)}
+	case Plus:
+		return linearize(e[0]).add(linearize(e[1]), bigInt(1))
+	case Mult:
+		x, y := linearize(e[0]), linearize(e[1])
+		if len(x.coef) == 0 {
+			return y.scale(x.c)
+		} else if len(y.coef) == 0 {
+			return x.scale(y.c)
+		}
+		// nonlinear: the product is an unknown integer
+		return linTerm{map[string]*big.Int{e.pretty(): bigInt(1)}, new(big.Int)}
+	}
+	return constTerm(new(big.Int))
+}
+
+// Splitting into conjunctions of literals
+
+// a formula that must hold (pos) or must not hold (!pos)
+type literal struct {
+	e   Exp
+	pos bool
+}
+
+type solver struct {
+	types   TyState // types of the free variables
+	bools   map[string]bool
+	cons    []linTerm // constraints t <= 0
+	unknown bool      // some conjunction could not be decided
+	model   model
+}
+
+// types gives the type of every free variable of f
+func satisfiable(f Exp, types TyState) (satResult, model) {
+	s := &solver{types: types, bools: make(map[string]bool)}
+	switch {
+	case s.search([]literal{{f, true}}):
+		return sat, s.model
+	case s.unknown:
+		return satUnknown, model{}
+	}
+	return unsat, model{}
+}
+
+// search for a model of the conjunction of todo and the current literals
+func (s *solver) search(todo []literal) bool {
+	if len(todo) == 0 {
+		res, ints := fourierMotzkin(s.cons)
+		switch res {
+		case sat:
+			bools := make(map[string]bool, len(s.bools))
+			for x, b := range s.bools {
+				bools[x] = b
+			}
+			s.model = model{ints, bools}
+			return true
+		case satUnknown:
+			s.unknown = true
+		}
+		return false
+	}
+	l, rest := todo[len(todo)-1], todo[:len(todo)-1]
+	// continue with more literals, or alternatively with others
+	with := func(ls ...literal) bool {
+		return s.search(append(append([]literal(nil), rest...), ls...))
+	}
+	either := func(a, b literal) bool {
+		return with(a) || with(b)
+	}
+	switch e := l.e.(type) {
+	case Bool:
+		return bool(e) == l.pos && with()
+	case Var:
+		if b, ok := s.bools[string(e)]; ok {
+			return b == l.pos && with()
+		}
+		s.bools[string(e)] = l.pos
+		if with() {
+			return true
+		}
+		delete(s.bools, string(e))
+		return false
+	case Not:
+		return with(literal{e.exp, !l.pos})
+	case And:
+		if l.pos {
+			return with(literal{e[0], true}, literal{e[1], true})
+		}
+		return either(literal{e[0], false}, literal{e[1], false})
+	case Or:
+		if l.pos {
+			return either(literal{e[0], true}, literal{e[1], true})
+		}
+		return with(literal{e[0], false}, literal{e[1], false})
+	case Implies:
+		if l.pos {
+			return either(literal{e[0], false}, literal{e[1], true})
+		}
+		return with(literal{e[0], true}, literal{e[1], false})
+	case Less:
+		x, y := linearize(e[0]), linearize(e[1])
+		if l.pos {
+			// x - y + 1 <= 0
+			return s.constrain(rest, x.add(y, bigInt(-1)).plus(1))
+		}
+		// y - x <= 0
+		return s.constrain(rest, y.add(x, bigInt(-1)))
+	case Equal:
+		if e[0].infer(s.types) == TyBool {
+			a, b := e[0], e[1]
+			if l.pos {
+				return either(literal{and(a, b), true}, literal{and(not(a), not(b)), true})
+			}
+			return either(literal{and(a, not(b)), true}, literal{and(not(a), b), true})
+		}
+		d := linearize(e[0]).add(linearize(e[1]), bigInt(-1))
+		if l.pos {
+			return s.constrain(rest, d, d.scale(bigInt(-1)))
+		}
+		// d < 0 or d > 0
+		return s.constrain(rest, d.plus(1)) ||
+			s.constrain(rest, d.scale(bigInt(-1)).plus(1))
+	}
+	// quantifiers are not supported
+	s.unknown = true
+	return false
+}
+
+// search with additional constraints
+func (s *solver) constrain(todo []literal, ts ...linTerm) bool {
+	n := len(s.cons)
+	s.cons = append(s.cons, ts...)
+	ok := s.search(todo)
+	s.cons = s.cons[:n]
+	return ok
+}
+
+// Fourier-Motzkin elimination
+
+// give up on conjunctions that grow beyond this number of constraints
+const maxConstraints = 5000
+
+// a variable and the constraints bounding it when it was eliminated
+type elimStep struct {
+	x    string
+	cons []linTerm
+}
+
+// decide a conjunction of constraints t <= 0 over the integers. a model with
+// a variable beyond the range of int is unknown
+func fourierMotzkin(cons []linTerm) (satResult, map[string]int) {
+	var steps []elimStep
+	for {
+		var next []linTerm
+		for _, t := range cons {
+			t = tighten(t)
+			if len(t.coef) == 0 {
+				if t.c.Sign() > 0 {
+					return unsat, nil
+				}
+				continue
+			}
+			next = append(next, t)
+		}
+		cons = next
+		if len(cons) == 0 {
+			break
+		}
+		if len(cons) > maxConstraints {
+			return satUnknown, nil
+		}
+		x := cheapestVar(cons)
+		var lower, upper, keep []linTerm
+		for _, t := range cons {
+			switch a := t.coef[x]; {
+			case a == nil:
+				keep = append(keep, t)
+			case a.Sign() > 0:
+				upper = append(upper, t)
+			default:
+				lower = append(lower, t)
+			}
+		}
+		steps = append(steps, elimStep{x, append(append([]linTerm(nil), lower...), upper...)})
+		// a*x + p <= 0 and -b*x + q <= 0 imply b*p + a*q <= 0
+		for _, u := range upper {
+			for _, l := range lower {
+				keep = append(keep, u.scale(new(big.Int).Neg(l.coef[x])).add(l, u.coef[x]))
+			}
+		}
+		cons = keep
+	}
+
+	// back-substitution, in reverse order of elimination. nil bounds are
+	// infinite
+	vals := make(map[string]*big.Int)
+	for i := len(steps) - 1; i >= 0; i-- {
+		x := steps[i].x
+		var lo, hi *big.Int
+		for _, t := range steps[i].cons {
+			r := new(big.Int).Set(t.c)
+			for y, b := range t.coef {
+				if v, ok := vals[y]; ok && y != x {
+					r.Add(r, new(big.Int).Mul(b, v))
+				}
+			}
+			if a := t.coef[x]; a.Sign() > 0 {
+				// x <= floor(-r / a)
+				if b := floorDiv(new(big.Int).Neg(r), a); hi == nil || b.Cmp(hi) < 0 {
+					hi = b
+				}
+			} else if b := ceilDiv(r, new(big.Int).Neg(a)); lo == nil || b.Cmp(lo) > 0 {
+				lo = b
+			}
+		}
+		switch {
+		case lo != nil && hi != nil && lo.Cmp(hi) > 0:
+			// the rational solution has no integer counterpart
+			return satUnknown, nil
+		case lo != nil && lo.Sign() > 0:
+			vals[x] = lo
+		case hi != nil && hi.Sign() < 0:
+			vals[x] = hi
+		default:
+			vals[x] = new(big.Int)
+		}
+	}
+	ret := make(map[string]int, len(vals))
+	for x, v := range vals {
+		switch {
+		case v.IsInt64():
+			ret[x] = int(v.Int64())
+		case !strings.HasPrefix(x, "("):
+			return satUnknown, nil
+		}
+		// a nonlinear product may be beyond the range, it is not part of
+		// the model
+	}
+	return sat, ret
+}
+
+// divide by the gcd of the coefficients, rounding the constant up
+func tighten(t linTerm) linTerm {
+	g := new(big.Int)
+	for _, a := range t.coef {
+		g.GCD(nil, nil, g, new(big.Int).Abs(a))
+	}
+	if g.Cmp(bigInt(1)) <= 0 {
+		return t
+	}
+	ret := constTerm(ceilDiv(t.c, g))
+	for x, a := range t.coef {
+		ret.coef[x] = new(big.Int).Quo(a, g)
+	}
+	return ret
+}
+
+// the variable whose elimination creates the fewest new constraints
+func cheapestVar(cons []linTerm) string {
+	lower, upper := make(map[string]int), make(map[string]int)
+	var vars []string
+	for _, t := range cons {
+		for x, a := range t.coef {
+			if lower[x] == 0 && upper[x] == 0 {
+				vars = append(vars, x)
+			}
+			if a.Sign() > 0 {
+				upper[x]++
+			} else {
+				lower[x]++
+			}
+		}
+	}
+	// deterministic choice among equally cheap variables
+	sort.Strings(vars)
+	best := vars[0]
+	for _, x := range vars {
+		if lower[x]*upper[x] < lower[best]*upper[best] {
+			best = x
+		}
+	}
+	return best
+}
+
+// a / b rounded down, for b > 0: Euclidean division
+func floorDiv(a, b *big.Int) *big.Int {
+	return new(big.Int).Div(a, b)
+}
+
+// a / b rounded up, for b > 0
+func ceilDiv(a, b *big.Int) *big.Int {
+	return new(big.Int).Neg(floorDiv(new(big.Int).Neg(a), b))
+}
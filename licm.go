@@ -0,0 +1,177 @@
+package main
+
+import "strconv"
+
+// Loop-invariant code motion
+//
+// Expressions in a while loop (its condition and body) whose variables are
+// neither declared nor assigned anywhere in the body evaluate to the same value
+// on every iteration. They are computed once into a fresh variable declared
+// right before the loop, i.e. in the scope enclosing the loop, so the
+// expression's variables resolve to the same bindings as inside the loop.
+// Inner loops are processed first, and the temporaries they declare move on
+// before the outer loop if their values are invariant there as well.
+
+type hoister struct {
+	names   map[string]bool // all variable names in the program
+	count   int             // number of temporaries so far
+	hoisted map[string]bool // names of the temporaries
+	written map[string]bool // variables written by the current loop body
+	decls   []Stmt          // temporaries of the current loop
+	temps   map[Exp]string  // hoisted expressions of the current loop
+}
+
+// hoist loop invariants out of all loops of a well-typed program
+func hoistInvariants(prog Program) Program {
+	h := &hoister{names: make(map[string]bool), hoisted: make(map[string]bool)}
+	mapStmtVars(prog, func(name string) string {
+		h.names[name] = true
+		return name
+	})
+	return (Program)(h.stmt(prog))
+}
+
+func (h *hoister) stmt(stmt Stmt) Stmt {
+	switch stmt := stmt.(type) {
+	case Seq:
+		return Seq{h.stmt(stmt[0]), h.stmt(stmt[1])}
+	case IfThenElse:
+		return IfThenElse{stmt.cond, h.stmt(stmt.thenStmt), h.stmt(stmt.elseStmt)}
+	case While:
+		body := h.stmt(stmt.body)
+		h.written = writtenVars(body)
+		h.decls = nil
+		h.temps = make(map[Exp]string)
+		body = h.lift(body)
+		loop := While{h.exp(stmt.cond), mapStmtExps(body, h.exp), stmt.inv}
+		if h.decls == nil {
+			return loop
+		}
+		return seq(h.decls[0], append(h.decls[1:], loop)...)
+	case Located:
+		return Located{stmt.pos, h.stmt(stmt.stmt)}
+	default:
+		return stmt
+	}
+}
+
+// move the temporaries of inner loops that are invariant in the current
+// loop out of its body. the ones left in the bodies of inner loops depend on
+// variables written there
+func (h *hoister) lift(stmt Stmt) Stmt {
+	switch stmt := stmt.(type) {
+	case Seq:
+		first := h.lift(stmt[0])
+		return mkSeq(first, h.lift(stmt[1]))
+	case IfThenElse:
+		return IfThenElse{stmt.cond, h.lift(stmt.thenStmt), h.lift(stmt.elseStmt)}
+	case Decl:
+		if h.hoisted[stmt.lhs] && h.invariant(stmt.rhs) {
+			// later temporaries may depend on it
+			delete(h.written, stmt.lhs)
+			h.decls = append(h.decls, stmt)
+			h.temps[stmt.rhs] = stmt.lhs
+			return Skip{}
+		}
+	case Located:
+		return Located{stmt.pos, h.lift(stmt.stmt)}
+	}
+	return stmt
+}
+
+// replace maximal invariant subexpressions by temporaries
+func (h *hoister) exp(e Exp) Exp {
+	if isOperator(e) && h.invariant(e) {
+		return Var(h.temp(e))
+	}
+	switch e := e.(type) {
+	case Plus:
+		return plus(h.exp(e[0]), h.exp(e[1]))
+	case Mult:
+		return mult(h.exp(e[0]), h.exp(e[1]))
+	case Equal:
+		return equal(h.exp(e[0]), h.exp(e[1]))
+	case Less:
+		return less(h.exp(e[0]), h.exp(e[1]))
+	case And:
+		return and(h.exp(e[0]), h.exp(e[1]))
+	case Or:
+		return or(h.exp(e[0]), h.exp(e[1]))
+	case Not:
+		return not(h.exp(e.exp))
+	default:
+		return e
+	}
+}
+
+func (h *hoister) invariant(e Exp) bool {
+	for x := range expVars(e) {
+		if h.written[x] {
+			return false
+		}
+	}
+	return true
+}
+
+// temporary holding the value of e. equal expressions share a temporary
+func (h *hoister) temp(e Exp) string {
+	if name, ok := h.temps[e]; ok {
+		return name
+	}
+	var name string
+	for name == "" || h.names[name] {
+		h.count++
+		name = "inv" + strconv.Itoa(h.count)
+	}
+	h.names[name] = true
+	h.hoisted[name] = true
+	h.temps[e] = name
+	h.decls = append(h.decls, Decl{name, e, Unlabelled})
+	return name
+}
+
+func isOperator(e Exp) bool {
+	switch e.(type) {
+	case Var, Num, Bool:
+		return false
+	}
+	return true
+}
+
+// apply f to every expression occurring in a statement
+func mapStmtExps(stmt Stmt, f func(Exp) Exp) Stmt {
+	switch stmt := stmt.(type) {
+	case Seq:
+		return Seq{mapStmtExps(stmt[0], f), mapStmtExps(stmt[1], f)}
+	case Decl:
+		return Decl{stmt.lhs, f(stmt.rhs), stmt.label}
+	case Assign:
+		return Assign{stmt.lhs, f(stmt.rhs)}
+	case Print:
+		return Print{f(stmt.exp)}
+	case IfThenElse:
+		return IfThenElse{f(stmt.cond), mapStmtExps(stmt.thenStmt, f), mapStmtExps(stmt.elseStmt, f)}
+	case While:
+		return While{f(stmt.cond), mapStmtExps(stmt.body, f), mapSpec(stmt.inv, f)}
+	case Requires:
+		return Requires{f(stmt.exp)}
+	case Ensures:
+		return Ensures{f(stmt.exp)}
+	case Assert:
+		return Assert{f(stmt.exp)}
+	case Assume:
+		return Assume{f(stmt.exp)}
+	case Located:
+		return Located{stmt.pos, mapStmtExps(stmt.stmt, f)}
+	default:
+		return stmt
+	}
+}
+
+// apply f to an optional expression such as a loop invariant
+func mapSpec(e Exp, f func(Exp) Exp) Exp {
+	if e == nil {
+		return nil
+	}
+	return f(e)
+}
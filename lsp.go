@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Language server
+//
+// serveLSP() implements the Language Server Protocol, JSON-RPC messages with
+// the same framing as the DAP server. Open documents are parsed with
+// newRecordingParser() and type-checked on every change, and the errors are
+// published as diagnostics. Requests at a position are answered from the
+// recorded spans: hover shows the type of the smallest expression there,
+// definition jumps from a variable to the declaration in scope, completion
+// offers the variables in scope and the keywords. Document symbols are the
+// declarations. Positions are counted in bytes, assuming ASCII sources.
+
+// Document analysis
+
+// a variable's type and declaring statement, as seen by the type checker
+type defBinding struct {
+	ty  Type
+	pos Pos
+}
+type DefState = Scopes[defBinding]
+
+func (def defBinding) typ() Type {
+	return def.ty
+}
+
+type diagnostic struct {
+	start, end int
+	message    string
+}
+
+type document struct {
+	text        string
+	parsed      bool
+	spans       []span
+	stmts       map[Pos]span     // every statement by position
+	before      map[Pos]DefState // variables in scope before every statement
+	after       map[Pos]DefState // and after it, in the statement's scope
+	diagnostics []diagnostic
+	fallback    *document // last version that parsed, if this one does not
+}
+
+// parse and type-check a document
+func analyzeDocument(text string) *document {
+	doc := &document{text: text, stmts: make(map[Pos]span), before: make(map[Pos]DefState), after: make(map[Pos]DefState)}
+	p := newRecordingParser()
+	prog, err := p.parse_fromstring(text)
+	if err != nil {
+		doc.diagnostics = []diagnostic{{p.lexer.start, p.lexer.cursor, err.Error()}}
+		return doc
+	}
+	doc.parsed = true
+	doc.spans = p.spans
+	for _, s := range p.spans {
+		if stmt, ok := s.node.(Located); ok {
+			doc.stmts[stmt.pos] = s
+		}
+	}
+	c := &docChecker{doc: doc, scopes: newScopes[defBinding]()}
+	c.stmt(prog)
+	return doc
+}
+
+// the type checker's rules, reporting every ill-typed statement
+type docChecker struct {
+	doc    *document
+	scopes DefState
+	pos    Pos // current statement
+}
+
+func (c *docChecker) stmt(stmt Stmt) {
+	t := c.scopes.types()
+	switch stmt := stmt.(type) {
+	case Seq:
+		c.stmt(stmt[0])
+		c.stmt(stmt[1])
+	case Located:
+		c.doc.before[stmt.pos] = c.scopes.copy()
+		c.pos = stmt.pos
+		c.stmt(stmt.stmt)
+		c.pos = stmt.pos
+		c.doc.after[stmt.pos] = c.scopes.copy()
+	case Decl:
+		if ty := stmt.rhs.infer(t); ty == TyIllTyped {
+			c.illTyped(stmt.rhs, t)
+		} else {
+			c.scopes[len(c.scopes)-1][stmt.lhs] = defBinding{ty, c.pos}
+		}
+	case Assign:
+		x, ty := t.lookup(stmt.lhs), stmt.rhs.infer(t)
+		switch {
+		case x == ty:
+		case ty == TyIllTyped:
+			c.illTyped(stmt.rhs, t)
+		case x == TyIllTyped:
+			c.report(nil, "%s is not declared", stmt.lhs)
+		default:
+			c.report(nil, "cannot assign %s to %s of type %s", showType(ty), stmt.lhs, showType(x))
+		}
+	case Read:
+		if t.lookup(stmt.lhs) == TyIllTyped {
+			c.report(nil, "%s is not declared", stmt.lhs)
+		}
+	case Print:
+		if stmt.exp.infer(t) == TyIllTyped {
+			c.illTyped(stmt.exp, t)
+		}
+	case Requires:
+		c.condition("precondition", stmt.exp, t)
+	case Ensures:
+		c.condition("postcondition", stmt.exp, t)
+	case Assert:
+		c.condition("assertion", stmt.exp, t)
+	case Assume:
+		c.condition("assumption", stmt.exp, t)
+	case IfThenElse:
+		c.condition("condition", stmt.cond, t)
+		c.block(stmt.thenStmt)
+		c.block(stmt.elseStmt)
+	case While:
+		c.condition("condition", stmt.cond, t)
+		if stmt.inv != nil {
+			c.condition("loop invariant", stmt.inv, t)
+		}
+		c.block(stmt.body)
+	case TestBlock:
+		// without the variables of the program
+		outer := c.scopes
+		c.scopes = newScopes[defBinding]()
+		c.stmt(stmt.body)
+		c.scopes = outer
+	}
+}
+
+func (c *docChecker) block(stmt Stmt) {
+	c.scopes.startBlock()
+	c.stmt(stmt)
+	c.scopes.endBlock()
+}
+
+func (c *docChecker) condition(what string, e Exp, t TyState) {
+	switch ty := e.infer(t); ty {
+	case TyBool:
+	case TyIllTyped:
+		c.illTyped(e, t)
+	default:
+		c.report(e, "%s must be Bool, found %s", what, showType(ty))
+	}
+}
+
+// report the innermost ill-typed part of e
+func (c *docChecker) illTyped(e Exp, t TyState) {
+	var subs []Exp
+	var msg string
+	switch e := e.(type) {
+	case Var:
+		c.report(e, "%s is not declared", e)
+		return
+	case Plus:
+		subs, msg = e[:], "operands of + must be Int"
+	case Mult:
+		subs, msg = e[:], "operands of * must be Int"
+	case Less:
+		subs, msg = e[:], "operands of < must be Int"
+	case And:
+		subs, msg = e[:], "operands of && must be Bool"
+	case Or:
+		subs, msg = e[:], "operands of || must be Bool"
+	case Equal:
+		subs, msg = e[:], "operands of == must have the same type"
+	case Not:
+		subs, msg = []Exp{e.exp}, "operand of ! must be Bool"
+	}
+	for _, sub := range subs {
+		if sub.infer(t) == TyIllTyped {
+			c.illTyped(sub, t)
+			return
+		}
+	}
+	c.report(e, "%s: %s", e.pretty(), msg)
+}
+
+// report an error at the span of e in the current statement, or at the
+// statement if e is nil or was not recorded
+func (c *docChecker) report(e Exp, format string, args ...interface{}) {
+	stmt := c.doc.stmts[c.pos]
+	at := stmt
+	if e != nil {
+		for _, s := range c.doc.spans {
+			if s.node == e && s.start >= stmt.start && s.end <= stmt.end {
+				at = s
+				break
+			}
+		}
+	}
+	c.doc.diagnostics = append(c.doc.diagnostics, diagnostic{at.start, at.end, fmt.Sprintf(format, args...)})
+}
+
+// the smallest span containing the offset, of a statement if stmts is set,
+// otherwise of an expression or variable name
+func (doc *document) spanAt(offset int, stmts bool) (span, bool) {
+	var ret span
+	found := false
+	for _, s := range doc.spans {
+		_, isStmt := s.node.(Located)
+		if isStmt != stmts || s.start > offset || offset >= s.end {
+			continue
+		}
+		if !found || s.end-s.start < ret.end-ret.start {
+			ret, found = s, true
+		}
+	}
+	return ret, found
+}
+
+// the expression or variable at the offset, and the variables in scope there
+func (doc *document) nodeAt(offset int) (span, DefState, bool) {
+	s, ok := doc.spanAt(offset, false)
+	if !ok {
+		return s, nil, false
+	}
+	stmt, ok := doc.spanAt(offset, true)
+	if !ok {
+		return s, nil, false
+	}
+	loc := stmt.node.(Located)
+	// the variable declared by a declaration is in scope afterwards
+	if x, ok := s.node.(lhs); ok {
+		if decl, ok := loc.stmt.(Decl); ok && decl.lhs == string(x) {
+			return s, doc.after[loc.pos], true
+		}
+	}
+	return s, doc.before[loc.pos], true
+}
+
+// type of the expression or variable at the offset
+func (doc *document) hover(offset int) (span, string, bool) {
+	s, scopes, ok := doc.nodeAt(offset)
+	if !ok {
+		return s, "", false
+	}
+	switch node := s.node.(type) {
+	case Exp:
+		return s, fmt.Sprintf("%s : %s", node.pretty(), showType(node.infer(scopes.types()))), true
+	case lhs:
+		def, _ := scopes.lookup(string(node))
+		return s, fmt.Sprintf("%s : %s", node, showType(def.ty)), true
+	}
+	return s, "", false
+}
+
+// span of the name declared by the declaration of the variable at the offset
+func (doc *document) definition(offset int) (span, bool) {
+	s, scopes, ok := doc.nodeAt(offset)
+	var name string
+	switch node := s.node.(type) {
+	case Var:
+		name = string(node)
+	case lhs:
+		name = string(node)
+	default:
+		return s, false
+	}
+	def, ok := scopes.lookup(name)
+	if !ok {
+		return s, false
+	}
+	decl := doc.stmts[def.pos]
+	for _, s := range doc.spans {
+		if x, ok := s.node.(lhs); ok && string(x) == name && s.start >= decl.start && s.end <= decl.end {
+			return s, true
+		}
+	}
+	return decl, true
+}
+
+// variables in scope at the offset: before the innermost statement
+// containing it, or after the last statement ending before it, whichever is
+// closer
+func (doc *document) scopeAt(offset int) DefState {
+	var scopes DefState
+	key := -1
+	if stmt, ok := doc.spanAt(offset, true); ok {
+		scopes, key = doc.before[stmt.node.(Located).pos], stmt.start
+	}
+	for _, s := range doc.spans {
+		if stmt, ok := s.node.(Located); ok && s.end <= offset && s.end > key {
+			scopes, key = doc.after[stmt.pos], s.end
+		}
+	}
+	if scopes == nil {
+		return newScopes[defBinding]()
+	}
+	return scopes
+}
+
+// Protocol
+
+type lspRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type lspResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+}
+
+type lspError struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   dapObject       `json:"error"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+var errUnsupported = errors.New("unsupported method")
+
+type lspServer struct {
+	out  io.Writer
+	docs map[string]*document // open documents by URI
+}
+
+// byte offset of an LSP position
+func (doc *document) offset(pos lspPosition) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		i := strings.IndexByte(doc.text[offset:], '\n')
+		if i < 0 {
+			return len(doc.text)
+		}
+		offset += i + 1
+	}
+	if end := strings.IndexByte(doc.text[offset:], '\n'); end >= 0 && pos.Character > end {
+		return offset + end
+	}
+	if offset+pos.Character > len(doc.text) {
+		return len(doc.text)
+	}
+	return offset + pos.Character
+}
+
+// LSP position of a byte offset
+func (doc *document) position(offset int) lspPosition {
+	line := strings.Count(doc.text[:offset], "\n")
+	return lspPosition{line, offset - (strings.LastIndexByte(doc.text[:offset], '\n') + 1)}
+}
+
+func (doc *document) lspRange(start, end int) dapObject {
+	return dapObject{"start": doc.position(start), "end": doc.position(end)}
+}
+
+// serve requests until exit or the end of the input
+func serveLSP(in io.Reader, out io.Writer) error {
+	s := &lspServer{out: out, docs: make(map[string]*document)}
+	r := bufio.NewReader(in)
+	for {
+		buf, err := readDAPMessage(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var req lspRequest
+		if err := json.Unmarshal(buf, &req); err != nil {
+			return err
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(req)
+		if len(req.ID) == 0 {
+			continue // notification
+		}
+		if err != nil {
+			code := -32602 // invalid params
+			if errors.Is(err, errUnsupported) {
+				code = -32601 // method not found
+			}
+			writeDAPMessage(out, lspError{"2.0", req.ID, dapObject{"code": code, "message": err.Error()}})
+		} else {
+			writeDAPMessage(out, lspResponse{"2.0", req.ID, result})
+		}
+	}
+}
+
+func (s *lspServer) handle(req lspRequest) (interface{}, error) {
+	var params struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+		Position lspPosition `json:"position"`
+	}
+	if len(req.Params) > 0 {
+		json.Unmarshal(req.Params, &params)
+	}
+	uri := params.TextDocument.URI
+	doc := s.docs[uri]
+	switch req.Method {
+	case "initialize":
+		return dapObject{
+			"capabilities": dapObject{
+				"textDocumentSync":       1, // full text on every change
+				"hoverProvider":          true,
+				"definitionProvider":     true,
+				"documentSymbolProvider": true,
+				"completionProvider":     dapObject{},
+			},
+			"serverInfo": dapObject{"name": "mbse-imp"},
+		}, nil
+	case "initialized", "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		s.update(uri, params.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		if n := len(params.ContentChanges); n > 0 {
+			s.update(uri, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		delete(s.docs, uri)
+		s.notify("textDocument/publishDiagnostics", dapObject{"uri": uri, "diagnostics": []dapObject{}})
+		return nil, nil
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("unknown document %s", uri)
+	}
+	offset := doc.offset(params.Position)
+	switch req.Method {
+	case "textDocument/hover":
+		if at, text, ok := doc.hover(offset); ok {
+			return dapObject{"contents": dapObject{"kind": "plaintext", "value": text}, "range": doc.lspRange(at.start, at.end)}, nil
+		}
+		return nil, nil
+	case "textDocument/definition":
+		if at, ok := doc.definition(offset); ok {
+			return dapObject{"uri": uri, "range": doc.lspRange(at.start, at.end)}, nil
+		}
+		return nil, nil
+	case "textDocument/documentSymbol":
+		symbols := []dapObject{}
+		for _, st := range doc.spans {
+			loc, ok := st.node.(Located)
+			if !ok {
+				continue
+			}
+			if decl, ok := loc.stmt.(Decl); ok {
+				def, _ := doc.after[loc.pos].lookup(decl.lhs)
+				name, _ := doc.definition(st.start)
+				symbols = append(symbols, dapObject{
+					"name":           decl.lhs,
+					"detail":         showType(def.ty),
+					"kind":           13, // variable
+					"range":          doc.lspRange(st.start, st.end),
+					"selectionRange": doc.lspRange(name.start, name.end),
+				})
+			}
+		}
+		return symbols, nil
+	case "textDocument/completion":
+		scopes := newScopes[defBinding]()
+		if doc.parsed {
+			scopes = doc.scopeAt(offset)
+		} else if doc.fallback != nil {
+			scopes = doc.fallback.scopeAt(offset)
+		}
+		return completions(scopes), nil
+	}
+	return nil, fmt.Errorf("%w %s", errUnsupported, req.Method)
+}
+
+// variables in scope, innermost first, then the keywords
+func completions(scopes DefState) []dapObject {
+	items := []dapObject{}
+	seen := make(map[string]bool)
+	for i := len(scopes) - 1; i >= 0; i-- {
+		var names []string
+		for x := range scopes[i] {
+			if !seen[x] {
+				names = append(names, x)
+				seen[x] = true
+			}
+		}
+		sort.Strings(names)
+		for _, x := range names {
+			items = append(items, dapObject{"label": x, "kind": 6, "detail": showType(scopes[i][x].ty)}) // variable
+		}
+	}
+	var kws []string
+	for kw := range keywords {
+		kws = append(kws, kw)
+	}
+	kws = append(kws, "true", "false")
+	sort.Strings(kws)
+	for _, kw := range kws {
+		items = append(items, dapObject{"label": kw, "kind": 14}) // keyword
+	}
+	return items
+}
+
+// analyze a new version of a document and publish its diagnostics
+func (s *lspServer) update(uri, text string) {
+	doc := analyzeDocument(text)
+	if old := s.docs[uri]; !doc.parsed && old != nil {
+		doc.fallback = old
+		if !old.parsed {
+			doc.fallback = old.fallback
+		}
+	}
+	s.docs[uri] = doc
+	diags := []dapObject{}
+	for _, d := range doc.diagnostics {
+		diags = append(diags, dapObject{"range": doc.lspRange(d.start, d.end), "severity": 1, "source": "imp", "message": d.message})
+	}
+	s.notify("textDocument/publishDiagnostics", dapObject{"uri": uri, "diagnostics": diags})
+}
+
+func (s *lspServer) notify(method string, params interface{}) {
+	writeDAPMessage(s.out, lspNotification{"2.0", method, params})
+}
+
+func lsp_cmd(args []string) int {
+	fs := flag.NewFlagSet("lsp", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		usage()
+	}
+	if err := serveLSP(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
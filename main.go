@@ -1,23 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"strings"
 )
 
 // Simple imperative language
 
 /*
 vars       Variable names, start with lower-case letter
+string     Characters other than '"' and newline, between double quotes
 
 prog      ::= statement
 block     ::= "{" statement "}"
 statement ::=  statement ";" statement           -- Command sequence
             |  vars ":=" exp                     -- Variable declaration
+            |  ("secret" | "public") vars ":=" exp  -- Declaration with security level
             |  vars "=" exp                      -- Variable assignment
-            |  "while" exp block                 -- While
+            |  "while" exp ["invariant" exp] block  -- While, with optional loop invariant
             |  "if" exp block "else" block       -- If-then-else
             |  "print" exp                       -- Print
+            |  "skip"                            -- No-op
+            |  "read" vars                       -- Read value of a declared variable from stdin
+            |  "requires" exp                    -- Precondition
+            |  "ensures" exp                     -- Postcondition
+            |  "assert" exp                      -- Assertion
+            |  "assume" exp                      -- Assumption
+            |  "test" string block               -- Unit test, see testrunner.go
 
 exp ::= 0 | 1 | -1 | ...     -- Integers
      | "true" | "false"      -- Booleans
@@ -34,28 +45,71 @@ exp ::= 0 | 1 | -1 | ...     -- Integers
 
 // Interpreter
 
-func interpret_file(f string, verbose bool) {
-	if verbose {
+// command line options
+type options struct {
+	verbose  bool   // -v: print tokens, AST and type-check result
+	optimize bool   // -O: constant folding and propagation, loop-invariant code motion, dead code elimination
+	taint    bool   // -taint: run programs with insecure information flows, reporting secret outputs
+	trace    string // -trace file: write the executed statements to file as JSON Lines
+}
+
+func interpret_file(f string, opts options) {
+	if opts.verbose {
 		lexer := newFileLexer(f)
 		lexer.lex_file()
 		fmt.Println()
 	}
-	parser := newParser()
+	parser := newLocatingParser()
 	prog, err := parser.parse_fromfile(f)
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println("Failed to parse", f)
 	}
-	if verbose {
+	if opts.verbose {
 		fmt.Println("Pretty print AST:")
 		fmt.Print(prog.pretty(), "\n\n")
 	}
 	// typecheck program
 	ts := newTyState()
 	if prog.check(ts) {
-		if verbose {
+		if opts.verbose {
 			fmt.Printf("Successfully type-checked %s\n\n", f)
 		}
+		if flows := checkFlows(prog); len(flows) > 0 {
+			for _, msg := range flows {
+				fmt.Println(msg)
+			}
+			if !opts.taint {
+				fmt.Printf("%s contains insecure information flows\n", f)
+				return
+			}
+		}
+		taint.enabled = opts.taint
+		if opts.optimize {
+			prog = hoistInvariants(optimize(prog))
+			var removed []string
+			prog, removed = eliminateDeadCode(prog)
+			if opts.verbose {
+				fmt.Println("Removed dead code:")
+				for _, r := range removed {
+					fmt.Println(strings.ReplaceAll(r, "\n", "\n\t"))
+				}
+				fmt.Println()
+				fmt.Println("Optimized AST:")
+				fmt.Print(prog.pretty(), "\n\n")
+			}
+		}
+		if opts.trace != "" {
+			f, err := os.Create(opts.trace)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			defer f.Close()
+			w := bufio.NewWriter(f)
+			defer w.Flush()
+			trace.out = w
+		}
 		// run program
 		vs := newValState()
 		prog.eval(vs)
@@ -64,27 +118,118 @@ func interpret_file(f string, verbose bool) {
 	}
 }
 
+// subcommands: mbse-imp <command> [arguments]. each returns the exit code
+var commands = map[string]func(args []string) int{
+	"analyze":  analyze_cmd,
+	"verify":   verify_cmd,
+	"wp":       wp_cmd,
+	"sp":       sp_cmd,
+	"smt":      smt_cmd,
+	"symexec":  symexec_cmd,
+	"bmc":      bmc_cmd,
+	"step":     step_cmd,
+	"derive":   derive_cmd,
+	"debug":    debug_cmd,
+	"dap":      dap_cmd,
+	"lsp":      lsp_cmd,
+	"replay":   replay_cmd,
+	"profile":  profile_cmd,
+	"coverage": coverage_cmd,
+	"test":     test_cmd,
+	"generate": generate_cmd,
+	"mutate":   mutate_cmd,
+	"rename":   rename_cmd,
+}
+
+func usage() {
+	fmt.Printf("usage: %s [-v] [-O] [-taint] [-trace out.jsonl] <filename>\n", os.Args[0])
+	fmt.Printf("       %s <command> [arguments]\n\n", os.Args[0])
+	fmt.Println("commands:")
+	fmt.Println("  analyze [-domain interval|sign|parity] <filename>")
+	fmt.Println("                       abstract state after every statement, possible overflows")
+	fmt.Println("  verify <filename>    prove requires/ensures/assert and loop invariants")
+	fmt.Println("  wp [-latex] <filename> <postcondition>")
+	fmt.Println("                       weakest precondition of the program")
+	fmt.Println("  sp [-latex] <filename>")
+	fmt.Println("                       strongest postcondition of the program")
+	fmt.Println("  smt [-unroll k] <filename>")
+	fmt.Println("                       verification conditions as SMT-LIB2 script")
+	fmt.Println("  symexec [-forks n] [-steps n] [-paths n] <filename>")
+	fmt.Println("                       feasible paths with concrete inputs driving them")
+	fmt.Println("  bmc [-unroll k] [-width w] <filename>")
+	fmt.Println("                       check specifications for executions with at most k loop iterations")
+	fmt.Println("  step [-n steps] <filename>")
+	fmt.Println("                       run with small-step semantics, printing every configuration")
+	fmt.Println("  derive [-type] [-format ascii|latex|html] [-depth d] [-iterations k] <filename>")
+	fmt.Println("                       derivation tree of running or type-checking the program")
+	fmt.Println("  debug <filename>     run step by step with breakpoints, type help at the prompt")
+	fmt.Println("  dap                  Debug Adapter Protocol server on stdin/stdout")
+	fmt.Println("  lsp                  Language Server Protocol server on stdin/stdout")
+	fmt.Println("  replay <trace.jsonl> print a trace written with -trace as a table")
+	fmt.Println("  profile [-top n] [-folded out.folded] <filename>")
+	fmt.Println("                       executions and time per statement and loop, annotated source")
+	fmt.Println("  coverage [-input file]... [-data cover.json] [-lcov out.info] [-html out.html] <filename>")
+	fmt.Println("                       statement and branch coverage of one run per input file")
+	fmt.Println("  test [-update] [-v] [files or directories]")
+	fmt.Println("                       run .imp files, comparing their output with the expected output")
+	fmt.Println("  generate [-seed s] [-n programs] [-stmts n]")
+	fmt.Println("                       random well-typed, terminating programs")
+	fmt.Println("  mutate [-steps n] [-v] [files or directories]")
+	fmt.Println("                       mutants of tested .imp files killed or survived by their tests")
+	fmt.Println("  rename <filename> <line>:<column> <name>")
+	fmt.Println("                       rename the variable at the position and its uses, not others of its name")
+	os.Exit(1)
+}
+
+// parse a file for tools that report source positions and make sure it type-checks
+func load_checked(f string) (Program, error) {
+	prog, err := newLocatingParser().parse_fromfile(f)
+	if err != nil {
+		return prog, err
+	}
+	if !prog.check(newTyState()) {
+		return prog, fmt.Errorf("%s contains type errors", f)
+	}
+	return prog, nil
+}
+
 func main() {
-	var verbose bool
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	var opts options
 	var fname string
-	args := os.Args
-	if len(args) == 2 {
-		// mbse-imp <file>
-		verbose = false
-		fname = args[1]
-	} else if len(args) == 3 && (args[1] == "-v" || args[2] == "-v") {
-		// -v: verbose
-		if args[1] == "-v" {
-			verbose = true
-			fname = args[2]
-		} else {
-			verbose = true
-			fname = args[1]
+	// options may appear before or after the file name
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-trace" || arg == "--trace":
+			if i+1 == len(args) {
+				usage()
+			}
+			i++
+			opts.trace = args[i]
+		case strings.HasPrefix(arg, "-trace=") || strings.HasPrefix(arg, "--trace="):
+			_, opts.trace, _ = strings.Cut(arg, "=")
+		case arg == "-v":
+			opts.verbose = true
+		case arg == "-O":
+			opts.optimize = true
+		case arg == "-taint":
+			opts.taint = true
+		case fname == "" && !strings.HasPrefix(arg, "-"):
+			fname = arg
+		default:
+			usage()
 		}
-	} else {
-		fmt.Printf("usage: %s [-v] <filename>\n", args[0])
-		os.Exit(1)
+	}
+	if fname == "" {
+		usage()
 	}
 
-	interpret_file(fname, verbose)
+	interpret_file(fname, opts)
 }
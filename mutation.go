@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Mutation testing
+//
+// A mutant is a program with one small fault: an operator replaced (+ and *,
+// < and ==, && and ||), the condition of an if or while negated, an
+// assignment, print, if or while deleted, or the branches of an if swapped.
+// A mutant is killed if the tests of its file fail for it (see
+// testrunner.go): its output differs from the expected output, a test block
+// reports a runtime error or it does not terminate within a number of small
+// steps. Survivors point to code the tests do not check.
+//
+// Specifications, declarations and reads are not mutated, and mutants that
+// do not type-check, e.g. (true<false) from (true==false), are dropped.
+
+type mutant struct {
+	pos  Pos
+	desc string
+	prog Stmt
+}
+
+// the mutants of a statement, located at the statement they change
+func mutants(stmt Stmt, pos Pos) []mutant {
+	var ret []mutant
+	add := func(desc string, prog Stmt) {
+		ret = append(ret, mutant{pos, desc, prog})
+	}
+	// mutants of a part of stmt, rebuilt into stmt
+	inner := func(part Stmt, pos Pos, rebuild func(Stmt) Stmt) {
+		for _, m := range mutants(part, pos) {
+			m.prog = rebuild(m.prog)
+			ret = append(ret, m)
+		}
+	}
+	exp := func(e Exp, rebuild func(Exp) Stmt) {
+		for _, m := range mutateExp(e) {
+			add(e.pretty()+" replaced by "+m.pretty(), rebuild(m))
+		}
+	}
+	switch s := stmt.(type) {
+	case Seq:
+		inner(s[0], pos, func(m Stmt) Stmt { return Seq{m, s[1]} })
+		inner(s[1], pos, func(m Stmt) Stmt { return Seq{s[0], m} })
+	case Located:
+		inner(s.stmt, s.pos, func(m Stmt) Stmt { return Located{s.pos, m} })
+	case Decl:
+		exp(s.rhs, func(m Exp) Stmt { return Decl{s.lhs, m, s.label} })
+	case Assign:
+		add("deleted "+s.pretty(), Skip{})
+		exp(s.rhs, func(m Exp) Stmt { return Assign{s.lhs, m} })
+	case Print:
+		add("deleted "+s.pretty(), Skip{})
+		exp(s.exp, func(m Exp) Stmt { return Print{m} })
+	case IfThenElse:
+		add("deleted "+stmtHeader(s), Skip{})
+		add("swapped the branches of "+stmtHeader(s), IfThenElse{s.cond, s.elseStmt, s.thenStmt})
+		add(s.cond.pretty()+" replaced by "+not(s.cond).pretty(), IfThenElse{not(s.cond), s.thenStmt, s.elseStmt})
+		exp(s.cond, func(m Exp) Stmt { return IfThenElse{m, s.thenStmt, s.elseStmt} })
+		inner(s.thenStmt, pos, func(m Stmt) Stmt { return IfThenElse{s.cond, m, s.elseStmt} })
+		inner(s.elseStmt, pos, func(m Stmt) Stmt { return IfThenElse{s.cond, s.thenStmt, m} })
+	case While:
+		add("deleted "+stmtHeader(s), Skip{})
+		add(s.cond.pretty()+" replaced by "+not(s.cond).pretty(), While{not(s.cond), s.body, s.inv})
+		exp(s.cond, func(m Exp) Stmt { return While{m, s.body, s.inv} })
+		inner(s.body, pos, func(m Stmt) Stmt { return While{s.cond, m, s.inv} })
+	case TestBlock:
+		inner(s.body, pos, func(m Stmt) Stmt { return TestBlock{s.name, m} })
+	}
+	return ret
+}
+
+// variants of an expression with one operator replaced
+func mutateExp(e Exp) []Exp {
+	var ret []Exp
+	switch e := e.(type) {
+	case Plus:
+		ret = append(ret, Mult(e))
+	case Mult:
+		ret = append(ret, Plus(e))
+	case Less:
+		ret = append(ret, Equal(e))
+	case Equal:
+		ret = append(ret, Less(e))
+	case And:
+		ret = append(ret, Or(e))
+	case Or:
+		ret = append(ret, And(e))
+	}
+	for i, sub := range subformulas(e) {
+		for _, m := range mutateExp(sub) {
+			ret = append(ret, replaceOperand(e, i, m))
+		}
+	}
+	return ret
+}
+
+// run a statement with new scopes for at most the given number of small
+// steps, returning what it prints, the number of runtime errors and whether
+// it terminated
+func runLimited(stmt Stmt, input []byte, steps int) (string, int, bool) {
+	var out bytes.Buffer
+	oldOut, oldIn, oldPos, errs := stdout, stdin, evalPos, runtimeErrors
+	stdout, stdin = &out, bytes.NewReader(input)
+	defer func() { stdout, stdin, evalPos = oldOut, oldIn, oldPos }()
+	s := newValState()
+	for n := 0; n < steps && !isSkip(stmt); n++ {
+		stmt = step(stmt, &s)
+	}
+	return out.String(), runtimeErrors - errs, isSkip(stmt)
+}
+
+// why the tests of t fail for prog: a test block, the output or a timeout.
+// "" if they pass
+func (t impTest) failure(prog Stmt, input []byte, steps int) string {
+	for _, l := range testBlocks(prog) {
+		tb := l.stmt.(TestBlock)
+		_, errs, done := runLimited(tb.body, input, steps)
+		if !done {
+			return "timeout"
+		}
+		if errs > 0 {
+			return fmt.Sprintf("test \"%s\"", tb.name)
+		}
+	}
+	if !t.has {
+		return ""
+	}
+	got, _, done := runLimited(prog, input, steps)
+	switch {
+	case !done:
+		return "timeout"
+	case got != t.want:
+		return "output"
+	}
+	return ""
+}
+
+type mutationSummary struct {
+	killed, survived int
+}
+
+// run the mutants of the tested files among the given files and
+// directories, reporting survivors and files whose tests fail anyway to w,
+// and killed mutants too if verbose
+func runMutationTests(paths []string, steps int, verbose bool, w io.Writer) (mutationSummary, error) {
+	var sum mutationSummary
+	files, err := findImpFiles(paths)
+	if err != nil {
+		return sum, err
+	}
+	for _, path := range files {
+		t, err := loadImpTest(path)
+		if err != nil {
+			return sum, err
+		}
+		if !t.has && !hasTestBlocks(t.source) {
+			continue
+		}
+		prog, input, err := t.load()
+		if err != nil {
+			fmt.Fprintf(w, "SKIP %s: %s\n", path, err)
+			continue
+		}
+		if why := t.failure(prog, input, steps); why != "" {
+			fmt.Fprintf(w, "SKIP %s: tests fail without mutations: %s\n", path, why)
+			continue
+		}
+		for _, m := range mutants(prog, Pos{}) {
+			if !m.prog.check(newTyState()) {
+				continue
+			}
+			if why := t.failure(m.prog, input, steps); why != "" {
+				sum.killed++
+				if verbose {
+					fmt.Fprintf(w, "KILLED   %s: %s: %s, by %s\n", path, m.pos, m.desc, why)
+				}
+			} else {
+				sum.survived++
+				fmt.Fprintf(w, "SURVIVED %s: %s: %s\n", path, m.pos, m.desc)
+			}
+		}
+	}
+	return sum, nil
+}
+
+func (s mutationSummary) String() string {
+	total := s.killed + s.survived
+	if total == 0 {
+		return "no mutants"
+	}
+	return fmt.Sprintf("%d mutants, %d killed, %d survived: score %.1f%%",
+		total, s.killed, s.survived, 100*float64(s.killed)/float64(total))
+}
+
+func mutate_cmd(args []string) int {
+	fs := flag.NewFlagSet("mutate", flag.ExitOnError)
+	steps := fs.Int("steps", 100000, "small steps after which a run counts as not terminating")
+	verbose := fs.Bool("v", false, "list killed mutants too")
+	fs.Parse(args)
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	sum, err := runMutationTests(paths, *steps, *verbose, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(sum)
+	return 0
+}
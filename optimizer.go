@@ -0,0 +1,313 @@
+package main
+
+// Optimizer: constant folding and constant propagation
+//
+// The optimizer rewrites a well-typed program into an equivalent one in which
+// constant subexpressions are evaluated ahead of time. Variables holding a
+// known constant are replaced by that constant, and if-then-else and while
+// statements with constant conditions are simplified.
+
+// ConstState mirrors ValState during optimization.
+// A variable's value is only known if every path reaching the current program
+// point assigns it the same constant. Types are tracked so that declarations
+// follow the same update-or-shadow rule as ValState.declare.
+type constEntry struct {
+	ty    Type
+	val   Val
+	known bool
+}
+type ConstState = Scopes[constEntry]
+
+func (e constEntry) typ() Type {
+	return e.ty
+}
+
+// same rule as ValState.assign, except that nothing is known about a
+// variable assigned a value of the wrong type (undefined behavior)
+func assignConst(c ConstState, name string, e constEntry) {
+	if old, ok := c.lookup(name); ok && old.ty != e.ty {
+		e = constEntry{ty: old.ty}
+	}
+	c.assign(name, e)
+}
+
+// forget the values of all mappings of the given variables
+func forgetConsts(c ConstState, names map[string]bool) {
+	for _, scope := range c {
+		for name, e := range scope {
+			if names[name] {
+				scope[name] = constEntry{ty: e.ty}
+			}
+		}
+	}
+}
+
+// keep only the values that are known and equal in both states.
+// both states must have the same scope structure as c
+func mergeConsts(c, a, b ConstState) {
+	for i, scope := range c {
+		for name := range scope {
+			ea, eb := a[i][name], b[i][name]
+			if ea.known && eb.known && ea.val.equal(eb.val) {
+				scope[name] = ea
+			} else {
+				scope[name] = constEntry{ty: ea.ty}
+			}
+		}
+	}
+}
+
+// optimize a program. the program should be well-typed
+func optimize(prog Program) Program {
+	c := newScopes[constEntry]()
+	return (Program)(optimizeStmt(prog, &c))
+}
+
+func optimizeStmt(stmt Stmt, c *ConstState) Stmt {
+	switch stmt := stmt.(type) {
+	case Seq:
+		first := optimizeStmt(stmt[0], c)
+		second := optimizeStmt(stmt[1], c)
+		return mkSeq(first, second)
+	case Decl:
+		rhs := fold(stmt.rhs, *c)
+		c.declare(stmt.lhs, constOf(rhs, *c))
+		return Decl{stmt.lhs, rhs, stmt.label}
+	case Assign:
+		rhs := fold(stmt.rhs, *c)
+		assignConst(*c, stmt.lhs, constOf(rhs, *c))
+		return Assign{stmt.lhs, rhs}
+	case Print:
+		return Print{fold(stmt.exp, *c)}
+	case IfThenElse:
+		cond := fold(stmt.cond, *c)
+		if b, ok := cond.(Bool); ok {
+			// only the taken branch remains
+			branch := stmt.elseStmt
+			if b {
+				branch = stmt.thenStmt
+			}
+			c.startBlock()
+			branch = optimizeStmt(branch, c)
+			c.endBlock()
+			if !declaresInScope(branch) {
+				// no local variables, so the block can be inlined
+				return branch
+			}
+			if b {
+				return IfThenElse{cond, branch, Skip{}}
+			}
+			return IfThenElse{cond, Skip{}, branch}
+		}
+		ct, ce := c.copy(), c.copy()
+		ct.startBlock()
+		thenStmt := optimizeStmt(stmt.thenStmt, &ct)
+		ct.endBlock()
+		ce.startBlock()
+		elseStmt := optimizeStmt(stmt.elseStmt, &ce)
+		ce.endBlock()
+		mergeConsts(*c, ct, ce)
+		return IfThenElse{cond, thenStmt, elseStmt}
+	case While:
+		// anything written by the body is unknown at the loop head
+		forgetConsts(*c, writtenVars(stmt.body))
+		cond := fold(stmt.cond, *c)
+		if cond == Exp(Bool(false)) {
+			return Skip{}
+		}
+		// the body may run zero times, so its effects are discarded
+		cb := c.copy()
+		cb.startBlock()
+		body := optimizeStmt(stmt.body, &cb)
+		return While{cond, body, mapSpec(stmt.inv, func(e Exp) Exp { return fold(e, *c) })}
+	case Read:
+		if e, ok := c.lookup(stmt.lhs); ok {
+			c.assign(stmt.lhs, constEntry{ty: e.ty})
+		}
+		return stmt
+	case Requires:
+		return Requires{fold(stmt.exp, *c)}
+	case Ensures:
+		return Ensures{fold(stmt.exp, *c)}
+	case Assert:
+		return Assert{fold(stmt.exp, *c)}
+	case Assume:
+		return Assume{fold(stmt.exp, *c)}
+	case Located:
+		return relocate(stmt.pos, optimizeStmt(stmt.stmt, c))
+	default:
+		return stmt
+	}
+}
+
+// fold constant subexpressions and substitute known variables
+func fold(e Exp, c ConstState) Exp {
+	switch e := e.(type) {
+	case Var:
+		if entry, ok := c.lookup(string(e)); ok && entry.known {
+			return valExp(entry.val)
+		}
+		return e
+	case Plus:
+		x, y := fold(e[0], c), fold(e[1], c)
+		switch {
+		case isLit(x) && isLit(y):
+			return evalLit(plus(x, y))
+		case x == Exp(Num(0)):
+			return y
+		case y == Exp(Num(0)):
+			return x
+		}
+		return plus(x, y)
+	case Mult:
+		x, y := fold(e[0], c), fold(e[1], c)
+		switch {
+		case isLit(x) && isLit(y):
+			return evalLit(mult(x, y))
+		case x == Exp(Num(1)):
+			return y
+		case y == Exp(Num(1)):
+			return x
+		}
+		return mult(x, y)
+	case Equal:
+		x, y := fold(e[0], c), fold(e[1], c)
+		if isLit(x) && isLit(y) {
+			return evalLit(equal(x, y))
+		}
+		return equal(x, y)
+	case Less:
+		x, y := fold(e[0], c), fold(e[1], c)
+		if isLit(x) && isLit(y) {
+			return evalLit(less(x, y))
+		}
+		return less(x, y)
+	case And:
+		x, y := fold(e[0], c), fold(e[1], c)
+		switch x {
+		case Exp(Bool(false)):
+			return x
+		case Exp(Bool(true)):
+			return y
+		}
+		if y == Exp(Bool(true)) {
+			return x
+		}
+		return and(x, y)
+	case Or:
+		x, y := fold(e[0], c), fold(e[1], c)
+		switch x {
+		case Exp(Bool(true)):
+			return x
+		case Exp(Bool(false)):
+			return y
+		}
+		if y == Exp(Bool(false)) {
+			return x
+		}
+		return or(x, y)
+	case Not:
+		x := fold(e.exp, c)
+		if isLit(x) {
+			return evalLit(not(x))
+		}
+		return not(x)
+	default:
+		return e
+	}
+}
+
+// Helpers
+
+func isLit(e Exp) bool {
+	switch e.(type) {
+	case Num, Bool:
+		return true
+	}
+	return false
+}
+
+// evaluate an expression on literals. ill-typed expressions are kept as is
+func evalLit(e Exp) Exp {
+	v := e.eval(newValState())
+	if v.flag == Undefined {
+		return e
+	}
+	return valExp(v)
+}
+
+func valExp(v Val) Exp {
+	if v.flag == ValueBool {
+		return Bool(v.valB)
+	}
+	return Num(v.valI)
+}
+
+// mapping for a variable initialized with e
+func constOf(e Exp, c ConstState) constEntry {
+	entry := constEntry{ty: e.infer(c.types())}
+	if isLit(e) {
+		entry.val = e.eval(newValState())
+		entry.known = true
+	}
+	return entry
+}
+
+// sequence two statements, dropping skips
+func mkSeq(first, second Stmt) Stmt {
+	if first == Stmt(Skip{}) {
+		return second
+	} else if second == Stmt(Skip{}) {
+		return first
+	}
+	return Seq{first, second}
+}
+
+// names of all variables declared or assigned anywhere in stmt
+func writtenVars(stmt Stmt) map[string]bool {
+	vars := make(map[string]bool)
+	var walk func(Stmt)
+	walk = func(stmt Stmt) {
+		switch stmt := stmt.(type) {
+		case Seq:
+			walk(stmt[0])
+			walk(stmt[1])
+		case Decl:
+			vars[stmt.lhs] = true
+		case Assign:
+			vars[stmt.lhs] = true
+		case Read:
+			vars[stmt.lhs] = true
+		case IfThenElse:
+			walk(stmt.thenStmt)
+			walk(stmt.elseStmt)
+		case While:
+			walk(stmt.body)
+		case Located:
+			walk(stmt.stmt)
+		}
+	}
+	walk(stmt)
+	return vars
+}
+
+// reports whether stmt declares variables in the current scope (i.e. outside nested blocks)
+func declaresInScope(stmt Stmt) bool {
+	switch stmt := stmt.(type) {
+	case Seq:
+		return declaresInScope(stmt[0]) || declaresInScope(stmt[1])
+	case Decl:
+		return true
+	case Located:
+		return declaresInScope(stmt.stmt)
+	}
+	return false
+}
+
+// keep the position of a transformed statement, unless it was removed
+func relocate(pos Pos, stmt Stmt) Stmt {
+	if stmt == Stmt(Skip{}) {
+		return stmt
+	}
+	return Located{pos, stmt}
+}
@@ -0,0 +1,100 @@
+package main
+
+// Parity domain
+//
+// An abstract integer is the set of possible parities: even and odd.
+// Parity is preserved by the wrapping Plus and Mult, so overflow does not
+// affect this domain.
+
+const (
+	parityEven = iota
+	parityOdd
+	numParities
+)
+
+type Parity atoms
+
+type ParityDomain struct{}
+
+func (ParityDomain) bottom() AbsInt {
+	return Parity(0)
+}
+
+func (ParityDomain) top() AbsInt {
+	return Parity(1<<numParities - 1)
+}
+
+func (ParityDomain) constant(n int) AbsInt {
+	return Parity(1 << (n & 1))
+}
+
+func (ParityDomain) isBottom(a AbsInt) bool {
+	return a.(Parity) == 0
+}
+
+func (ParityDomain) leq(a, b AbsInt) bool {
+	return a.(Parity)|b.(Parity) == b.(Parity)
+}
+
+func (ParityDomain) join(a, b AbsInt) AbsInt {
+	return a.(Parity) | b.(Parity)
+}
+
+// the domain is finite, so joining terminates
+func (d ParityDomain) widen(a, b AbsInt) AbsInt {
+	return d.join(a, b)
+}
+
+func (ParityDomain) plus(a, b AbsInt) AbsInt {
+	return Parity(liftAtoms(atoms(a.(Parity)), atoms(b.(Parity)), numParities, func(x, y int) atoms {
+		return 1 << (x ^ y)
+	}))
+}
+
+func (ParityDomain) mult(a, b AbsInt) AbsInt {
+	return Parity(liftAtoms(atoms(a.(Parity)), atoms(b.(Parity)), numParities, func(x, y int) atoms {
+		return 1 << (x & y)
+	}))
+}
+
+// numbers of any parity can be ordered either way
+func parityLess(x, y int) AbsBool {
+	return boolTop
+}
+
+func parityEqual(x, y int) AbsBool {
+	if x != y {
+		return boolFalse
+	}
+	return boolTop
+}
+
+func (ParityDomain) less(a, b AbsInt) AbsBool {
+	return liftBool(atoms(a.(Parity)), atoms(b.(Parity)), numParities, parityLess)
+}
+
+func (ParityDomain) equal(a, b AbsInt) AbsBool {
+	return liftBool(atoms(a.(Parity)), atoms(b.(Parity)), numParities, parityEqual)
+}
+
+func (ParityDomain) assumeLess(a, b AbsInt, truth bool) (AbsInt, AbsInt) {
+	x, y := refineAtoms(atoms(a.(Parity)), atoms(b.(Parity)), numParities, truth, parityLess)
+	return Parity(x), Parity(y)
+}
+
+func (ParityDomain) assumeEqual(a, b AbsInt, truth bool) (AbsInt, AbsInt) {
+	x, y := refineAtoms(atoms(a.(Parity)), atoms(b.(Parity)), numParities, truth, parityEqual)
+	return Parity(x), Parity(y)
+}
+
+func (d ParityDomain) show(a AbsInt) string {
+	switch a.(Parity) {
+	case 0:
+		return "bottom"
+	case 1 << parityEven:
+		return "even"
+	case 1 << parityOdd:
+		return "odd"
+	}
+	return "top"
+}
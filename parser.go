@@ -6,6 +6,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 // IMP parser grammar
@@ -18,9 +19,16 @@ seq2    ::= stmt ";" seq2
           | epsilon
 stmt    ::= vars ":=" exp
           | vars "=" exp
-          | "while" exp block
+          | "while" exp ["invariant" exp] block
           | "if" exp block "else" block
           | "print" exp
+          | "skip"
+          | "read" vars
+          | "requires" exp
+          | "ensures" exp
+          | "assert" exp
+          | "assume" exp
+          | "test" string block
 exp     ::= exp2 comp
 comp    ::= "==" exp2 comp
           | "<" exp2 comp
@@ -38,6 +46,7 @@ factor  ::= lit | vars
           | "(" exp ")"
 lit     ::= 0 | 1 | -1 | ...
           | "true" | "false"
+string  ::= '"' characters other than '"' and newline '"'
 */
 
 // Tokens
@@ -54,6 +63,16 @@ const (
 	TokIf
 	TokElse
 	TokPrint
+	TokSkip
+	TokRead
+	TokRequires
+	TokEnsures
+	TokAssert
+	TokAssume
+	TokInvariant
+	TokSecret
+	TokPublic
+	TokTest
 	TokInt
 	TokBool
 	TokPlus
@@ -66,6 +85,8 @@ const (
 	TokParenOpen
 	TokParenClose
 	TokName
+	TokString
+	TokIllegal // unexpected character, which no rule of the parser accepts
 	TokEOF
 )
 
@@ -77,6 +98,19 @@ type Lexer struct {
 	tokType TokType      // current token type
 	tok     bytes.Buffer // current token string
 	line    int          // current line
+	start   int          // position of current token in source
+	last    int          // end of the previous token in source
+}
+
+// Source positions
+
+type Pos struct {
+	line int
+	col  int
+}
+
+func (pos Pos) String() string {
+	return fmt.Sprintf("line %d", pos.line)
 }
 
 func newFileLexer(f string) *Lexer {
@@ -85,7 +119,7 @@ func newFileLexer(f string) *Lexer {
 }
 
 func newLexer(code string) *Lexer {
-	lex := &Lexer{code, 0, TokEOF, bytes.Buffer{}, 1}
+	lex := &Lexer{code, 0, TokEOF, bytes.Buffer{}, 1, 0, 0}
 	lex.next()
 	return lex
 }
@@ -99,9 +133,11 @@ var rBool = regexp.MustCompile(`^(true|false)`)
 var rIdent = regexp.MustCompile(`^[a-z]\w*`)
 var rOperator = regexp.MustCompile(`^(:=|=[^=]|\+|\*|\|\||&&|!|==|<)`) // TODO: test all operators
 var rComment = regexp.MustCompile(`^//[^\n]*`)
+var rString = regexp.MustCompile(`^"[^"\n]*"`)
 
 // next token
 func (l *Lexer) next() (bool, error) {
+	l.last = l.cursor
 	l.tok.Reset()
 	if l.eol() {
 		return true, nil
@@ -120,6 +156,7 @@ func (l *Lexer) next() (bool, error) {
 	}
 
 	// check EOL again after skipping whitespace
+	l.start = l.cursor
 	if l.eol() {
 		return true, nil
 	}
@@ -132,15 +169,24 @@ func (l *Lexer) next() (bool, error) {
 	case l.lex_operator(): // operators
 	case l.lex_brace(): // parens and curly braces
 	case l.lex_semi(): // semicolon
+	case l.lex_string(): // string literals, the names of tests
 	case l.lex_comment(): // "//" marks rest of line as comment
 		return l.next()
 	default:
+		l.tokType = TokIllegal
+		l.tok.WriteByte(l.s[l.cursor])
 		return false, fmt.Errorf("unexpected character on line %d: \"%c\"", l.line, l.s[l.cursor])
 	}
 
 	return true, nil
 }
 
+// position of the current token
+func (l *Lexer) pos() Pos {
+	col := l.start - strings.LastIndexByte(l.s[:l.start], '\n')
+	return Pos{l.line, col}
+}
+
 // detect EOF
 func (l *Lexer) eol() bool {
 	if l.cursor == len(l.s) {
@@ -177,6 +223,23 @@ func (l *Lexer) lex_bool() bool {
 	return true
 }
 
+var keywords = map[string]TokType{
+	"while":     TokWhile,
+	"if":        TokIf,
+	"else":      TokElse,
+	"print":     TokPrint,
+	"skip":      TokSkip,
+	"read":      TokRead,
+	"requires":  TokRequires,
+	"ensures":   TokEnsures,
+	"assert":    TokAssert,
+	"assume":    TokAssume,
+	"invariant": TokInvariant,
+	"secret":    TokSecret,
+	"public":    TokPublic,
+	"test":      TokTest,
+}
+
 func (l *Lexer) lex_ident() bool {
 	// slurp ^[a-z]\w
 	s := l.s[l.cursor:]
@@ -186,16 +249,9 @@ func (l *Lexer) lex_ident() bool {
 	}
 	tok := s[loc[0]:loc[1]]
 	// test for keywords, else variable name
-	switch tok {
-	case "while":
-		l.tokType = TokWhile
-	case "if":
-		l.tokType = TokIf
-	case "else":
-		l.tokType = TokElse
-	case "print":
-		l.tokType = TokPrint
-	default: // variable name
+	if kw, ok := keywords[tok]; ok {
+		l.tokType = kw
+	} else {
 		l.tokType = TokName
 	}
 	l.tok.WriteString(tok)
@@ -267,6 +323,18 @@ func (l *Lexer) lex_semi() bool {
 	return false
 }
 
+func (l *Lexer) lex_string() bool {
+	s := l.s[l.cursor:]
+	loc := rString.FindStringIndex(s)
+	if loc == nil {
+		return false
+	}
+	l.tok.WriteString(s[loc[0]:loc[1]])
+	l.tokType = TokString
+	l.cursor += loc[1]
+	return true
+}
+
 // ignore everything from // to end of line
 func (l *Lexer) lex_comment() bool {
 	s := l.s[l.cursor:]
@@ -301,6 +369,28 @@ func (l *Lexer) lex_file() {
 			fmt.Print("TokElse")
 		case TokPrint:
 			fmt.Print("TokPrint")
+		case TokSkip:
+			fmt.Print("TokSkip")
+		case TokRead:
+			fmt.Print("TokRead")
+		case TokRequires:
+			fmt.Print("TokRequires")
+		case TokEnsures:
+			fmt.Print("TokEnsures")
+		case TokAssert:
+			fmt.Print("TokAssert")
+		case TokAssume:
+			fmt.Print("TokAssume")
+		case TokInvariant:
+			fmt.Print("TokInvariant")
+		case TokSecret:
+			fmt.Print("TokSecret")
+		case TokPublic:
+			fmt.Print("TokPublic")
+		case TokTest:
+			fmt.Print("TokTest")
+		case TokString:
+			fmt.Print("TokString")
 		case TokInt:
 			fmt.Print("TokInt")
 		case TokBool:
@@ -325,6 +415,8 @@ func (l *Lexer) lex_file() {
 			fmt.Print("TokParenClose")
 		case TokName:
 			fmt.Print("TokName")
+		case TokIllegal:
+			fmt.Print("TokIllegal")
 		case TokEOF:
 			panic("lexer test should not reach EOF")
 		default:
@@ -338,11 +430,47 @@ func (l *Lexer) lex_file() {
 // Parser
 
 type Parser struct {
-	lexer *Lexer
+	lexer     *Lexer
+	located   bool   // wrap statements in Located to record their source positions
+	recording bool   // record the spans of statements and expressions
+	spans     []span // recorded spans, each node after its children
 }
 
+// source extent of a statement, expression or assigned variable, as byte
+// offsets [start, end)
+type span struct {
+	start, end int
+	node       interface{} // Stmt (Located), Exp, or lhs
+}
+
+// variable on the left-hand side of a declaration, assignment or read
+type lhs string
+
 func newParser() *Parser {
-	return &Parser{nil}
+	return &Parser{nil, false, false, nil}
+}
+
+// parser for tools that report source positions
+func newLocatingParser() *Parser {
+	return &Parser{nil, true, false, nil}
+}
+
+// locating parser that also records spans, for editors
+func newRecordingParser() *Parser {
+	return &Parser{nil, true, true, nil}
+}
+
+// node was parsed from start up to the previous token
+func (p *Parser) record(start int, node interface{}) {
+	if !p.recording {
+		return
+	}
+	if n := len(p.spans); n > 0 && p.spans[n-1].start == start && p.spans[n-1].end == p.lexer.last {
+		if _, ok := node.(Exp); ok {
+			return // the same expression, e.g. a term that is a single factor
+		}
+	}
+	p.spans = append(p.spans, span{start, p.lexer.last, node})
 }
 
 func (p *Parser) err_expected(what string) error {
@@ -359,6 +487,16 @@ func (p *Parser) parse_fromstring(code string) (Program, error) {
 	return p.parse_prog()
 }
 
+// parse a single expression, e.g. a condition given on the command line
+func (p *Parser) parse_expfromstring(code string) (Exp, error) {
+	p.lexer = newLexer(code)
+	exp, err := p.parse_exp()
+	if err == nil && p.lexer.tokType != TokEOF {
+		return exp, p.err_expected("end of expression")
+	}
+	return exp, err
+}
+
 func (p *Parser) parse_prog() (Program, error) {
 	prog, err := p.parse_seq()
 	return (Program)(prog), err
@@ -399,15 +537,25 @@ func (p *Parser) parse_seq2(stmt Stmt) (Stmt, error) {
 }
 
 func (p *Parser) parse_stmt() (Stmt, error) {
+	pos, start := p.lexer.pos(), p.lexer.start
+	stmt, err := p.parse_stmt_kind()
+	if p.located && err == nil {
+		stmt = Located{pos, stmt}
+		p.record(start, stmt)
+	}
+	return stmt, err
+}
+
+func (p *Parser) parse_stmt_kind() (Stmt, error) {
 	switch p.lexer.tokType {
 	case TokName:
 		lhs := p.lexer.tok.String()
-		p.lexer.next()
+		p.name(lhs)
 		switch p.lexer.tokType {
 		case TokDecl:
 			p.lexer.next()
 			rhs, err := p.parse_exp()
-			return Decl{lhs, rhs}, err
+			return Decl{lhs, rhs, Unlabelled}, err
 		case TokAssign:
 			p.lexer.next()
 			rhs, err := p.parse_exp()
@@ -415,14 +563,39 @@ func (p *Parser) parse_stmt() (Stmt, error) {
 		default:
 			return Seq{}, p.err_expected("declaration or assignment")
 		}
+	case TokSecret, TokPublic:
+		label := Public
+		if p.lexer.tokType == TokSecret {
+			label = Secret
+		}
+		p.lexer.next()
+		if p.lexer.tokType != TokName {
+			return Seq{}, p.err_expected("variable name")
+		}
+		lhs := p.lexer.tok.String()
+		p.name(lhs)
+		if p.lexer.tokType != TokDecl {
+			return Seq{}, p.err_expected("\":=\"")
+		}
+		p.lexer.next()
+		rhs, err := p.parse_exp()
+		return Decl{lhs, rhs, label}, err
 	case TokWhile:
 		p.lexer.next()
 		cond, err := p.parse_exp()
 		if err != nil {
 			return Seq{}, err
 		}
+		var inv Exp
+		if p.lexer.tokType == TokInvariant {
+			p.lexer.next()
+			inv, err = p.parse_exp()
+			if err != nil {
+				return Seq{}, err
+			}
+		}
 		body, err := p.parse_block()
-		return While{cond, body}, err
+		return While{cond, body, inv}, err
 	case TokIf:
 		p.lexer.next()
 		cond, err := p.parse_exp()
@@ -443,11 +616,54 @@ func (p *Parser) parse_stmt() (Stmt, error) {
 		p.lexer.next()
 		exp, err := p.parse_exp()
 		return Print{exp}, err
+	case TokSkip:
+		p.lexer.next()
+		return Skip{}, nil
+	case TokRead:
+		p.lexer.next()
+		if p.lexer.tokType != TokName {
+			return Seq{}, p.err_expected("variable name")
+		}
+		lhs := p.lexer.tok.String()
+		p.name(lhs)
+		return Read{lhs}, nil
+	case TokRequires:
+		p.lexer.next()
+		exp, err := p.parse_exp()
+		return Requires{exp}, err
+	case TokEnsures:
+		p.lexer.next()
+		exp, err := p.parse_exp()
+		return Ensures{exp}, err
+	case TokAssert:
+		p.lexer.next()
+		exp, err := p.parse_exp()
+		return Assert{exp}, err
+	case TokAssume:
+		p.lexer.next()
+		exp, err := p.parse_exp()
+		return Assume{exp}, err
+	case TokTest:
+		p.lexer.next()
+		if p.lexer.tokType != TokString {
+			return Seq{}, p.err_expected("name of the test")
+		}
+		name := strings.Trim(p.lexer.tok.String(), "\"")
+		p.lexer.next()
+		body, err := p.parse_block()
+		return TestBlock{name, body}, err
 	default:
 		return Seq{}, p.err_expected("name or keyword")
 	}
 }
 
+// consume the variable name x on the left-hand side of a statement
+func (p *Parser) name(x string) {
+	start := p.lexer.start
+	p.lexer.next()
+	p.record(start, lhs(x))
+}
+
 func (p *Parser) parse_block() (Stmt, error) {
 	if p.lexer.tokType != TokBraceOpen {
 		return Seq{}, p.err_expected("\"{\"")
@@ -464,11 +680,15 @@ func (p *Parser) parse_block() (Stmt, error) {
 }
 
 func (p *Parser) parse_exp() (Exp, error) {
+	start := p.lexer.start
 	exp2, err := p.parse_exp2()
 	if err != nil {
 		return exp2, err
 	}
 	exp, err := p.parse_comp(exp2)
+	if err == nil {
+		p.record(start, exp)
+	}
 	return exp, err
 }
 
@@ -496,11 +716,15 @@ func (p *Parser) parse_comp(lhs Exp) (Exp, error) {
 }
 
 func (p *Parser) parse_exp2() (Exp, error) {
+	start := p.lexer.start
 	term, err := p.parse_term()
 	if err != nil {
 		return term, err
 	}
 	exp, err := p.parse_exp3(term)
+	if err == nil {
+		p.record(start, exp)
+	}
 	return exp, err
 }
 
@@ -525,11 +749,16 @@ func (p *Parser) parse_exp3(lhs Exp) (Exp, error) {
 }
 
 func (p *Parser) parse_term() (Exp, error) {
+	start := p.lexer.start
 	factor, err := p.parse_factor()
 	if err != nil {
 		return factor, err
 	}
-	return p.parse_term2(factor)
+	term, err := p.parse_term2(factor)
+	if err == nil {
+		p.record(start, term)
+	}
+	return term, err
 }
 
 func (p *Parser) parse_term2(lhs Exp) (Exp, error) {
@@ -553,6 +782,15 @@ func (p *Parser) parse_term2(lhs Exp) (Exp, error) {
 }
 
 func (p *Parser) parse_factor() (Exp, error) {
+	start := p.lexer.start
+	factor, err := p.parse_factor_kind()
+	if err == nil {
+		p.record(start, factor)
+	}
+	return factor, err
+}
+
+func (p *Parser) parse_factor_kind() (Exp, error) {
 	switch p.lexer.tokType {
 	case TokInt:
 		num, err := strconv.Atoi(p.lexer.tok.String())
@@ -603,7 +841,7 @@ func (p *Parser) parse_factor() (Exp, error) {
 
 // combine statements into nested sequences
 func seq(stmt Stmt, rest ...Stmt) Stmt {
-	if rest == nil {
+	if len(rest) == 0 {
 		return stmt
 	} else if len(rest) > 1 {
 		return Seq{stmt, seq(rest[0], rest[1:]...)}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Predicate transformers
+//
+// weakestPre() and strongestPost() compute wp(prog, Q) and sp(true, prog) as
+// simplified formulas. Like the verifier they work on the resolved program,
+// so declarations are assignments:
+//   wp(x := e, Q) = Q[e/x]             sp(P, x := e) = exists x'. x == e[x'/x] && P[x'/x]
+//   wp(read x, Q) = forall x. Q        sp(P, read x) = exists x'. P[x'/x]
+//   wp(requires e, Q) = e ==> Q        sp(P, requires e) = P && e, the same for assume
+//   wp(assert e, Q) = e && Q           sp(P, assert e) = P && e, the same for ensures
+//   wp(if b {s1} else {s2}, Q) = (b ==> wp(s1, Q)) && (!b ==> wp(s2, Q))
+//   sp(P, if b {s1} else {s2}) = sp(P && b, s1) || sp(P && !b, s2)
+//   wp(while b invariant I {s}, Q) = I && forall x1 ... xn. (I && b ==> wp(s, I)) && (I && !b ==> Q)
+//   sp(P, while b invariant I {s}) = (exists x1' ... xn'. P[x'/x]) && I && !b
+// where x1 ... xn are the variables written by the loop body. Variables
+// declared in a branch are existentially quantified at its end. A loop
+// without invariant has the invariant true, which gives a stronger
+// precondition and a weaker postcondition than the loop actually has.
+
+type transformer struct {
+	types    map[string]Type // types of the bindings
+	declared map[string]bool // bindings declared so far by sp
+}
+
+func newTransformer(types map[string]Type) *transformer {
+	return &transformer{types, make(map[string]bool)}
+}
+
+// weakest precondition of a well-typed program for a postcondition over its final state
+func weakestPre(prog Program, post Exp) (Exp, error) {
+	resolved, post, types, err := resolvePost(prog, post)
+	if err != nil {
+		return nil, err
+	}
+	t := newTransformer(types)
+	return t.display(simplify(t.wp(resolved, post))), nil
+}
+
+// strongest postcondition of a well-typed program, starting from true
+func strongestPost(prog Program) Exp {
+	resolved, types := resolveTyped(prog)
+	t := newTransformer(types)
+	return t.display(simplify(t.sp(Bool(true), resolved)))
+}
+
+func (t *transformer) wp(stmt Stmt, q Exp) Exp {
+	switch stmt := stmt.(type) {
+	case Seq:
+		return t.wp(stmt[0], t.wp(stmt[1], q))
+	case Decl:
+		return subst(q, stmt.lhs, stmt.rhs)
+	case Assign:
+		return subst(q, stmt.lhs, stmt.rhs)
+	case Read:
+		return forall(stmt.lhs, t.types[stmt.lhs], q)
+	case Requires:
+		return implies(stmt.exp, q)
+	case Assume:
+		return implies(stmt.exp, q)
+	case Ensures:
+		return and(stmt.exp, q)
+	case Assert:
+		return and(stmt.exp, q)
+	case IfThenElse:
+		return and(implies(stmt.cond, t.wp(stmt.thenStmt, q)), implies(not(stmt.cond), t.wp(stmt.elseStmt, q)))
+	case While:
+		inv := stmt.inv
+		if inv == nil {
+			inv = Bool(true)
+		}
+		body := and(implies(and(inv, stmt.cond), t.wp(stmt.body, inv)), implies(and(inv, not(stmt.cond)), q))
+		mod := sortedVars(writtenVars(stmt.body))
+		for i := len(mod) - 1; i >= 0; i-- {
+			body = forall(mod[i], t.types[mod[i]], body)
+		}
+		return and(inv, body)
+	case Located:
+		return t.wp(stmt.stmt, q)
+	default:
+		return q
+	}
+}
+
+func (t *transformer) sp(p Exp, stmt Stmt) Exp {
+	switch stmt := stmt.(type) {
+	case Seq:
+		return t.sp(t.sp(p, stmt[0]), stmt[1])
+	case Decl:
+		t.declared[stmt.lhs] = true
+		return t.assign(p, stmt.lhs, stmt.rhs)
+	case Assign:
+		return t.assign(p, stmt.lhs, stmt.rhs)
+	case Read:
+		x := prime(stmt.lhs, freeVars(p))
+		return exists(x, t.types[stmt.lhs], subst(p, stmt.lhs, Var(x)))
+	case Requires:
+		return and(p, stmt.exp)
+	case Assume:
+		return and(p, stmt.exp)
+	case Ensures:
+		return and(p, stmt.exp)
+	case Assert:
+		return and(p, stmt.exp)
+	case IfThenElse:
+		thenPost := t.block(and(p, stmt.cond), stmt.thenStmt)
+		elsePost := t.block(and(p, not(stmt.cond)), stmt.elseStmt)
+		return or(thenPost, elsePost)
+	case While:
+		for _, x := range sortedVars(writtenVars(stmt.body)) {
+			y := prime(x, freeVars(p))
+			p = exists(y, t.types[x], subst(p, x, Var(y)))
+		}
+		if stmt.inv != nil {
+			p = and(p, stmt.inv)
+		}
+		return and(p, not(stmt.cond))
+	case Located:
+		return t.sp(p, stmt.stmt)
+	default:
+		return p
+	}
+}
+
+// x = e, where x has been declared
+func (t *transformer) assign(p Exp, x string, e Exp) Exp {
+	y := prime(x, freeVars(p))
+	return exists(y, t.types[x], and(equal(Var(x), subst(e, x, Var(y))), subst(p, x, Var(y))))
+}
+
+// sp of a block, hiding the variables declared in it
+func (t *transformer) block(p Exp, stmt Stmt) Exp {
+	outer := copySet(t.declared)
+	p = t.sp(p, stmt)
+	var locals []string
+	for x := range t.declared {
+		if !outer[x] {
+			locals = append(locals, x)
+		}
+	}
+	sort.Strings(locals)
+	for _, x := range locals {
+		p = exists(x, t.types[x], p)
+	}
+	t.declared = outer
+	return p
+}
+
+// show unique names in source form, unless the variable has several bindings
+func (t *transformer) display(f Exp) Exp {
+	bindings := make(map[string]int)
+	for x := range t.types {
+		bindings[sourceName(x)]++
+	}
+	return mapExpVars(f, func(x string) string {
+		name := sourceName(x)
+		if bindings[name] != 1 {
+			return x
+		}
+		return name + strings.Repeat("'", len(x)-len(strings.TrimRight(x, "'")))
+	})
+}
+
+func sortedVars(vars map[string]bool) []string {
+	ret := make([]string, 0, len(vars))
+	for x := range vars {
+		ret = append(ret, x)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func wp_cmd(args []string) int {
+	fs := flag.NewFlagSet("wp", flag.ExitOnError)
+	latex := fs.Bool("latex", false, "print the formula in LaTeX notation")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	post, err := newParser().parse_expfromstring(fs.Arg(1))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	f, err := weakestPre(prog, post)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(showFormula(f, *latex))
+	return 0
+}
+
+func sp_cmd(args []string) int {
+	fs := flag.NewFlagSet("sp", flag.ExitOnError)
+	latex := fs.Bool("latex", false, "print the formula in LaTeX notation")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(showFormula(strongestPost(prog), *latex))
+	return 0
+}
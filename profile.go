@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Profiler
+//
+// With profiling enabled, the evaluator counts how often every statement
+// with a source position is executed, how many iterations every loop runs,
+// and the wall time spent in every statement: total time including nested
+// statements, and self time excluding them. The report lists the hottest
+// statements and annotates the source with counts and self times. The self
+// times are also written in folded-stack format, one line per stack of
+// nested statements ("frame;frame;frame nanoseconds"), for flame graphs.
+
+type stmtProfile struct {
+	stmt        Stmt
+	pos         Pos
+	count       int // executions
+	iterations  int // of a loop
+	total, self time.Duration
+}
+
+type profileFrame struct {
+	stats    *stmtProfile
+	name     string        // in folded stacks
+	children time.Duration // total time of the nested statements
+}
+
+// state of the profiling evaluator
+var prof struct {
+	enabled bool
+	now     func() time.Time // the clock, replaced by tests
+	stats   map[Pos]*stmtProfile
+	stack   []profileFrame
+	folded  map[string]time.Duration // self time of every stack
+}
+
+func startProfile() {
+	prof.enabled = true
+	prof.now = time.Now
+	prof.stats = make(map[Pos]*stmtProfile)
+	prof.stack = nil
+	prof.folded = make(map[string]time.Duration)
+}
+
+// run a located statement, measuring it
+func profileStmt(l Located, s ValState) {
+	p := prof.stats[l.pos]
+	if p == nil {
+		p = &stmtProfile{stmt: l.stmt, pos: l.pos}
+		prof.stats[l.pos] = p
+	}
+	p.count++
+	// ";" separates the frames of folded stacks
+	name := strings.ReplaceAll(fmt.Sprintf("%s: %s", l.pos, stmtHeader(l.stmt)), ";", ",")
+	prof.stack = append(prof.stack, profileFrame{stats: p, name: name})
+	start := prof.now()
+	l.stmt.eval(s)
+	elapsed := prof.now().Sub(start)
+
+	frame := prof.stack[len(prof.stack)-1]
+	var names []string
+	for _, f := range prof.stack {
+		names = append(names, f.name)
+	}
+	prof.stack = prof.stack[:len(prof.stack)-1]
+	p.total += elapsed
+	p.self += elapsed - frame.children
+	prof.folded[strings.Join(names, ";")] += elapsed - frame.children
+	if n := len(prof.stack); n > 0 {
+		prof.stack[n-1].children += elapsed
+	}
+}
+
+// the innermost loop runs another iteration
+func profileIteration() {
+	if prof.enabled && len(prof.stack) > 0 {
+		prof.stack[len(prof.stack)-1].stats.iterations++
+	}
+}
+
+// statement profiles, most total time first
+func sortedProfiles() []*stmtProfile {
+	var ret []*stmtProfile
+	for _, p := range prof.stats {
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].total != ret[j].total {
+			return ret[i].total > ret[j].total
+		}
+		return ret[i].pos.line < ret[j].pos.line || ret[i].pos.line == ret[j].pos.line && ret[i].pos.col < ret[j].pos.col
+	})
+	return ret
+}
+
+// the top statements by total time, then the loops by iterations
+func writeProfileReport(w io.Writer, top int) {
+	profiles := sortedProfiles()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "hot statements:")
+	fmt.Fprintln(tw, "line\tcount\ttotal\tself\t\t")
+	for i, p := range profiles {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t\t%s\n", p.pos.line, p.count, p.total, p.self, stmtHeader(p.stmt))
+	}
+	tw.Flush()
+
+	var loops []*stmtProfile
+	for _, p := range profiles {
+		if _, ok := p.stmt.(While); ok {
+			loops = append(loops, p)
+		}
+	}
+	if len(loops) == 0 {
+		return
+	}
+	sort.SliceStable(loops, func(i, j int) bool { return loops[i].iterations > loops[j].iterations })
+	fmt.Fprintln(w, "\nhot loops:")
+	fmt.Fprintln(tw, "line\tentered\titerations\tper entry\ttotal\t\t")
+	for _, p := range loops {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%.1f\t%s\t\t%s\n", p.pos.line, p.count, p.iterations, float64(p.iterations)/float64(p.count), p.total, stmtHeader(p.stmt))
+	}
+	tw.Flush()
+}
+
+// the source with the executions and self time of the statements on every line
+func writeAnnotatedSource(w io.Writer, source string) {
+	type lineProfile struct {
+		count int
+		self  time.Duration
+	}
+	lines := make(map[int]*lineProfile)
+	for pos, p := range prof.stats {
+		l := lines[pos.line]
+		if l == nil {
+			l = &lineProfile{}
+			lines[pos.line] = l
+		}
+		if p.count > l.count {
+			l.count = p.count
+		}
+		l.self += p.self
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "count\tself\t\t")
+	for i, text := range strings.Split(strings.TrimSuffix(source, "\n"), "\n") {
+		// tabs in the source would be taken for cells
+		text = strings.ReplaceAll(text, "\t", "    ")
+		if l := lines[i+1]; l != nil {
+			fmt.Fprintf(tw, "%d\t%s\t\t%s\n", l.count, l.self, text)
+		} else {
+			fmt.Fprintf(tw, "\t\t\t%s\n", text)
+		}
+	}
+	tw.Flush()
+}
+
+// one line per stack of statements with its self time in nanoseconds
+func writeFoldedStacks(w io.Writer) {
+	var stacks []string
+	for stack := range prof.folded {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	for _, stack := range stacks {
+		fmt.Fprintf(w, "%s %d\n", stack, prof.folded[stack].Nanoseconds())
+	}
+}
+
+func profile_cmd(args []string) int {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	folded := fs.String("folded", "", "write folded stacks for flame graphs to this file")
+	top := fs.Int("top", 10, "number of hot statements listed")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	source, _ := os.ReadFile(fs.Arg(0))
+
+	startProfile()
+	prog.eval(newValState())
+	prof.enabled = false
+
+	fmt.Println()
+	writeProfileReport(os.Stdout, *top)
+	fmt.Println()
+	writeAnnotatedSource(os.Stdout, string(source))
+	if *folded != "" {
+		f, err := os.Create(*folded)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer f.Close()
+		writeFoldedStacks(f)
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Rename refactoring
+//
+// rename() renames one variable: the declaration of the variable at an
+// offset and the uses referring to it, resolved like go to definition in the
+// language server. Variables of the same name declared in other blocks, or
+// shadowing it in inner blocks, are left alone. Only the names are replaced,
+// so the rest of the source keeps its formatting and comments.
+//
+// The variables of the renamed source are resolved again, and the rename is
+// refused if any of them refers to another declaration than before: a
+// renamed use captured by a declaration of the new name,
+//
+//	x := 1; if c { y := 2; print x; } ...   (rename x to y)
+//
+// or a use of the new name captured by the renamed declaration. At runtime
+// a declaration updates a variable of the same name and type declared in an
+// outer scope instead of shadowing it (see ValState.declare), so the rename
+// is also refused if it splits or joins such a pair,
+//
+//	x := 1; if c { x := 2; } ...   (rename either x)
+
+// the variable names in a document, in source order, and for each the index
+// of the name in the declaration it refers to, -1 if it is not declared
+func (doc *document) bindings() ([]span, []int) {
+	var names []span
+	for _, s := range doc.spans {
+		var name string
+		switch node := s.node.(type) {
+		case Var:
+			name = string(node)
+		case lhs:
+			name = string(node)
+		default:
+			continue
+		}
+		// not a parenthesized variable
+		if doc.text[s.start:s.end] == name {
+			names = append(names, s)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].start < names[j].start })
+	index := make(map[int]int) // by offset
+	for i, s := range names {
+		index[s.start] = i
+	}
+	decls := make([]int, len(names))
+	for i, s := range names {
+		decls[i] = -1
+		if def, ok := doc.definition(s.start); ok {
+			if j, ok := index[def.start]; ok {
+				decls[i] = j
+			}
+		}
+	}
+	return names, decls
+}
+
+// for the name of every declaration that updates a variable of an outer
+// scope at runtime, the index of the name declaring that variable
+func (doc *document) updates(names []span) map[int]int {
+	index := make(map[Pos]int) // by declaring statement
+	for i, s := range names {
+		if _, ok := s.node.(lhs); !ok {
+			continue
+		}
+		if stmt, ok := doc.spanAt(s.start, true); ok {
+			index[stmt.node.(Located).pos] = i
+		}
+	}
+	ret := make(map[int]int)
+	for pos, i := range index {
+		x := string(names[i].node.(lhs))
+		if _, ok := doc.stmts[pos].node.(Located).stmt.(Decl); !ok {
+			continue
+		}
+		def, _ := doc.after[pos].lookup(x)
+		// the variable ValState.declare updates, if declared in an outer scope
+		scopes := doc.before[pos]
+		if k, update := declScope(scopes, x, def.ty); update && k < len(scopes)-1 {
+			if j, ok := index[scopes[k][x].pos]; ok {
+				ret[i] = j
+			}
+		}
+	}
+	return ret
+}
+
+// line of a byte offset, counted from 1
+func (doc *document) line(offset int) int {
+	return doc.position(offset).Line + 1
+}
+
+// the source with the variable at the offset renamed
+func rename(text string, offset int, to string) (string, int, error) {
+	if rIdent.FindString(to) != to {
+		return "", 0, fmt.Errorf("%s is not a variable name", to)
+	}
+	if _, ok := keywords[to]; ok {
+		return "", 0, fmt.Errorf("%s is a keyword", to)
+	}
+	doc := analyzeDocument(text)
+	if len(doc.diagnostics) > 0 {
+		d := doc.diagnostics[0]
+		return "", 0, fmt.Errorf("line %d: %s", doc.line(d.start), d.message)
+	}
+	names, decls := doc.bindings()
+	decl := -1
+	for i, s := range names {
+		if s.start <= offset && offset < s.end {
+			decl = decls[i]
+		}
+	}
+	if decl < 0 {
+		return "", 0, fmt.Errorf("no declared variable at line %d", doc.line(offset))
+	}
+	from := text[names[decl].start:names[decl].end]
+
+	var b strings.Builder
+	last, renamed := 0, 0
+	for i, s := range names {
+		if decls[i] == decl {
+			b.WriteString(text[last:s.start] + to)
+			last = s.end
+			renamed++
+		}
+	}
+	b.WriteString(text[last:])
+
+	after := analyzeDocument(b.String())
+	newNames, newDecls := after.bindings()
+	if len(newNames) != len(names) {
+		return "", 0, fmt.Errorf("%s cannot be renamed to %s", from, to)
+	}
+	for i, s := range newNames {
+		switch {
+		case newDecls[i] == decls[i]:
+		case decls[i] == decl:
+			return "", 0, fmt.Errorf("%s on line %d would refer to the %s declared on line %d",
+				from, doc.line(names[i].start), to, after.line(newNames[newDecls[i]].start))
+		case newDecls[i] == decl:
+			return "", 0, fmt.Errorf("%s on line %d would refer to the renamed %s declared on line %d",
+				to, after.line(s.start), from, doc.line(names[decl].start))
+		default:
+			return "", 0, fmt.Errorf("%s on line %d would refer to another variable", to, after.line(s.start))
+		}
+	}
+	updates, newUpdates := doc.updates(names), after.updates(newNames)
+	for i := range names {
+		j, ok := updates[i]
+		k, newOk := newUpdates[i]
+		switch {
+		case ok && (!newOk || j != k):
+			x := text[names[i].start:names[i].end]
+			return "", 0, fmt.Errorf("the declaration of %s on line %d updates the %s declared on line %d at runtime",
+				x, doc.line(names[i].start), x, doc.line(names[j].start))
+		case newOk && (!ok || j != k):
+			return "", 0, fmt.Errorf("the declaration of %s on line %d would update the %s declared on line %d at runtime",
+				to, after.line(newNames[i].start), to, after.line(newNames[k].start))
+		}
+	}
+	if len(after.diagnostics) > 0 {
+		return "", 0, fmt.Errorf("%s cannot be renamed to %s", from, to)
+	}
+	return b.String(), renamed, nil
+}
+
+func rename_cmd(args []string) int {
+	fs := flag.NewFlagSet("rename", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		usage()
+	}
+	path, to := fs.Arg(0), fs.Arg(2)
+	var line, col int
+	if _, err := fmt.Sscanf(fs.Arg(1), "%d:%d", &line, &col); err != nil || line < 1 || col < 1 {
+		usage()
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	doc := &document{text: string(text)}
+	renamed, n, err := rename(doc.text, doc.offset(lspPosition{line - 1, col - 1}), to)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err := os.WriteFile(path, []byte(renamed), 0o644); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("renamed %d occurrences\n", n)
+	return 0
+}
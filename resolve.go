@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Name resolution
+//
+// resolve() gives every variable binding of a well-typed program a unique name
+// of the form "x#1", "x#2", ... so that later passes can treat variable names as
+// bindings without worrying about shadowing. Bindings are created and updated
+// by the same rules as ValState.declare, using the static types of the
+// declared expressions. unresolve() strips the suffixes again.
+
+type binding struct {
+	name string // unique name
+	ty   Type
+}
+type ResState = Scopes[binding]
+
+func (b binding) typ() Type {
+	return b.ty
+}
+
+type resolver struct {
+	scopes ResState
+	count  map[string]int  // number of bindings per source name
+	types  map[string]Type // type of every unique name
+}
+
+func resolve(stmt Stmt) Stmt {
+	ret, _ := resolveTyped(stmt)
+	return ret
+}
+
+func newResolver() *resolver {
+	return &resolver{newScopes[binding](), make(map[string]int), make(map[string]Type)}
+}
+
+// resolve, and also return the type of every binding
+func resolveTyped(stmt Stmt) (Stmt, map[string]Type) {
+	r := newResolver()
+	return r.stmt(stmt), r.types
+}
+
+// bind a declaration to the variable it updates at runtime, the most recent
+// one of its name and type, or else to a new one in the current scope
+func (r *resolver) declare(name string, ty Type) string {
+	i, update := declScope(r.scopes, name, ty)
+	if update {
+		return r.scopes[i][name].name
+	}
+	r.count[name]++
+	b := binding{name + "#" + strconv.Itoa(r.count[name]), ty}
+	r.scopes[i][name] = b
+	r.types[b.name] = ty
+	return b.name
+}
+
+// unique name of a variable use. unbound variables keep their name
+func (r *resolver) use(name string) string {
+	if b, ok := r.scopes.lookup(name); ok {
+		return b.name
+	}
+	return name
+}
+
+func (r *resolver) stmt(stmt Stmt) Stmt {
+	switch stmt := stmt.(type) {
+	case Seq:
+		first := r.stmt(stmt[0])
+		return Seq{first, r.stmt(stmt[1])}
+	case Decl:
+		rhs := r.exp(stmt.rhs)
+		ty := stmt.rhs.infer(r.scopes.types())
+		return Decl{r.declare(stmt.lhs, ty), rhs, stmt.label}
+	case Assign:
+		return Assign{r.use(stmt.lhs), r.exp(stmt.rhs)}
+	case Print:
+		return Print{r.exp(stmt.exp)}
+	case IfThenElse:
+		cond := r.exp(stmt.cond)
+		r.scopes.startBlock()
+		thenStmt := r.stmt(stmt.thenStmt)
+		r.scopes.endBlock()
+		r.scopes.startBlock()
+		elseStmt := r.stmt(stmt.elseStmt)
+		r.scopes.endBlock()
+		return IfThenElse{cond, thenStmt, elseStmt}
+	case While:
+		cond := r.exp(stmt.cond)
+		inv := mapSpec(stmt.inv, r.exp)
+		r.scopes.startBlock()
+		body := r.stmt(stmt.body)
+		r.scopes.endBlock()
+		return While{cond, body, inv}
+	case Read:
+		return Read{r.use(stmt.lhs)}
+	case Requires:
+		return Requires{r.exp(stmt.exp)}
+	case Ensures:
+		return Ensures{r.exp(stmt.exp)}
+	case Assert:
+		return Assert{r.exp(stmt.exp)}
+	case Assume:
+		return Assume{r.exp(stmt.exp)}
+	case Located:
+		return Located{stmt.pos, r.stmt(stmt.stmt)}
+	default:
+		return stmt
+	}
+}
+
+// resolve a program and a condition on its final state. the condition
+// must be a Bool expression over the variables in scope at the end
+func resolvePost(stmt Stmt, post Exp) (Stmt, Exp, map[string]Type, error) {
+	r := newResolver()
+	stmt = r.stmt(stmt)
+	if post.infer(r.scopes.types()) != TyBool {
+		return stmt, post, r.types, fmt.Errorf("%s is not a Bool expression over the program's variables", post.pretty())
+	}
+	return stmt, r.exp(post), r.types, nil
+}
+
+func (r *resolver) exp(e Exp) Exp {
+	return mapExpVars(e, r.use)
+}
+
+// strip the suffixes added by resolve()
+func unresolve(stmt Stmt) Stmt {
+	return mapStmtVars(stmt, sourceName)
+}
+
+func sourceName(name string) string {
+	before, _, _ := strings.Cut(name, "#")
+	return before
+}
+
+// Helpers to rename variables
+
+// rename every variable occurring in a statement
+func mapStmtVars(stmt Stmt, f func(string) string) Stmt {
+	rename := func(e Exp) Exp { return mapExpVars(e, f) }
+	switch stmt := stmt.(type) {
+	case Seq:
+		return Seq{mapStmtVars(stmt[0], f), mapStmtVars(stmt[1], f)}
+	case Decl:
+		return Decl{f(stmt.lhs), mapExpVars(stmt.rhs, f), stmt.label}
+	case Assign:
+		return Assign{f(stmt.lhs), mapExpVars(stmt.rhs, f)}
+	case Print:
+		return Print{mapExpVars(stmt.exp, f)}
+	case IfThenElse:
+		return IfThenElse{mapExpVars(stmt.cond, f), mapStmtVars(stmt.thenStmt, f), mapStmtVars(stmt.elseStmt, f)}
+	case While:
+		return While{mapExpVars(stmt.cond, f), mapStmtVars(stmt.body, f), mapSpec(stmt.inv, rename)}
+	case Read:
+		return Read{f(stmt.lhs)}
+	case Requires:
+		return Requires{rename(stmt.exp)}
+	case Ensures:
+		return Ensures{rename(stmt.exp)}
+	case Assert:
+		return Assert{rename(stmt.exp)}
+	case Assume:
+		return Assume{rename(stmt.exp)}
+	case Located:
+		return Located{stmt.pos, mapStmtVars(stmt.stmt, f)}
+	default:
+		return stmt
+	}
+}
+
+// rename every variable occurring in an expression
+func mapExpVars(e Exp, f func(string) string) Exp {
+	switch e := e.(type) {
+	case Var:
+		return Var(f(string(e)))
+	case Plus:
+		return plus(mapExpVars(e[0], f), mapExpVars(e[1], f))
+	case Mult:
+		return mult(mapExpVars(e[0], f), mapExpVars(e[1], f))
+	case Equal:
+		return equal(mapExpVars(e[0], f), mapExpVars(e[1], f))
+	case Less:
+		return less(mapExpVars(e[0], f), mapExpVars(e[1], f))
+	case And:
+		return and(mapExpVars(e[0], f), mapExpVars(e[1], f))
+	case Or:
+		return or(mapExpVars(e[0], f), mapExpVars(e[1], f))
+	case Not:
+		return not(mapExpVars(e.exp, f))
+	case Implies:
+		return implies(mapExpVars(e[0], f), mapExpVars(e[1], f))
+	case Forall:
+		return forall(f(e.x), e.ty, mapExpVars(e.body, f))
+	case Exists:
+		return exists(f(e.x), e.ty, mapExpVars(e.body, f))
+	default:
+		return e
+	}
+}
+
+// names of all variables read by an expression
+func expVars(e Exp) map[string]bool {
+	vars := make(map[string]bool)
+	mapExpVars(e, func(name string) string {
+		vars[name] = true
+		return name
+	})
+	return vars
+}
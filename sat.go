@@ -0,0 +1,445 @@
+package main
+
+// SAT solver
+//
+// A CDCL solver in the style of MiniSat: two watched literals per clause,
+// first-UIP clause learning with non-chronological backjumping, VSIDS
+// variable activities, phase saving and Luby restarts. Learnt clauses are
+// kept forever, which is fine for the formulas of the bounded model checker.
+// solve() takes assumptions, so the same clause database can be queried for
+// several properties, and clauses may be added between calls.
+
+// literal of variable v: 2v for v, 2v+1 for !v. variable 0 is unused
+type lit int
+
+func (l lit) not() lit {
+	return l ^ 1
+}
+
+func (l lit) variable() int {
+	return int(l) >> 1
+}
+
+type clause struct {
+	lits []lit // lits[0] and lits[1] are watched
+}
+
+const (
+	lUndef int8 = 0
+	lTrue  int8 = 1
+	lFalse int8 = -1
+)
+
+type satSolver struct {
+	ok       bool      // false once the clauses are unsatisfiable
+	assigns  []int8    // value of every variable
+	level    []int     // decision level of every assigned variable
+	reason   []*clause // clause that implied the variable, nil for decisions
+	polarity []bool    // last value, to decide the same again
+	activity []float64
+	varInc   float64
+	order    varHeap // unassigned variables by activity
+	watches  [][]*clause
+	trail    []lit // assigned literals in order
+	trailLim []int // trail index where each decision level starts
+	qhead    int   // next literal on the trail to propagate
+	seen     []bool
+	model    []bool
+}
+
+func newSatSolver() *satSolver {
+	s := &satSolver{ok: true, varInc: 1}
+	s.order.activity = &s.activity
+	s.newVar() // variable 0
+	return s
+}
+
+// positive literal of a new variable
+func (s *satSolver) newVar() lit {
+	v := len(s.assigns)
+	s.assigns = append(s.assigns, lUndef)
+	s.level = append(s.level, 0)
+	s.reason = append(s.reason, nil)
+	s.polarity = append(s.polarity, false)
+	s.activity = append(s.activity, 0)
+	s.seen = append(s.seen, false)
+	s.watches = append(s.watches, nil, nil)
+	if v > 0 {
+		s.order.insert(v)
+	}
+	return lit(2 * v)
+}
+
+func (s *satSolver) value(l lit) int8 {
+	v := s.assigns[l.variable()]
+	if l&1 == 1 {
+		return -v
+	}
+	return v
+}
+
+func (s *satSolver) decisionLevel() int {
+	return len(s.trailLim)
+}
+
+// add a clause at decision level 0. false if the clauses became unsatisfiable
+func (s *satSolver) addClause(lits ...lit) bool {
+	if !s.ok {
+		return false
+	}
+	s.cancelUntil(0)
+	var ps []lit
+	for _, l := range lits {
+		switch s.value(l) {
+		case lTrue:
+			return true
+		case lFalse:
+			continue
+		}
+		dup := false
+		for _, p := range ps {
+			if p == l.not() {
+				return true // tautology
+			}
+			dup = dup || p == l
+		}
+		if !dup {
+			ps = append(ps, l)
+		}
+	}
+	switch len(ps) {
+	case 0:
+		s.ok = false
+	case 1:
+		s.enqueue(ps[0], nil)
+		s.ok = s.propagate() == nil
+	default:
+		s.attach(&clause{ps})
+	}
+	return s.ok
+}
+
+func (s *satSolver) attach(c *clause) {
+	s.watches[c.lits[0].not()] = append(s.watches[c.lits[0].not()], c)
+	s.watches[c.lits[1].not()] = append(s.watches[c.lits[1].not()], c)
+}
+
+func (s *satSolver) enqueue(l lit, from *clause) {
+	v := l.variable()
+	s.assigns[v] = lTrue
+	if l&1 == 1 {
+		s.assigns[v] = lFalse
+	}
+	s.level[v] = s.decisionLevel()
+	s.reason[v] = from
+	s.trail = append(s.trail, l)
+}
+
+// unit propagation. returns a conflicting clause, or nil
+func (s *satSolver) propagate() *clause {
+	for s.qhead < len(s.trail) {
+		p := s.trail[s.qhead]
+		s.qhead++
+		falseLit := p.not()
+		ws := s.watches[p]
+		i, j := 0, 0
+		for i < len(ws) {
+			c := ws[i]
+			i++
+			if c.lits[0] == falseLit {
+				c.lits[0], c.lits[1] = c.lits[1], c.lits[0]
+			}
+			if s.value(c.lits[0]) == lTrue {
+				ws[j] = c
+				j++
+				continue
+			}
+			found := false
+			for k := 2; k < len(c.lits); k++ {
+				if s.value(c.lits[k]) != lFalse {
+					c.lits[1], c.lits[k] = c.lits[k], c.lits[1]
+					s.watches[c.lits[1].not()] = append(s.watches[c.lits[1].not()], c)
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+			ws[j] = c
+			j++
+			if s.value(c.lits[0]) == lFalse {
+				j += copy(ws[j:], ws[i:])
+				s.watches[p] = ws[:j]
+				s.qhead = len(s.trail)
+				return c
+			}
+			s.enqueue(c.lits[0], c)
+		}
+		s.watches[p] = ws[:j]
+	}
+	return nil
+}
+
+// first-UIP learnt clause for a conflict, and the level to backjump to
+func (s *satSolver) analyze(confl *clause) ([]lit, int) {
+	learnt := []lit{0} // learnt[0] is the asserting literal
+	pathC := 0
+	var p lit = -1
+	index := len(s.trail) - 1
+	c := confl
+	for {
+		for _, q := range c.lits {
+			if q == p {
+				continue
+			}
+			v := q.variable()
+			if !s.seen[v] && s.level[v] > 0 {
+				s.seen[v] = true
+				s.bump(v)
+				if s.level[v] == s.decisionLevel() {
+					pathC++
+				} else {
+					learnt = append(learnt, q)
+				}
+			}
+		}
+		for !s.seen[s.trail[index].variable()] {
+			index--
+		}
+		p = s.trail[index]
+		index--
+		c = s.reason[p.variable()]
+		s.seen[p.variable()] = false
+		pathC--
+		if pathC == 0 {
+			break
+		}
+	}
+	learnt[0] = p.not()
+
+	back := 0
+	for i := 1; i < len(learnt); i++ {
+		s.seen[learnt[i].variable()] = false
+		if l := s.level[learnt[i].variable()]; l > back {
+			back = l
+			learnt[1], learnt[i] = learnt[i], learnt[1]
+		}
+	}
+	return learnt, back
+}
+
+func (s *satSolver) bump(v int) {
+	s.activity[v] += s.varInc
+	if s.activity[v] > 1e100 {
+		for i := range s.activity {
+			s.activity[i] *= 1e-100
+		}
+		s.varInc *= 1e-100
+	}
+	s.order.update(v)
+}
+
+func (s *satSolver) cancelUntil(level int) {
+	if s.decisionLevel() <= level {
+		return
+	}
+	for i := len(s.trail) - 1; i >= s.trailLim[level]; i-- {
+		v := s.trail[i].variable()
+		s.polarity[v] = s.assigns[v] == lTrue
+		s.assigns[v] = lUndef
+		s.reason[v] = nil
+		s.order.insert(v)
+	}
+	s.trail = s.trail[:s.trailLim[level]]
+	s.trailLim = s.trailLim[:level]
+	s.qhead = len(s.trail)
+}
+
+// unassigned variable with the highest activity, 0 if all are assigned
+func (s *satSolver) pickBranch() int {
+	for !s.order.empty() {
+		if v := s.order.pop(); s.assigns[v] == lUndef {
+			return v
+		}
+	}
+	return 0
+}
+
+// whether the clauses and the assumptions are satisfiable. the assignment
+// found is available with modelValue() afterwards
+func (s *satSolver) solve(assumptions ...lit) bool {
+	if !s.ok {
+		return false
+	}
+	s.cancelUntil(0)
+	for restart := 1; ; restart++ {
+		switch s.search(100*luby(restart), assumptions) {
+		case lTrue:
+			s.model = make([]bool, len(s.assigns))
+			for v := range s.assigns {
+				s.model[v] = s.assigns[v] == lTrue
+			}
+			s.cancelUntil(0)
+			return true
+		case lFalse:
+			s.cancelUntil(0)
+			return false
+		}
+	}
+}
+
+// CDCL until a model is found, unsatisfiability is shown or the conflict
+// budget is used up (lUndef)
+func (s *satSolver) search(budget int, assumptions []lit) int8 {
+	conflicts := 0
+	for {
+		if confl := s.propagate(); confl != nil {
+			conflicts++
+			if s.decisionLevel() == 0 {
+				s.ok = false
+				return lFalse
+			}
+			learnt, back := s.analyze(confl)
+			s.cancelUntil(back)
+			if len(learnt) == 1 {
+				s.enqueue(learnt[0], nil)
+			} else {
+				c := &clause{learnt}
+				s.attach(c)
+				s.enqueue(learnt[0], c)
+			}
+			s.varInc /= 0.95
+			continue
+		}
+		if conflicts >= budget {
+			s.cancelUntil(0)
+			return lUndef
+		}
+		var next lit = -1
+		for s.decisionLevel() < len(assumptions) {
+			p := assumptions[s.decisionLevel()]
+			if s.value(p) == lTrue {
+				// already holds, open an empty level to keep the numbering
+				s.trailLim = append(s.trailLim, len(s.trail))
+				continue
+			} else if s.value(p) == lFalse {
+				return lFalse
+			}
+			next = p
+			break
+		}
+		if next == -1 {
+			v := s.pickBranch()
+			if v == 0 {
+				return lTrue
+			}
+			next = lit(2 * v)
+			if !s.polarity[v] {
+				next = next.not()
+			}
+		}
+		s.trailLim = append(s.trailLim, len(s.trail))
+		s.enqueue(next, nil)
+	}
+}
+
+// value of a literal in the last model
+func (s *satSolver) modelValue(l lit) bool {
+	return s.model[l.variable()] != (l&1 == 1)
+}
+
+// 1, 1, 2, 1, 1, 2, 4, 1, 1, 2, ...
+func luby(i int) int {
+	size, seq := 1, 0
+	for size < i+1 {
+		seq++
+		size = 2*size + 1
+	}
+	for size-1 != i {
+		size = (size - 1) >> 1
+		seq--
+		i = i % size
+	}
+	return 1 << seq
+}
+
+// max-heap of variables by activity
+type varHeap struct {
+	activity *[]float64
+	heap     []int
+	index    []int // position of every variable in heap, -1 if absent
+}
+
+func (h *varHeap) less(i, j int) bool {
+	return (*h.activity)[h.heap[i]] > (*h.activity)[h.heap[j]]
+}
+
+func (h *varHeap) swap(i, j int) {
+	h.heap[i], h.heap[j] = h.heap[j], h.heap[i]
+	h.index[h.heap[i]] = i
+	h.index[h.heap[j]] = j
+}
+
+func (h *varHeap) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !h.less(i, parent) {
+			return
+		}
+		h.swap(i, parent)
+		i = parent
+	}
+}
+
+func (h *varHeap) down(i int) {
+	for {
+		child := 2*i + 1
+		if child >= len(h.heap) {
+			return
+		}
+		if child+1 < len(h.heap) && h.less(child+1, child) {
+			child++
+		}
+		if !h.less(child, i) {
+			return
+		}
+		h.swap(i, child)
+		i = child
+	}
+}
+
+func (h *varHeap) empty() bool {
+	return len(h.heap) == 0
+}
+
+func (h *varHeap) insert(v int) {
+	for len(h.index) <= v {
+		h.index = append(h.index, -1)
+	}
+	if h.index[v] >= 0 {
+		return
+	}
+	h.index[v] = len(h.heap)
+	h.heap = append(h.heap, v)
+	h.up(len(h.heap) - 1)
+}
+
+// restore the heap after the activity of v increased
+func (h *varHeap) update(v int) {
+	if v < len(h.index) && h.index[v] >= 0 {
+		h.up(h.index[v])
+	}
+}
+
+func (h *varHeap) pop() int {
+	v := h.heap[0]
+	last := len(h.heap) - 1
+	h.swap(0, last)
+	h.heap = h.heap[:last]
+	h.index[v] = -1
+	if last > 0 {
+		h.down(0)
+	}
+	return v
+}
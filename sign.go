@@ -0,0 +1,136 @@
+package main
+
+import "strings"
+
+// Sign domain
+//
+// An abstract integer is the set of possible signs: negative, zero and
+// positive. Plus and Mult wrap around on overflow: the sum of two positive
+// numbers may be negative, the sum of two negative numbers may have any sign
+// (the smallest int plus itself is 0), and so may the product of two non-zero
+// numbers (2^32 * 2^32 is 0). The interval domain warns about overflows.
+
+const (
+	signNeg = iota
+	signZero
+	signPos
+	numSigns
+)
+
+type Sign atoms
+
+type SignDomain struct{}
+
+func (SignDomain) bottom() AbsInt {
+	return Sign(0)
+}
+
+func (SignDomain) top() AbsInt {
+	return Sign(1<<numSigns - 1)
+}
+
+func (SignDomain) constant(n int) AbsInt {
+	switch {
+	case n < 0:
+		return Sign(1 << signNeg)
+	case n == 0:
+		return Sign(1 << signZero)
+	}
+	return Sign(1 << signPos)
+}
+
+func (SignDomain) isBottom(a AbsInt) bool {
+	return a.(Sign) == 0
+}
+
+func (SignDomain) leq(a, b AbsInt) bool {
+	return a.(Sign)|b.(Sign) == b.(Sign)
+}
+
+func (SignDomain) join(a, b AbsInt) AbsInt {
+	return a.(Sign) | b.(Sign)
+}
+
+// the domain is finite, so joining terminates
+func (d SignDomain) widen(a, b AbsInt) AbsInt {
+	return d.join(a, b)
+}
+
+func (d SignDomain) plus(a, b AbsInt) AbsInt {
+	return Sign(liftAtoms(atoms(a.(Sign)), atoms(b.(Sign)), numSigns, func(x, y int) atoms {
+		switch {
+		case x == signZero:
+			return 1 << y
+		case y == signZero:
+			return 1 << x
+		case x == signPos && y == signPos:
+			return 1<<signPos | 1<<signNeg
+		}
+		// a negative and a positive number, or wrapping around from below
+		return atoms(d.top().(Sign))
+	}))
+}
+
+func (d SignDomain) mult(a, b AbsInt) AbsInt {
+	return Sign(liftAtoms(atoms(a.(Sign)), atoms(b.(Sign)), numSigns, func(x, y int) atoms {
+		if x == signZero || y == signZero {
+			return 1 << signZero
+		}
+		return atoms(d.top().(Sign))
+	}))
+}
+
+func signLess(x, y int) AbsBool {
+	switch {
+	case x == y && x != signZero:
+		return boolTop
+	case x < y:
+		return boolTrue
+	}
+	return boolFalse
+}
+
+func signEqual(x, y int) AbsBool {
+	switch {
+	case x != y:
+		return boolFalse
+	case x == signZero:
+		return boolTrue
+	}
+	return boolTop
+}
+
+func (SignDomain) less(a, b AbsInt) AbsBool {
+	return liftBool(atoms(a.(Sign)), atoms(b.(Sign)), numSigns, signLess)
+}
+
+func (SignDomain) equal(a, b AbsInt) AbsBool {
+	return liftBool(atoms(a.(Sign)), atoms(b.(Sign)), numSigns, signEqual)
+}
+
+func (SignDomain) assumeLess(a, b AbsInt, truth bool) (AbsInt, AbsInt) {
+	x, y := refineAtoms(atoms(a.(Sign)), atoms(b.(Sign)), numSigns, truth, signLess)
+	return Sign(x), Sign(y)
+}
+
+func (SignDomain) assumeEqual(a, b AbsInt, truth bool) (AbsInt, AbsInt) {
+	x, y := refineAtoms(atoms(a.(Sign)), atoms(b.(Sign)), numSigns, truth, signEqual)
+	return Sign(x), Sign(y)
+}
+
+func (d SignDomain) show(a AbsInt) string {
+	switch s := a.(Sign); s {
+	case 0:
+		return "bottom"
+	case d.top():
+		return "top"
+	default:
+		var signs []string
+		for i, name := range []string{"-", "0", "+"} {
+			if atoms(s).has(i) {
+				signs = append(signs, name)
+			}
+		}
+		return strings.Join(signs, "|")
+	}
+}
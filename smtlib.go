@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SMT-LIB2 export
+//
+// exportSMT() writes the verification conditions of the verifier (see
+// verify.go) as an SMT-LIB2 script, for use with external solvers. Every
+// specification becomes one query that is unsat iff the specification holds.
+// Int is translated to the unbounded Int sort; wrap-around is covered by the
+// overflow queries of every sum and product, as in the verifier.
+//
+// Loops are abstracted by their invariants, or unrolled: with a bound k > 0,
+// every loop is replaced by k nested if-then-else statements followed by
+// assume !cond, so only executions with at most k iterations per loop are
+// considered. Loop invariants are ignored in that case.
+
+// replace every loop by k copies of its body
+func unroll(stmt Stmt, k int) Stmt {
+	switch stmt := stmt.(type) {
+	case Seq:
+		return Seq{unroll(stmt[0], k), unroll(stmt[1], k)}
+	case IfThenElse:
+		return IfThenElse{stmt.cond, unroll(stmt.thenStmt, k), unroll(stmt.elseStmt, k)}
+	case While:
+		body := unroll(stmt.body, k)
+		var ret Stmt = Assume{not(stmt.cond)}
+		for i := 0; i < k; i++ {
+			// each iteration is a block of its own, like the loop body
+			iter := IfThenElse{Bool(true), body, Skip{}}
+			ret = IfThenElse{stmt.cond, Seq{iter, ret}, Skip{}}
+		}
+		return ret
+	case Located:
+		return Located{stmt.pos, unroll(stmt.stmt, k)}
+	default:
+		return stmt
+	}
+}
+
+// SMT-LIB2 script for the specifications of a well-typed program.
+// loops are unrolled k times if k > 0
+func exportSMT(prog Program, k int) string {
+	if k > 0 {
+		prog = unroll(prog, k)
+	}
+	resolved, types := resolveTyped(prog)
+	v := newVerifier(types)
+	goals := v.wp(resolved, nil)
+
+	// the copies of a specification in unrolled loops are checked together
+	var merged []goal
+	index := make(map[string]int)
+	for _, g := range goals {
+		key := g.pos.String() + ": " + g.what
+		if i, ok := index[key]; ok {
+			merged[i].vc = and(merged[i].vc, g.vc)
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, g)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		a, b := merged[i].pos, merged[j].pos
+		return a.line < b.line || a.line == b.line && a.col < b.col
+	})
+
+	vars := make(map[string]bool)
+	nonlinear := false
+	for i := range merged {
+		merged[i].vc = simplify(merged[i].vc)
+		for x := range freeVars(merged[i].vc) {
+			vars[x] = true
+		}
+		nonlinear = nonlinear || isNonlinear(merged[i].vc)
+	}
+
+	var b strings.Builder
+	b.WriteString("; verification conditions: each check-sat is unsat iff the specification holds\n")
+	if nonlinear {
+		b.WriteString("(set-logic QF_NIA)\n")
+	} else {
+		b.WriteString("(set-logic QF_LIA)\n")
+	}
+	names := sortedVars(vars)
+	sort.SliceStable(names, func(i, j int) bool {
+		return v.fresh[names[i]].pos.line < v.fresh[names[j]].pos.line
+	})
+	for _, x := range names {
+		fmt.Fprintf(&b, "(declare-const %s %s)", smtSymbol(x), smtSort(v.types[x]))
+		if f, ok := v.fresh[x]; ok {
+			if f.loop {
+				fmt.Fprintf(&b, " ; %s at the loop head (%s)", f.name, f.pos)
+			} else {
+				fmt.Fprintf(&b, " ; %s read at %s", f.name, f.pos)
+			}
+		}
+		b.WriteString("\n")
+	}
+	for _, g := range merged {
+		fmt.Fprintf(&b, "\n; %s: %s\n", g.pos, g.what)
+		b.WriteString("(push 1)\n")
+		fmt.Fprintf(&b, "(assert (not %s))\n", smtTerm(g.vc))
+		b.WriteString("(check-sat)\n")
+		b.WriteString("(pop 1)\n")
+	}
+	return b.String()
+}
+
+func smtSort(ty Type) string {
+	if ty == TyBool {
+		return "Bool"
+	}
+	return "Int"
+}
+
+var rSimpleSymbol = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// variable names with # or @ are quoted
+func smtSymbol(x string) string {
+	if rSimpleSymbol.MatchString(x) {
+		return x
+	}
+	return "|" + x + "|"
+}
+
+func smtTerm(e Exp) string {
+	app := func(op string, args ...Exp) string {
+		ret := "(" + op
+		for _, arg := range args {
+			ret += " " + smtTerm(arg)
+		}
+		return ret + ")"
+	}
+	switch e := e.(type) {
+	case Num:
+		if e < 0 {
+			// without the sign, as the negation of the smallest int overflows
+			return "(- " + strings.TrimPrefix(e.pretty(), "-") + ")"
+		}
+		return e.pretty()
+	case Bool:
+		return e.pretty()
+	case Var:
+		return smtSymbol(string(e))
+	case Plus:
+		return app("+", e[0], e[1])
+	case Mult:
+		return app("*", e[0], e[1])
+	case Equal:
+		return app("=", e[0], e[1])
+	case Less:
+		return app("<", e[0], e[1])
+	case And:
+		return app("and", e[0], e[1])
+	case Or:
+		return app("or", e[0], e[1])
+	case Implies:
+		return app("=>", e[0], e[1])
+	case Not:
+		return app("not", e.exp)
+	case Forall:
+		return "(forall ((" + smtSymbol(e.x) + " " + smtSort(e.ty) + ")) " + smtTerm(e.body) + ")"
+	case Exists:
+		return "(exists ((" + smtSymbol(e.x) + " " + smtSort(e.ty) + ")) " + smtTerm(e.body) + ")"
+	}
+	return e.pretty()
+}
+
+// reports whether a formula multiplies two non-constant terms
+func isNonlinear(f Exp) bool {
+	if m, ok := f.(Mult); ok && len(linearize(m[0]).coef) > 0 && len(linearize(m[1]).coef) > 0 {
+		return true
+	}
+	for _, g := range subformulas(f) {
+		if isNonlinear(g) {
+			return true
+		}
+	}
+	return false
+}
+
+func smt_cmd(args []string) int {
+	fs := flag.NewFlagSet("smt", flag.ExitOnError)
+	k := fs.Int("unroll", 0, "unroll loops k times instead of using their invariants")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *k < 0 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Print(exportSMT(prog, *k))
+	return 0
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Small-step semantics
+//
+// step() reduces a configuration (stmt, s) by one step, as an alternative to
+// the big-step Stmt.eval. Expressions are evaluated in a single step.
+//   (skip; s2, σ) → (s2, σ)
+//   (s1; s2, σ) → (s1'; s2, σ')                 if (s1, σ) → (s1', σ')
+//   (x := e, σ) → (skip, σ'), the same for the other atomic statements
+//   (if b {s1} else {s2}, σ) → ({s1}, σ·[])     if b evaluates to true
+//   (while b {s}, σ) → ({s}; while b {s}, σ·[]) if b evaluates to true
+//   (while b {s}, σ) → (skip, σ)                 if b evaluates to false
+//   ({s}, σ) → ({s'}, σ')                       if (s, σ) → (s', σ')
+//   ({skip}, σ·[...]) → (skip, σ)
+// A block {s} is a statement whose scope is already on the stack, and is
+// popped when it has been reduced to skip. Runtime errors are reported as
+// by eval() and reduce to skip, except when the condition of a loop becomes
+// undefined after an iteration, which ends the loop silently like eval().
+
+// the body of an if or while, with its scope on top of the scope stack
+type Block struct {
+	stmt Stmt
+}
+
+// a loop after an iteration: the invariant is checked and the condition is
+// tested again
+type iterate struct {
+	loop While
+}
+
+func (b Block) pretty() string {
+	ret := "{\n\t" + strings.ReplaceAll(b.stmt.pretty(), "\n", "\n\t")
+	if ret[len(ret)-1] != ';' {
+		ret += ";"
+	}
+	return ret + "\n}"
+}
+
+func (i iterate) pretty() string {
+	return i.loop.pretty()
+}
+
+// blocks only occur in configurations, they are run to completion
+func (b Block) eval(s ValState) {
+	run(b, &s)
+}
+
+func (i iterate) eval(s ValState) {
+	run(i, &s)
+}
+
+func (b Block) check(t TyState) bool {
+	t.startBlock()
+	ok := b.stmt.check(t)
+	t.endBlock()
+	return ok
+}
+
+func (i iterate) check(t TyState) bool {
+	return i.loop.check(t)
+}
+
+func isSkip(stmt Stmt) bool {
+	switch stmt := stmt.(type) {
+	case Skip:
+		return true
+	case Located:
+		return isSkip(stmt.stmt)
+	}
+	return false
+}
+
+// reduce a configuration that is not skip by one step
+func step(stmt Stmt, s *ValState) Stmt {
+	switch stmt := stmt.(type) {
+	case Seq:
+		if isSkip(stmt[0]) {
+			return stmt[1]
+		}
+		return Seq{step(stmt[0], s), stmt[1]}
+	case Located:
+		evalPos = stmt.pos
+		next := step(stmt.stmt, s)
+		// a loop keeps its position across iterations
+		if seq, ok := next.(Seq); ok {
+			if loop, ok := seq[1].(iterate); ok {
+				return Seq{seq[0], Located{stmt.pos, loop}}
+			}
+		}
+		return next
+	case Block:
+		if isSkip(stmt.stmt) {
+			s.endBlock()
+			return Skip{}
+		}
+		return Block{step(stmt.stmt, s)}
+	case IfThenElse:
+		v := stmt.cond.eval(*s)
+		if v.flag != ValueBool {
+			runtimeError("if-then-else eval fail: condition has type %s instead of boolean", showValType(v))
+			return Skip{}
+		}
+		s.startBlock()
+		if v.valB {
+			return Block{stmt.thenStmt}
+		}
+		return Block{stmt.elseStmt}
+	case While:
+		v := stmt.cond.eval(*s)
+		if v.flag != ValueBool {
+			runtimeError("while eval fail: condition has type %s instead of boolean", showValType(v))
+			return Skip{}
+		}
+		checkSpec("loop invariant", stmt.inv, *s)
+		return enterLoop(stmt, v, s)
+	case iterate:
+		checkSpec("loop invariant", stmt.loop.inv, *s)
+		return enterLoop(stmt.loop, stmt.loop.cond.eval(*s), s)
+	default:
+		// atomic statements
+		stmt.eval(*s)
+		return Skip{}
+	}
+}
+
+func enterLoop(loop While, cond Val, s *ValState) Stmt {
+	if !cond.valB {
+		return Skip{}
+	}
+	s.startBlock()
+	return Seq{Block{loop.body}, iterate{loop}}
+}
+
+// reduce a configuration to skip
+func run(stmt Stmt, s *ValState) {
+	for !isSkip(stmt) {
+		stmt = step(stmt, s)
+	}
+}
+
+// scope stack, innermost scope last
+func showScopes(s ValState) string {
+	var scopes []string
+	for _, scope := range s {
+		var vars []string
+		for x, v := range scope {
+			vars = append(vars, x+" = "+showVal(v))
+		}
+		sort.Strings(vars)
+		scopes = append(scopes, "["+strings.Join(vars, ", ")+"]")
+	}
+	return strings.Join(scopes, " ")
+}
+
+func step_cmd(args []string) int {
+	fs := flag.NewFlagSet("step", flag.ExitOnError)
+	n := fs.Int("n", 1000, "maximal number of steps")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	var stmt Stmt = prog
+	s := newValState()
+	for i := 0; ; i++ {
+		fmt.Printf("--- %d ---\n%s\n%s\n", i, stmt.pretty(), showScopes(s))
+		if isSkip(stmt) {
+			return 0
+		}
+		if i == *n {
+			fmt.Printf("stopped after %d steps\n", *n)
+			return 1
+		}
+		stmt = step(stmt, &s)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Symbolic execution
+//
+// The symbolic evaluator runs a well-typed program on symbolic inputs: every
+// read statement introduces a fresh symbol, and variables hold terms over the
+// symbols instead of values. Conditions that depend on the inputs fork the
+// execution into one path per outcome, each with its path condition. Paths
+// whose condition is unsatisfiable are dropped, using the decision procedure
+// in lia.go. Integers are unbounded, so paths that are feasible only because
+// of overflow at runtime are not found.
+//
+// Exploration is bounded by the number of forks and of evaluated conditions
+// per path, and by the total number of paths. For every path, concrete inputs
+// are derived from a model of its path condition, which is checked by the
+// interpreter with 64-bit wraparound.
+
+// symbolic value of a variable. types are static, so the type is always known
+type SymVal struct {
+	ty   Type
+	term Exp
+}
+type SymState = Scopes[SymVal]
+
+func (v SymVal) typ() Type {
+	return v.ty
+}
+
+// Paths
+
+type pathStatus int
+
+const (
+	pathRunning pathStatus = iota
+	pathCompleted
+	pathFailed     // a specification does not hold
+	pathBounded    // a limit was reached
+	pathInfeasible // an assumption does not hold
+)
+
+type symPath struct {
+	state    SymState
+	pc       []Exp    // path condition
+	inputs   []string // symbols, in the order they were read
+	outputs  []Exp    // terms of printed values
+	branches []string // outcome of each fork
+	status   pathStatus
+	failure  string // failed specification, or why the path was stopped
+	forks    int
+	steps    int // conditions evaluated
+}
+
+// add a condition to the path condition, unless it is already there
+func (p *symPath) constrain(c Exp) {
+	if c == Exp(Bool(true)) {
+		return
+	}
+	for _, d := range p.pc {
+		if d == c {
+			return
+		}
+	}
+	p.pc = append(p.pc, c)
+}
+
+func (p *symPath) fork() *symPath {
+	q := *p
+	q.state = p.state.copy()
+	q.pc = append([]Exp(nil), p.pc...)
+	q.inputs = append([]string(nil), p.inputs...)
+	q.outputs = append([]Exp(nil), p.outputs...)
+	q.branches = append([]string(nil), p.branches...)
+	return &q
+}
+
+// an input symbol and where it was read
+type symbol struct {
+	name string
+	ty   Type
+	pos  Pos
+}
+
+type explorer struct {
+	maxForks  int // forks per path
+	maxSteps  int // conditions per path, to stop loops that do not fork
+	maxPaths  int
+	paths     int // paths created so far
+	truncated bool
+	pos       Pos
+	symbols   map[string]symbol
+	types     TyState // types of the symbols
+}
+
+func newExplorer(maxForks, maxSteps, maxPaths int) *explorer {
+	return &explorer{maxForks: maxForks, maxSteps: maxSteps, maxPaths: maxPaths, paths: 1,
+		symbols: make(map[string]symbol), types: newTyState()}
+}
+
+// explore all paths of a well-typed program. the result includes failed and bounded paths
+func (e *explorer) explore(prog Program) []*symPath {
+	paths := e.exec(prog, []*symPath{{state: newScopes[SymVal]()}})
+	var ret []*symPath
+	for _, p := range paths {
+		if p.status == pathRunning {
+			p.status = pathCompleted
+		}
+		if p.status != pathInfeasible {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func (e *explorer) exec(stmt Stmt, paths []*symPath) []*symPath {
+	var ret []*symPath
+	for _, p := range paths {
+		if p.status != pathRunning {
+			ret = append(ret, p)
+			continue
+		}
+		ret = append(ret, e.execPath(stmt, p)...)
+	}
+	return ret
+}
+
+func (e *explorer) execPath(stmt Stmt, p *symPath) []*symPath {
+	if p.status != pathRunning {
+		return []*symPath{p}
+	}
+	switch stmt := stmt.(type) {
+	case Seq:
+		return e.exec(stmt[1], e.execPath(stmt[0], p))
+	case Decl:
+		ty := stmt.rhs.infer(p.state.types())
+		p.state.declare(stmt.lhs, SymVal{ty, e.eval(stmt.rhs, p)})
+	case Assign:
+		v, _ := p.state.lookup(stmt.lhs)
+		p.state.assign(stmt.lhs, SymVal{v.ty, e.eval(stmt.rhs, p)})
+	case Read:
+		v, _ := p.state.lookup(stmt.lhs)
+		name := stmt.lhs + "@" + strconv.Itoa(len(e.symbols)+1)
+		e.symbols[name] = symbol{stmt.lhs, v.ty, e.pos}
+		e.types.declare(name, v.ty)
+		p.inputs = append(p.inputs, name)
+		p.state.assign(stmt.lhs, SymVal{v.ty, Var(name)})
+	case Print:
+		p.outputs = append(p.outputs, e.eval(stmt.exp, p))
+	case Requires:
+		e.assume(stmt.exp, p)
+	case Assume:
+		e.assume(stmt.exp, p)
+	case Ensures:
+		return e.check("postcondition", stmt.exp, p)
+	case Assert:
+		return e.check("assertion", stmt.exp, p)
+	case IfThenElse:
+		onTrue, onFalse := e.branch(stmt.cond, p)
+		return append(e.block(stmt.thenStmt, onTrue), e.block(stmt.elseStmt, onFalse)...)
+	case While:
+		pos := e.pos
+		var ret []*symPath
+		paths := []*symPath{p}
+		if stmt.inv != nil {
+			paths = e.check("loop invariant", stmt.inv, p)
+		}
+		// run the body once more on all paths that enter the loop again
+		for len(paths) > 0 {
+			var next []*symPath
+			for _, q := range paths {
+				e.pos = pos
+				onTrue, onFalse := e.branch(stmt.cond, q)
+				ret = append(ret, onFalse...)
+				for _, r := range e.block(stmt.body, onTrue) {
+					if stmt.inv != nil && r.status == pathRunning {
+						e.pos = pos
+						next = append(next, e.check("loop invariant", stmt.inv, r)...)
+					} else if r.status == pathRunning {
+						next = append(next, r)
+					} else {
+						ret = append(ret, r)
+					}
+				}
+			}
+			paths = next
+		}
+		return ret
+	case Located:
+		e.pos = stmt.pos
+		return e.execPath(stmt.stmt, p)
+	}
+	return []*symPath{p}
+}
+
+// execute a block on all paths
+func (e *explorer) block(stmt Stmt, paths []*symPath) []*symPath {
+	for _, p := range paths {
+		p.state.startBlock()
+	}
+	ret := e.exec(stmt, paths)
+	for _, p := range ret {
+		p.state.endBlock()
+	}
+	return ret
+}
+
+// the term of an expression, over the input symbols
+func (e *explorer) eval(exp Exp, p *symPath) Exp {
+	for x := range expVars(exp) {
+		if v, ok := p.state.lookup(x); ok {
+			exp = subst(exp, x, v.term)
+		}
+	}
+	return simplify(exp)
+}
+
+// the feasible paths on which a condition is true and false. a path that
+// reaches the fork limit stops, and is returned as if the condition were false
+func (e *explorer) branch(cond Exp, p *symPath) ([]*symPath, []*symPath) {
+	c := e.eval(cond, p)
+	if p.steps++; p.steps > e.maxSteps {
+		p.status = pathBounded
+		p.failure = fmt.Sprintf("stopped after %d conditions", e.maxSteps)
+		return nil, []*symPath{p}
+	}
+	if b, ok := c.(Bool); ok {
+		// no fork
+		if b {
+			return []*symPath{p}, nil
+		}
+		return nil, []*symPath{p}
+	}
+	if p.forks >= e.maxForks {
+		p.status = pathBounded
+		p.failure = fmt.Sprintf("stopped after %d forks", e.maxForks)
+		return nil, []*symPath{p}
+	}
+	var ret [2][]*symPath
+	for i, outcome := range []bool{true, false} {
+		lit := c
+		if !outcome {
+			lit = simplify(not(c))
+		}
+		if !e.feasible(append(p.pc, lit)) {
+			continue
+		}
+		if ret[0] != nil {
+			if e.paths >= e.maxPaths {
+				e.truncated = true
+				break
+			}
+			e.paths++
+		}
+		q := p.fork()
+		q.pc = append(q.pc, lit)
+		q.branches = append(q.branches, fmt.Sprintf("%s %v", e.pos, outcome))
+		q.forks++
+		ret[i] = []*symPath{q}
+	}
+	return ret[0], ret[1]
+}
+
+func (e *explorer) assume(exp Exp, p *symPath) {
+	p.constrain(e.eval(exp, p))
+	if !e.feasible(p.pc) {
+		p.status = pathInfeasible
+	}
+}
+
+// a path on which the specification fails, if any, and the path on which it holds
+func (e *explorer) check(what string, spec Exp, p *symPath) []*symPath {
+	c := e.eval(spec, p)
+	var ret []*symPath
+	if fail := simplify(not(c)); e.feasible(append(p.pc, fail)) {
+		q := p.fork()
+		q.pc = append(q.pc, fail)
+		q.status = pathFailed
+		q.failure = what + " failed: " + spec.pretty()
+		ret = append(ret, q)
+	}
+	if e.feasible(append(p.pc, c)) {
+		if ret != nil {
+			// the failed path is a new one
+			if e.paths >= e.maxPaths {
+				e.truncated = true
+				return ret
+			}
+			e.paths++
+		}
+		p.constrain(c)
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// paths whose condition cannot be decided are explored
+func (e *explorer) feasible(pc []Exp) bool {
+	res, _ := satisfiable(conjunction(pc), e.types)
+	return res != unsat
+}
+
+// Test inputs
+
+// concrete inputs driving a path, and the values it prints.
+// false if no model was found, e.g. for nonlinear path conditions, or if the
+// model does not satisfy the path condition when integers wrap around
+func (e *explorer) concretize(p *symPath) ([]Val, []Val, bool) {
+	res, m := satisfiable(conjunction(p.pc), e.types)
+	if res != sat {
+		return nil, nil, false
+	}
+	s := newValState()
+	var inputs []Val
+	for _, x := range p.inputs {
+		v := mkInt(m.ints[x])
+		if e.symbols[x].ty == TyBool {
+			v = mkBool(m.bools[x])
+		}
+		s.declare(x, v)
+		inputs = append(inputs, v)
+	}
+	// products are opaque to the solver and sums and products overflow in the
+	// interpreter, so the model must be checked
+	if v := conjunction(p.pc).eval(s); v.flag != ValueBool || !v.valB {
+		return nil, nil, false
+	}
+	var outputs []Val
+	for _, t := range p.outputs {
+		outputs = append(outputs, t.eval(s))
+	}
+	return inputs, outputs, true
+}
+
+func (e *explorer) report(paths []*symPath) string {
+	var b strings.Builder
+	for i, p := range paths {
+		fmt.Fprintf(&b, "path %d: ", i+1)
+		switch p.status {
+		case pathCompleted:
+			b.WriteString("completed\n")
+		default:
+			b.WriteString(p.failure + "\n")
+		}
+		if len(p.branches) > 0 {
+			fmt.Fprintf(&b, "\tbranches: %s\n", strings.Join(p.branches, ", "))
+		}
+		if len(p.pc) > 0 {
+			fmt.Fprintf(&b, "\tcondition: %s\n", showFormula(conjunction(p.pc), false))
+		}
+		inputs, outputs, ok := e.concretize(p)
+		if !ok {
+			b.WriteString("\tinputs: unknown\n")
+			continue
+		}
+		if len(inputs) > 0 {
+			var in []string
+			for j, x := range p.inputs {
+				in = append(in, fmt.Sprintf("%s = %s read at %s", e.symbols[x].name, showVal(inputs[j]), e.symbols[x].pos))
+			}
+			fmt.Fprintf(&b, "\tinputs: %s\n", strings.Join(in, ", "))
+		}
+		if len(outputs) > 0 {
+			var out []string
+			for _, v := range outputs {
+				out = append(out, showVal(v))
+			}
+			fmt.Fprintf(&b, "\toutput: %s\n", strings.Join(out, " "))
+		}
+	}
+	if e.truncated {
+		fmt.Fprintf(&b, "more paths not explored (limit %d)\n", e.maxPaths)
+	}
+	return b.String()
+}
+
+func symexec_cmd(args []string) int {
+	fs := flag.NewFlagSet("symexec", flag.ExitOnError)
+	forks := fs.Int("forks", 20, "maximal number of forks per path")
+	steps := fs.Int("steps", 10000, "maximal number of conditions evaluated per path")
+	paths := fs.Int("paths", 100, "maximal number of paths")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	e := newExplorer(*forks, *steps, *paths)
+	fmt.Print(e.report(e.explore(prog)))
+	return 0
+}
@@ -0,0 +1,27 @@
+; verification conditions: each check-sat is unsat iff the specification holds
+(set-logic QF_LIA)
+(declare-const |x#1@5| Int) ; x read at line 3
+
+; line 6: no overflow in (x*-1)
+(push 1)
+(assert (not (=> (< |x#1@5| 0) (and (not (< (* |x#1@5| (- 1)) (- 9223372036854775808))) (not (< 9223372036854775807 (* |x#1@5| (- 1))))))))
+(check-sat)
+(pop 1)
+
+; line 10: assertion !(y<0)
+(push 1)
+(assert (not (=> (and (< |x#1@5| 0) (and (not (< (* |x#1@5| (- 1)) (- 9223372036854775808))) (not (< 9223372036854775807 (* |x#1@5| (- 1)))))) (not (< (* |x#1@5| (- 1)) 0)))))
+(check-sat)
+(pop 1)
+
+; line 11: no overflow in (x*-1)
+(push 1)
+(assert (not (and (=> (and (< |x#1@5| 0) (and (and (not (< (* |x#1@5| (- 1)) (- 9223372036854775808))) (not (< 9223372036854775807 (* |x#1@5| (- 1))))) (not (< (* |x#1@5| (- 1)) 0)))) (and (not (< (* |x#1@5| (- 1)) (- 9223372036854775808))) (not (< 9223372036854775807 (* |x#1@5| (- 1)))))) (=> (and (not (< |x#1@5| 0)) (not (< |x#1@5| 0))) (and (not (< (* |x#1@5| (- 1)) (- 9223372036854775808))) (not (< 9223372036854775807 (* |x#1@5| (- 1)))))))))
+(check-sat)
+(pop 1)
+
+; line 11: assertion ((y==x)||(y==(x*-1)))
+(push 1)
+(assert (not true))
+(check-sat)
+(pop 1)
@@ -0,0 +1,16 @@
+; verification conditions: each check-sat is unsat iff the specification holds
+(set-logic QF_NIA)
+(declare-const |x#1@4| Int) ; x read at line 3
+(declare-const |b#1@3| Bool) ; b read at line 5
+
+; line 7: no overflow in (x*x)
+(push 1)
+(assert (not (=> |b#1@3| (and (not (< (* |x#1@4| |x#1@4|) (- 9223372036854775808))) (not (< 9223372036854775807 (* |x#1@4| |x#1@4|)))))))
+(check-sat)
+(pop 1)
+
+; line 11: assertion !(x<0)
+(push 1)
+(assert (not (=> (and |b#1@3| (and (not (< (* |x#1@4| |x#1@4|) (- 9223372036854775808))) (not (< 9223372036854775807 (* |x#1@4| |x#1@4|))))) (not (< (* |x#1@4| |x#1@4|) 0)))))
+(check-sat)
+(pop 1)
@@ -0,0 +1,53 @@
+; verification conditions: each check-sat is unsat iff the specification holds
+(set-logic QF_LIA)
+(declare-const |n#1@11| Int) ; n read at line 3
+(declare-const |i#1@9| Int) ; i at the loop head (line 7)
+(declare-const |s#1@10| Int) ; s at the loop head (line 7)
+
+; line 7: loop invariant ((i<(n+1))&&(s==(i*2))) on entry
+(push 1)
+(assert (not (=> (not (< |n#1@11| 0)) (< 0 (+ |n#1@11| 1)))))
+(check-sat)
+(pop 1)
+
+; line 7: no overflow in (i*2)
+(push 1)
+(assert (not (=> (and (not (< |n#1@11| 0)) (and (and (and (< |i#1@9| (+ |n#1@11| 1)) (= |s#1@10| (* |i#1@9| 2))) (< |i#1@9| |n#1@11|)) (and (and (not (< (+ |s#1@10| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |s#1@10| 2)))) (and (not (< (+ |i#1@9| 1) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |i#1@9| 1))))))) (and (not (< (* (+ |i#1@9| 1) 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* (+ |i#1@9| 1) 2)))))))
+(check-sat)
+(pop 1)
+
+; line 7: no overflow in (n+1)
+(push 1)
+(assert (not (and (=> (not (< |n#1@11| 0)) (and (not (< (+ |n#1@11| 1) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |n#1@11| 1))))) (=> (and (not (< |n#1@11| 0)) (and (and (and (< |i#1@9| (+ |n#1@11| 1)) (= |s#1@10| (* |i#1@9| 2))) (< |i#1@9| |n#1@11|)) (and (and (not (< (+ |s#1@10| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |s#1@10| 2)))) (and (and (not (< (+ |i#1@9| 1) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |i#1@9| 1)))) (and (not (< (* (+ |i#1@9| 1) 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* (+ |i#1@9| 1) 2)))))))) (and (not (< (+ |n#1@11| 1) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |n#1@11| 1))))))))
+(check-sat)
+(pop 1)
+
+; line 7: loop invariant ((i<(n+1))&&(s==(i*2))) preserved
+(push 1)
+(assert (not (=> (and (not (< |n#1@11| 0)) (and (and (and (< |i#1@9| (+ |n#1@11| 1)) (= |s#1@10| (* |i#1@9| 2))) (< |i#1@9| |n#1@11|)) (and (and (not (< (+ |s#1@10| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |s#1@10| 2)))) (and (not (< (+ |i#1@9| 1) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |i#1@9| 1))))))) (and (< (+ |i#1@9| 1) (+ |n#1@11| 1)) (= (+ |s#1@10| 2) (* (+ |i#1@9| 1) 2))))))
+(check-sat)
+(pop 1)
+
+; line 8: no overflow in (s+2)
+(push 1)
+(assert (not (=> (and (not (< |n#1@11| 0)) (and (and (< |i#1@9| (+ |n#1@11| 1)) (= |s#1@10| (* |i#1@9| 2))) (< |i#1@9| |n#1@11|))) (and (not (< (+ |s#1@10| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |s#1@10| 2)))))))
+(check-sat)
+(pop 1)
+
+; line 9: no overflow in (i+1)
+(push 1)
+(assert (not (=> (and (not (< |n#1@11| 0)) (and (and (and (< |i#1@9| (+ |n#1@11| 1)) (= |s#1@10| (* |i#1@9| 2))) (< |i#1@9| |n#1@11|)) (and (not (< (+ |s#1@10| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |s#1@10| 2)))))) (and (not (< (+ |i#1@9| 1) (- 9223372036854775808))) (not (< 9223372036854775807 (+ |i#1@9| 1)))))))
+(check-sat)
+(pop 1)
+
+; line 11: no overflow in (n*2)
+(push 1)
+(assert (not (=> (and (not (< |n#1@11| 0)) (and (and (< |i#1@9| (+ |n#1@11| 1)) (= |s#1@10| (* |i#1@9| 2))) (not (< |i#1@9| |n#1@11|)))) (and (not (< (* |n#1@11| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* |n#1@11| 2)))))))
+(check-sat)
+(pop 1)
+
+; line 11: assertion (s==(n*2))
+(push 1)
+(assert (not (=> (and (not (< |n#1@11| 0)) (and (and (and (< |i#1@9| (+ |n#1@11| 1)) (= |s#1@10| (* |i#1@9| 2))) (not (< |i#1@9| |n#1@11|))) (and (not (< (* |n#1@11| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* |n#1@11| 2)))))) (= |s#1@10| (* |n#1@11| 2)))))
+(check-sat)
+(pop 1)
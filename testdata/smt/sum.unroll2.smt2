@@ -0,0 +1,27 @@
+; verification conditions: each check-sat is unsat iff the specification holds
+(set-logic QF_LIA)
+(declare-const |n#1@7| Int) ; n read at line 3
+
+; line 8: no overflow in (s+2)
+(push 1)
+(assert (not true))
+(check-sat)
+(pop 1)
+
+; line 9: no overflow in (i+1)
+(push 1)
+(assert (not true))
+(check-sat)
+(pop 1)
+
+; line 11: no overflow in (n*2)
+(push 1)
+(assert (not (=> (not (< |n#1@7| 0)) (and (=> (< 0 |n#1@7|) (and (=> (and (< 1 |n#1@7|) (not (< 2 |n#1@7|))) (and (not (< (* |n#1@7| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* |n#1@7| 2))))) (=> (not (< 1 |n#1@7|)) (and (not (< (* |n#1@7| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* |n#1@7| 2))))))) (=> (not (< 0 |n#1@7|)) (and (not (< (* |n#1@7| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* |n#1@7| 2)))))))))
+(check-sat)
+(pop 1)
+
+; line 11: assertion (s==(n*2))
+(push 1)
+(assert (not (=> (not (< |n#1@7| 0)) (and (=> (< 0 |n#1@7|) (and (=> (and (< 1 |n#1@7|) (and (not (< 2 |n#1@7|)) (and (not (< (* |n#1@7| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* |n#1@7| 2)))))) (= 4 (* |n#1@7| 2))) (=> (and (not (< 1 |n#1@7|)) (and (not (< (* |n#1@7| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* |n#1@7| 2))))) (= 2 (* |n#1@7| 2))))) (=> (and (not (< 0 |n#1@7|)) (and (not (< (* |n#1@7| 2) (- 9223372036854775808))) (not (< 9223372036854775807 (* |n#1@7| 2))))) (= 0 (* |n#1@7| 2)))))))
+(check-sat)
+(pop 1)
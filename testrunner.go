@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Test runner
+//
+// runImpTests() runs .imp files and compares what they print with the
+// expected output: a block of comment lines following a "// output:" line,
+//
+//	print 1 + 2;
+//	// output:
+//	// 3
+//
+// or else the sibling .out file, e.g. sum.out for sum.imp. The input of read
+// statements is taken from the sibling .in file, if any. Files without
+// expected output are skipped. With update, the expected output is replaced
+// by the actual output, in the comment block if the file has one and in the
+// .out file otherwise; an empty block or .out file records the output of a
+// new test.
+//
+// Test blocks, test "name" { ... }, are run as well, each on its own with new
+// scopes. A test passes if it reports no runtime error, such as a failed
+// assertion.
+
+const outputMarker = "// output:"
+
+type impTest struct {
+	path     string
+	source   string
+	want     string
+	has      bool // the test has expected output
+	inSource bool // the expected output is a comment block of the source
+	block    [2]int
+}
+
+// the .imp files of the given files and directories, directories searched recursively
+func findImpFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && filepath.Ext(p) == ".imp" {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// the lines of the comment block after the output marker: the first and
+// after the last, and their text
+func outputBlock(lines []string) (start, end int, text string, ok bool) {
+	for i, line := range lines {
+		if strings.TrimSpace(line) != outputMarker {
+			continue
+		}
+		var b strings.Builder
+		end = i + 1
+		for ; end < len(lines); end++ {
+			line := strings.TrimSpace(lines[end])
+			if !strings.HasPrefix(line, "//") {
+				break
+			}
+			line = strings.TrimPrefix(strings.TrimPrefix(line, "//"), " ")
+			b.WriteString(line + "\n")
+		}
+		return i + 1, end, b.String(), true
+	}
+	return 0, 0, "", false
+}
+
+func goldenFile(path string) string {
+	return strings.TrimSuffix(path, ".imp") + ".out"
+}
+
+func loadImpTest(path string) (impTest, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return impTest{}, err
+	}
+	t := impTest{path: path, source: string(source)}
+	if start, end, text, ok := outputBlock(strings.Split(t.source, "\n")); ok {
+		t.want, t.has, t.inSource, t.block = text, true, true, [2]int{start, end}
+		return t, nil
+	}
+	golden, err := os.ReadFile(goldenFile(path))
+	if err == nil {
+		t.want, t.has = string(golden), true
+		if t.want != "" && !strings.HasSuffix(t.want, "\n") {
+			t.want += "\n"
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return t, err
+	}
+	return t, nil
+}
+
+// whether the source has test blocks, found without parsing it
+func hasTestBlocks(source string) bool {
+	l := newLexer(source)
+	for l.tokType != TokEOF {
+		if l.tokType == TokTest {
+			return true
+		}
+		if ok, _ := l.next(); !ok {
+			return false
+		}
+	}
+	return false
+}
+
+// the program, if it can run, and the input of its read statements
+func (t impTest) load() (Program, []byte, error) {
+	prog, err := newLocatingParser().parse_fromstring(t.source)
+	if err != nil {
+		return prog, nil, err
+	}
+	if !prog.check(newTyState()) {
+		return prog, nil, fmt.Errorf("%s contains type errors", t.path)
+	}
+	if flows := checkFlows(prog); len(flows) > 0 {
+		return prog, nil, fmt.Errorf("%s contains insecure information flows", t.path)
+	}
+	input, err := os.ReadFile(strings.TrimSuffix(t.path, ".imp") + ".in")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return prog, nil, err
+	}
+	return prog, input, nil
+}
+
+// run a statement with new scopes, returning what it prints and the number
+// of runtime errors
+func runCaptured(stmt Stmt, input []byte) (string, int) {
+	var out bytes.Buffer
+	oldOut, oldIn, errs := stdout, stdin, runtimeErrors
+	stdout, stdin = &out, bytes.NewReader(input)
+	defer func() { stdout, stdin = oldOut, oldIn }()
+	stmt.eval(newValState())
+	return out.String(), runtimeErrors - errs
+}
+
+// the test blocks of a program with their positions
+func testBlocks(stmt Stmt) []Located {
+	var ret []Located
+	var walk func(stmt Stmt, pos Pos)
+	walk = func(stmt Stmt, pos Pos) {
+		switch stmt := stmt.(type) {
+		case Seq:
+			walk(stmt[0], pos)
+			walk(stmt[1], pos)
+		case Located:
+			walk(stmt.stmt, stmt.pos)
+		case IfThenElse:
+			walk(stmt.thenStmt, pos)
+			walk(stmt.elseStmt, pos)
+		case While:
+			walk(stmt.body, pos)
+		case TestBlock:
+			ret = append(ret, Located{pos, stmt})
+			walk(stmt.body, pos)
+		}
+	}
+	walk(stmt, Pos{})
+	return ret
+}
+
+// replace the expected output by got
+func (t impTest) update(got string) error {
+	if !t.inSource {
+		return os.WriteFile(goldenFile(t.path), []byte(got), 0o644)
+	}
+	lines := strings.Split(t.source, "\n")
+	var block []string
+	for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+		if line == "" {
+			block = append(block, "//")
+		} else {
+			block = append(block, "// "+line)
+		}
+	}
+	if got == "" {
+		block = nil
+	}
+	lines = append(lines[:t.block[0]], append(block, lines[t.block[1]:]...)...)
+	return os.WriteFile(t.path, []byte(strings.Join(lines, "\n")), 0o644)
+}
+
+// the first line where got differs from want
+func outputDiff(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	for i := 0; ; i++ {
+		switch {
+		case i == len(wantLines)-1 && i < len(gotLines)-1:
+			return fmt.Sprintf("output line %d: unexpected %q", i+1, gotLines[i])
+		case i == len(gotLines)-1 && i < len(wantLines)-1:
+			return fmt.Sprintf("output line %d: missing %q", i+1, wantLines[i])
+		case wantLines[i] != gotLines[i]:
+			return fmt.Sprintf("output line %d: want %q, got %q", i+1, wantLines[i], gotLines[i])
+		}
+	}
+}
+
+type testSummary struct {
+	passed, failed, skipped, updated int
+}
+
+// run the tests in the given files and directories, reporting failures to w,
+// and passed tests too if verbose
+func runImpTests(paths []string, update, verbose bool, w io.Writer) (testSummary, error) {
+	var sum testSummary
+	files, err := findImpFiles(paths)
+	if err != nil {
+		return sum, err
+	}
+	for _, path := range files {
+		t, err := loadImpTest(path)
+		if err != nil {
+			return sum, err
+		}
+		if !t.has && !hasTestBlocks(t.source) {
+			sum.skipped++
+			if verbose {
+				fmt.Fprintf(w, "SKIP %s: no expected output\n", path)
+			}
+			continue
+		}
+		prog, input, err := t.load()
+		if err != nil {
+			sum.failed++
+			fmt.Fprintf(w, "FAIL %s: %s\n", path, err)
+			continue
+		}
+		for _, l := range testBlocks(prog) {
+			tb := l.stmt.(TestBlock)
+			out, errs := runCaptured(tb.body, input)
+			if errs == 0 {
+				sum.passed++
+				if verbose {
+					fmt.Fprintf(w, "ok   %s: test \"%s\"\n", path, tb.name)
+				}
+				continue
+			}
+			sum.failed++
+			fmt.Fprintf(w, "FAIL %s: test \"%s\" at %s\n", path, tb.name, l.pos)
+			fmt.Fprint(w, "    "+strings.ReplaceAll(strings.TrimSuffix(out, "\n"), "\n", "\n    ")+"\n")
+		}
+		if !t.has {
+			continue
+		}
+		got, _ := runCaptured(prog, input)
+		switch {
+		case update && got != t.want:
+			if err := t.update(got); err != nil {
+				return sum, err
+			}
+			sum.updated++
+			fmt.Fprintf(w, "UPDATE %s\n", path)
+		case got != t.want:
+			sum.failed++
+			fmt.Fprintf(w, "FAIL %s: %s\n", path, outputDiff(t.want, got))
+		default:
+			sum.passed++
+			if verbose {
+				fmt.Fprintf(w, "ok   %s\n", path)
+			}
+		}
+	}
+	return sum, nil
+}
+
+func (s testSummary) String() string {
+	text := fmt.Sprintf("%d passed, %d failed, %d skipped", s.passed, s.failed, s.skipped)
+	if s.updated > 0 {
+		text += fmt.Sprintf(", %d updated", s.updated)
+	}
+	return text
+}
+
+func test_cmd(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	update := fs.Bool("update", false, "replace the expected output by the actual output")
+	verbose := fs.Bool("v", false, "list passed and skipped tests too")
+	fs.Parse(args)
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	sum, err := runImpTests(paths, *update, *verbose, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(sum)
+	if sum.failed > 0 {
+		return 1
+	}
+	return 0
+}
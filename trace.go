@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Execution tracing
+//
+// With tracing enabled, the evaluator writes one JSON object per line for
+// every executed statement with a source position: atomic statements when
+// they are done, with the variables they wrote, and if and while whenever
+// they test their condition, with the branch taken. Every event has the
+// statement's kind, position and scope depth. replay_cmd prints a trace as
+// a table.
+
+type traceVal struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"` // null if undefined
+}
+
+type writeEvent struct {
+	Var string    `json:"var"`
+	Old *traceVal `json:"old"` // null for a new variable
+	New traceVal  `json:"new"`
+}
+
+type traceEvent struct {
+	Step   int          `json:"step"`
+	Kind   string       `json:"kind"`
+	Line   int          `json:"line"`
+	Col    int          `json:"col"`
+	Depth  int          `json:"depth"`
+	Stmt   string       `json:"stmt"`
+	Writes []writeEvent `json:"writes,omitempty"`
+	Cond   *traceVal    `json:"cond,omitempty"`
+	Branch string       `json:"branch,omitempty"` // then, else, body, exit or error
+	Output string       `json:"output,omitempty"` // printed value
+}
+
+// state of the tracing evaluator
+var trace struct {
+	out    io.Writer    // nil unless tracing
+	step   int          // events written
+	stmts  []Located    // statements being executed, innermost last
+	writes []writeEvent // of the innermost statement so far
+	output string
+}
+
+func newTraceVal(v Val) traceVal {
+	switch v.flag {
+	case ValueInt:
+		return traceVal{"Int", v.valI}
+	case ValueBool:
+		return traceVal{"Bool", v.valB}
+	}
+	return traceVal{"Undefined", nil}
+}
+
+func (v traceVal) String() string {
+	if v.Value == nil {
+		return "undefined"
+	}
+	return fmt.Sprint(v.Value)
+}
+
+// kind of a statement, e.g. Assign
+func stmtKind(stmt Stmt) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", stmt), "main.")
+}
+
+// first line of a statement, e.g. "while (i<3)"
+func stmtHeader(stmt Stmt) string {
+	return strings.TrimSuffix(strings.SplitN(stmt.pretty(), "\n", 2)[0], " {")
+}
+
+// run a located statement, tracing it if enabled
+func traceStmt(l Located, s ValState) {
+	trace.stmts = append(trace.stmts, l)
+	trace.writes, trace.output = nil, ""
+	l.stmt.eval(s)
+	switch l.stmt.(type) {
+	case IfThenElse, While, Seq, Located:
+		// traced by traceBranch
+	default:
+		emitTrace(traceEvent{Writes: trace.writes, Output: trace.output}, s)
+	}
+	trace.stmts = trace.stmts[:len(trace.stmts)-1]
+}
+
+// a variable is written, old is nil for a new variable
+func traceWrite(name string, old *Val, v Val) {
+	if trace.out == nil {
+		return
+	}
+	w := writeEvent{Var: name, New: newTraceVal(v)}
+	if old != nil {
+		o := newTraceVal(*old)
+		w.Old = &o
+	}
+	trace.writes = append(trace.writes, w)
+}
+
+func traceOutput(v Val) {
+	if trace.out != nil {
+		trace.output = showVal(v)
+	}
+}
+
+// the condition of an if or while is tested. branch is the part run next
+func traceBranch(cond Val, branch string, s ValState) {
+	if trace.out == nil {
+		return
+	}
+	if cond.flag != ValueBool {
+		branch = "error"
+	}
+	c := newTraceVal(cond)
+	emitTrace(traceEvent{Cond: &c, Branch: branch}, s)
+}
+
+func emitTrace(e traceEvent, s ValState) {
+	if len(trace.stmts) == 0 {
+		return
+	}
+	l := trace.stmts[len(trace.stmts)-1]
+	trace.step++
+	e.Step, e.Kind, e.Line, e.Col, e.Depth = trace.step, stmtKind(l.stmt), l.pos.line, l.pos.col, len(s)
+	e.Stmt = stmtHeader(l.stmt)
+	enc := json.NewEncoder(trace.out)
+	enc.SetEscapeHTML(false)
+	enc.Encode(e)
+}
+
+// what an event did, for the table
+func (e traceEvent) effect() string {
+	var effects []string
+	if e.Branch != "" {
+		effects = append(effects, fmt.Sprintf("%s -> %s", e.Cond, e.Branch))
+	}
+	for _, w := range e.Writes {
+		if w.Old == nil {
+			effects = append(effects, fmt.Sprintf("%s = %s", w.Var, w.New))
+		} else {
+			effects = append(effects, fmt.Sprintf("%s: %s -> %s", w.Var, *w.Old, w.New))
+		}
+	}
+	if e.Output != "" {
+		effects = append(effects, "prints "+e.Output)
+	}
+	return strings.Join(effects, ", ")
+}
+
+// print a trace as a table
+func replayTrace(in io.Reader, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "step\tline\tdepth\tstatement\teffect")
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		var e traceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		// statements are indented by their scope depth
+		indent := ""
+		if e.Depth > 1 {
+			indent = strings.Repeat("  ", e.Depth-1)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s%s\t%s\n", e.Step, e.Line, e.Depth, indent, e.Stmt, e.effect())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func replay_cmd(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer f.Close()
+	if err := replayTrace(f, os.Stdout); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -19,7 +19,7 @@ func (x Num) infer(t TyState) Type {
 func (e Equal) infer(t TyState) Type {
 	t1 := e[0].infer(t)
 	t2 := e[1].infer(t)
-	if t1 == t2 {
+	if t1 == t2 && t1 != TyIllTyped {
 		return TyBool
 	}
 	return TyIllTyped
@@ -99,13 +99,17 @@ func (decl Decl) check(t TyState) bool {
 
 func (a Assign) check(t TyState) bool {
 	x := (string)(a.lhs)
-	return t.lookup(x) == a.rhs.infer(t)
+	ty := t.lookup(x)
+	return ty != TyIllTyped && ty == a.rhs.infer(t)
 }
 
 func (w While) check(t TyState) bool {
 	if w.cond.infer(t) != TyBool {
 		return false
 	}
+	if w.inv != nil && w.inv.infer(t) != TyBool {
+		return false
+	}
 	t.startBlock()
 	b := w.body.check(t)
 	t.endBlock()
@@ -131,3 +135,36 @@ func (ite IfThenElse) check(t TyState) bool {
 func (print Print) check(t TyState) bool {
 	return print.exp.infer(t) != TyIllTyped
 }
+
+func (skip Skip) check(t TyState) bool {
+	return true
+}
+
+func (l Located) check(t TyState) bool {
+	return l.stmt.check(t)
+}
+
+func (r Read) check(t TyState) bool {
+	return t.lookup(r.lhs) != TyIllTyped
+}
+
+func (r Requires) check(t TyState) bool {
+	return r.exp.infer(t) == TyBool
+}
+
+func (e Ensures) check(t TyState) bool {
+	return e.exp.infer(t) == TyBool
+}
+
+func (a Assert) check(t TyState) bool {
+	return a.exp.infer(t) == TyBool
+}
+
+func (a Assume) check(t TyState) bool {
+	return a.exp.infer(t) == TyBool
+}
+
+// a test runs on its own, without the variables of the program
+func (tb TestBlock) check(t TyState) bool {
+	return tb.body.check(newTyState())
+}
@@ -16,9 +16,10 @@ const (
 )
 
 type Val struct {
-	flag Kind
-	valI int
-	valB bool
+	flag   Kind
+	valI   int
+	valB   bool
+	secret bool // depends on a secret value, see flow.go
 }
 
 func mkInt(x int) Val {
@@ -56,6 +57,17 @@ func showValType(v Val) string {
 }
 
 // for tests
+// type of a value, TyIllTyped if undefined
+func (v Val) typ() Type {
+	switch v.flag {
+	case ValueInt:
+		return TyInt
+	case ValueBool:
+		return TyBool
+	}
+	return TyIllTyped
+}
+
 func (v Val) equal(other Val) bool {
 	switch v.flag {
 	case ValueInt:
@@ -116,16 +128,18 @@ func (env ValState) lookup(name string) Val {
 // if var is declared multiple times, only the most recent is valid
 func (env ValState) declare(name string, val Val) {
 	// overwrite existing if same type
-	for i := len(env) - 1; i >= 0; i-- {
-		if old_val, ok := env[i][name]; ok {
-			if val.flag == old_val.flag {
-				env[i][name] = val
-				return
-			}
-		}
+	i, update := declScope(env, name, val.typ())
+	old_val, ok := env[i][name]
+	if update {
+		val = tainted(val, old_val)
 	}
 	// otherwise declare new/overwrite in current scope
-	env[len(env)-1][name] = val
+	if ok {
+		traceWrite(name, &old_val, val)
+	} else {
+		traceWrite(name, nil, val)
+	}
+	env[i][name] = val
 }
 
 // assign new value to existing mapping
@@ -135,11 +149,14 @@ func (env ValState) assign(name string, new_val Val) bool {
 		val, ok := env[i][name]
 		if ok {
 			if val.flag == new_val.flag {
-				env[i][name] = new_val
+				// once a variable held a secret value it stays secret
+				env[i][name] = tainted(new_val, val)
+				traceWrite(name, &val, new_val)
 				return true
 			}
 			// assigning wrong type is undefined behavior
 			env[i][name] = mkUndefined()
+			traceWrite(name, &val, mkUndefined())
 			return false
 		}
 	}
@@ -159,30 +176,44 @@ func (env *ValState) endBlock() {
 // Value State is a mapping from variable names to values
 // type ValState map[string]Val
 
-// TyScope is a mapping from variable names to types
+// TyScope is a mapping from variable names to types and security levels
 // TyState is a stack of multiple TyScopes
-type TyScope map[string]Type
+type TyBinding struct {
+	ty    Type
+	level Level // Unlabelled, except in the information-flow checker
+}
+type TyScope map[string]TyBinding
 type TyState []TyScope
 
+func (b TyBinding) typ() Type {
+	return b.ty
+}
+
 func newTyState() TyState {
 	return TyState{make(TyScope)}
 }
 
 // lookup() traverses the stack and returns the first mapping found or TyIllTyped
 func (t TyState) lookup(name string) Type {
+	b, _ := t.binding(name)
+	return b.ty
+}
+
+// binding() is lookup() with the security level
+func (t TyState) binding(name string) (TyBinding, bool) {
 	for i := len(t) - 1; i >= 0; i-- {
-		if ty, ok := t[i][name]; ok {
-			return ty
+		if b, ok := t[i][name]; ok {
+			return b, true
 		}
 	}
-	return TyIllTyped
+	return TyBinding{ty: TyIllTyped}, false
 }
 
 // declare new type mapping in current scope
 // masks previous declarations in outer scopes until current scope ends
 // overwrites previous declarations in same scope
 func (t TyState) declare(name string, ty Type) {
-	t[len(t)-1][name] = ty
+	t[len(t)-1][name] = TyBinding{ty: ty}
 }
 
 // push a new scope onto the type environment stack (TyState)
@@ -196,6 +227,94 @@ func (ts *TyState) endBlock() {
 	*ts = (*ts)[:len(*ts)-1]
 }
 
+// Scopes[V] is the stack of scopes the analyses keep about the variables,
+// like ValState does their values: a mapping from variable names to V per
+// block, innermost last. a nil stack stays nil, for unreachable code
+type typed interface {
+	typ() Type
+}
+type Scopes[V typed] []map[string]V
+
+func newScopes[V typed]() Scopes[V] {
+	return Scopes[V]{make(map[string]V)}
+}
+
+// the innermost mapping of name
+func (s Scopes[V]) lookup(name string) (V, bool) {
+	for i := len(s) - 1; i >= 0; i-- {
+		if v, ok := s[i][name]; ok {
+			return v, true
+		}
+	}
+	var none V
+	return none, false
+}
+
+// the scope a declaration of name with type ty writes to at runtime, see
+// ValState.declare: the innermost one with a variable of that name and type,
+// which is updated, otherwise the current scope, shadowing outer variables
+func declScope[M ~map[string]V, V typed](scopes []M, name string, ty Type) (int, bool) {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if old, ok := scopes[i][name]; ok && old.typ() == ty {
+			return i, true
+		}
+	}
+	return len(scopes) - 1, false
+}
+
+func (s Scopes[V]) declare(name string, v V) {
+	i, _ := declScope(s, name, v.typ())
+	s[i][name] = v
+}
+
+// the most recent mapping is updated, as by ValState.assign
+func (s Scopes[V]) assign(name string, v V) {
+	for i := len(s) - 1; i >= 0; i-- {
+		if _, ok := s[i][name]; ok {
+			s[i][name] = v
+			return
+		}
+	}
+}
+
+func (s Scopes[V]) copy() Scopes[V] {
+	if s == nil {
+		return nil
+	}
+	ret := make(Scopes[V], len(s))
+	for i, scope := range s {
+		ret[i] = make(map[string]V, len(scope))
+		for name, v := range scope {
+			ret[i][name] = v
+		}
+	}
+	return ret
+}
+
+// type environment view, used to infer the types of expressions
+func (s Scopes[V]) types() TyState {
+	t := make(TyState, len(s))
+	for i, scope := range s {
+		t[i] = make(TyScope, len(scope))
+		for name, v := range scope {
+			t[i][name] = TyBinding{ty: v.typ()}
+		}
+	}
+	return t
+}
+
+func (s *Scopes[V]) startBlock() {
+	if *s != nil {
+		*s = append(*s, make(map[string]V))
+	}
+}
+
+func (s *Scopes[V]) endBlock() {
+	if *s != nil {
+		*s = (*s)[:len(*s)-1]
+	}
+}
+
 // Interface
 
 type Exp interface {
@@ -215,8 +334,9 @@ type Stmt interface {
 type Seq [2]Stmt
 type Program Stmt
 type Decl struct {
-	lhs string
-	rhs Exp
+	lhs   string
+	rhs   Exp
+	label Level // security level, see flow.go
 }
 type Assign struct {
 	lhs string
@@ -225,6 +345,7 @@ type Assign struct {
 type While struct {
 	cond Exp
 	body Stmt
+	inv  Exp // loop invariant, nil if not annotated
 }
 type IfThenElse struct {
 	cond     Exp
@@ -234,6 +355,37 @@ type IfThenElse struct {
 type Print struct {
 	exp Exp
 }
+type Skip struct{}
+type Read struct {
+	lhs string
+}
+
+// Specification statements, checked at runtime and by the verifier
+
+type Requires struct {
+	exp Exp
+}
+type Ensures struct {
+	exp Exp
+}
+type Assert struct {
+	exp Exp
+}
+type Assume struct {
+	exp Exp
+}
+
+// unit test, skipped when the program runs and run on its own by the test runner
+type TestBlock struct {
+	name string
+	body Stmt
+}
+
+// statement annotated with its source position, see newLocatingParser()
+type Located struct {
+	pos  Pos
+	stmt Stmt
+}
 
 // Expression cases
 
@@ -254,7 +406,8 @@ type Var string
 // pretty print
 
 func (stmt Seq) pretty() string {
-	ret := stmt[0].pretty() + ";\n" + stmt[1].pretty()
+	// the first statement may itself be a sequence ending in ";"
+	ret := strings.TrimSuffix(stmt[0].pretty(), ";") + ";\n" + stmt[1].pretty()
 	if ret[len(ret)-1] != ';' {
 		ret += ";"
 	}
@@ -262,7 +415,14 @@ func (stmt Seq) pretty() string {
 }
 
 func (decl Decl) pretty() string {
-	return decl.lhs + " := " + decl.rhs.pretty()
+	ret := decl.lhs + " := " + decl.rhs.pretty()
+	switch decl.label {
+	case Public:
+		ret = "public " + ret
+	case Secret:
+		ret = "secret " + ret
+	}
+	return ret
 }
 
 func (assign Assign) pretty() string {
@@ -270,7 +430,11 @@ func (assign Assign) pretty() string {
 }
 
 func (while While) pretty() string {
-	ret := "while " + while.cond.pretty() + " {\n" +
+	ret := "while " + while.cond.pretty()
+	if while.inv != nil {
+		ret += " invariant " + while.inv.pretty()
+	}
+	ret += " {\n" +
 		"\t" + strings.ReplaceAll(while.body.pretty(), "\n", "\n\t")
 	if ret[len(ret)-1] != ';' {
 		ret += ";"
@@ -296,6 +460,43 @@ func (print Print) pretty() string {
 	return "print " + print.exp.pretty()
 }
 
+func (skip Skip) pretty() string {
+	return "skip"
+}
+
+func (read Read) pretty() string {
+	return "read " + read.lhs
+}
+
+func (r Requires) pretty() string {
+	return "requires " + r.exp.pretty()
+}
+
+func (e Ensures) pretty() string {
+	return "ensures " + e.exp.pretty()
+}
+
+func (a Assert) pretty() string {
+	return "assert " + a.exp.pretty()
+}
+
+func (a Assume) pretty() string {
+	return "assume " + a.exp.pretty()
+}
+
+func (tb TestBlock) pretty() string {
+	ret := "test \"" + tb.name + "\" {\n" +
+		"\t" + strings.ReplaceAll(tb.body.pretty(), "\n", "\n\t")
+	if ret[len(ret)-1] != ';' {
+		ret += ";"
+	}
+	return ret + "\n}"
+}
+
+func (l Located) pretty() string {
+	return l.stmt.pretty()
+}
+
 /////////////////////////
 // Exp instances
 
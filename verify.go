@@ -0,0 +1,375 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Hoare-logic verifier
+//
+// verify() proves the requires/ensures/assert annotations and loop invariants
+// of a well-typed program. The program is resolved first (see resolve.go), so
+// declarations can be treated like assignments. Verification conditions are
+// computed by weakest precondition, backwards from the end of the program:
+//   - x := e and x = e substitute e for x
+//   - assert e and ensures e add the goal e and assume e afterwards
+//   - requires e and assume e assume e for every later goal
+//   - if b splits every goal into b -> wp(then) and !b -> wp(else)
+//   - while b invariant I needs I on entry, I && b -> wp(body, I) for the body,
+//     and I && !b -> Q for every goal Q after the loop, where the last two
+//     hold for all values of the variables written by the loop. A loop
+//     without invariant has the invariant true
+//   - read x holds for all values of x
+// Universally quantified variables are replaced by fresh ones, which is sound
+// since they only occur in positive positions. Each condition is decided by
+// the procedure in lia.go.
+//
+// Formulas are over unbounded integers, but the interpreter wraps around at
+// 64 bits. So every sum and product a statement evaluates adds the goal that
+// it stays within the range of int, which the later goals assume; where all
+// of these goals hold, both semantics agree. Overflow goals are reported only
+// if they are not proved.
+
+// a formula that must be valid, and the specification it comes from
+type goal struct {
+	id       int
+	what     string
+	pos      Pos
+	vc       Exp
+	overflow bool // a sum or product stays within the range of int
+}
+
+// a variable standing for an arbitrary value
+type freshVar struct {
+	name string // variable in the source
+	pos  Pos
+	loop bool // value at a loop head, rather than read from the input
+}
+
+type verifier struct {
+	types map[string]Type // types of bindings and fresh variables
+	fresh map[string]freshVar
+	count int
+	pos   Pos // position of the current statement
+}
+
+func newVerifier(types map[string]Type) *verifier {
+	return &verifier{types: types, fresh: make(map[string]freshVar)}
+}
+
+func (v *verifier) newGoal(what string, e Exp) goal {
+	v.count++
+	return goal{v.count, what + " " + mapExpVars(e, sourceName).pretty(), v.pos, e, false}
+}
+
+func (v *verifier) freshVar(x string, loop bool) string {
+	v.count++
+	name := x + "@" + strconv.Itoa(v.count)
+	v.types[name] = v.types[x]
+	v.fresh[name] = freshVar{sourceName(x), v.pos, loop}
+	return name
+}
+
+// weakest precondition of a statement for a list of goals
+func (v *verifier) wp(stmt Stmt, goals []goal) []goal {
+	switch stmt := stmt.(type) {
+	case Seq:
+		return v.wp(stmt[0], v.wp(stmt[1], goals))
+	case Decl:
+		return v.evaluates(stmt.rhs, mapGoals(goals, func(f Exp) Exp { return subst(f, stmt.lhs, stmt.rhs) }))
+	case Assign:
+		return v.evaluates(stmt.rhs, mapGoals(goals, func(f Exp) Exp { return subst(f, stmt.lhs, stmt.rhs) }))
+	case Print:
+		return v.evaluates(stmt.exp, goals)
+	case Read:
+		x := v.freshVar(stmt.lhs, false)
+		return mapGoals(goals, func(f Exp) Exp { return subst(f, stmt.lhs, Var(x)) })
+	case Requires:
+		return v.evaluates(stmt.exp, mapGoals(goals, func(f Exp) Exp { return implies(stmt.exp, f) }))
+	case Assume:
+		return v.evaluates(stmt.exp, mapGoals(goals, func(f Exp) Exp { return implies(stmt.exp, f) }))
+	case Ensures:
+		return v.evaluates(stmt.exp, v.check(v.newGoal("postcondition", stmt.exp), goals))
+	case Assert:
+		return v.evaluates(stmt.exp, v.check(v.newGoal("assertion", stmt.exp), goals))
+	case IfThenElse:
+		thenGoals := v.wp(stmt.thenStmt, goals)
+		elseGoals := v.wp(stmt.elseStmt, goals)
+		return v.evaluates(stmt.cond, mergeGoals(stmt.cond, thenGoals, elseGoals))
+	case While:
+		pos := v.pos
+		inv := stmt.inv
+		var ret []goal
+		var preserved []goal
+		if inv != nil {
+			ret = append(ret, v.newGoal("loop invariant", inv))
+			ret[0].what += " on entry"
+			preserved = append(preserved, v.newGoal("loop invariant", inv))
+			preserved[0].what += " preserved"
+		} else {
+			inv = Bool(true)
+		}
+		// the condition and invariant are evaluated on entry and after
+		// every iteration
+		head := v.evaluates(stmt.cond, nil)
+		if stmt.inv != nil {
+			head = v.evaluates(stmt.inv, head)
+		}
+		ret = append(ret, head...)
+		preserved = v.wp(stmt.body, append(preserved, head...))
+		v.pos = pos
+		havoc := v.havoc(writtenVars(stmt.body))
+		for _, g := range preserved {
+			g.vc = havoc(implies(and(inv, stmt.cond), g.vc))
+			ret = append(ret, g)
+		}
+		for _, g := range goals {
+			g.vc = havoc(implies(and(inv, not(stmt.cond)), g.vc))
+			ret = append(ret, g)
+		}
+		return ret
+	case Located:
+		v.pos = stmt.pos
+		return v.wp(stmt.stmt, goals)
+	default:
+		return goals
+	}
+}
+
+// e is evaluated here: its sums and products must not overflow, which the
+// later goals may assume
+func (v *verifier) evaluates(e Exp, goals []goal) []goal {
+	seen := make(map[string]bool)
+	var walk func(e Exp)
+	walk = func(e Exp) {
+		switch e.(type) {
+		case Plus, Mult:
+			if !seen[e.pretty()] {
+				seen[e.pretty()] = true
+				g := v.newGoal("no overflow in", e)
+				g.vc, g.overflow = inIntRange(e), true
+				goals = v.check(g, goals)
+			}
+		}
+		// inner goals are checked first, so outer ones assume them
+		for _, sub := range subformulas(e) {
+			walk(sub)
+		}
+	}
+	walk(e)
+	return goals
+}
+
+func inIntRange(e Exp) Exp {
+	return and(not(less(e, Num(math.MinInt64))), not(less(Num(math.MaxInt64), e)))
+}
+
+// g must hold here, and may be assumed by the later goals
+func (v *verifier) check(g goal, goals []goal) []goal {
+	return append([]goal{g}, mapGoals(goals, func(f Exp) Exp { return implies(g.vc, f) })...)
+}
+
+// replace the given variables by fresh ones, the same for every formula
+func (v *verifier) havoc(vars map[string]bool) func(Exp) Exp {
+	names := make([]string, 0, len(vars))
+	for x := range vars {
+		names = append(names, x)
+	}
+	sort.Strings(names)
+	renamed := make(map[string]string, len(names))
+	for _, x := range names {
+		renamed[x] = v.freshVar(x, true)
+	}
+	return func(f Exp) Exp {
+		return mapExpVars(f, func(x string) string {
+			if y, ok := renamed[x]; ok {
+				return y
+			}
+			return x
+		})
+	}
+}
+
+func mapGoals(goals []goal, f func(Exp) Exp) []goal {
+	ret := make([]goal, len(goals))
+	for i, g := range goals {
+		g.vc = f(g.vc)
+		ret[i] = g
+	}
+	return ret
+}
+
+// combine the goals of both branches. goals coming from after the
+// if-then-else occur in both and are joined into one
+func mergeGoals(cond Exp, thenGoals, elseGoals []goal) []goal {
+	elseVCs := make(map[int]Exp, len(elseGoals))
+	for _, g := range elseGoals {
+		elseVCs[g.id] = g.vc
+	}
+	var ret []goal
+	inThen := make(map[int]bool, len(thenGoals))
+	for _, g := range thenGoals {
+		inThen[g.id] = true
+		vc := implies(cond, g.vc)
+		if e, ok := elseVCs[g.id]; ok {
+			vc = and(vc, implies(not(cond), e))
+		}
+		g.vc = vc
+		ret = append(ret, g)
+	}
+	for _, g := range elseGoals {
+		if !inThen[g.id] {
+			g.vc = implies(not(cond), g.vc)
+			ret = append(ret, g)
+		}
+	}
+	return ret
+}
+
+// Results
+
+type verdict struct {
+	pos    Pos
+	what   string
+	status string // proved, failed or not proved
+	reason string // why the goal is not proved
+}
+
+func (r verdict) String() string {
+	ret := r.pos.String() + ": " + r.what + " " + r.status
+	if r.reason != "" {
+		ret += ": " + r.reason
+	}
+	return ret
+}
+
+// verify all specifications of a well-typed program, in program order
+func verify(prog Program) []verdict {
+	resolved, types := resolveTyped(prog)
+	v := newVerifier(types)
+	goals := v.wp(resolved, nil)
+	sort.SliceStable(goals, func(i, j int) bool {
+		a, b := goals[i].pos, goals[j].pos
+		return a.line < b.line || a.line == b.line && a.col < b.col
+	})
+	var ret []verdict
+	for _, g := range goals {
+		if r := v.decide(g); !g.overflow || r.status != "proved" {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+func (v *verifier) decide(g goal) verdict {
+	ret := verdict{pos: g.pos, what: g.what}
+	ts := newTyState()
+	for x, ty := range v.types {
+		ts.declare(x, ty)
+	}
+	// the variables hold ints
+	var ints []string
+	for x := range expVars(g.vc) {
+		if v.types[x] == TyInt {
+			ints = append(ints, x)
+		}
+	}
+	sort.Strings(ints)
+	vc := g.vc
+	for _, x := range ints {
+		vc = implies(inIntRange(Var(x)), vc)
+	}
+	res, m := satisfiable(not(simplify(vc)), ts)
+	switch res {
+	case unsat:
+		ret.status = "proved"
+		return ret
+	case satUnknown:
+		ret.status = "not proved"
+		ret.reason = "the decision procedure gave up"
+		return ret
+	}
+
+	// run the condition on the model, which may be spurious for nonlinear
+	// formulas. models of linear ones are exact, and the wrapping interpreter
+	// would reject the counterexamples of overflow goals
+	s := newValState()
+	var vars []string
+	for x := range expVars(g.vc) {
+		if v.types[x] == TyBool {
+			s.declare(x, mkBool(m.bools[x]))
+		} else {
+			s.declare(x, mkInt(m.ints[x]))
+		}
+		vars = append(vars, x)
+	}
+	if val := g.vc.eval(s); isNonlinear(g.vc) && (val.flag != ValueBool || val.valB) {
+		ret.status = "not proved"
+		ret.reason = "nonlinear arithmetic"
+		return ret
+	}
+
+	ret.status = "failed"
+	if len(vars) == 0 {
+		ret.reason = "false in every execution"
+		return ret
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		a, b := v.fresh[vars[i]], v.fresh[vars[j]]
+		if a.pos.line != b.pos.line {
+			return a.pos.line < b.pos.line
+		}
+		return vars[i] < vars[j]
+	})
+	ret.reason = "counterexample"
+	loop := false
+	for i, x := range vars {
+		f := v.fresh[x]
+		if i > 0 {
+			ret.reason += ","
+		}
+		ret.reason += " " + f.name + " = " + showVal(s.lookup(x))
+		if f.loop {
+			ret.reason += " at the loop head (" + f.pos.String() + ")"
+			loop = true
+		} else {
+			ret.reason += " read at " + f.pos.String()
+		}
+	}
+	if loop {
+		// the state at the loop head may not be reachable
+		ret.status = "not proved"
+		ret.reason += ", the loop invariant may be too weak"
+	}
+	return ret
+}
+
+func verify_cmd(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	prog, err := load_checked(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	verdicts := verify(prog)
+	if len(verdicts) == 0 {
+		fmt.Println("nothing to verify")
+		return 0
+	}
+	ok := true
+	for _, r := range verdicts {
+		fmt.Println(r)
+		ok = ok && r.status == "proved"
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}